@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func adminRequest(t *testing.T, url, method, path, token, body string) (*http.Response, map[string]any) {
+	t.Helper()
+	request, err := http.NewRequest(method, url+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatalf("Failed to create request: %v", err)
+	}
+	if token != "" {
+		request.Header.Set("Authorization", "Bearer "+token)
+	}
+	response, err := http.DefaultClient.Do(request)
+	if err != nil {
+		t.Fatalf("Failed to send request: %v", err)
+	}
+	defer response.Body.Close()
+	if response.StatusCode == http.StatusNoContent {
+		return response, nil
+	}
+	var decoded any
+	if err := json.NewDecoder(response.Body).Decode(&decoded); err != nil {
+		t.Fatalf("Failed to decode response: %v", err)
+	}
+	object, _ := decoded.(map[string]any)
+	if list, ok := decoded.([]any); ok {
+		object = map[string]any{"list": list}
+	}
+	return response, object
+}
+
+func TestAdminAPI(t *testing.T) {
+	useMemoryBackend(t)
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+
+	admin := httptest.NewServer(server.NewAdminHandler("secret"))
+	defer admin.Close()
+
+	if response, _ := adminRequest(t, admin.URL, http.MethodGet, "/v1/stats", "", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d without a token, got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodGet, "/v1/stats", "wrong", ""); response.StatusCode != http.StatusUnauthorized {
+		t.Errorf("Expected %d with a wrong token, got %d", http.StatusUnauthorized, response.StatusCode)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodPost, "/v1/bans", "secret", `{"key":"admin:banned","ttl":"bad"}`); response.StatusCode != http.StatusBadRequest {
+		t.Errorf("Expected %d for an invalid ttl, got %d", http.StatusBadRequest, response.StatusCode)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodPost, "/v1/bans", "secret", `{"key":"admin:banned","ttl":"1h"}`); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d for a ban, got %d", http.StatusCreated, response.StatusCode)
+	}
+	if _, bans := adminRequest(t, admin.URL, http.MethodGet, "/v1/bans", "secret", ""); len(bans["list"].([]any)) != 1 {
+		t.Errorf("Expected one ban, got %v", bans)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodPost, "/v1/allows", "secret", `{"key":"admin:allowed","ttl":"1h"}`); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d for an allow-list entry, got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	// the overrides are kept by the backend and decided from the cache of the server
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	newClient, err := client.NewClientWithContext(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+	result, err := newClient.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: "admin:banned"})
+	if err != nil {
+		t.Fatalf("Failed to rate limit a banned key: %v", err)
+	}
+	if result.Allowed != 0 || result.RetryAfter <= 0 {
+		t.Errorf("Expected the banned key to be denied, got %+v", result)
+	}
+	result, err = newClient.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: "admin:allowed"})
+	if err != nil {
+		t.Fatalf("Failed to rate limit an allowed key: %v", err)
+	}
+	if result.Allowed != 1 {
+		t.Errorf("Expected the allowed key to be allowed, got %+v", result)
+	}
+
+	if _, stats := adminRequest(t, admin.URL, http.MethodGet, "/v1/stats", "secret", ""); stats["decisions"].(float64) < 2 || stats["bans"].(float64) != 1 {
+		t.Errorf("Expected the decisions and the ban to be counted, got %v", stats)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodDelete, "/v1/bans/admin:banned", "secret", ""); response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %d when lifting a ban, got %d", http.StatusNoContent, response.StatusCode)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodDelete, "/v1/bans/admin:banned", "secret", ""); response.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected %d when lifting a missing ban, got %d", http.StatusNotFound, response.StatusCode)
+	}
+	if response, _ := adminRequest(t, admin.URL, http.MethodDelete, "/v1/allows/admin:allowed", "secret", ""); response.StatusCode != http.StatusNoContent {
+		t.Errorf("Expected %d when removing an allow-list entry, got %d", http.StatusNoContent, response.StatusCode)
+	}
+}
@@ -0,0 +1,81 @@
+//go:build !race
+
+package main
+
+import (
+	"context"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"testing"
+	"time"
+)
+
+// The race detector allocates on its own, the allocation tests only run
+// without it.
+
+// TestSendRequestAllocations expects a round trip through the client and the
+// server to allocate nothing on either side. Contexts with a deadline made for
+// each request allocate in the caller, so the requests share one.
+func TestSendRequestAllocations(t *testing.T) {
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	newClient, err := client.NewClientWithContext(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	var pingErr error
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := newClient.Ping(ctx); err != nil {
+			pingErr = err
+		}
+	})
+	if pingErr != nil {
+		t.Fatalf("Failed to ping: %v", pingErr)
+	}
+	if allocs != 0 {
+		t.Errorf("Expected %v allocations per round trip \nWanted 0", allocs)
+	}
+}
+
+// TestRateLimitAllocations expects a decision through the client, the server
+// and the memory backend to allocate no more than the result handed to each
+// caller: the response data of the client and the result of the backend.
+func TestRateLimitAllocations(t *testing.T) {
+	useMemoryBackend(t)
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+	newClient, err := client.NewClientWithContext(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	payload := &comm.RateLimitRequestData{Key: "allocations", Rate: 1 << 20, Burst: 1 << 20, Period: time.Hour}
+	var decisionErr error
+	allocs := testing.AllocsPerRun(1000, func() {
+		if _, err := newClient.RateLimit(ctx, payload); err != nil {
+			decisionErr = err
+		}
+	})
+	if decisionErr != nil {
+		t.Fatalf("Failed to decide: %v", decisionErr)
+	}
+	if allocs > 2 {
+		t.Errorf("Expected %v allocations per decision \nWanted at most 2", allocs)
+	}
+}
@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"context"
 	"fmt"
 	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
 	"github.com/zekihan/traefik-rate-limit/internal/server"
 	"log/slog"
 	"os"
@@ -23,6 +25,9 @@ func init() {
 
 func BenchmarkSendRequest(b *testing.B) {
 	// Use a unique socket path for each benchmark run
+	if err := os.MkdirAll("./tmp", 0o755); err != nil {
+		b.Fatalf("Failed to create socket directory: %v", err)
+	}
 	socketPath := fmt.Sprintf("./tmp/traefik-rate-limit-%d.sock", time.Now().UnixNano())
 	defer os.Remove(socketPath) // Clean up socket file afterwards
 
@@ -62,12 +67,13 @@ func BenchmarkSendRequest(b *testing.B) {
 		}
 	}
 
+	// a context per request would count its allocations, those of the caller
+	ctx, cancel := context.WithTimeout(context.Background(), time.Hour)
+	defer cancel()
+	b.ReportAllocs()
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		// Use a shorter timeout for benchmark requests
-		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
 		_, err := newClient.Ping(ctx)
-		cancel()
 		if err != nil {
 			// Don't necessarily stop the whole benchmark on single request failure
 			b.Logf("Request %d failed: %v", i, err)
@@ -80,3 +86,88 @@ func BenchmarkSendRequest(b *testing.B) {
 	serverCancel()
 	newClient.Close() // Close client connection
 }
+
+// BenchmarkRateLimit measures decisions through the client and the server,
+// backend included. It is skipped without a reachable Redis.
+func BenchmarkRateLimit(b *testing.B) {
+	socketPath := fmt.Sprintf("./tmp/traefik-rate-limit-%d.sock", time.Now().UnixNano())
+	if err := os.MkdirAll("./tmp", 0o755); err != nil {
+		b.Fatalf("Failed to create socket directory: %v", err)
+	}
+	defer os.Remove(socketPath)
+
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	newClient, err := client.NewClient(socketPath)
+	if err != nil {
+		b.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	data := &comm.RateLimitRequestData{Rate: 1 << 30, Burst: 1 << 30, Period: time.Second, Key: "benchmark"}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	_, err = newClient.RateLimit(ctx, data)
+	cancel()
+	if err != nil {
+		b.Skipf("backend unavailable: %v", err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		ctx, cancel := context.WithTimeout(context.Background(), 500*time.Millisecond)
+		_, err := newClient.RateLimit(ctx, data)
+		cancel()
+		if err != nil {
+			b.Logf("Request %d failed: %v", i, err)
+		}
+	}
+}
+
+// BenchmarkDecisionCodec measures the codec work of a decision on both sides,
+// without the connection: the client encodes the request, the server reads
+// and decodes it and encodes the response, and the client decodes it.
+func BenchmarkDecisionCodec(b *testing.B) {
+	req := &comm.Request{
+		Header:    comm.Header{RequestID: 1, Version: comm.VERSION, Timeout: time.Second},
+		Type:      comm.RequestTypeRateLimit,
+		RateLimit: comm.RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "traefik:default:203.0.113.7"},
+	}
+	stream := &bytes.Buffer{}
+	frames := comm.NewFrameReader(stream, 1024*1024)
+	defer frames.Release()
+	decoded := &comm.Request{}
+	resp := &comm.Response{}
+	received := &comm.Response{}
+	var reqBuf, respBuf []byte
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		var err error
+		if reqBuf, err = req.Append(reqBuf[:0]); err != nil {
+			b.Fatalf("failed to encode request: %v", err)
+		}
+		stream.Write(reqBuf)
+		header, payload, err := frames.Next()
+		if err != nil {
+			b.Fatalf("failed to read request: %v", err)
+		}
+		if err := decoded.Unmarshal(header, payload); err != nil {
+			b.Fatalf("failed to decode request: %v", err)
+		}
+		resp.Reset(header, decoded.Type)
+		resp.RateLimit = comm.RateLimitResponseData{Allowed: 1, Remaining: 199, RetryAfter: -1, ResetAfter: 300 * time.Millisecond}
+		if respBuf, err = resp.Append(respBuf[:0]); err != nil {
+			b.Fatalf("failed to encode response: %v", err)
+		}
+		if err := received.Unmarshal(header, respBuf[header.Size():]); err != nil {
+			b.Fatalf("failed to decode response: %v", err)
+		}
+	}
+}
@@ -2,6 +2,6 @@ package client
 
 import "github.com/zekihan/traefik-rate-limit/internal/client"
 
-func Run(socketPath string) {
-	client.RunClient(socketPath)
+func Run(socketPath string, options *client.Options) {
+	client.RunClient(socketPath, options)
 }
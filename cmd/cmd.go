@@ -9,6 +9,14 @@ const (
 	CommandClient command = "client"
 	// CommandHealthCheck is the command to run the health check
 	CommandHealthCheck command = "healthcheck"
+	// CommandPeek is the command to show the state of a key
+	CommandPeek command = "peek"
+	// CommandReset is the command to reset keys
+	CommandReset command = "reset"
+	// CommandKeys is the command to list keys
+	CommandKeys command = "keys"
+	// CommandEvents is the command to print the events pushed by the server
+	CommandEvents command = "events"
 	// CommandVersion is the command to run the version check
 	CommandVersion command = "version"
 	// CommandHelp is the command to show help
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// goldenFrame reads a frame of the wire codec conformance suite.
+func goldenFrame(t *testing.T, name string) []byte {
+	t.Helper()
+	frame, err := os.ReadFile(filepath.Join("..", "internal", "comm", "testdata", "golden", name+".bin"))
+	if err != nil {
+		t.Fatalf("failed to read golden frame: %v", err)
+	}
+	return frame
+}
+
+func testSocketPath(t *testing.T) string {
+	t.Helper()
+	if err := os.MkdirAll("./tmp", 0o755); err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
+	socketPath := fmt.Sprintf("./tmp/traefik-rate-limit-%d.sock", time.Now().UnixNano())
+	t.Cleanup(func() { _ = os.Remove(socketPath) })
+	return socketPath
+}
+
+// TestServerConformance sends golden request frames to the server and
+// expects the golden response frames back, byte for byte.
+func TestServerConformance(t *testing.T) {
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+	time.Sleep(100 * time.Millisecond)
+
+	conn, err := net.Dial("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer conn.Close()
+
+	exchanges := []struct {
+		request  string
+		response string
+	}{
+		{request: "ping_request_v1", response: "ping_response_v1"},
+		{request: "hello_request", response: "hello_response"},
+		{request: "unknown_request", response: "error_response_v3"},
+		// the hello of the client does not negotiate events
+		{request: "subscribe_request", response: "unnegotiated_response"},
+	}
+	for _, exchange := range exchanges {
+		t.Run(exchange.request, func(t *testing.T) {
+			if _, err := conn.Write(goldenFrame(t, exchange.request)); err != nil {
+				t.Fatalf("failed to write request: %v", err)
+			}
+			expected := goldenFrame(t, exchange.response)
+			got := make([]byte, len(expected))
+			_ = conn.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := io.ReadFull(conn, got); err != nil {
+				t.Fatalf("failed to read response: %v", err)
+			}
+			if !bytes.Equal(got, expected) {
+				t.Errorf("Expected %x \nWanted %x", got, expected)
+			}
+		})
+	}
+}
+
+// TestClientConformance answers the requests of the client with golden
+// response frames and checks what the client makes of them.
+func TestClientConformance(t *testing.T) {
+	socketPath := testSocketPath(t)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	responses := map[comm.RequestType][]byte{
+		comm.RequestTypeHello:     goldenFrame(t, "hello_response"),
+		comm.RequestTypePing:      goldenFrame(t, "ping_response_v1"),
+		comm.RequestTypeRateLimit: goldenFrame(t, "rate_limit_response"),
+		comm.RequestTypeReset:     goldenFrame(t, "error_response_v3"),
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			header, err := comm.ReadHeader(conn)
+			if err != nil {
+				return
+			}
+			payload := make([]byte, header.ContentLength)
+			if _, err := io.ReadFull(conn, payload); err != nil || len(payload) == 0 {
+				return
+			}
+			frame, ok := responses[comm.RequestType(payload[0])]
+			if !ok {
+				return
+			}
+			// the golden frame answers with the request ID of the client
+			frame = bytes.Clone(frame)
+			binary.BigEndian.PutUint32(frame, header.RequestID)
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	newClient, err := client.NewClientWithContext(ctx, socketPath)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+	if newClient.Version() != 3 {
+		t.Errorf("Expected version %d \nWanted %d", newClient.Version(), 3)
+	}
+
+	pong, err := newClient.Ping(ctx)
+	if err != nil || pong != "pong to ping" {
+		t.Errorf("Expected %q, %v \nWanted %q", pong, err, "pong to ping")
+	}
+
+	res, err := newClient.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "a", Cost: 3})
+	expected := &comm.RateLimitResponseData{Allowed: 3, Remaining: 197, RetryAfter: -1, ResetAfter: 1800 * time.Millisecond}
+	if err != nil || !reflect.DeepEqual(res, expected) {
+		t.Errorf("Expected %+v, %v \nWanted %+v", res, err, expected)
+	}
+
+	if err := newClient.Reset(ctx, "a"); !errors.Is(err, client.ErrUnknownType) {
+		t.Errorf("Expected %v \nWanted %v", err, client.ErrUnknownType)
+	}
+}
+
+// TestEvents subscribes to the events of the server and expects it to report
+// its backend down once a decision fails to reach it.
+func TestEvents(t *testing.T) {
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+
+	received := make(chan comm.EventData, 16)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, &client.Options{
+		Events:  comm.AllEvents,
+		OnEvent: func(event comm.EventData) { received <- event },
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	// the backend of the tests is not reachable
+	if _, err := newClient.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: "events"}); err == nil {
+		t.Skip("the backend is reachable")
+	}
+	select {
+	case event := <-received:
+		expected := comm.EventData{Type: comm.EventTypeBackendHealth, Healthy: false}
+		if !reflect.DeepEqual(event, expected) {
+			t.Errorf("Expected %+v \nWanted %+v", event, expected)
+		}
+	case <-ctx.Done():
+		t.Fatalf("no event received")
+	}
+	if newClient.BackendAvailable() {
+		t.Errorf("Expected the backend to be reported unavailable")
+	}
+}
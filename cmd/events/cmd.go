@@ -0,0 +1,64 @@
+package events
+
+import (
+	"context"
+	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+)
+
+const (
+	connectTimeout = 5 * time.Second
+	// keepAlive pings the server while no event comes, so that the connection
+	// outlives the idle timeout of the server.
+	keepAlive = 30 * time.Second
+)
+
+// Run prints the events pushed by the server, one per line, until interrupted
+// or the server goes away.
+func Run(socketPath string, options *client.Options) {
+	subscribed := *options
+	subscribed.Events = comm.AllEvents
+	subscribed.OnEvent = printEvent
+	subscribed.KeepAlive = keepAlive
+
+	ctx, cancel := context.WithTimeout(context.Background(), connectTimeout)
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, &subscribed)
+	cancel()
+	if err != nil {
+		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", socketPath))
+		os.Exit(1)
+	}
+	defer newClient.Close()
+	if !newClient.Features().Has(comm.FeatureEvents) {
+		slog.Error("server does not support events", slog.String("socket", socketPath))
+		os.Exit(1)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	select {
+	case <-signals:
+	case <-newClient.Done():
+		slog.Error("connection closed", slog.String("socket", socketPath))
+		os.Exit(1)
+	case <-newClient.GoAway():
+		slog.Info("server is going away", slog.String("socket", socketPath))
+	}
+}
+
+func printEvent(event comm.EventData) {
+	switch event.Type {
+	case comm.EventTypeBanAdded:
+		fmt.Printf("%s %s %s\n", event.Type, event.Key, event.Duration)
+	case comm.EventTypeBackendHealth:
+		fmt.Printf("%s healthy=%t\n", event.Type, event.Healthy)
+	default:
+		fmt.Printf("%s %s\n", event.Type, event.Key)
+	}
+}
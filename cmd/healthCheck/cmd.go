@@ -3,29 +3,37 @@ package healthCheck
 import (
 	"context"
 	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
 	"log/slog"
 	"os"
 	"time"
 )
 
-func Run(socketPath string) {
-	startTime := time.Now()
-	maxWait := 1 * time.Second
-	for {
-		if _, err := os.Stat(socketPath); err == nil {
-			break
-		}
-		if time.Since(startTime) > maxWait {
-			slog.Error("timed out waiting for socket file", slog.String("socket", socketPath))
-			os.Exit(1)
+func Run(socketPath string, options *client.Options) {
+	address, err := transport.ParseAddress(socketPath)
+	if err != nil {
+		slog.Error("invalid socket address", slog.Any("error", err), slog.String("socket", socketPath))
+		os.Exit(1)
+	}
+	if address.IsUnix() {
+		startTime := time.Now()
+		maxWait := 1 * time.Second
+		for {
+			if _, err := os.Stat(address.Address); err == nil {
+				break
+			}
+			if time.Since(startTime) > maxWait {
+				slog.Error("timed out waiting for socket file", slog.String("socket", socketPath))
+				os.Exit(1)
+			}
+			time.Sleep(100 * time.Millisecond)
 		}
-		time.Sleep(100 * time.Millisecond)
+		slog.Debug("found socket file", slog.String("socket", socketPath))
 	}
-	slog.Debug("found socket file", slog.String("socket", socketPath))
 
-	newClient, err := client.NewClient(socketPath)
+	newClient, err := client.NewClientWithOptions(context.Background(), socketPath, options)
 	if err != nil {
-		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", newClient.SocketPath))
+		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", socketPath))
 		os.Exit(1)
 	}
 	defer newClient.Close()
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestKeepAlive connects to a server that stops answering after the
+// handshake, and expects the keepalive ping to fail the pending request
+// instead of leaving it waiting for its context.
+func TestKeepAlive(t *testing.T) {
+	socketPath := testSocketPath(t)
+	listener, err := net.Listen("unix", socketPath)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	defer listener.Close()
+
+	hello := goldenFrame(t, "hello_response")
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			header, err := comm.ReadHeader(conn)
+			if err != nil {
+				return
+			}
+			payload := make([]byte, header.ContentLength)
+			if _, err := io.ReadFull(conn, payload); err != nil || len(payload) == 0 {
+				return
+			}
+			// only the handshake is answered, like a peer gone silent
+			if comm.RequestType(payload[0]) != comm.RequestTypeHello {
+				continue
+			}
+			frame := bytes.Clone(hello)
+			binary.BigEndian.PutUint32(frame, header.RequestID)
+			if _, err := conn.Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, &client.Options{
+		KeepAlive:        50 * time.Millisecond,
+		KeepAliveTimeout: 50 * time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	start := time.Now()
+	_, err = newClient.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: "keepalive"})
+	if !errors.Is(err, client.ErrServerUnavailable) || !strings.Contains(err.Error(), "keepalive") {
+		t.Fatalf("Expected the request to fail with the keepalive, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the request to fail once the ping timed out, it took %s", elapsed)
+	}
+	select {
+	case <-newClient.Done():
+	default:
+		t.Errorf("Expected the connection to be closed")
+	}
+}
+
+// TestIdleConnection leaves a connection without keepalive idle past the
+// idle timeout of the server, and expects the next decision to be made on a
+// new connection instead of failing on the one closed.
+func TestIdleConnection(t *testing.T) {
+	useMemoryBackend(t)
+	cfg := *config.GetConfig()
+	cfg.IdleTimeout = 100 * time.Millisecond
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServerWithConfig(serverCtx, socketPath, func() *config.Config { return &cfg })
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	r := client.NewReconnector(socketPath, nil)
+	defer r.Close()
+	decide := func() *client.Client {
+		t.Helper()
+		var used *client.Client
+		err := r.Do(ctx, func(c *client.Client) error {
+			used = c
+			_, err := c.RateLimit(ctx, &comm.RateLimitRequestData{Rate: 10, Burst: 10, Period: time.Second, Key: "idle"})
+			return err
+		})
+		if err != nil {
+			t.Fatalf("Expected the decision to succeed, got %v", err)
+		}
+		return used
+	}
+
+	idle := decide()
+	select {
+	case <-idle.GoAway():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the server to send a GOAWAY on the idle connection")
+	}
+	if next := decide(); next == idle {
+		t.Errorf("Expected the decision to be made on a new connection")
+	}
+}
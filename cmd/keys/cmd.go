@@ -0,0 +1,122 @@
+package keys
+
+import (
+	"context"
+	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"log/slog"
+	"os"
+	"strconv"
+	"time"
+)
+
+const requestTimeout = 5 * time.Second
+
+// Peek prints the state of a key, given as <key> <rate> <burst> <period>
+// and optionally the algorithm, GCRA by default.
+func Peek(socketPath string, options *client.Options, args []string) {
+	if len(args) != 4 && len(args) != 5 {
+		fmt.Println("Usage: peek <key> <rate> <burst> <period> [algorithm]")
+		os.Exit(1)
+	}
+	rate, err := strconv.ParseUint(args[1], 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid rate: %v\n", err)
+		os.Exit(1)
+	}
+	burst, err := strconv.ParseUint(args[2], 10, 64)
+	if err != nil {
+		fmt.Printf("Invalid burst: %v\n", err)
+		os.Exit(1)
+	}
+	period, err := time.ParseDuration(args[3])
+	if err != nil {
+		fmt.Printf("Invalid period: %v\n", err)
+		os.Exit(1)
+	}
+	algorithm := comm.AlgorithmGCRA
+	if len(args) == 5 {
+		if algorithm, err = comm.ParseAlgorithm(args[4]); err != nil {
+			fmt.Printf("Invalid algorithm: %v\n", err)
+			os.Exit(1)
+		}
+	}
+
+	newClient := connect(socketPath, options)
+	defer newClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	res, err := newClient.Peek(ctx, &comm.RateLimitRequestData{Algorithm: algorithm, Rate: rate, Burst: burst, Period: period, Key: args[0]})
+	if err != nil {
+		slog.Error("failed to peek key", slog.Any("error", err), slog.String("key", args[0]))
+		os.Exit(1)
+	}
+	fmt.Printf("key: %s\nremaining: %d\nretryAfter: %s\nresetAfter: %s\n", args[0], res.Remaining, res.RetryAfter, res.ResetAfter)
+}
+
+// Reset clears the state of the keys given as arguments.
+func Reset(socketPath string, options *client.Options, args []string) {
+	if len(args) == 0 {
+		fmt.Println("Usage: reset <key>...")
+		os.Exit(1)
+	}
+
+	newClient := connect(socketPath, options)
+	defer newClient.Close()
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+
+	for _, key := range args {
+		if err := newClient.Reset(ctx, key); err != nil {
+			slog.Error("failed to reset key", slog.Any("error", err), slog.String("key", key))
+			os.Exit(1)
+		}
+		fmt.Printf("reset %s\n", key)
+	}
+}
+
+// List prints the keys starting with the optional prefix argument, one per line.
+func List(socketPath string, options *client.Options, args []string) {
+	if len(args) > 1 {
+		fmt.Println("Usage: keys [prefix]")
+		os.Exit(1)
+	}
+	prefix := ""
+	if len(args) == 1 {
+		prefix = args[0]
+	}
+
+	newClient := connect(socketPath, options)
+	defer newClient.Close()
+
+	cursor := uint64(0)
+	for {
+		ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+		keys, next, err := newClient.ListKeys(ctx, prefix, cursor, 0)
+		cancel()
+		if err != nil {
+			slog.Error("failed to list keys", slog.Any("error", err), slog.String("prefix", prefix))
+			os.Exit(1)
+		}
+		for _, key := range keys {
+			fmt.Println(key)
+		}
+		if next == 0 {
+			return
+		}
+		cursor = next
+	}
+}
+
+func connect(socketPath string, options *client.Options) *client.Client {
+	ctx, cancel := context.WithTimeout(context.Background(), requestTimeout)
+	defer cancel()
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, options)
+	if err != nil {
+		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", socketPath))
+		os.Exit(1)
+	}
+	return newClient
+}
@@ -4,16 +4,21 @@ import (
 	"flag"
 	"fmt"
 	"github.com/zekihan/traefik-rate-limit/cmd/client"
+	"github.com/zekihan/traefik-rate-limit/cmd/events"
 	"github.com/zekihan/traefik-rate-limit/cmd/healthCheck"
+	"github.com/zekihan/traefik-rate-limit/cmd/keys"
 	"github.com/zekihan/traefik-rate-limit/cmd/server"
+	internalClient "github.com/zekihan/traefik-rate-limit/internal/client"
 	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
 	"github.com/zekihan/traefik-rate-limit/internal/utils"
 	"log"
 	"log/slog"
 	"os"
 	"runtime"
 	"runtime/pprof"
-	"strings"
+	// the image has no time zone database for the calendars of policies
+	_ "time/tzdata"
 )
 
 var (
@@ -21,6 +26,7 @@ var (
 	memprofile = flag.String("memprofile", "", "write memory profile to `file`")
 	socketPath = flag.String("socket", "", "path to unix domain socket")
 	logLevel   = flag.String("logLevel", "", "log level (debug, info, warn, error)") // Added logLevel flag
+	configFile = flag.String("config", "", "path to a YAML or JSON config file")
 )
 
 func main() {
@@ -33,13 +39,17 @@ func main() {
 	os.Args = os.Args[1:]
 	flag.Parse()
 
+	config.SetFile(*configFile)
+	// the flags take precedence over the config, also when it is reloaded
+	config.SetOverride(func(cfg *config.Config) {
+		if *socketPath != "" {
+			cfg.SocketPath = *socketPath
+		}
+		if *logLevel != "" {
+			cfg.LogLevel = *logLevel
+		}
+	})
 	cfg := config.GetConfig()
-	if *socketPath != "" {
-		cfg.SocketPath = *socketPath
-	}
-	if *logLevel != "" {
-		cfg.LogLevel = *logLevel
-	}
 
 	setLogger(cmd)
 	cpu := setCpuProfile()
@@ -49,9 +59,17 @@ func main() {
 	case string(CommandServer):
 		server.Run(cfg.SocketPath)
 	case string(CommandClient):
-		client.Run(cfg.SocketPath)
+		client.Run(cfg.SocketPath, clientOptions(cfg))
 	case string(CommandHealthCheck):
-		healthCheck.Run(cfg.SocketPath)
+		healthCheck.Run(cfg.SocketPath, clientOptions(cfg))
+	case string(CommandPeek):
+		keys.Peek(cfg.SocketPath, clientOptions(cfg), flag.Args())
+	case string(CommandReset):
+		keys.Reset(cfg.SocketPath, clientOptions(cfg), flag.Args())
+	case string(CommandKeys):
+		keys.List(cfg.SocketPath, clientOptions(cfg), flag.Args())
+	case string(CommandEvents):
+		events.Run(cfg.SocketPath, clientOptions(cfg))
 	case string(CommandVersion):
 		fmt.Printf("%s\n%s\n", utils.Version, utils.GetStartupInfo())
 	case string(CommandHelp):
@@ -65,30 +83,44 @@ func main() {
 	defer mem()
 }
 
+// clientOptions returns how the CLI commands connect to the server.
+func clientOptions(cfg *config.Config) *internalClient.Options {
+	options := &internalClient.Options{}
+	if cfg.Auth != nil {
+		options.AuthToken = cfg.Auth.Token
+		options.AdminToken = cfg.Auth.AdminToken
+	}
+	address, err := transport.ParseAddress(cfg.SocketPath)
+	if err != nil || address.Scheme != transport.SchemeTLS {
+		return options
+	}
+	tlsCfg := cfg.TLS
+	tlsConfig, err := transport.ClientTLSConfig(tlsCfg.CAFile, tlsCfg.ClientCertFile, tlsCfg.ClientKeyFile, tlsCfg.ServerName, false)
+	if err != nil {
+		log.Fatalf("invalid TLS configuration: %v", err)
+	}
+	options.TLS = tlsConfig
+	return options
+}
+
 func printHelp() {
-	fmt.Printf("Available commands: [%s] [%s] [%s] [%s] [%s]\n", string(CommandServer), string(CommandClient), string(CommandHealthCheck), string(CommandVersion), string(CommandHelp))
+	fmt.Printf("Available commands: [%s] [%s] [%s] [%s] [%s] [%s] [%s] [%s] [%s]\n", string(CommandServer), string(CommandClient), string(CommandHealthCheck), string(CommandPeek), string(CommandReset), string(CommandKeys), string(CommandEvents), string(CommandVersion), string(CommandHelp))
 }
 
 func printUnknownCommand(cmd string) {
 	fmt.Printf("Unknown command: %s\n", cmd)
-	fmt.Printf("Available commands: [%s] [%s] [%s] [%s] [%s]\n", string(CommandServer), string(CommandClient), string(CommandHealthCheck), string(CommandVersion), string(CommandHelp))
+	fmt.Printf("Available commands: [%s] [%s] [%s] [%s] [%s] [%s] [%s] [%s] [%s]\n", string(CommandServer), string(CommandClient), string(CommandHealthCheck), string(CommandPeek), string(CommandReset), string(CommandKeys), string(CommandEvents), string(CommandVersion), string(CommandHelp))
 }
 
 func setLogger(cmd string) {
-	var level slog.Level
-	switch strings.ToLower(config.GetConfig().LogLevel) {
-	case "debug":
-		level = slog.LevelDebug
-	case "info":
-		level = slog.LevelInfo
-	case "warn":
-		level = slog.LevelWarn
-	case "error":
-		level = slog.LevelError
-	default:
-		log.Printf("Invalid log level '%s', defaulting to 'info'", *logLevel)
-		level = slog.LevelInfo
-	}
+	// the config is valid, its log level is known
+	level := &slog.LevelVar{}
+	l, _ := config.ParseLogLevel(config.GetConfig().LogLevel)
+	level.Set(l)
+	config.OnReload(func(cfg *config.Config) {
+		l, _ := config.ParseLogLevel(cfg.LogLevel)
+		level.Set(l)
+	})
 
 	logger := slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{
 		AddSource:   false,
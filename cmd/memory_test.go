@@ -0,0 +1,104 @@
+package main
+
+import (
+	"context"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"testing"
+	"time"
+)
+
+// useMemoryBackend stores the keys in memory until the test ends, for the
+// tests needing a backend without Redis.
+func useMemoryBackend(t *testing.T) {
+	t.Helper()
+	cfg := *config.GetConfig()
+	cfg.Backend = rate_limit.BackendMemory
+	backend, err := rate_limit.NewBackend(&cfg)
+	if err != nil {
+		t.Fatalf("Failed to create the memory backend: %v", err)
+	}
+	rate_limit.SetBackend(backend)
+	t.Cleanup(func() { _ = rate_limit.Close() })
+}
+
+// TestMemoryBackend decides, peeks, lists and resets keys with the memory
+// backend, without Redis, under GCRA and a window algorithm, and takes and
+// gives back leases.
+func TestMemoryBackend(t *testing.T) {
+	useMemoryBackend(t)
+
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, nil)
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+
+	data := &comm.RateLimitRequestData{Rate: 1, Burst: 2, Period: time.Minute, Key: "memory:a"}
+	for i, allowed := range []int64{1, 1, 0} {
+		result, err := newClient.RateLimit(ctx, data)
+		if err != nil {
+			t.Fatalf("Failed to rate limit: %v", err)
+		}
+		if result.Allowed != allowed {
+			t.Errorf("Decision %d: expected %d allowed, got %+v", i, allowed, result)
+		}
+	}
+	if result, err := newClient.Peek(ctx, data); err != nil || result.Remaining != 0 || result.ResetAfter <= time.Minute {
+		t.Errorf("Expected the key to be out of tokens, got %+v, %v", result, err)
+	}
+	if keys, _, err := newClient.ListKeys(ctx, "memory:", 0, 10); err != nil || len(keys) != 1 || keys[0] != "memory:a" {
+		t.Errorf("Expected the key to be listed, got %v, %v", keys, err)
+	}
+	if err := newClient.Reset(ctx, data.Key); err != nil {
+		t.Fatalf("Failed to reset: %v", err)
+	}
+	if result, err := newClient.RateLimit(ctx, data); err != nil || result.Allowed != 1 || result.Remaining != 1 {
+		t.Errorf("Expected a full burst after a reset, got %+v, %v", result, err)
+	}
+
+	// the algorithm is carried by the request
+	window := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmSlidingWindowLog, Rate: 2, Period: time.Hour, Key: "memory:window"}
+	for i, allowed := range []int64{1, 1, 0} {
+		result, err := newClient.RateLimit(ctx, window)
+		if err != nil {
+			t.Fatalf("Failed to rate limit with a sliding window log: %v", err)
+		}
+		if result.Allowed != allowed {
+			t.Errorf("Window decision %d: expected %d allowed, got %+v", i, allowed, result)
+		}
+		if allowed == 0 && (result.RetryAfter <= time.Hour-time.Minute || result.RetryAfter > time.Hour) {
+			t.Errorf("Expected to retry once the first token leaves the window, got %s", result.RetryAfter)
+		}
+	}
+
+	first, err := newClient.AcquireLease(ctx, "memory:a", 1, time.Minute)
+	if err != nil || !first.Acquired() {
+		t.Fatalf("Expected a lease, got %+v, %v", first, err)
+	}
+	if lease, err := newClient.AcquireLease(ctx, "memory:a", 1, time.Minute); err != nil || lease.Acquired() {
+		t.Errorf("Expected the only slot to be held, got %+v, %v", lease, err)
+	}
+	if err := newClient.ReleaseLease(ctx, first); err != nil {
+		t.Fatalf("Failed to release the lease: %v", err)
+	}
+	if lease, err := newClient.AcquireLease(ctx, "memory:a", 1, time.Minute); err != nil || !lease.Acquired() {
+		t.Errorf("Expected the released slot to be taken, got %+v, %v", lease, err)
+	}
+	// the leases of a key are not listed with the keys
+	if keys, _, err := newClient.ListKeys(ctx, "memory:", 0, 10); err != nil || len(keys) != 2 {
+		t.Errorf("Expected the decided keys only, got %v, %v", keys, err)
+	}
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMetrics(t *testing.T) {
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServer(serverCtx, socketPath)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	// the metrics are those of the process, the policy is new to them
+	name := fmt.Sprintf("metrics-%d", time.Now().UnixNano())
+	policy := &comm.PolicyData{ID: 1, Algorithm: comm.AlgorithmGCRA, Rate: 1, Burst: 1, Period: time.Second, Name: name}
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, &client.Options{Policies: []*comm.PolicyData{policy}})
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+	// the backend of the tests is not reachable, the decision fails
+	_, _ = newClient.RateLimit(ctx, &comm.RateLimitRequestData{PolicyID: 1, Rate: 1, Burst: 1, Period: time.Second, Key: "metrics"})
+
+	metrics := httptest.NewServer(server.NewMetricsHandler())
+	defer metrics.Close()
+	response, err := http.Get(metrics.URL)
+	if err != nil {
+		t.Fatalf("Failed to scrape metrics: %v", err)
+	}
+	defer response.Body.Close()
+	body, err := io.ReadAll(response.Body)
+	if err != nil {
+		t.Fatalf("Failed to read metrics: %v", err)
+	}
+	for _, expected := range []string{
+		`# TYPE traefik_rate_limit_decisions_total counter`,
+		`traefik_rate_limit_decisions_total{policy="` + name + `",outcome="error"} 1`,
+		`traefik_rate_limit_decision_duration_seconds_bucket{phase="socket",le="+Inf"}`,
+		`traefik_rate_limit_decision_duration_seconds_count{phase="backend"}`,
+		`traefik_rate_limit_backend_errors_total{code="backend_unavailable"}`,
+		`# TYPE traefik_rate_limit_connections gauge`,
+		`traefik_rate_limit_requests_in_flight 0`,
+		`traefik_rate_limit_redis_pool_connections{state="idle"}`,
+	} {
+		if !strings.Contains(string(body), expected) {
+			t.Errorf("Expected the metrics to contain %q, got:\n%s", expected, body)
+		}
+	}
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// TestNamedPolicies registers policies of the server config by name, and
+// expects decisions under them to take its limits and key namespace.
+func TestNamedPolicies(t *testing.T) {
+	useMemoryBackend(t)
+	// the server reads the config of the test, changed like by a reload
+	var current atomic.Pointer[config.Config]
+	cfg := *config.GetConfig()
+	cfg.Policies = map[string]*config.PolicyConfig{
+		"api-default": {Algorithm: comm.AlgorithmGCRA, Rate: 10, Burst: 10, Period: time.Second, Namespace: "api"},
+	}
+	current.Store(&cfg)
+
+	socketPath := testSocketPath(t)
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	defer serverCancel()
+	go func() {
+		server.RunServerWithConfig(serverCtx, socketPath, current.Load)
+	}()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.NewClientWithOptions(ctx, socketPath, &client.Options{Policies: []*comm.PolicyData{{ID: 1, Name: "missing"}}})
+	if !errors.Is(err, client.ErrUnknownPolicy) {
+		t.Fatalf("Expected an unknown policy error, got %v", err)
+	}
+
+	// allowed keys are answered without the backend
+	admin := httptest.NewServer(server.NewAdminHandler("secret"))
+	defer admin.Close()
+	if response, _ := adminRequest(t, admin.URL, http.MethodPost, "/v1/allows", "secret", `{"key":"api:named","ttl":"1h"}`); response.StatusCode != http.StatusCreated {
+		t.Fatalf("Expected %d for an allow-list entry, got %d", http.StatusCreated, response.StatusCode)
+	}
+
+	newClient, err := client.NewClientWithOptions(ctx, socketPath, &client.Options{Policies: []*comm.PolicyData{{ID: 1, Name: "api-default"}}})
+	if err != nil {
+		t.Fatalf("Failed to connect to socket: %v", err)
+	}
+	defer newClient.Close()
+	result, err := newClient.RateLimit(ctx, &comm.RateLimitRequestData{PolicyID: 1, Key: "named"})
+	if err != nil {
+		t.Fatalf("Failed to rate limit under a named policy: %v", err)
+	}
+	if result.Allowed != 1 || result.Remaining != 10 {
+		t.Errorf("Expected the namespaced key to be allowed with the limits of the config, got %+v", result)
+	}
+
+	// policies removed from the config fail the decisions under them
+	reloaded := cfg
+	reloaded.Policies = nil
+	current.Store(&reloaded)
+	if _, err := newClient.RateLimit(ctx, &comm.RateLimitRequestData{PolicyID: 1, Key: "named"}); !errors.Is(err, client.ErrUnknownPolicy) {
+		t.Errorf("Expected an unknown policy error, got %v", err)
+	}
+}
@@ -2,9 +2,24 @@ package server
 
 import (
 	"context"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
 	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
 )
 
 func Run(socketPath string) {
-	server.RunServer(context.Background(), socketPath)
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	go func() {
+		// a second signal kills the process
+		<-ctx.Done()
+		stop()
+	}()
+	server.RunServer(ctx, socketPath)
+	if err := rate_limit.Close(); err != nil {
+		slog.Warn("failed to close the backend", slog.Any("error", err))
+	}
 }
@@ -22,6 +22,9 @@ func Test(t *testing.T) {
 	slog.SetDefault(logger)
 
 	// Use a unique socket path for each benchmark run
+	if err := os.MkdirAll("./tmp", 0o755); err != nil {
+		t.Fatalf("Failed to create socket directory: %v", err)
+	}
 	socketPath := fmt.Sprintf("./tmp/traefik-rate-limit-%d.sock", time.Now().UnixNano())
 	defer os.Remove(socketPath) // Clean up socket file afterwards
 
@@ -50,14 +53,16 @@ func Test(t *testing.T) {
 			defer wg.Done()
 			newClient, err := client.NewClient(socketPath)
 			if err != nil {
-				t.Fatalf("Failed to connect to socket: %v", err)
+				t.Errorf("Failed to connect to socket: %v", err)
+				return
 			}
 			defer newClient.Close()
 			ctx, cancel := context.WithTimeout(context.Background(), 1*time.Second)
 			res, err := newClient.Ping(ctx)
 			if err != nil {
 				cancel()
-				t.Fatalf("Ping failed: %v", err)
+				t.Errorf("Ping failed: %v", err)
+				return
 			}
 			slog.Info("Ping succeeded", slog.Any("response", res))
 			cancel()
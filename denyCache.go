@@ -0,0 +1,127 @@
+package traefik_rate_limit
+
+import (
+	"container/list"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	DenyCacheEvictionLRU  = "lru"
+	DenyCacheEvictionFIFO = "fifo"
+)
+
+type DenyCacheConfig struct {
+	// Enabled answers requests of recently denied keys locally until their retry time.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// MaxEntries is the maximum number of denied keys remembered.
+	MaxEntries int `json:"maxEntries,omitempty"`
+
+	// Eviction is the policy used when the cache is full, either "lru" or "fifo".
+	Eviction string `json:"eviction,omitempty"`
+}
+
+func (c *DenyCacheConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxEntries <= 0 {
+		return fmt.Errorf("maxEntries must be greater than 0")
+	}
+	switch strings.ToLower(c.Eviction) {
+	case "", DenyCacheEvictionLRU, DenyCacheEvictionFIFO:
+	default:
+		return fmt.Errorf("unknown eviction policy: %s", c.Eviction)
+	}
+	return nil
+}
+
+type denyCacheEntry struct {
+	key        string
+	retryUntil time.Time
+}
+
+// DenyCache remembers denied keys until their retry time, bounded in size.
+type DenyCache struct {
+	mu         sync.Mutex
+	entries    map[string]*list.Element
+	order      *list.List // front is the next entry to keep, back the next to evict
+	maxEntries int
+	lru        bool
+}
+
+func NewDenyCache(config *DenyCacheConfig) *DenyCache {
+	return &DenyCache{
+		entries:    make(map[string]*list.Element),
+		order:      list.New(),
+		maxEntries: config.MaxEntries,
+		lru:        !strings.EqualFold(config.Eviction, DenyCacheEvictionFIFO),
+	}
+}
+
+// Get returns the time left until the key may retry, if it is still denied.
+func (c *DenyCache) Get(key string, now time.Time) (time.Duration, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[key]
+	if !ok {
+		return 0, false
+	}
+	entry := elem.Value.(*denyCacheEntry)
+	retryAfter := entry.retryUntil.Sub(now)
+	if retryAfter <= 0 {
+		c.remove(elem)
+		return 0, false
+	}
+	if c.lru {
+		c.order.MoveToFront(elem)
+	}
+	return retryAfter, true
+}
+
+// Put remembers the key as denied for retryAfter.
+func (c *DenyCache) Put(key string, retryAfter time.Duration, now time.Time) {
+	if retryAfter <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		elem.Value.(*denyCacheEntry).retryUntil = now.Add(retryAfter)
+		if c.lru {
+			c.order.MoveToFront(elem)
+		}
+		return
+	}
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Back())
+	}
+	c.entries[key] = c.order.PushFront(&denyCacheEntry{key: key, retryUntil: now.Add(retryAfter)})
+}
+
+// Delete forgets the key.
+func (c *DenyCache) Delete(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if elem, ok := c.entries[key]; ok {
+		c.remove(elem)
+	}
+}
+
+// Len returns the number of remembered keys, including expired ones not yet evicted.
+func (c *DenyCache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+func (c *DenyCache) remove(elem *list.Element) {
+	entry := c.order.Remove(elem).(*denyCacheEntry)
+	delete(c.entries, entry.key)
+}
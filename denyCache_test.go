@@ -0,0 +1,89 @@
+package traefik_rate_limit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDenyCacheExpiry(t *testing.T) {
+	cache := NewDenyCache(&DenyCacheConfig{Enabled: true, MaxEntries: 10})
+	now := time.Unix(1_700_000_000, 0)
+	cache.Put("a", time.Second, now)
+	cache.Put("b", 0, now)
+
+	if left, ok := cache.Get("a", now.Add(400*time.Millisecond)); !ok || left != 600*time.Millisecond {
+		t.Errorf("Expected %s left \nWanted %s", left, 600*time.Millisecond)
+	}
+	if _, ok := cache.Get("b", now); ok {
+		t.Errorf("Expected a key without retry time not to be remembered")
+	}
+	if _, ok := cache.Get("a", now.Add(time.Second)); ok {
+		t.Errorf("Expected the key to expire at its retry time")
+	}
+	if cache.Len() != 0 {
+		t.Errorf("Expected the expired key to be evicted, %d left", cache.Len())
+	}
+}
+
+func TestDenyCacheEviction(t *testing.T) {
+	now := time.Unix(1_700_000_000, 0)
+	tests := []struct {
+		name     string
+		eviction string
+		// read reads a before c is added, instead of denying it again
+		read    bool
+		evicted string
+		kept    string
+	}{
+		{name: "LRUDeniedAgain", eviction: DenyCacheEvictionLRU, evicted: "b", kept: "a"},
+		{name: "LRURead", eviction: DenyCacheEvictionLRU, read: true, evicted: "b", kept: "a"},
+		{name: "DefaultRead", eviction: "", read: true, evicted: "b", kept: "a"},
+		{name: "FIFODeniedAgain", eviction: DenyCacheEvictionFIFO, evicted: "a", kept: "b"},
+		{name: "FIFORead", eviction: DenyCacheEvictionFIFO, read: true, evicted: "a", kept: "b"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			cache := NewDenyCache(&DenyCacheConfig{Enabled: true, MaxEntries: 2, Eviction: tt.eviction})
+			cache.Put("a", time.Minute, now)
+			cache.Put("b", time.Minute, now)
+			if tt.read {
+				cache.Get("a", now)
+			} else {
+				cache.Put("a", 2*time.Minute, now)
+			}
+			cache.Put("c", time.Minute, now)
+
+			if cache.Len() != 2 {
+				t.Errorf("Expected %d keys \nWanted %d", cache.Len(), 2)
+			}
+			if _, ok := cache.Get(tt.evicted, now); ok {
+				t.Errorf("Expected %s to be evicted", tt.evicted)
+			}
+			for _, key := range []string{tt.kept, "c"} {
+				if _, ok := cache.Get(key, now); !ok {
+					t.Errorf("Expected %s to be kept", key)
+				}
+			}
+		})
+	}
+}
+
+func TestDenyCacheMaxEntries(t *testing.T) {
+	cache := NewDenyCache(&DenyCacheConfig{Enabled: true, MaxEntries: 3})
+	now := time.Unix(1_700_000_000, 0)
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		cache.Put(key, time.Minute, now)
+		if cache.Len() > 3 {
+			t.Fatalf("Expected at most %d keys, got %d", 3, cache.Len())
+		}
+	}
+	for _, key := range []string{"a", "b"} {
+		if _, ok := cache.Get(key, now); ok {
+			t.Errorf("Expected %s to be evicted", key)
+		}
+	}
+	cache.Delete("e")
+	if _, ok := cache.Get("e", now); ok || cache.Len() != 2 {
+		t.Errorf("Expected e to be forgotten, %d keys left", cache.Len())
+	}
+}
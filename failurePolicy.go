@@ -0,0 +1,107 @@
+package traefik_rate_limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"strings"
+)
+
+const (
+	// FailOpen lets the request through when no decision could be made.
+	FailOpen = "open"
+	// FailClosed rejects the request when no decision could be made.
+	FailClosed = "closed"
+)
+
+type FailurePolicyConfig struct {
+	// BackendUnavailable applies when the sidecar or its backend cannot be reached.
+	BackendUnavailable string `json:"backendUnavailable,omitempty"`
+
+	// Timeout applies when no decision was made within the timeout.
+	Timeout string `json:"timeout,omitempty"`
+
+	// Overloaded applies when the sidecar sheds load.
+	Overloaded string `json:"overloaded,omitempty"`
+
+	// InvalidRequest applies when the sidecar rejects the request as malformed.
+	InvalidRequest string `json:"invalidRequest,omitempty"`
+
+	// Unauthorized applies when the sidecar does not accept the plugin.
+	Unauthorized string `json:"unauthorized,omitempty"`
+
+	// UnknownPolicy applies when the sidecar does not define the policy.
+	UnknownPolicy string `json:"unknownPolicy,omitempty"`
+
+	// Default applies to any other error.
+	Default string `json:"default,omitempty"`
+}
+
+func (c *FailurePolicyConfig) Validate() error {
+	policies := map[string]string{
+		"backendUnavailable": c.BackendUnavailable,
+		"timeout":            c.Timeout,
+		"overloaded":         c.Overloaded,
+		"invalidRequest":     c.InvalidRequest,
+		"unauthorized":       c.Unauthorized,
+		"unknownPolicy":      c.UnknownPolicy,
+		"default":            c.Default,
+	}
+	for name, policy := range policies {
+		switch strings.ToLower(policy) {
+		case "", FailOpen, FailClosed:
+		default:
+			return fmt.Errorf("unknown policy %s for %s, expected %s or %s", policy, name, FailOpen, FailClosed)
+		}
+	}
+	return nil
+}
+
+// errorClass names the kind of error for the failure policy and the logs.
+func errorClass(err error) string {
+	switch {
+	case errors.Is(err, client.ErrBackendUnavailable), errors.Is(err, client.ErrServerUnavailable):
+		return "backendUnavailable"
+	case errors.Is(err, client.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, client.ErrOverloaded):
+		return "overloaded"
+	case errors.Is(err, client.ErrInvalidRequest):
+		return "invalidRequest"
+	case errors.Is(err, client.ErrUnauthorized):
+		return "unauthorized"
+	case errors.Is(err, client.ErrUnknownPolicy):
+		return "unknownPolicy"
+	default:
+		return "default"
+	}
+}
+
+// FailClosed reports whether a request whose decision failed with the error
+// must be rejected. Without a policy for its class, the default one applies,
+// failing open when unset.
+func (c *FailurePolicyConfig) FailClosed(err error) bool {
+	if c == nil {
+		return false
+	}
+	policy := ""
+	switch errorClass(err) {
+	case "backendUnavailable":
+		policy = c.BackendUnavailable
+	case "timeout":
+		policy = c.Timeout
+	case "overloaded":
+		policy = c.Overloaded
+	case "invalidRequest":
+		policy = c.InvalidRequest
+	case "unauthorized":
+		policy = c.Unauthorized
+	case "unknownPolicy":
+		policy = c.UnknownPolicy
+	}
+	if policy == "" {
+		policy = c.Default
+	}
+	return strings.ToLower(policy) == FailClosed
+}
@@ -0,0 +1,226 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// Batcher groups concurrent rate limit decisions into batch frames. Decisions
+// for the same key, limits and algorithm waiting in the same batch are
+// coalesced into a single entry whose cost is the sum of their costs.
+type Batcher struct {
+	client   *Client
+	maxSize  int
+	maxDelay time.Duration
+
+	mu    sync.Mutex
+	calls map[batchKey]*batchCall
+	batch []*batchCall
+	timer *time.Timer
+	// closed sends the decisions on their own once the batcher is replaced.
+	closed bool
+}
+
+type batchKey struct {
+	key       string
+	rate      uint64
+	burst     uint64
+	period    time.Duration
+	policyID  uint32
+	algorithm comm.Algorithm
+}
+
+type batchCall struct {
+	data       *comm.RateLimitRequestData
+	deadline   time.Time
+	noDeadline bool
+	done       chan struct{}
+	result     *comm.RateLimitResponseData
+	err        error
+}
+
+// NewBatcher returns a batcher sending through the client. A batch is flushed
+// once it holds maxSize distinct entries or maxDelay after its first entry.
+func NewBatcher(client *Client, maxSize int, maxDelay time.Duration) *Batcher {
+	if maxSize <= 0 {
+		maxSize = 1
+	}
+	if maxSize > comm.MaxBatchSize {
+		maxSize = comm.MaxBatchSize
+	}
+	return &Batcher{
+		client:   client,
+		maxSize:  maxSize,
+		maxDelay: maxDelay,
+		calls:    make(map[batchKey]*batchCall),
+	}
+}
+
+// Client returns the client the batcher sends through.
+func (b *Batcher) Client() *Client {
+	return b.client
+}
+
+// RateLimit queues the decision in the current batch and waits for its result.
+// Without batch support on the server, the decision is sent right away.
+func (b *Batcher) RateLimit(ctx context.Context, data *comm.RateLimitRequestData) (*comm.RateLimitResponseData, error) {
+	if !b.client.Features().Has(comm.FeatureBatch) {
+		return b.client.RateLimit(ctx, data)
+	}
+	// an algorithm the server lacks would fail the whole batch
+	if err := b.client.requireAlgorithm(data.Algorithm); err != nil {
+		return nil, err
+	}
+	cost := data.GetCost()
+	key := batchKey{key: data.Key, rate: data.Rate, burst: data.Burst, period: data.Period, policyID: data.PolicyID, algorithm: data.Algorithm}
+
+	b.mu.Lock()
+	if b.closed {
+		b.mu.Unlock()
+		return b.client.RateLimit(ctx, data)
+	}
+	call, ok := b.calls[key]
+	if !ok {
+		call = &batchCall{
+			data: &comm.RateLimitRequestData{
+				Rate:     data.Rate,
+				Burst:    data.Burst,
+				Period:   data.Period,
+				Key:      data.Key,
+				PolicyID: data.PolicyID,
+				// the algorithm is part of the key, coalesced decisions share it
+				Algorithm: data.Algorithm,
+				// coalesced decisions are traced in the trace of the first one
+				Trace: data.Trace,
+			},
+			done: make(chan struct{}),
+		}
+		b.calls[key] = call
+		b.batch = append(b.batch, call)
+	}
+	offset := call.data.Cost
+	call.data.Cost += cost
+	if deadline, ok := ctx.Deadline(); !ok {
+		call.noDeadline = true
+	} else if deadline.After(call.deadline) {
+		call.deadline = deadline
+	}
+	if len(b.batch) >= b.maxSize {
+		b.flushLocked()
+	} else if b.timer == nil {
+		b.timer = time.AfterFunc(b.maxDelay, b.flush)
+	}
+	b.mu.Unlock()
+
+	select {
+	case <-call.done:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	if call.err != nil {
+		return nil, call.err
+	}
+	if call.result == nil {
+		return nil, fmt.Errorf("empty rate limit response")
+	}
+	return share(call.result, call.data, offset, cost), nil
+}
+
+// Close sends the current batch right away and stops batching: later
+// decisions, from callers still holding the batcher, are sent on their own.
+func (b *Batcher) Close() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.closed = true
+	b.flushLocked()
+}
+
+func (b *Batcher) flush() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.flushLocked()
+}
+
+func (b *Batcher) flushLocked() {
+	if b.timer != nil {
+		b.timer.Stop()
+		b.timer = nil
+	}
+	if len(b.batch) == 0 {
+		return
+	}
+	batch := b.batch
+	b.batch = nil
+	b.calls = make(map[batchKey]*batchCall)
+	go b.send(batch)
+}
+
+func (b *Batcher) send(batch []*batchCall) {
+	ctx := context.Background()
+	var deadline time.Time
+	noDeadline := false
+	for _, call := range batch {
+		noDeadline = noDeadline || call.noDeadline
+		if call.deadline.After(deadline) {
+			deadline = call.deadline
+		}
+	}
+	if !noDeadline {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// a lone entry goes out as a plain rate limit frame
+	if len(batch) == 1 {
+		call := batch[0]
+		call.result, call.err = b.client.RateLimit(ctx, call.data)
+		close(call.done)
+		return
+	}
+
+	entries := make([]*comm.RateLimitRequestData, len(batch))
+	for i, call := range batch {
+		entries[i] = call.data
+	}
+	results, err := b.client.RateLimitBatch(ctx, entries)
+	for i, call := range batch {
+		switch {
+		case err != nil:
+			call.err = err
+		case results[i].Status != comm.ResponseStatusOK:
+			call.err = newServerError(results[i].Code, results[i].Error)
+		default:
+			call.result = &results[i].Data
+		}
+		close(call.done)
+	}
+}
+
+// share returns the part of a coalesced result for the caller whose tokens
+// start at offset. A caller is allowed only if all its tokens were granted.
+func share(result *comm.RateLimitResponseData, data *comm.RateLimitRequestData, offset uint64, cost uint64) *comm.RateLimitResponseData {
+	if result.Allowed > 0 && offset+cost <= uint64(result.Allowed) {
+		return &comm.RateLimitResponseData{
+			Allowed:    int64(cost),
+			Remaining:  result.Remaining,
+			RetryAfter: result.RetryAfter,
+			ResetAfter: result.ResetAfter,
+		}
+	}
+	retryAfter := result.RetryAfter
+	if retryAfter <= 0 && data.Rate > 0 {
+		// the entry was partly granted, the next token is one emission interval away
+		retryAfter = data.Period / time.Duration(data.Rate)
+	}
+	return &comm.RateLimitResponseData{
+		Allowed:    0,
+		Remaining:  0,
+		RetryAfter: retryAfter,
+		ResetAfter: result.ResetAfter,
+	}
+}
@@ -0,0 +1,231 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// recordingServer is a fakeServer granting every decision and recording the
+// decision frames it receives.
+func recordingServer(t *testing.T) (*fakeServer, chan *comm.Request) {
+	received := make(chan *comm.Request, 64)
+	s := newFakeServer(t, comm.SupportedFeatures, func(conn *fakeConn, req *comm.Request) {
+		received <- req
+		decide(conn, req)
+	})
+	return s, received
+}
+
+// decideAll runs the decisions concurrently and returns their results in order.
+func decideAll(t *testing.T, b *Batcher, entries ...*comm.RateLimitRequestData) ([]*comm.RateLimitResponseData, []error) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	results := make([]*comm.RateLimitResponseData, len(entries))
+	errs := make([]error, len(entries))
+	var wg sync.WaitGroup
+	for i, entry := range entries {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			results[i], errs[i] = b.RateLimit(ctx, entry)
+		}()
+	}
+	wg.Wait()
+	return results, errs
+}
+
+func entry(key string) *comm.RateLimitRequestData {
+	return &comm.RateLimitRequestData{Rate: 10, Burst: 10, Period: time.Second, Key: key}
+}
+
+func TestBatcherFlushOnSize(t *testing.T) {
+	s, received := recordingServer(t)
+	b := NewBatcher(s.dial(t, nil), 3, time.Hour)
+
+	results, errs := decideAll(t, b, entry("a"), entry("b"), entry("c"))
+	for i, err := range errs {
+		if err != nil || results[i].Allowed != 1 {
+			t.Errorf("decision %d: expected to be allowed, got %+v, %v", i, results[i], err)
+		}
+	}
+	req := <-received
+	if req.Type != comm.RequestTypeRateLimitBatch || len(req.Batch.Entries) != 3 {
+		t.Errorf("expected a batch of 3 entries, got %s of %d", req.Type, len(req.Batch.Entries))
+	}
+}
+
+func TestBatcherFlushOnDelay(t *testing.T) {
+	s, received := recordingServer(t)
+	delay := 50 * time.Millisecond
+	b := NewBatcher(s.dial(t, nil), 64, delay)
+
+	start := time.Now()
+	_, errs := decideAll(t, b, entry("a"), entry("b"))
+	if elapsed := time.Since(start); elapsed < delay {
+		t.Errorf("expected the batch to wait %s, flushed after %s", delay, elapsed)
+	}
+	if errs[0] != nil || errs[1] != nil {
+		t.Fatalf("expected the decisions to succeed, got %v", errs)
+	}
+	if req := <-received; req.Type != comm.RequestTypeRateLimitBatch || len(req.Batch.Entries) != 2 {
+		t.Errorf("expected a batch of 2 entries, got %s of %d", req.Type, len(req.Batch.Entries))
+	}
+
+	// a lone entry goes out as a plain frame
+	if _, errs = decideAll(t, b, entry("a")); errs[0] != nil {
+		t.Fatalf("expected the decision to succeed, got %v", errs[0])
+	}
+	if req := <-received; req.Type != comm.RequestTypeRateLimit {
+		t.Errorf("expected a plain decision, got %s", req.Type)
+	}
+}
+
+func TestBatcherCoalesces(t *testing.T) {
+	s, received := recordingServer(t)
+	b := NewBatcher(s.dial(t, nil), 64, 50*time.Millisecond)
+
+	results, errs := decideAll(t, b, entry("a"), entry("a"), entry("b"))
+	for i, err := range errs {
+		if err != nil || results[i].Allowed != 1 {
+			t.Errorf("decision %d: expected to be allowed, got %+v, %v", i, results[i], err)
+		}
+	}
+	req := <-received
+	costs := map[string]uint64{}
+	for _, entry := range req.Batch.Entries {
+		costs[entry.Key] = entry.GetCost()
+	}
+	if len(costs) != 2 || costs["a"] != 2 || costs["b"] != 1 {
+		t.Errorf("expected the decisions of a to be coalesced, got costs %v", costs)
+	}
+}
+
+// TestBatcherAlgorithms expects the decisions of a key under a window
+// algorithm to keep it in their batch entry, apart from those under GCRA.
+func TestBatcherAlgorithms(t *testing.T) {
+	s, received := recordingServer(t)
+	b := NewBatcher(s.dial(t, nil), 64, 50*time.Millisecond)
+
+	window := func() *comm.RateLimitRequestData {
+		data := entry("a")
+		data.Algorithm = comm.AlgorithmFixedWindow
+		return data
+	}
+	_, errs := decideAll(t, b, window(), window(), entry("a"))
+	for i, err := range errs {
+		if err != nil {
+			t.Errorf("decision %d: expected to succeed, got %v", i, err)
+		}
+	}
+	req := <-received
+	costs := map[comm.Algorithm]uint64{}
+	for _, entry := range req.Batch.Entries {
+		costs[entry.Algorithm] += entry.GetCost()
+	}
+	if len(req.Batch.Entries) != 2 || costs[comm.AlgorithmFixedWindow] != 2 || costs[comm.AlgorithmGCRA] != 1 {
+		t.Errorf("expected an entry per algorithm, got %d entries with costs %v", len(req.Batch.Entries), costs)
+	}
+
+	// without the feature on the server the decision fails on its own
+	s = newFakeServer(t, comm.FeatureBatch, decide)
+	b = NewBatcher(s.dial(t, nil), 64, time.Hour)
+	if _, err := b.RateLimit(context.Background(), window()); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("expected the algorithm to be refused, got %v", err)
+	}
+}
+
+func TestBatcherErrors(t *testing.T) {
+	s := newFakeServer(t, comm.SupportedFeatures, func(conn *fakeConn, req *comm.Request) {
+		resp := answer(req)
+		for _, entry := range req.Batch.Entries {
+			if entry.Key == "down" {
+				resp.SetError(comm.ErrorCodeBackendUnavailable, "redis: connection refused")
+			}
+		}
+		if resp.Status == comm.ResponseStatusOK {
+			// each entry fails or succeeds on its own
+			for _, entry := range req.Batch.Entries {
+				result := &comm.RateLimitBatchResult{Status: comm.ResponseStatusOK, Data: allowed(entry)}
+				if entry.Key == "invalid" {
+					result = &comm.RateLimitBatchResult{Status: comm.ResponseStatusError, Code: comm.ErrorCodeInvalidRequest, Error: "rate must be positive"}
+				}
+				resp.Batch.Results = append(resp.Batch.Results, result)
+			}
+		}
+		conn.send(resp)
+	})
+	b := NewBatcher(s.dial(t, nil), 3, time.Hour)
+
+	_, errs := decideAll(t, b, entry("down"), entry("b"), entry("c"))
+	for i, err := range errs {
+		if !errors.Is(err, ErrBackendUnavailable) {
+			t.Errorf("decision %d: expected the error of the batch, got %v", i, err)
+		}
+	}
+
+	results, errs := decideAll(t, b, entry("a"), entry("invalid"), entry("c"))
+	for i, key := range []string{"a", "invalid", "c"} {
+		if key == "invalid" {
+			if !errors.Is(errs[i], ErrInvalidRequest) {
+				t.Errorf("decision %d: expected the error of its entry, got %+v, %v", i, results[i], errs[i])
+			}
+		} else if errs[i] != nil || results[i].Allowed != 1 {
+			t.Errorf("decision %d: expected to be allowed, got %+v, %v", i, results[i], errs[i])
+		}
+	}
+}
+
+func TestBatcherClose(t *testing.T) {
+	s, received := recordingServer(t)
+	b := NewBatcher(s.dial(t, nil), 64, time.Hour)
+
+	done := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() {
+			_, err := b.RateLimit(context.Background(), entry(fmt.Sprint(i)))
+			done <- err
+		}()
+	}
+	// the batch waits for an hour unless closed
+	for deadline := time.Now().Add(5 * time.Second); ; {
+		b.mu.Lock()
+		waiting := len(b.batch)
+		b.mu.Unlock()
+		if waiting == 2 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected 2 decisions waiting, got %d", waiting)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	b.Close()
+	for i := 0; i < 2; i++ {
+		select {
+		case err := <-done:
+			if err != nil {
+				t.Errorf("expected the waiting decisions to be sent, got %v", err)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("the waiting decisions were not sent on close")
+		}
+	}
+	if req := <-received; req.Type != comm.RequestTypeRateLimitBatch {
+		t.Errorf("expected the waiting decisions in a batch, got %s", req.Type)
+	}
+
+	// a closed batcher still answers, without batching
+	if _, errs := decideAll(t, b, entry("a")); errs[0] != nil {
+		t.Fatalf("expected the decision to succeed, got %v", errs[0])
+	}
+	if req := <-received; req.Type != comm.RequestTypeRateLimit {
+		t.Errorf("expected a plain decision, got %s", req.Type)
+	}
+}
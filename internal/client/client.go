@@ -2,8 +2,11 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
 	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
 	"log/slog"
 	"math/rand/v2"
 	"net"
@@ -15,13 +18,175 @@ import (
 type Client struct {
 	SocketPath string
 	conn       net.Conn
-	pending    sync.Map
+	// pending are the channels of the requests waiting for a response, by
+	// request ID.
+	pendingMu sync.Mutex
+	pending   map[uint32]chan *comm.Response
+	// done is closed once the connection stops delivering responses.
+	done chan struct{}
+	// goAway is closed once the server asked the client to leave the connection.
+	goAway chan struct{}
+	// mu guards the number of requests waiting for a response and whether the
+	// connection is draining after a GOAWAY.
+	mu       sync.Mutex
+	inflight int
+	draining bool
+	// version and features are agreed on with the server in the handshake.
+	version  uint32
+	features comm.Feature
+	// policies are the policies registered on the connection, by ID.
+	policies map[uint32]*comm.PolicyData
+	// onEvent handles the events pushed by the server, if any.
+	onEvent func(event comm.EventData)
+	// backendDown is set while the server reports its backend unavailable,
+	// guarded by mu.
+	backendDown bool
+	// closeErr is why the connection stopped, guarded by mu.
+	closeErr error
+	// writeMu serializes the frames written to the connection, each within
+	// its write deadline.
+	writeMu sync.Mutex
 }
 
+// Options configure how the client connects to the server.
+type Options struct {
+	// TLS is the configuration used for tls:// addresses.
+	TLS *tls.Config
+	// AuthToken is the pre-shared token proven to servers requiring authentication.
+	AuthToken string
+	// AdminToken is proven in place of AuthToken to reset and list keys on
+	// servers configured with an admin token.
+	AdminToken string
+	// Policies are registered on every new connection. Decisions under them
+	// then only send the policy ID and the key.
+	Policies []*comm.PolicyData
+	// Events are subscribed to on every new connection to servers supporting
+	// them. The events pushed by the server are handed to OnEvent.
+	Events comm.EventMask
+	// OnEvent is called from the goroutine reading the responses of the
+	// connection, it must not block.
+	OnEvent func(event comm.EventData)
+	// KeepAlive is the time between two pings checking that the connection is
+	// alive, none when zero. A connection whose ping is not answered within
+	// KeepAliveTimeout is closed, failing its pending requests.
+	KeepAlive        time.Duration
+	KeepAliveTimeout time.Duration
+}
+
+// defaultKeepAliveTimeout is the time a keepalive ping waits for its answer
+// when Options.KeepAliveTimeout is not set.
+const defaultKeepAliveTimeout = 5 * time.Second
+
+// defaultWriteTimeout bounds the writing of requests whose context has no deadline.
+const defaultWriteTimeout = 5 * time.Second
+
 func NewClient(socketPath string) (*Client, error) {
+	return NewClientWithContext(context.Background(), socketPath)
+}
+
+// NewClientWithContext connects to the server like NewClient, giving up
+// waiting for the socket file once the context is done.
+func NewClientWithContext(ctx context.Context, socketPath string) (*Client, error) {
+	return NewClientWithOptions(ctx, socketPath, nil)
+}
+
+// NewClientWithOptions connects to the server at the address, a unix socket
+// path or a unix://, tcp:// or tls:// URL.
+func NewClientWithOptions(ctx context.Context, socketPath string, options *Options) (*Client, error) {
 	if socketPath == "" {
 		return nil, fmt.Errorf("socket path is empty")
 	}
+	if options == nil {
+		options = &Options{}
+	}
+	address, err := transport.ParseAddress(socketPath)
+	if err != nil {
+		return nil, err
+	}
+	if address.IsUnix() {
+		if err := waitForSocketFile(ctx, address.Address); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := transport.Dial(ctx, address, options.TLS)
+	if err != nil {
+		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", socketPath))
+		return nil, fmt.Errorf("%w: %w", ErrServerUnavailable, err)
+	}
+
+	newClient := &Client{
+		SocketPath: socketPath,
+		conn:       conn,
+		done:       make(chan struct{}),
+		goAway:     make(chan struct{}),
+		onEvent:    options.OnEvent,
+	}
+
+	go newClient.ReadResponses(conn)
+
+	features, token := comm.SupportedFeatures, options.AuthToken
+	if options.AdminToken != "" {
+		features, token = features|comm.FeatureAdmin, options.AdminToken
+	}
+	if err := newClient.handshake(ctx, features); err != nil {
+		newClient.Close()
+		return nil, fmt.Errorf("protocol negotiation failed: %w", err)
+	}
+	if options.AdminToken != "" && !newClient.Features().Has(comm.FeatureAdmin) {
+		newClient.Close()
+		return nil, fmt.Errorf("authentication failed: the server has no admin token")
+	}
+	if token != "" {
+		if err := newClient.authenticate(ctx, token); err != nil {
+			newClient.Close()
+			return nil, fmt.Errorf("authentication failed: %w", err)
+		}
+	}
+	if err := newClient.registerPolicies(ctx, options.Policies); err != nil {
+		newClient.Close()
+		return nil, fmt.Errorf("policy registration failed: %w", err)
+	}
+	if options.Events != 0 && newClient.Features().Has(comm.FeatureEvents) {
+		if err := newClient.Subscribe(ctx, options.Events); err != nil {
+			newClient.Close()
+			return nil, fmt.Errorf("event subscription failed: %w", err)
+		}
+	}
+	if options.KeepAlive > 0 {
+		timeout := options.KeepAliveTimeout
+		if timeout <= 0 {
+			timeout = defaultKeepAliveTimeout
+		}
+		go newClient.keepAlive(options.KeepAlive, timeout)
+	}
+
+	return newClient, nil
+}
+
+// keepAlive pings the server every interval until the connection stops,
+// closing it when a ping is not answered within the timeout.
+func (c *Client) keepAlive(interval time.Duration, timeout time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		_, err := c.Ping(ctx)
+		cancel()
+		if err != nil && !errors.Is(err, ErrServerUnavailable) {
+			slog.Warn("server did not answer the keepalive ping, closing connection", slog.String("socket", c.SocketPath), slog.Any("error", err))
+			c.fail(fmt.Errorf("keepalive ping failed: %w", err))
+			return
+		}
+	}
+}
+
+func waitForSocketFile(ctx context.Context, socketPath string) error {
 	startTime := time.Now()
 	maxWait := 5 * time.Second
 	for {
@@ -30,29 +195,279 @@ func NewClient(socketPath string) (*Client, error) {
 		}
 		if time.Since(startTime) > maxWait {
 			slog.Error("timed out waiting for socket file", slog.String("socket", socketPath))
-			return nil, fmt.Errorf("timed out waiting for socket file: %s", socketPath)
+			return fmt.Errorf("%w: timed out waiting for socket file: %s", ErrServerUnavailable, socketPath)
+		}
+		select {
+		case <-ctx.Done():
+			return fmt.Errorf("waiting for socket file %s: %w", socketPath, ctx.Err())
+		case <-time.After(100 * time.Millisecond):
 		}
-		time.Sleep(100 * time.Millisecond)
 	}
 	slog.Info("found socket file", slog.String("socket", socketPath))
+	return nil
+}
 
-	conn, err := net.Dial("unix", socketPath)
+// handshake agrees with the server on the protocol version and features.
+// Servers predating the handshake are spoken to in comm.MinVersion without
+// optional features.
+func (c *Client) handshake(ctx context.Context, features comm.Feature) error {
+	req := c.newRequest(comm.RequestTypeHello)
+	defer releaseRequest(req)
+	req.Version = comm.MinVersion
+	req.Hello = comm.HelloData{
+		MinVersion: comm.MinVersion,
+		MaxVersion: comm.VERSION,
+		Features:   features,
+	}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	// servers answer a hello with a hello, unless they predate the handshake
+	var serverErr *ServerError
+	if errors.As(err, &serverErr) {
+		slog.Info("server does not support the handshake, using the oldest protocol version", slog.Uint64("version", uint64(comm.MinVersion)), slog.String("error", serverErr.Message))
+		c.version = comm.MinVersion
+		c.features = 0
+		return nil
+	}
 	if err != nil {
-		slog.Error("failed to dial server", slog.Any("error", err), slog.String("socket", socketPath))
-		return nil, err
+		return err
 	}
+	hello := res.Hello
+	releaseResponse(res)
+	// a server sharing no version answers with the versions it supports
+	if hello.MinVersion != hello.MaxVersion || hello.MaxVersion < comm.MinVersion || hello.MaxVersion > comm.VERSION {
+		return fmt.Errorf("%w: server supports %d to %d, expected %d to %d", comm.ErrUnsupportedVersion, hello.MinVersion, hello.MaxVersion, comm.MinVersion, comm.VERSION)
+	}
+	c.version = hello.MaxVersion
+	c.features = hello.Features & features
+	slog.Debug("handshake completed", slog.Uint64("version", uint64(c.version)), slog.String("features", c.features.String()))
+	return nil
+}
 
-	newClient := &Client{
-		SocketPath: socketPath,
-		conn:       conn,
+// authenticate proves to the server that the client knows the token, after
+// checking that the server knows it too.
+func (c *Client) authenticate(ctx context.Context, token string) error {
+	clientNonce, err := comm.NewAuthNonce()
+	if err != nil {
+		return err
 	}
 
-	go newClient.ReadResponses(conn)
+	req := c.newRequest(comm.RequestTypeAuthChallenge)
+	defer releaseRequest(req)
+	req.Auth = comm.AuthData{Nonce: clientNonce}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return err
+	}
+	challenge := res.Auth
+	releaseResponse(res)
+	if !comm.VerifyProof(comm.ServerProof(token, clientNonce, challenge.Nonce), challenge.MAC) {
+		return fmt.Errorf("server does not know the token")
+	}
 
-	return newClient, nil
+	req.Header = comm.Header{RequestID: newRequestID(), Version: c.Version()}
+	req.Type = comm.RequestTypeAuth
+	req.Auth = comm.AuthData{MAC: comm.ClientProof(token, clientNonce, challenge.Nonce)}
+	res, err = c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return err
+	}
+	releaseResponse(res)
+	slog.Debug("authenticated to server")
+	return nil
+}
+
+// registerPolicies registers the policies on the connection. Servers without
+// policy support keep receiving full rate limit frames, named policies then
+// fail as they carry no limits.
+func (c *Client) registerPolicies(ctx context.Context, policies []*comm.PolicyData) error {
+	for _, policy := range policies {
+		if policy.IsNamed() && !c.Features().Has(comm.FeaturePolicies|comm.FeatureNamedPolicies) {
+			return fmt.Errorf("policy %q: %w: the server does not support named policies", policy.Name, ErrUnknownPolicy)
+		}
+		if err := c.requireAlgorithm(policy.Algorithm); err != nil {
+			return fmt.Errorf("policy %q: %w", policy.Name, err)
+		}
+	}
+	if len(policies) == 0 || !c.Features().Has(comm.FeaturePolicies) {
+		return nil
+	}
+	registered := make(map[uint32]*comm.PolicyData, len(policies))
+	for _, policy := range policies {
+		req := c.newRequest(comm.RequestTypeRegisterPolicy)
+		req.Policy = *policy
+		res, err := c.SendRequest(ctx, c.conn, req)
+		releaseRequest(req)
+		if err != nil {
+			return fmt.Errorf("policy %d: %w", policy.ID, err)
+		}
+		releaseResponse(res)
+		registered[policy.ID] = policy
+	}
+	c.policies = registered
+	slog.Debug("policies registered", slog.Int("count", len(registered)))
+	return nil
+}
+
+// policyRequest sets dst to the short form of the request and reports
+// whether its policy is registered on the connection.
+func (c *Client) policyRequest(payload *comm.RateLimitRequestData, dst *comm.PolicyRateLimitRequestData) bool {
+	if payload.PolicyID == 0 {
+		return false
+	}
+	if _, ok := c.policies[payload.PolicyID]; !ok {
+		return false
+	}
+	*dst = comm.PolicyRateLimitRequestData{PolicyID: payload.PolicyID, Cost: payload.Cost, Key: payload.Key, Trace: payload.Trace}
+	return true
+}
+
+// Subscribe sets the events the server pushes on the connection, replacing
+// the earlier subscription. No event is pushed after an empty set.
+func (c *Client) Subscribe(ctx context.Context, events comm.EventMask) error {
+	if err := c.requireFeature(comm.FeatureEvents); err != nil {
+		return err
+	}
+	req := c.newRequest(comm.RequestTypeSubscribe)
+	defer releaseRequest(req)
+	req.Subscribe = comm.SubscribeData{Events: events}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return err
+	}
+	releaseResponse(res)
+	slog.Debug("events subscribed", slog.Uint64("events", uint64(events)))
+	return nil
+}
+
+// handleEvent records the health of the backend and hands the event to the
+// handler of the client.
+func (c *Client) handleEvent(event comm.EventData) {
+	if event.Type == comm.EventTypeBackendHealth {
+		c.mu.Lock()
+		c.backendDown = !event.Healthy
+		c.mu.Unlock()
+	}
+	if c.onEvent != nil {
+		c.onEvent(event)
+	}
+}
+
+// BackendAvailable reports whether the backend of the server is available,
+// as last announced by the server. It is assumed to be without an announcement.
+func (c *Client) BackendAvailable() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return !c.backendDown
+}
+
+// Version returns the protocol version agreed on with the server.
+func (c *Client) Version() uint32 {
+	if c.version == 0 {
+		return comm.VERSION
+	}
+	return c.version
+}
+
+// Features returns the optional features both the client and the server support.
+func (c *Client) Features() comm.Feature {
+	return c.features
+}
+
+// Done returns a channel that is closed once the client can no longer receive
+// responses, after Close or when the server goes away.
+func (c *Client) Done() <-chan struct{} {
+	return c.done
+}
+
+// GoAway returns a channel that is closed once the server asked the client to
+// leave the connection. New requests belong on another connection, the client
+// closes this one once its pending requests are answered.
+func (c *Client) GoAway() <-chan struct{} {
+	return c.goAway
+}
+
+// newRequestID returns a random request ID, never comm.PushRequestID.
+func newRequestID() uint32 {
+	for {
+		if id := rand.Uint32(); id != comm.PushRequestID {
+			return id
+		}
+	}
+}
+
+// startRequest counts a request waiting for its response. Requests are no
+// longer sent once the server asked the client to go away, the connection may
+// already be closed.
+func (c *Client) startRequest() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return ErrGoingAway
+	}
+	c.inflight++
+	return nil
+}
+
+// endRequest counts a request done, closing a draining connection once no
+// request is left.
+func (c *Client) endRequest() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.inflight--
+	if c.draining && c.inflight == 0 {
+		c.closeConn()
+	}
+}
+
+// drain handles a GOAWAY of the server.
+func (c *Client) drain() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.draining {
+		return
+	}
+	c.draining = true
+	close(c.goAway)
+	slog.Info("server is going away, draining connection", slog.String("socket", c.SocketPath), slog.Int("pending", c.inflight))
+	if c.inflight == 0 {
+		c.closeConn()
+	}
+}
+
+// fail closes the connection for the reason, which the pending requests and
+// those sent afterwards fail with.
+func (c *Client) fail(reason error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closeErr == nil {
+		c.closeErr = reason
+	}
+	c.closeConn()
+}
+
+// closedError returns the error of the requests of a connection that stopped.
+func (c *Client) closedError() error {
+	c.mu.Lock()
+	reason := c.closeErr
+	c.mu.Unlock()
+	if reason == nil {
+		return fmt.Errorf("%w: connection closed", ErrServerUnavailable)
+	}
+	return fmt.Errorf("%w: connection closed: %w", ErrServerUnavailable, reason)
+}
+
+// closeConn closes the connection, ending ReadResponses.
+func (c *Client) closeConn() {
+	if conn := c.conn; conn != nil {
+		if err := conn.Close(); err != nil && !errors.Is(err, net.ErrClosed) {
+			slog.Debug("failed to close connection", slog.Any("error", err))
+		}
+	}
 }
 
 func (c *Client) Close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
 	if c.conn != nil {
 		err := c.conn.Close()
 		if err != nil {
@@ -64,43 +479,191 @@ func (c *Client) Close() {
 }
 
 func (c *Client) Ping(ctx context.Context) (string, error) {
-	req := &comm.Request{}
-	req.Header = &comm.Header{}
-	req.RequestID = rand.Uint32()
-	req.Version = comm.VERSION
-
-	req.Type = comm.RequestTypePing
-	req.Data = "ping"
+	req := c.newRequest(comm.RequestTypePing)
+	defer releaseRequest(req)
+	req.Ping = "ping"
 	res, err := c.SendRequest(ctx, c.conn, req)
 	if err != nil {
-		slog.Error("failed to send request", slog.Any("error", err))
 		return "", err
 	}
-	return res.(string), nil
+	defer releaseResponse(res)
+	return res.Message, nil
 }
 
 func (c *Client) RateLimit(ctx context.Context, payload *comm.RateLimitRequestData) (*comm.RateLimitResponseData, error) {
-	req := &comm.Request{}
-	req.Header = &comm.Header{}
-	req.RequestID = rand.Uint32()
-	req.Version = comm.VERSION
+	if err := c.requireAlgorithm(payload.Algorithm); err != nil {
+		return nil, err
+	}
+	req := c.newRequest(comm.RequestTypeRateLimit)
+	defer releaseRequest(req)
+	if c.policyRequest(payload, &req.PolicyRateLimit) {
+		req.Type = comm.RequestTypeRateLimitPolicy
+	} else {
+		req.RateLimit = *payload
+	}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return nil, err
+	}
+	data := new(comm.RateLimitResponseData)
+	*data = res.RateLimit
+	releaseResponse(res)
+	if slog.Default().Enabled(ctx, slog.LevelDebug) {
+		slog.Debug("received response", slog.Any("data", data))
+	}
+	return data, nil
+}
+
+// RateLimitBatch sends several rate limit decisions in one frame and returns
+// their results in the same order. Each result carries its own status, at most
+// comm.MaxBatchSize entries fit in a batch.
+func (c *Client) RateLimitBatch(ctx context.Context, entries []*comm.RateLimitRequestData) ([]comm.RateLimitBatchResult, error) {
+	if len(entries) > comm.MaxBatchSize {
+		return nil, fmt.Errorf("batch too large: got %d entries, expected at most %d", len(entries), comm.MaxBatchSize)
+	}
+	for _, entry := range entries {
+		if err := c.requireAlgorithm(entry.Algorithm); err != nil {
+			return nil, err
+		}
+	}
+	req := c.newRequest(comm.RequestTypeRateLimitPolicyBatch)
+	defer releaseRequest(req)
 
-	req.Type = comm.RequestTypeRateLimit
-	req.Data = payload
+	policyEntries := req.PolicyBatch.SetLen(len(entries))
+	for i, entry := range entries {
+		if !c.policyRequest(entry, policyEntries[i]) {
+			req.Type = comm.RequestTypeRateLimitBatch
+			break
+		}
+	}
+	if req.Type == comm.RequestTypeRateLimitBatch {
+		batchEntries := req.Batch.SetLen(len(entries))
+		for i, entry := range entries {
+			*batchEntries[i] = *entry
+		}
+	}
 	res, err := c.SendRequest(ctx, c.conn, req)
 	if err != nil {
-		slog.Error("failed to send request", slog.Any("error", err))
 		return nil, err
 	}
-	data, ok := res.(*comm.RateLimitResponseData)
-	if !ok {
-		slog.Error("unexpected response data type", slog.Any("data", res))
-		return nil, nil
+	defer releaseResponse(res)
+	if len(res.Batch.Results) != len(entries) {
+		return nil, fmt.Errorf("unexpected number of results: got %d, expected %d", len(res.Batch.Results), len(entries))
+	}
+	results := make([]comm.RateLimitBatchResult, len(res.Batch.Results))
+	for i, result := range res.Batch.Results {
+		results[i] = *result
+	}
+	return results, nil
+}
+
+// Peek returns the state of the key under the limit without taking tokens.
+func (c *Client) Peek(ctx context.Context, payload *comm.RateLimitRequestData) (*comm.RateLimitResponseData, error) {
+	if err := c.requireFeature(comm.FeaturePeek); err != nil {
+		return nil, err
+	}
+	if err := c.requireAlgorithm(payload.Algorithm); err != nil {
+		return nil, err
 	}
-	if data == nil {
-		slog.Error("unexpected nil response data")
-		return nil, nil
+	req := c.newRequest(comm.RequestTypePeek)
+	defer releaseRequest(req)
+	req.RateLimit = *payload
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return nil, err
 	}
-	slog.Debug("received response", slog.Any("data", data))
+	data := new(comm.RateLimitResponseData)
+	*data = res.RateLimit
+	releaseResponse(res)
 	return data, nil
 }
+
+// Reset forgets the state of the key, giving it a full burst again.
+func (c *Client) Reset(ctx context.Context, key string) error {
+	if err := c.requireFeature(comm.FeaturePeek); err != nil {
+		return err
+	}
+	req := c.newRequest(comm.RequestTypeReset)
+	defer releaseRequest(req)
+	req.Key = comm.KeyData{Key: key}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return err
+	}
+	releaseResponse(res)
+	return nil
+}
+
+// ListKeys returns a page of the keys starting with the prefix and the cursor
+// of the next page. Listing starts with a zero cursor and is over once the
+// returned cursor is zero again.
+func (c *Client) ListKeys(ctx context.Context, prefix string, cursor uint64, count uint32) ([]string, uint64, error) {
+	if err := c.requireFeature(comm.FeaturePeek); err != nil {
+		return nil, 0, err
+	}
+	req := c.newRequest(comm.RequestTypeListKeys)
+	defer releaseRequest(req)
+	req.ListKeys = comm.ListKeysRequestData{Prefix: prefix, Cursor: cursor, Count: count}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return nil, 0, err
+	}
+	// the keys are decoded into a slice of their own, they outlive the response
+	keys, next := res.ListKeys.Keys, res.ListKeys.Cursor
+	res.ListKeys.Keys = nil
+	releaseResponse(res)
+	return keys, next, nil
+}
+
+// AcquireLease takes one of the limit concurrent slots of the key for at most
+// ttl. The lease holds no slot when all of them are held, see
+// comm.LeaseData.Acquired.
+func (c *Client) AcquireLease(ctx context.Context, key string, limit uint64, ttl time.Duration) (*comm.LeaseData, error) {
+	if err := c.requireFeature(comm.FeatureLeases); err != nil {
+		return nil, err
+	}
+	req := c.newRequest(comm.RequestTypeAcquireLease)
+	defer releaseRequest(req)
+	req.AcquireLease = comm.AcquireLeaseRequestData{Limit: limit, TTL: ttl, Key: key}
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return nil, err
+	}
+	lease := new(comm.LeaseData)
+	*lease = res.Lease
+	releaseResponse(res)
+	return lease, nil
+}
+
+// ReleaseLease gives the slot of the lease back before it expires.
+func (c *Client) ReleaseLease(ctx context.Context, lease *comm.LeaseData) error {
+	if err := c.requireFeature(comm.FeatureLeases); err != nil {
+		return err
+	}
+	req := c.newRequest(comm.RequestTypeReleaseLease)
+	defer releaseRequest(req)
+	req.Lease = *lease
+	res, err := c.SendRequest(ctx, c.conn, req)
+	if err != nil {
+		return err
+	}
+	releaseResponse(res)
+	return nil
+}
+
+// requireAlgorithm fails for the algorithms other than GCRA unless the server
+// supports them, older servers deciding with GCRA whatever the algorithm.
+func (c *Client) requireAlgorithm(algorithm comm.Algorithm) error {
+	if algorithm == comm.AlgorithmGCRA {
+		return nil
+	}
+	return c.requireFeature(comm.FeatureAlgorithms)
+}
+
+// requireFeature fails unless the feature was agreed on with the server.
+func (c *Client) requireFeature(feature comm.Feature) error {
+	if !c.Features().Has(feature) {
+		return fmt.Errorf("%w: server does not support %s", ErrUnknownType, feature)
+	}
+	return nil
+}
@@ -0,0 +1,244 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// fakeServer answers the clients of a test like a server: their hello with
+// its hello handler, then their other requests with its handler.
+type fakeServer struct {
+	t        *testing.T
+	address  string
+	listener net.Listener
+	hello    func(req *comm.Request) *comm.Response
+	handle   func(conn *fakeConn, req *comm.Request)
+
+	mu    sync.Mutex
+	conns []*fakeConn
+}
+
+// fakeConn is a connection accepted by a fakeServer.
+type fakeConn struct {
+	net.Conn
+	writeMu sync.Mutex
+}
+
+// newFakeServer starts a fakeServer agreeing on the features in the handshake.
+func newFakeServer(t *testing.T, features comm.Feature, handle func(conn *fakeConn, req *comm.Request)) *fakeServer {
+	t.Helper()
+	return startFakeServer(t, func(req *comm.Request) *comm.Response {
+		resp := answer(req)
+		agreed, err := req.Hello.Negotiate(comm.MinVersion, comm.VERSION, features)
+		if err != nil {
+			t.Errorf("failed to negotiate: %v", err)
+			return resp
+		}
+		resp.Hello = *agreed
+		return resp
+	}, handle)
+}
+
+// startFakeServer listens on a unix socket of the test until it ends. The
+// handlers are called from the goroutine reading the connection of the request.
+func startFakeServer(t *testing.T, hello func(req *comm.Request) *comm.Response, handle func(conn *fakeConn, req *comm.Request)) *fakeServer {
+	t.Helper()
+	address := filepath.Join(t.TempDir(), "server.sock")
+	listener, err := net.Listen("unix", address)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &fakeServer{t: t, address: address, listener: listener, hello: hello, handle: handle}
+	go s.serve()
+	t.Cleanup(s.close)
+	return s
+}
+
+func (s *fakeServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		fake := &fakeConn{Conn: conn}
+		s.mu.Lock()
+		s.conns = append(s.conns, fake)
+		s.mu.Unlock()
+		go s.read(fake)
+	}
+}
+
+func (s *fakeServer) read(conn *fakeConn) {
+	defer conn.Close()
+	for {
+		header, err := comm.ReadHeader(conn)
+		if err != nil {
+			return
+		}
+		payload := make([]byte, header.ContentLength)
+		if _, err := io.ReadFull(conn, payload); err != nil {
+			return
+		}
+		req := &comm.Request{}
+		if err := req.Unmarshal(header, payload); err != nil {
+			s.t.Errorf("failed to decode request: %v", err)
+			return
+		}
+		if req.Type == comm.RequestTypeHello {
+			conn.send(s.hello(req))
+		} else {
+			s.handle(conn, req)
+		}
+	}
+}
+
+// connections returns the number of connections accepted so far.
+func (s *fakeServer) connections() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.conns)
+}
+
+// conn returns the i-th connection accepted.
+func (s *fakeServer) conn(i int) *fakeConn {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.conns[i]
+}
+
+func (s *fakeServer) close() {
+	_ = s.listener.Close()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, conn := range s.conns {
+		_ = conn.Close()
+	}
+}
+
+// dial connects a client to the server, closed when the test ends.
+func (s *fakeServer) dial(t *testing.T, options *Options) *Client {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	c, err := NewClientWithOptions(ctx, s.address, options)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+	t.Cleanup(c.Close)
+	return c
+}
+
+// send writes the response to the connection.
+func (c *fakeConn) send(resp *comm.Response) {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	_ = resp.Marshal(c.Conn)
+}
+
+// answer returns an OK response to the request.
+func answer(req *comm.Request) *comm.Response {
+	resp := &comm.Response{}
+	resp.Reset(&req.Header, req.Type)
+	return resp
+}
+
+// allowed returns the decision granting the cost of the entry.
+func allowed(data *comm.RateLimitRequestData) comm.RateLimitResponseData {
+	return comm.RateLimitResponseData{Allowed: int64(data.GetCost()), Remaining: 10, RetryAfter: -1, ResetAfter: time.Second}
+}
+
+// decide answers the decisions of the request, granting them.
+func decide(conn *fakeConn, req *comm.Request) {
+	resp := answer(req)
+	switch req.Type {
+	case comm.RequestTypeRateLimit:
+		resp.RateLimit = allowed(&req.RateLimit)
+	case comm.RequestTypeRateLimitBatch:
+		for _, entry := range req.Batch.Entries {
+			resp.Batch.Results = append(resp.Batch.Results, &comm.RateLimitBatchResult{Status: comm.ResponseStatusOK, Data: allowed(entry)})
+		}
+	case comm.RequestTypePing:
+		resp.Message = "pong"
+	default:
+		resp.SetError(comm.ErrorCodeUnknownType, "unknown request type")
+	}
+	conn.send(resp)
+}
+
+func TestHandshake(t *testing.T) {
+	s := newFakeServer(t, comm.FeatureBatch|comm.FeatureEvents|1<<30, decide)
+	c := s.dial(t, nil)
+	if c.Version() != comm.VERSION || c.Features() != comm.FeatureBatch|comm.FeatureEvents {
+		t.Errorf("Expected version %d with %s, got %d with %s", comm.VERSION, comm.FeatureBatch|comm.FeatureEvents, c.Version(), c.Features())
+	}
+	if _, err := c.Peek(context.Background(), entry("a")); !errors.Is(err, ErrUnknownType) {
+		t.Errorf("Expected peeking without the feature to fail, got %v", err)
+	}
+}
+
+// TestHandshakeLegacyServer expects servers answering the hello with an
+// error, whatever its message, to be spoken to in the oldest version.
+func TestHandshakeLegacyServer(t *testing.T) {
+	s := startFakeServer(t, func(req *comm.Request) *comm.Response {
+		resp := answer(req)
+		resp.SetError(comm.ErrorCodeUnknown, "unsupported request")
+		return resp
+	}, decide)
+	c := s.dial(t, nil)
+	if c.Version() != comm.MinVersion || c.Features() != 0 {
+		t.Errorf("Expected version %d without features, got %d with %s", comm.MinVersion, c.Version(), c.Features())
+	}
+	if _, err := c.RateLimit(context.Background(), entry("a")); err != nil {
+		t.Errorf("Expected decisions in the oldest version, got %v", err)
+	}
+}
+
+// TestHandshakeNoSharedVersion expects a server sharing no version with the
+// client, which answers with the versions it supports, to be refused.
+func TestHandshakeNoSharedVersion(t *testing.T) {
+	s := startFakeServer(t, func(req *comm.Request) *comm.Response {
+		resp := answer(req)
+		resp.Hello = comm.HelloData{MinVersion: comm.VERSION + 1, MaxVersion: comm.VERSION + 2}
+		return resp
+	}, decide)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := NewClientWithOptions(ctx, s.address, nil); !errors.Is(err, comm.ErrUnsupportedVersion) {
+		t.Errorf("Expected %v \nWanted %v", err, comm.ErrUnsupportedVersion)
+	}
+}
+
+// TestHandshakeAdmin expects clients holding the admin token to refuse
+// servers without one, as they could not reset nor list keys.
+func TestHandshakeAdmin(t *testing.T) {
+	s := newFakeServer(t, comm.SupportedFeatures, decide)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if _, err := NewClientWithOptions(ctx, s.address, &Options{AdminToken: "admin"}); err == nil {
+		t.Errorf("expected the server without the admin feature to be refused")
+	}
+
+	s = newFakeServer(t, comm.SupportedFeatures|comm.FeatureAdmin, func(conn *fakeConn, req *comm.Request) {
+		resp := answer(req)
+		switch req.Type {
+		case comm.RequestTypeAuthChallenge:
+			resp.Auth = comm.AuthData{MAC: comm.ServerProof("admin", req.Auth.Nonce, [comm.AuthNonceSize]byte{})}
+		case comm.RequestTypeAuth:
+		default:
+			resp.SetError(comm.ErrorCodeUnknownType, "unknown request type")
+		}
+		conn.send(resp)
+	})
+	c := s.dial(t, &Options{AuthToken: "token", AdminToken: "admin"})
+	if !c.Features().Has(comm.FeatureAdmin) {
+		t.Errorf("expected the admin feature, got %s", c.Features())
+	}
+}
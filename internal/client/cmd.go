@@ -8,8 +8,8 @@ import (
 	"time"
 )
 
-func RunClient(socketPath string) {
-	client, err := NewClient(socketPath)
+func RunClient(socketPath string, options *Options) {
+	client, err := NewClientWithOptions(context.Background(), socketPath, options)
 	if err != nil {
 		panic(err)
 	}
@@ -0,0 +1,71 @@
+package client
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// Errors reported by the server are matched with errors.Is against these,
+// according to their error code.
+var (
+	ErrBackendUnavailable = errors.New("backend unavailable")
+	ErrTimeout            = errors.New("timeout")
+	ErrInvalidRequest     = errors.New("invalid request")
+	ErrUnauthorized       = errors.New("unauthorized")
+	ErrOverloaded         = errors.New("overloaded")
+	ErrUnknownType        = errors.New("unknown request type")
+	// ErrUnknownPolicy is returned for named policies the server does not
+	// define, or when it does not support named policies.
+	ErrUnknownPolicy = errors.New("unknown policy")
+)
+
+// ErrServerUnavailable is returned when the server cannot be reached or the
+// connection goes away before a response arrives.
+var ErrServerUnavailable = errors.New("server unavailable")
+
+// ErrGoingAway is returned for requests started once the server asked the
+// client to leave the connection. They were not sent, so they may be sent
+// again on another connection, as Reconnector.Do does.
+var ErrGoingAway = fmt.Errorf("%w: the server is going away", ErrServerUnavailable)
+
+// ServerError is an error reported by the server in its response.
+type ServerError struct {
+	Code    comm.ErrorCode
+	Message string
+}
+
+func (e *ServerError) Error() string {
+	return "server error: " + e.Message
+}
+
+// Unwrap returns the sentinel error of the error code, if any.
+func (e *ServerError) Unwrap() error {
+	switch e.Code {
+	case comm.ErrorCodeBackendUnavailable:
+		return ErrBackendUnavailable
+	case comm.ErrorCodeTimeout:
+		return ErrTimeout
+	case comm.ErrorCodeInvalidRequest:
+		return ErrInvalidRequest
+	case comm.ErrorCodeUnauthorized:
+		return ErrUnauthorized
+	case comm.ErrorCodeOverloaded:
+		return ErrOverloaded
+	case comm.ErrorCodeUnknownType:
+		return ErrUnknownType
+	case comm.ErrorCodeUnsupportedVersion:
+		return comm.ErrUnsupportedVersion
+	case comm.ErrorCodeUnknownPolicy:
+		return ErrUnknownPolicy
+	default:
+		return nil
+	}
+}
+
+// newServerError builds the error of a response. Servers older than version 3
+// send no error code, their errors match none of the sentinel errors.
+func newServerError(code comm.ErrorCode, message string) *ServerError {
+	return &ServerError{Code: code, Message: message}
+}
@@ -1,133 +1,252 @@
 package client
 
 import (
-	"bytes"
 	"context"
 	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"os"
 	"sync"
+	"time"
 
 	"github.com/zekihan/traefik-rate-limit/internal/comm"
 )
 
-var bufPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
+// maxResponseSize is the largest payload accepted from the server. The
+// connection is closed on larger ones.
+const maxResponseSize = 10 * 1024 * 1024
+
+// requestPool, responsePool and channelPool hold the values of a request in
+// flight, so that a decision does not allocate them anew.
+var (
+	requestPool = sync.Pool{
+		New: func() interface{} {
+			return new(comm.Request)
+		},
+	}
+	responsePool = sync.Pool{
+		New: func() interface{} {
+			return new(comm.Response)
+		},
+	}
+	channelPool = sync.Pool{
+		New: func() interface{} {
+			return make(chan *comm.Response, 1)
+		},
+	}
+)
+
+// newRequest returns a pooled request of the type, in the version agreed on
+// with the server. releaseRequest returns it once sent.
+func (c *Client) newRequest(reqType comm.RequestType) *comm.Request {
+	req := requestPool.Get().(*comm.Request)
+	req.Header = comm.Header{RequestID: newRequestID(), Version: c.Version()}
+	req.Type = reqType
+	return req
 }
 
-func (c *Client) SendRequest(ctx context.Context, conn net.Conn, req *comm.Request) (any, error) {
+func releaseRequest(req *comm.Request) {
+	requestPool.Put(req)
+}
+
+// releaseResponse returns a response of SendRequest to the pool. Its data must
+// not be used anymore.
+func releaseResponse(resp *comm.Response) {
+	responsePool.Put(resp)
+}
+
+// SendRequest sends the request and waits for its response. Error responses
+// are returned as a *ServerError. The response is pooled: callers copy what
+// they keep of it and release it with releaseResponse.
+func (c *Client) SendRequest(ctx context.Context, conn net.Conn, req *comm.Request) (*comm.Response, error) {
 	if conn == nil {
-		return "", fmt.Errorf("connection is nil")
+		return nil, fmt.Errorf("%w: connection is nil", ErrServerUnavailable)
 	}
 
-	buf := bufPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufPool.Put(buf)
+	if deadline, ok := ctx.Deadline(); ok {
+		req.SetTimeout(deadline)
+	}
 
-	if err := req.Marshal(buf); err != nil {
-		return "", fmt.Errorf("marshal request: %w", err)
+	buf := sendBufferPool.Get().(*[]byte)
+	defer sendBufferPool.Put(buf)
+	frame, err := req.Append((*buf)[:0])
+	*buf = frame
+	if err != nil {
+		return nil, fmt.Errorf("marshal request: %w", err)
 	}
 
-	ch := make(chan *comm.Response, 1)
-	c.pending.Store(req.RequestID, ch)
-	defer c.pending.Delete(req.RequestID)
+	if err := c.startRequest(); err != nil {
+		return nil, err
+	}
+	defer c.endRequest()
+	ch := channelPool.Get().(chan *comm.Response)
+	c.addPending(req.RequestID, ch)
+	defer c.removePending(req.RequestID, ch)
 
-	_, err := conn.Write(buf.Bytes())
-	if err != nil {
-		return "", fmt.Errorf("write request: %w", err)
+	if err := c.write(ctx, conn, frame); err != nil {
+		return nil, err
 	}
 
 	select {
 	case resp := <-ch:
-		return c.handleResponse(req.Type, resp)
+		return handleResponse(req.Type, resp)
+	case <-c.done:
+		select {
+		case resp := <-ch:
+			return handleResponse(req.Type, resp)
+		default:
+			return nil, c.closedError()
+		}
 	case <-ctx.Done():
-		slog.Info("context done", slog.Any("error", ctx.Err()))
-		return "", ctx.Err()
+		return nil, ctx.Err()
+	}
+}
+
+// write writes the frame within the deadline of the context, or the default
+// write timeout. A frame not written in time may be partly written, so the
+// connection is closed, failing the pending requests.
+func (c *Client) write(ctx context.Context, conn net.Conn, frame []byte) error {
+	deadline, ok := ctx.Deadline()
+	if !ok {
+		deadline = time.Now().Add(defaultWriteTimeout)
+	}
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	if err := conn.SetWriteDeadline(deadline); err != nil {
+		return fmt.Errorf("%w: set write deadline: %w", ErrServerUnavailable, err)
+	}
+	if _, err := conn.Write(frame); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			c.fail(fmt.Errorf("write timed out"))
+		}
+		return fmt.Errorf("%w: write request: %w", ErrServerUnavailable, err)
 	}
+	return nil
+}
+
+// sendBufferPool holds the buffers requests are encoded into.
+var sendBufferPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 0, 512)
+		return &buf
+	},
 }
 
-func (c *Client) handleResponse(reqType comm.RequestType, resp *comm.Response) (any, error) {
+// handleResponse checks the response of a request of reqType, releasing it
+// when it is an error.
+func handleResponse(reqType comm.RequestType, resp *comm.Response) (*comm.Response, error) {
 	if resp.Status == comm.ResponseStatusError {
-		return "", fmt.Errorf("server error: %s", resp.Error)
+		err := newServerError(resp.Code, resp.Error)
+		releaseResponse(resp)
+		return nil, err
+	}
+	if resp.Type != reqType {
+		err := fmt.Errorf("unexpected response type: got %d, expected %d", resp.Type, reqType)
+		releaseResponse(resp)
+		return nil, err
 	}
+	return resp, nil
+}
 
-	switch reqType {
-	case comm.RequestTypePing:
-		data, ok := resp.Data.(string)
-		if !ok {
-			return "", fmt.Errorf("unexpected response type: %T", resp.Data)
-		}
-		return data, nil
-	case comm.RequestTypeRateLimit:
-		data, ok := resp.Data.(*comm.RateLimitResponseData)
-		if !ok {
-			return "", fmt.Errorf("unexpected response type: %T", resp.Data)
-		}
-		return data, nil
+// addPending registers the channel the response of the request is delivered to.
+func (c *Client) addPending(requestID uint32, ch chan *comm.Response) {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	if c.pending == nil {
+		c.pending = make(map[uint32]chan *comm.Response)
+	}
+	c.pending[requestID] = ch
+}
+
+// removePending unregisters the request and returns its channel to the pool,
+// releasing a response that arrived too late to be read.
+func (c *Client) removePending(requestID uint32, ch chan *comm.Response) {
+	c.pendingMu.Lock()
+	delete(c.pending, requestID)
+	c.pendingMu.Unlock()
+	select {
+	case resp := <-ch:
+		releaseResponse(resp)
 	default:
-		return resp.Data, nil
+	}
+	channelPool.Put(ch)
+}
+
+// deliver hands the response to the request waiting for it, reporting
+// whether one was.
+func (c *Client) deliver(resp *comm.Response) bool {
+	c.pendingMu.Lock()
+	defer c.pendingMu.Unlock()
+	ch, ok := c.pending[resp.RequestID]
+	if !ok {
+		return false
+	}
+	select {
+	case ch <- resp:
+		return true
+	default:
+		return false
 	}
 }
 
 func (c *Client) ReadResponses(conn net.Conn) {
-	defer func() { slog.Debug("response reader stopped") }()
+	var readErr error
+	defer func() {
+		// the requests waiting for a response fail with the reason
+		c.mu.Lock()
+		if c.closeErr == nil && readErr != nil {
+			c.closeErr = readErr
+		}
+		c.mu.Unlock()
+		if c.done != nil {
+			close(c.done)
+		}
+		slog.Debug("response reader stopped")
+	}()
+	frames := comm.NewFrameReader(conn, maxResponseSize)
+	defer frames.Release()
 	for {
-		header, err := readHeader(conn)
+		header, payload, err := frames.Next()
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
-				slog.Debug("connection closed while reading header")
+			readErr = err
+			if errors.Is(err, comm.ErrFrameTooLarge) {
+				slog.Error("response payload too large", slog.Uint64("length", uint64(header.ContentLength)))
+				conn.Close()
+			} else if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+				slog.Debug("connection closed while reading frame")
+				readErr = nil
+				if errors.Is(err, io.EOF) {
+					readErr = fmt.Errorf("closed by the server")
+				}
 			} else {
-				slog.Error("read header error", slog.Any("error", err))
+				slog.Error("read frame error", slog.Any("error", err))
 			}
 			return
 		}
-		if header.ContentLength > 10*1024*1024 {
-			slog.Error("response payload too large", slog.Uint64("length", uint64(header.ContentLength)))
-			conn.Close()
-			return
-		}
-		payload := make([]byte, header.ContentLength)
-		if err := readFull(conn, payload); err != nil {
-			slog.Debug("read payload error", slog.Any("error", err))
-			return
-		}
-		slog.Debug("read payload", slog.Int("bytes", int(header.ContentLength)))
 
-		resp := &comm.Response{}
+		resp := responsePool.Get().(*comm.Response)
 		if err := resp.Unmarshal(header, payload); err != nil {
 			slog.Info("unmarshal response error", slog.Any("error", err))
+			releaseResponse(resp)
 			continue
 		}
-		if chVal, ok := c.pending.Load(header.RequestID); ok {
-			if ch, castOK := chVal.(chan *comm.Response); castOK {
-				select {
-				case ch <- resp:
-				default:
-					slog.Warn("could not send response to channel", slog.Uint64("request_id", uint64(header.RequestID)))
-				}
-			} else {
-				slog.Error("invalid type in pending map", slog.Uint64("request_id", uint64(header.RequestID)))
-				c.pending.Delete(header.RequestID)
+		if header.RequestID == comm.PushRequestID {
+			switch resp.Type {
+			case comm.RequestTypeGoAway:
+				c.drain()
+			case comm.RequestTypeEvent:
+				c.handleEvent(resp.Event)
+			default:
+				slog.Warn("unexpected unsolicited frame", slog.String("type", resp.Type.String()))
 			}
-		} else {
+			releaseResponse(resp)
+			continue
+		}
+		if !c.deliver(resp) {
 			slog.Warn("unknown request ID", slog.Uint64("request_id", uint64(header.RequestID)))
+			releaseResponse(resp)
 		}
 	}
 }
-
-func readHeader(conn net.Conn) (*comm.Header, error) {
-	header := make([]byte, 12)
-	if err := readFull(conn, header); err != nil {
-		return nil, err
-	}
-	return comm.UnmarshalHeader(header), nil
-}
-
-func readFull(r io.Reader, buf []byte) error {
-	_, err := io.ReadFull(r, buf)
-	return err
-}
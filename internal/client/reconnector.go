@@ -0,0 +1,141 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log/slog"
+	"sync"
+)
+
+// Reconnector keeps a connection to the server for its callers. It dials a
+// new one when the current connection goes away or the server sends a GOAWAY,
+// leaving the old connection to drain its pending requests.
+type Reconnector struct {
+	socketPath string
+	options    *Options
+
+	mu     sync.Mutex
+	client *Client
+	// dialing is closed once the connection being dialed is published, nil
+	// when none is. The other callers wait for it instead of dialing.
+	dialing chan struct{}
+	// closed is set once closed, no more connections are dialed.
+	closed bool
+}
+
+// errReconnectorClosed is returned by a closed Reconnector.
+var errReconnectorClosed = fmt.Errorf("%w: the reconnector is closed", ErrServerUnavailable)
+
+func NewReconnector(socketPath string, options *Options) *Reconnector {
+	return &Reconnector{
+		socketPath: socketPath,
+		options:    options,
+	}
+}
+
+// Client returns the current connection, dialing a new one when needed. A
+// single caller dials at a time, without holding the lock, and the others
+// wait for it within their own context, dialing again if it failed.
+func (r *Reconnector) Client(ctx context.Context) (*Client, error) {
+	for {
+		r.mu.Lock()
+		if r.closed {
+			r.mu.Unlock()
+			return nil, errReconnectorClosed
+		}
+		if current := r.current(); current != nil {
+			r.mu.Unlock()
+			return current, nil
+		}
+		if dialing := r.dialing; dialing != nil {
+			r.mu.Unlock()
+			select {
+			case <-dialing:
+				continue
+			case <-ctx.Done():
+				return nil, ctx.Err()
+			}
+		}
+		dialing := make(chan struct{})
+		r.dialing = dialing
+		r.mu.Unlock()
+
+		newClient, err := NewClientWithOptions(ctx, r.socketPath, r.options)
+
+		r.mu.Lock()
+		r.dialing = nil
+		close(dialing)
+		if err == nil && r.closed {
+			newClient.Close()
+			err = errReconnectorClosed
+		} else if err == nil {
+			r.client = newClient
+		}
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		return newClient, nil
+	}
+}
+
+// current returns the current connection, nil once it went away or the
+// server sent a GOAWAY on it. r.mu must be held.
+func (r *Reconnector) current() *Client {
+	if r.client == nil {
+		return nil
+	}
+	select {
+	case <-r.client.Done():
+		slog.Debug("connection went away, reconnecting", slog.String("socket", r.socketPath))
+		r.client.Close()
+		r.client = nil
+	case <-r.client.GoAway():
+		// the old client closes itself once drained
+		slog.Debug("server sent a GOAWAY, reconnecting", slog.String("socket", r.socketPath))
+		r.client = nil
+	default:
+	}
+	return r.client
+}
+
+// Do calls fn with the current connection. When the server sent a GOAWAY
+// before the requests of fn went out, which then fail with ErrGoingAway, or
+// the connection was closed under them, fn is called once more with a new
+// connection.
+func (r *Reconnector) Do(ctx context.Context, fn func(c *Client) error) error {
+	c, err := r.Client(ctx)
+	if err != nil {
+		return err
+	}
+	if err := fn(c); !errors.Is(err, ErrGoingAway) && !(errors.Is(err, ErrServerUnavailable) && stopped(c)) {
+		return err
+	}
+	if c, err = r.Client(ctx); err != nil {
+		return err
+	}
+	return fn(c)
+}
+
+// Close closes the current connection. No other connection is dialed
+// afterwards.
+func (r *Reconnector) Close() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.closed = true
+	if r.client != nil {
+		r.client.Close()
+		r.client = nil
+	}
+}
+
+// stopped reports whether the connection of the client stopped.
+func stopped(c *Client) bool {
+	select {
+	case <-c.Done():
+		return true
+	default:
+		return false
+	}
+}
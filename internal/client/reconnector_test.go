@@ -0,0 +1,215 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// goAway sends a GOAWAY on the connection, like a server shutting down.
+func goAway(conn *fakeConn) {
+	conn.send(&comm.Response{
+		Header:  comm.Header{RequestID: comm.GoAwayRequestID, Version: comm.VERSION},
+		Type:    comm.RequestTypeGoAway,
+		Status:  comm.ResponseStatusOK,
+		Message: "server shutting down",
+	})
+}
+
+// holdingServer is a fakeServer holding the decisions of its first
+// connection until release is closed, and granting the others at once.
+func holdingServer(t *testing.T) (s *fakeServer, held chan *comm.Request, release chan struct{}) {
+	held = make(chan *comm.Request, 64)
+	release = make(chan struct{})
+	var mu sync.Mutex
+	var first *fakeConn
+	s = newFakeServer(t, comm.SupportedFeatures, func(conn *fakeConn, req *comm.Request) {
+		mu.Lock()
+		if first == nil {
+			first = conn
+		}
+		hold := conn == first && req.Type == comm.RequestTypeRateLimit
+		mu.Unlock()
+		if !hold {
+			decide(conn, req)
+			return
+		}
+		held <- req
+		go func() {
+			<-release
+			decide(conn, req)
+		}()
+	})
+	return s, held, release
+}
+
+// TestGoAwayDrain sends a GOAWAY while decisions are in flight and expects
+// none of them to fail: those already sent are answered on the old
+// connection, those started afterwards are sent on a new one.
+func TestGoAwayDrain(t *testing.T) {
+	s, held, release := holdingServer(t)
+	r := NewReconnector(s.address, nil)
+	t.Cleanup(r.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	old, err := r.Client(ctx)
+	if err != nil {
+		t.Fatalf("failed to connect: %v", err)
+	}
+
+	const inFlight = 5
+	errs := make(chan error, 2*inFlight)
+	decideOn := func(c *Client) error {
+		res, err := c.RateLimit(ctx, entry("a"))
+		if err == nil && res.Allowed != 1 {
+			err = errors.New("expected the decision to be allowed")
+		}
+		return err
+	}
+	for range inFlight {
+		go func() { errs <- r.Do(ctx, decideOn) }()
+	}
+	for range inFlight {
+		<-held
+	}
+
+	goAway(s.conn(0))
+	<-old.GoAway()
+	// callers still holding the old connection do not send on it
+	if _, err := old.RateLimit(ctx, entry("a")); !errors.Is(err, ErrGoingAway) {
+		t.Errorf("expected %v, got %v", ErrGoingAway, err)
+	}
+	for range inFlight {
+		go func() { errs <- r.Do(ctx, decideOn) }()
+	}
+	close(release)
+	for range 2 * inFlight {
+		if err := <-errs; err != nil {
+			t.Errorf("expected the decision to succeed, got %v", err)
+		}
+	}
+	select {
+	case <-old.Done():
+	case <-time.After(5 * time.Second):
+		t.Errorf("expected the old connection to be closed once drained")
+	}
+	if len(held) != 0 {
+		t.Errorf("expected no decision sent on the old connection after the GOAWAY")
+	}
+}
+
+// TestReconnectorDoRetries expects a decision started as the GOAWAY arrives,
+// on the connection the caller already took, to be made on the next one.
+func TestReconnectorDoRetries(t *testing.T) {
+	s := newFakeServer(t, comm.SupportedFeatures, decide)
+	r := NewReconnector(s.address, nil)
+	t.Cleanup(r.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var used []*Client
+	err := r.Do(ctx, func(c *Client) error {
+		used = append(used, c)
+		if len(used) == 1 {
+			goAway(s.conn(0))
+			<-c.GoAway()
+		}
+		_, err := c.RateLimit(ctx, entry("a"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected the decision to succeed, got %v", err)
+	}
+	if len(used) != 2 || used[0] == used[1] {
+		t.Errorf("expected the decision to be retried on a new connection, got %d calls", len(used))
+	}
+}
+
+// TestReconnectorDoRetriesClosed expects a decision started as the server
+// closes the connection the caller already took to be made on the next one.
+func TestReconnectorDoRetriesClosed(t *testing.T) {
+	s := newFakeServer(t, comm.SupportedFeatures, decide)
+	r := NewReconnector(s.address, nil)
+	t.Cleanup(r.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var used []*Client
+	err := r.Do(ctx, func(c *Client) error {
+		used = append(used, c)
+		if len(used) == 1 {
+			s.conn(0).Close()
+			<-c.Done()
+		}
+		_, err := c.RateLimit(ctx, entry("a"))
+		return err
+	})
+	if err != nil {
+		t.Fatalf("expected the decision to succeed, got %v", err)
+	}
+	if len(used) != 2 || used[0] == used[1] {
+		t.Errorf("expected the decision to be retried on a new connection, got %d calls", len(used))
+	}
+}
+
+// TestReconnectorSlowDial holds the handshake of the connection being dialed
+// and expects the other callers to wait for it within their own context, then
+// to share it.
+func TestReconnectorSlowDial(t *testing.T) {
+	release := make(chan struct{})
+	s := startFakeServer(t, func(req *comm.Request) *comm.Response {
+		<-release
+		resp := answer(req)
+		agreed, err := req.Hello.Negotiate(comm.MinVersion, comm.VERSION, comm.SupportedFeatures)
+		if err != nil {
+			t.Errorf("failed to negotiate: %v", err)
+			return resp
+		}
+		resp.Hello = *agreed
+		return resp
+	}, decide)
+	var releaseOnce sync.Once
+	t.Cleanup(func() { releaseOnce.Do(func() { close(release) }) })
+	r := NewReconnector(s.address, nil)
+	t.Cleanup(r.Close)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	dialed := make(chan *Client, 2)
+	for range 2 {
+		go func() {
+			c, err := r.Client(ctx)
+			if err != nil {
+				t.Errorf("failed to get a connection: %v", err)
+			}
+			dialed <- c
+		}()
+	}
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(time.Millisecond) {
+		r.mu.Lock()
+		dialing := r.dialing != nil
+		r.mu.Unlock()
+		if dialing {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected a connection to be dialed")
+		}
+	}
+
+	waitCtx, waitCancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer waitCancel()
+	if _, err := r.Client(waitCtx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("expected the wait for the dial to end with the context, got %v", err)
+	}
+
+	releaseOnce.Do(func() { close(release) })
+	first, second := <-dialed, <-dialed
+	if first == nil || first != second {
+		t.Errorf("expected the callers to share the connection dialed")
+	}
+}
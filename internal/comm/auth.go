@@ -0,0 +1,85 @@
+package comm
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"fmt"
+)
+
+const (
+	AuthNonceSize = 16
+	AuthMACSize   = sha256.Size
+	authSize      = AuthNonceSize + AuthMACSize
+)
+
+const (
+	authLabelServer = "traefik-rate-limit server"
+	authLabelClient = "traefik-rate-limit client"
+)
+
+// AuthData carries the challenge-response authentication with a pre-shared
+// token. The client sends its nonce in a RequestTypeAuthChallenge and gets the
+// server nonce along with the server proof. It then sends its own proof in a
+// RequestTypeAuth. Proofs are HMAC-SHA256 of both nonces keyed by the token,
+// so the token never travels on the connection.
+type AuthData struct {
+	Nonce [AuthNonceSize]byte
+	MAC   [AuthMACSize]byte
+}
+
+// NewAuthNonce returns a random nonce.
+func NewAuthNonce() ([AuthNonceSize]byte, error) {
+	var nonce [AuthNonceSize]byte
+	if _, err := rand.Read(nonce[:]); err != nil {
+		return nonce, fmt.Errorf("failed to generate nonce: %w", err)
+	}
+	return nonce, nil
+}
+
+// ServerProof is the proof of the server that it knows the token.
+func ServerProof(token string, clientNonce [AuthNonceSize]byte, serverNonce [AuthNonceSize]byte) [AuthMACSize]byte {
+	return authMAC(token, authLabelServer, clientNonce, serverNonce)
+}
+
+// ClientProof is the proof of the client that it knows the token.
+func ClientProof(token string, clientNonce [AuthNonceSize]byte, serverNonce [AuthNonceSize]byte) [AuthMACSize]byte {
+	return authMAC(token, authLabelClient, serverNonce, clientNonce)
+}
+
+// VerifyProof compares proofs in constant time.
+func VerifyProof(expected [AuthMACSize]byte, actual [AuthMACSize]byte) bool {
+	return subtle.ConstantTimeCompare(expected[:], actual[:]) == 1
+}
+
+func authMAC(token string, label string, first [AuthNonceSize]byte, second [AuthNonceSize]byte) [AuthMACSize]byte {
+	mac := hmac.New(sha256.New, []byte(token))
+	mac.Write([]byte(label))
+	mac.Write(first[:])
+	mac.Write(second[:])
+	var sum [AuthMACSize]byte
+	copy(sum[:], mac.Sum(nil))
+	return sum
+}
+
+// Marshall encodes AuthData into a byte slice.
+func (a *AuthData) Marshall() []byte {
+	return a.Append(make([]byte, 0, authSize))
+}
+
+// Append appends the encoding of AuthData to dst.
+func (a *AuthData) Append(dst []byte) []byte {
+	dst = append(dst, a.Nonce[:]...)
+	return append(dst, a.MAC[:]...)
+}
+
+// Unmarshal decodes AuthData from a byte slice.
+func (a *AuthData) Unmarshal(data []byte) error {
+	if len(data) < authSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), authSize)
+	}
+	copy(a.Nonce[:], data)
+	copy(a.MAC[:], data[AuthNonceSize:])
+	return nil
+}
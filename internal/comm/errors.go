@@ -0,0 +1,49 @@
+package comm
+
+// ErrorCode classifies the error of a response. Codes are carried from
+// version 3 on, older peers only get the message.
+type ErrorCode uint8
+
+const (
+	ErrorCodeUnknown ErrorCode = iota
+	ErrorCodeBackendUnavailable
+	ErrorCodeTimeout
+	ErrorCodeInvalidRequest
+	ErrorCodeUnauthorized
+	ErrorCodeOverloaded
+	ErrorCodeUnknownType
+	ErrorCodeUnsupportedVersion
+	// ErrorCodeUnknownPolicy answers references to a named policy the server
+	// does not define.
+	ErrorCodeUnknownPolicy
+)
+
+func (c ErrorCode) String() string {
+	switch c {
+	case ErrorCodeBackendUnavailable:
+		return "backend unavailable"
+	case ErrorCodeTimeout:
+		return "timeout"
+	case ErrorCodeInvalidRequest:
+		return "invalid request"
+	case ErrorCodeUnauthorized:
+		return "unauthorized"
+	case ErrorCodeOverloaded:
+		return "overloaded"
+	case ErrorCodeUnknownType:
+		return "unknown request type"
+	case ErrorCodeUnsupportedVersion:
+		return "unsupported protocol version"
+	case ErrorCodeUnknownPolicy:
+		return "unknown policy"
+	default:
+		return "unknown error"
+	}
+}
+
+// SetError turns the response into an error response.
+func (r *Response) SetError(code ErrorCode, message string) {
+	r.Status = ResponseStatusError
+	r.Code = code
+	r.Error = message
+}
@@ -0,0 +1,133 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	subscribeSize   = 4
+	eventHeaderSize = 14
+)
+
+// EventType is the kind of an event pushed by the server.
+type EventType uint8
+
+const (
+	EventTypeUnknown EventType = iota
+	// EventTypeBanAdded is sent when a key starts being denied. Duration is
+	// how long it stays denied.
+	EventTypeBanAdded
+	// EventTypeBanRemoved is sent when a denied key is reset.
+	EventTypeBanRemoved
+	// EventTypePolicyChanged is sent when a policy is registered under a name
+	// with limits other than those of the policy registered before. Key is
+	// the name of the policy.
+	EventTypePolicyChanged
+	// EventTypeBackendHealth is sent when the backend of the server goes down
+	// or comes back. Healthy is its new state.
+	EventTypeBackendHealth
+)
+
+func (t EventType) String() string {
+	switch t {
+	case EventTypeBanAdded:
+		return "ban_added"
+	case EventTypeBanRemoved:
+		return "ban_removed"
+	case EventTypePolicyChanged:
+		return "policy_changed"
+	case EventTypeBackendHealth:
+		return "backend_health"
+	default:
+		return fmt.Sprintf("event(%d)", uint8(t))
+	}
+}
+
+// EventMask is a set of event types.
+type EventMask uint32
+
+// AllEvents are all the event types known to this package.
+const AllEvents = EventMask(1<<EventTypeBanAdded | 1<<EventTypeBanRemoved | 1<<EventTypePolicyChanged | 1<<EventTypeBackendHealth)
+
+// Mask returns the set of the event type alone.
+func (t EventType) Mask() EventMask {
+	return 1 << t
+}
+
+// Has reports whether the set holds the event type.
+func (m EventMask) Has(t EventType) bool {
+	return m&t.Mask() != 0
+}
+
+// SubscribeData asks the server to push the events of the given types on the
+// connection, in a RequestTypeSubscribe. An empty set stops the events.
+type SubscribeData struct {
+	Events EventMask
+}
+
+// Marshall encodes SubscribeData into a byte slice.
+func (s *SubscribeData) Marshall() []byte {
+	return s.Append(make([]byte, 0, subscribeSize))
+}
+
+// Append appends the encoding of SubscribeData to dst.
+func (s *SubscribeData) Append(dst []byte) []byte {
+	return binary.BigEndian.AppendUint32(dst, uint32(s.Events))
+}
+
+// Unmarshal decodes SubscribeData from a byte slice.
+func (s *SubscribeData) Unmarshal(data []byte) error {
+	if len(data) < subscribeSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), subscribeSize)
+	}
+	s.Events = EventMask(binary.BigEndian.Uint32(data))
+	return nil
+}
+
+// EventData is an event pushed by the server in an unsolicited
+// RequestTypeEvent frame. The fields other than Type depend on the type.
+type EventData struct {
+	Type EventType
+	// Healthy is the state of the backend of EventTypeBackendHealth.
+	Healthy bool
+	// Duration is how long the key of EventTypeBanAdded is denied.
+	Duration time.Duration
+	// Key is the key of ban events and the policy name of EventTypePolicyChanged.
+	Key string
+}
+
+// Marshall encodes EventData into a byte slice.
+func (e *EventData) Marshall() []byte {
+	return e.Append(make([]byte, 0, eventHeaderSize+len(e.Key)))
+}
+
+// Append appends the encoding of EventData to dst.
+func (e *EventData) Append(dst []byte) []byte {
+	dst = append(dst, byte(e.Type))
+	healthy := byte(0)
+	if e.Healthy {
+		healthy = 1
+	}
+	dst = append(dst, healthy)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(e.Duration))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(e.Key)))
+	return append(dst, e.Key...)
+}
+
+// Unmarshal decodes EventData from a byte slice.
+func (e *EventData) Unmarshal(data []byte) error {
+	if len(data) < eventHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), eventHeaderSize)
+	}
+	e.Type = EventType(data[0])
+	e.Healthy = data[1] != 0
+	e.Duration = time.Duration(binary.BigEndian.Uint64(data[2:]))
+	keyLen := binary.BigEndian.Uint32(data[10:])
+	if uint64(keyLen) > uint64(len(data)-eventHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", keyLen, len(data)-eventHeaderSize)
+	}
+	e.Key = decodeKey(e.Key, data[eventHeaderSize:eventHeaderSize+keyLen])
+	return nil
+}
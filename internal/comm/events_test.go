@@ -0,0 +1,42 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestEventData(t *testing.T) {
+	events := []*EventData{
+		{Type: EventTypeBanAdded, Duration: 30 * time.Second, Key: "traefik:default:203.0.113.7"},
+		{Type: EventTypeBanRemoved, Key: "traefik:default:203.0.113.7"},
+		{Type: EventTypePolicyChanged, Key: "my-middleware"},
+		{Type: EventTypeBackendHealth, Healthy: true},
+	}
+	for _, e := range events {
+		unmarshalled := &EventData{}
+		if err := unmarshalled.Unmarshal(e.Marshall()); err != nil {
+			t.Errorf("failed to unmarshal: %v", err)
+			continue
+		}
+		if !reflect.DeepEqual(unmarshalled, e) {
+			t.Errorf("Expected %v \nWanted %v", unmarshalled, e)
+		}
+	}
+	if err := (&EventData{}).Unmarshal(make([]byte, eventHeaderSize-1)); err == nil {
+		t.Errorf("expected an error for a short event")
+	}
+}
+
+func TestEventMask(t *testing.T) {
+	mask := EventTypeBanAdded.Mask() | EventTypeBackendHealth.Mask()
+	if !mask.Has(EventTypeBanAdded) || !mask.Has(EventTypeBackendHealth) {
+		t.Errorf("Expected %b to hold its event types", mask)
+	}
+	if mask.Has(EventTypeBanRemoved) || mask.Has(EventTypeUnknown) {
+		t.Errorf("Expected %b not to hold other event types", mask)
+	}
+	if !AllEvents.Has(EventTypePolicyChanged) {
+		t.Errorf("Expected all events to hold %s", EventTypePolicyChanged)
+	}
+}
@@ -0,0 +1,113 @@
+package comm
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// ErrFrameTooLarge is returned for frames whose payload exceeds the limit of the reader.
+var ErrFrameTooLarge = errors.New("frame too large")
+
+const (
+	// frameReaderSize is the size of the buffer of frame readers, holding
+	// many decisions.
+	frameReaderSize = 4096
+	// maxRetainedPayload is the largest payload buffer kept from one frame to
+	// the next. Larger payloads get a buffer of their own.
+	maxRetainedPayload = 64 * 1024
+)
+
+var frameReaderPool = sync.Pool{
+	New: func() interface{} {
+		return bufio.NewReaderSize(nil, frameReaderSize)
+	},
+}
+
+// FrameReader reads frames from a connection through a pooled buffer. The
+// header and the payload it returns are only valid until the next frame is
+// read, decoding into a reused Request or Response reads a frame without
+// allocating.
+type FrameReader struct {
+	r          *bufio.Reader
+	header     Header
+	payload    []byte
+	maxPayload uint32
+}
+
+// NewFrameReader returns a reader of the frames of r, with payloads of at
+// most maxPayload bytes. Release returns its buffer once the connection is done.
+func NewFrameReader(r io.Reader, maxPayload uint32) *FrameReader {
+	reader := frameReaderPool.Get().(*bufio.Reader)
+	reader.Reset(r)
+	return &FrameReader{r: reader, maxPayload: maxPayload}
+}
+
+// Next reads the next frame. With ErrUnsupportedVersion or ErrFrameTooLarge,
+// the header is returned without the payload and the reader is out of sync
+// with the connection.
+func (f *FrameReader) Next() (*Header, []byte, error) {
+	prefix, err := f.r.Peek(HeaderSize)
+	if err != nil {
+		return nil, nil, err
+	}
+	f.header = Header{
+		RequestID:     binary.BigEndian.Uint32(prefix[0:]),
+		Version:       binary.BigEndian.Uint32(prefix[4:]),
+		ContentLength: binary.BigEndian.Uint32(prefix[8:]),
+	}
+	if f.header.Version < MinVersion || f.header.Version > VERSION {
+		_, _ = f.r.Discard(HeaderSize)
+		return &f.header, nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, f.header.Version)
+	}
+	size := headerSize(f.header.Version)
+	if size > HeaderSize {
+		header, err := f.r.Peek(size)
+		if err != nil {
+			return nil, nil, err
+		}
+		f.header.readTimeout(binary.BigEndian.Uint64(header[HeaderSize:]), time.Now())
+	}
+	_, _ = f.r.Discard(size)
+	if f.header.ContentLength > f.maxPayload {
+		return &f.header, nil, fmt.Errorf("%w: %d bytes, expected at most %d", ErrFrameTooLarge, f.header.ContentLength, f.maxPayload)
+	}
+
+	n := int(f.header.ContentLength)
+	var payload []byte
+	if n > maxRetainedPayload {
+		payload = make([]byte, n)
+	} else {
+		if cap(f.payload) < n {
+			f.payload = make([]byte, n)
+		}
+		payload = f.payload[:n]
+	}
+	if _, err := io.ReadFull(f.r, payload); err != nil {
+		return nil, nil, err
+	}
+	return &f.header, payload, nil
+}
+
+// Wait blocks until the next frame starts arriving, so that the time a
+// connection stays idle can be bounded apart from the time a frame takes to
+// arrive whole.
+func (f *FrameReader) Wait() error {
+	_, err := f.r.Peek(1)
+	return err
+}
+
+// Release returns the buffer of the reader to the pool. The reader must not
+// be used anymore.
+func (f *FrameReader) Release() {
+	if f.r == nil {
+		return
+	}
+	f.r.Reset(nil)
+	frameReaderPool.Put(f.r)
+	f.r = nil
+}
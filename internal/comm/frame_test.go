@@ -0,0 +1,113 @@
+package comm
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"testing"
+	"time"
+)
+
+func TestFrameReader(t *testing.T) {
+	stream := &bytes.Buffer{}
+	var expected [][]byte
+	for _, golden := range goldenFrames {
+		if golden.request == nil || golden.raw != nil {
+			continue
+		}
+		frame, err := golden.encode()
+		if err != nil {
+			t.Fatalf("failed to encode %s: %v", golden.name, err)
+		}
+		stream.Write(frame)
+		expected = append(expected, frame)
+	}
+
+	frames := NewFrameReader(stream, 1024)
+	defer frames.Release()
+	// decoded into the same request, like the server does
+	req := &Request{}
+	for _, want := range expected {
+		header, payload, err := frames.Next()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if err := req.Unmarshal(header, payload); err != nil {
+			t.Fatalf("failed to decode frame: %v", err)
+		}
+		got, err := req.Append(nil)
+		if err != nil {
+			t.Fatalf("failed to encode %+v: %v", req, err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("Expected %x \nWanted %x", got, want)
+		}
+	}
+	if _, _, err := frames.Next(); !errors.Is(err, io.EOF) {
+		t.Errorf("Expected %v \nWanted %v", err, io.EOF)
+	}
+}
+
+func TestFrameReaderTooLarge(t *testing.T) {
+	header := Header{RequestID: 1, Version: VERSION}
+	frame := header.Marshal(VERSION, 2048)
+	frames := NewFrameReader(bytes.NewReader(frame), 1024)
+	defer frames.Release()
+	got, _, err := frames.Next()
+	if !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("Expected %v \nWanted %v", err, ErrFrameTooLarge)
+	}
+	if got.RequestID != 1 || got.ContentLength != 2048 {
+		t.Errorf("Expected %+v \nWanted the header of the frame", got)
+	}
+}
+
+// replayReader returns the same frame over and over.
+type replayReader struct {
+	frame []byte
+	off   int
+}
+
+func (r *replayReader) Read(p []byte) (int, error) {
+	n := copy(p, r.frame[r.off:])
+	r.off = (r.off + n) % len(r.frame)
+	return n, nil
+}
+
+func TestDecisionAllocations(t *testing.T) {
+	req := &Request{
+		Header:    Header{RequestID: 1, Version: VERSION, Timeout: time.Second},
+		Type:      RequestTypeRateLimit,
+		RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "traefik:default:203.0.113.7"},
+	}
+	frame, err := req.Append(nil)
+	if err != nil {
+		t.Fatalf("failed to encode request: %v", err)
+	}
+	frames := NewFrameReader(&replayReader{frame: frame}, 1024)
+	defer frames.Release()
+	decoded := &Request{}
+	resp := &Response{}
+	buf := make([]byte, 0, 512)
+
+	allocs := testing.AllocsPerRun(1000, func() {
+		header, payload, err := frames.Next()
+		if err != nil {
+			t.Fatalf("failed to read frame: %v", err)
+		}
+		if err := decoded.Unmarshal(header, payload); err != nil {
+			t.Fatalf("failed to decode request: %v", err)
+		}
+		resp.Reset(header, decoded.Type)
+		resp.RateLimit = RateLimitResponseData{Allowed: 1, Remaining: 199, RetryAfter: -1, ResetAfter: 300 * time.Millisecond}
+		if buf, err = resp.Append(buf[:0]); err != nil {
+			t.Fatalf("failed to encode response: %v", err)
+		}
+		if err := resp.Unmarshal(header, buf[header.Size():]); err != nil {
+			t.Fatalf("failed to decode response: %v", err)
+		}
+	})
+	if allocs != 0 {
+		t.Errorf("Expected %v allocations per decision \nWanted 0", allocs)
+	}
+}
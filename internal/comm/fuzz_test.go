@@ -0,0 +1,248 @@
+package comm
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// codec is a payload type encoded with Marshall and decoded with Unmarshal.
+type codec[T any] interface {
+	*T
+	Marshall() []byte
+	Unmarshal(data []byte) error
+}
+
+// fuzzCodec checks that decoding never panics and that whatever decodes
+// encodes back to the same value.
+func fuzzCodec[T any, P codec[T]](f *testing.F, seeds ...P) {
+	for _, seed := range seeds {
+		data := seed.Marshall()
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+	}
+	f.Add([]byte{})
+	f.Add(bytes.Repeat([]byte{0xff}, 64))
+	f.Fuzz(func(t *testing.T, data []byte) {
+		decoded := P(new(T))
+		if err := decoded.Unmarshal(data); err != nil {
+			return
+		}
+		again := P(new(T))
+		if err := again.Unmarshal(decoded.Marshall()); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", decoded, err)
+		}
+		if !reflect.DeepEqual(decoded, again) {
+			t.Fatalf("Expected %+v \nWanted %+v", again, decoded)
+		}
+	})
+}
+
+func FuzzRateLimitRequestData(f *testing.F) {
+	fuzzCodec(f,
+		&RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "testing", Cost: 2},
+		&RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "testing", Trace: goldenTrace},
+		&RateLimitRequestData{},
+	)
+}
+
+func FuzzRateLimitResponseData(f *testing.F) {
+	fuzzCodec(f, &RateLimitResponseData{Allowed: 1, Remaining: 99, RetryAfter: -1, ResetAfter: time.Second})
+}
+
+func FuzzRateLimitBatchRequestData(f *testing.F) {
+	fuzzCodec(f, &RateLimitBatchRequestData{Entries: []*RateLimitRequestData{
+		{Rate: 100, Burst: 200, Period: time.Minute, Key: "a"},
+		{Rate: 10, Burst: 10, Period: time.Second, Key: "b", Cost: 2},
+	}})
+}
+
+func FuzzRateLimitBatchResponseData(f *testing.F) {
+	results := &RateLimitBatchResponseData{Results: []*RateLimitBatchResult{
+		{Status: ResponseStatusOK, Data: RateLimitResponseData{Allowed: 1, Remaining: 99}},
+		{Status: ResponseStatusError, Code: ErrorCodeTimeout, Error: "deadline exceeded"},
+	}}
+	for version := MinVersion; version <= VERSION; version++ {
+		f.Add(results.MarshallVersion(version), version)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, version uint32) {
+		decoded := &RateLimitBatchResponseData{}
+		if err := decoded.UnmarshalVersion(data, version); err != nil {
+			return
+		}
+		again := &RateLimitBatchResponseData{}
+		if err := again.UnmarshalVersion(decoded.MarshallVersion(version), version); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", decoded, err)
+		}
+		if !reflect.DeepEqual(decoded, again) {
+			t.Fatalf("Expected %+v \nWanted %+v", again, decoded)
+		}
+	})
+}
+
+func FuzzHelloData(f *testing.F) {
+	fuzzCodec(f, &HelloData{MinVersion: MinVersion, MaxVersion: VERSION, Features: SupportedFeatures})
+}
+
+func FuzzAuthData(f *testing.F) {
+	fuzzCodec(f, &AuthData{Nonce: goldenBytes16(1), MAC: goldenBytes32(2)})
+}
+
+func FuzzKeyData(f *testing.F) {
+	fuzzCodec(f, &KeyData{Key: "testing"})
+}
+
+func FuzzListKeysRequestData(f *testing.F) {
+	fuzzCodec(f, &ListKeysRequestData{Prefix: "traefik:", Cursor: 42, Count: 100})
+}
+
+func FuzzListKeysResponseData(f *testing.F) {
+	fuzzCodec(f, &ListKeysResponseData{Cursor: 42, Keys: []string{"a", "b"}})
+}
+
+func FuzzPolicyData(f *testing.F) {
+	fuzzCodec(f, &PolicyData{ID: 1, Rate: 100, Burst: 200, Period: time.Minute, Cost: 1, Name: "default"})
+}
+
+func FuzzPolicyRateLimitRequestData(f *testing.F) {
+	fuzzCodec(f,
+		&PolicyRateLimitRequestData{PolicyID: 1, Cost: 2, Key: "testing"},
+		&PolicyRateLimitRequestData{PolicyID: 1, Key: "testing", Trace: goldenTrace},
+	)
+}
+
+func FuzzPolicyBatchRequestData(f *testing.F) {
+	fuzzCodec(f, &PolicyBatchRequestData{Entries: []*PolicyRateLimitRequestData{
+		{PolicyID: 1, Key: "a"},
+		{PolicyID: 2, Cost: 2, Key: "b", Trace: goldenTrace},
+	}})
+}
+
+func FuzzSubscribeData(f *testing.F) {
+	fuzzCodec(f, &SubscribeData{Events: AllEvents})
+}
+
+func FuzzAcquireLeaseRequestData(f *testing.F) {
+	fuzzCodec(f, &AcquireLeaseRequestData{Limit: 10, TTL: 30 * time.Second, Key: "testing"})
+}
+
+func FuzzLeaseData(f *testing.F) {
+	fuzzCodec(f, &LeaseData{Key: "testing", ID: "0123456789abcdef"}, &LeaseData{Key: "testing"})
+}
+
+func FuzzEventData(f *testing.F) {
+	fuzzCodec(f,
+		&EventData{Type: EventTypeBanAdded, Duration: time.Minute, Key: "traefik:default:203.0.113.7"},
+		&EventData{Type: EventTypeBackendHealth, Healthy: true},
+	)
+}
+
+// readFrame reads a header and its payload like a peer, reporting frames
+// that are cut short.
+func readFrame(frame []byte) (*Header, []byte, bool) {
+	r := bytes.NewReader(frame)
+	header, err := ReadHeader(r)
+	if err != nil || uint64(header.ContentLength) > uint64(r.Len()) {
+		return nil, nil, false
+	}
+	payload := frame[len(frame)-r.Len():]
+	return header, payload[:header.ContentLength], true
+}
+
+func FuzzReadHeader(f *testing.F) {
+	for _, golden := range goldenFrames {
+		frame, _ := golden.encode()
+		f.Add(frame)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		header, err := ReadHeader(bytes.NewReader(data))
+		if err != nil {
+			return
+		}
+		encoded := header.Marshal(header.Version, header.ContentLength)
+		if !bytes.Equal(encoded, data[:len(encoded)]) {
+			t.Fatalf("Expected %x \nWanted %x", encoded, data[:len(encoded)])
+		}
+	})
+}
+
+func FuzzRequest(f *testing.F) {
+	for _, golden := range goldenFrames {
+		if golden.request != nil {
+			frame, _ := golden.encode()
+			f.Add(frame)
+		}
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		header, payload, ok := readFrame(frame)
+		if !ok {
+			return
+		}
+		decoded := &Request{}
+		if err := decoded.Unmarshal(header, payload); err != nil || decoded.Type == RequestTypeUnknown {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := decoded.Marshal(buf); err != nil {
+			// batches of no entry are decoded but never sent
+			return
+		}
+		header, payload, ok = readFrame(buf.Bytes())
+		if !ok {
+			t.Fatalf("failed to read re-encoded %+v", decoded)
+		}
+		again := &Request{}
+		if err := again.Unmarshal(header, payload); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", decoded, err)
+		}
+		decoded.ContentLength, again.ContentLength = 0, 0
+		// the deadlines of timeouts are taken on reading
+		if decoded.Timeout != 0 {
+			decoded.Deadline, again.Deadline = time.Time{}, time.Time{}
+		}
+		if !reflect.DeepEqual(decoded, again) {
+			t.Fatalf("Expected %+v \nWanted %+v", again, decoded)
+		}
+	})
+}
+
+func FuzzResponse(f *testing.F) {
+	for _, golden := range goldenFrames {
+		if golden.response != nil {
+			frame, _ := golden.encode()
+			f.Add(frame)
+		}
+	}
+	f.Fuzz(func(t *testing.T, frame []byte) {
+		header, payload, ok := readFrame(frame)
+		if !ok {
+			return
+		}
+		decoded := &Response{}
+		if err := decoded.Unmarshal(header, payload); err != nil {
+			return
+		}
+		buf := &bytes.Buffer{}
+		if err := decoded.Marshal(buf); err != nil {
+			// data of unknown response types is kept raw and never sent
+			return
+		}
+		header, payload, ok = readFrame(buf.Bytes())
+		if !ok {
+			t.Fatalf("failed to read re-encoded %+v", decoded)
+		}
+		again := &Response{}
+		if err := again.Unmarshal(header, payload); err != nil {
+			t.Fatalf("failed to decode re-encoded %+v: %v", decoded, err)
+		}
+		decoded.ContentLength, again.ContentLength = 0, 0
+		// the deadlines of timeouts are taken on reading
+		if decoded.Timeout != 0 {
+			decoded.Deadline, again.Deadline = time.Time{}, time.Time{}
+		}
+		if !reflect.DeepEqual(decoded, again) {
+			t.Fatalf("Expected %+v \nWanted %+v", again, decoded)
+		}
+	})
+}
@@ -0,0 +1,499 @@
+package comm
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var update = flag.Bool("update", false, "rewrite the golden frames in testdata/golden")
+
+// goldenTimeout is the timeout of the golden frames.
+const goldenTimeout = 500 * time.Millisecond
+
+// goldenTrace is the trace context of the traced golden frames, that of the
+// traceparent 00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01.
+var goldenTrace = TraceContext{
+	TraceID: [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+	SpanID:  [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+	Flags:   0x01,
+}
+
+// goldenFrame is a frame of testdata/golden and its decoded value. Exactly
+// one of request and response is set. Frames this package does not send, as
+// those of older peers, are given as raw bytes. docs/PROTOCOL.md is derived
+// from the frames, a change of encoding must change both.
+type goldenFrame struct {
+	name     string
+	raw      []byte
+	request  *Request
+	response *Response
+}
+
+var goldenFrames = []goldenFrame{
+	{
+		name: "ping_request_v1",
+		request: &Request{
+			Header: Header{RequestID: 1, Version: 1},
+			Type:   RequestTypePing,
+			Ping:   "ping",
+		},
+	},
+	{
+		name: "hello_request",
+		request: &Request{
+			Header: Header{RequestID: 1, Version: 1},
+			Type:   RequestTypeHello,
+			Hello: HelloData{
+				MinVersion: 1,
+				MaxVersion: 3,
+				Features:   FeatureBatch | FeaturePeek | FeatureDeadlines | FeaturePolicies | FeatureGoAway,
+			},
+		},
+	},
+	{
+		name: "auth_challenge_request",
+		request: &Request{
+			Header: Header{RequestID: 2, Version: 3},
+			Type:   RequestTypeAuthChallenge,
+			Auth:   AuthData{Nonce: goldenBytes16(0x10)},
+		},
+	},
+	{
+		name: "auth_request",
+		request: &Request{
+			Header: Header{RequestID: 3, Version: 3},
+			Type:   RequestTypeAuth,
+			Auth:   AuthData{MAC: goldenBytes32(0x40)},
+		},
+	},
+	{
+		name: "rate_limit_request_v1",
+		request: &Request{
+			Header:    Header{RequestID: 4, Version: 1},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "traefik:default:203.0.113.7"},
+		},
+	},
+	{
+		name: "rate_limit_request_v3",
+		request: &Request{
+			Header:    Header{RequestID: 5, Version: 3, Timeout: goldenTimeout},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "traefik:default:203.0.113.7", Cost: 3},
+		},
+	},
+	{
+		name: "rate_limit_batch_request",
+		request: &Request{
+			Header: Header{RequestID: 6, Version: 3, Timeout: goldenTimeout},
+			Type:   RequestTypeRateLimitBatch,
+			Batch: RateLimitBatchRequestData{Entries: []*RateLimitRequestData{
+				{Rate: 100, Burst: 200, Period: time.Minute, Key: "a"},
+				{Rate: 10, Burst: 10, Period: time.Second, Key: "b", Cost: 2},
+			}},
+		},
+	},
+	{
+		name: "peek_request",
+		request: &Request{
+			Header:    Header{RequestID: 7, Version: 3},
+			Type:      RequestTypePeek,
+			RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "a"},
+		},
+	},
+	{
+		name: "reset_request",
+		request: &Request{
+			Header: Header{RequestID: 8, Version: 3},
+			Type:   RequestTypeReset,
+			Key:    KeyData{Key: "a"},
+		},
+	},
+	{
+		name: "list_keys_request",
+		request: &Request{
+			Header:   Header{RequestID: 9, Version: 3},
+			Type:     RequestTypeListKeys,
+			ListKeys: ListKeysRequestData{Prefix: "traefik:", Cursor: 42, Count: 100},
+		},
+	},
+	{
+		name: "register_policy_request",
+		request: &Request{
+			Header: Header{RequestID: 10, Version: 3},
+			Type:   RequestTypeRegisterPolicy,
+			Policy: PolicyData{ID: 1, Algorithm: AlgorithmGCRA, Rate: 100, Burst: 200, Period: time.Minute, Cost: 1, Name: "default"},
+		},
+	},
+	{
+		name: "rate_limit_policy_request",
+		request: &Request{
+			Header:          Header{RequestID: 11, Version: 3, Timeout: goldenTimeout},
+			Type:            RequestTypeRateLimitPolicy,
+			PolicyRateLimit: PolicyRateLimitRequestData{PolicyID: 1, Cost: 0, Key: "a"},
+		},
+	},
+	{
+		name: "rate_limit_policy_batch_request",
+		request: &Request{
+			Header: Header{RequestID: 12, Version: 3, Timeout: goldenTimeout},
+			Type:   RequestTypeRateLimitPolicyBatch,
+			PolicyBatch: PolicyBatchRequestData{Entries: []*PolicyRateLimitRequestData{
+				{PolicyID: 1, Key: "a"},
+				{PolicyID: 1, Cost: 2, Key: "b"},
+			}},
+		},
+	},
+	{
+		name: "rate_limit_request_traced",
+		request: &Request{
+			Header:    Header{RequestID: 14, Version: 3, Timeout: goldenTimeout},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "a", Cost: 1, Trace: goldenTrace},
+		},
+	},
+	{
+		name: "rate_limit_policy_request_traced",
+		request: &Request{
+			Header:          Header{RequestID: 15, Version: 3, Timeout: goldenTimeout},
+			Type:            RequestTypeRateLimitPolicy,
+			PolicyRateLimit: PolicyRateLimitRequestData{PolicyID: 1, Key: "a", Trace: goldenTrace},
+		},
+	},
+	{
+		name: "rate_limit_request_algorithm",
+		request: &Request{
+			Header:    Header{RequestID: 17, Version: 3, Timeout: goldenTimeout},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 100, Period: time.Hour, Key: "a", Cost: 1, Algorithm: AlgorithmSlidingWindowLog},
+		},
+	},
+	{
+		name: "rate_limit_request_calendar",
+		request: &Request{
+			Header:    Header{RequestID: 20, Version: 3, Timeout: goldenTimeout},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 10000, Key: "a", Cost: 1, Algorithm: AlgorithmFixedWindow, Calendar: CalendarDay, TimeZone: "Europe/Istanbul"},
+		},
+	},
+	{
+		name: "subscribe_request",
+		request: &Request{
+			Header:    Header{RequestID: 16, Version: 3},
+			Type:      RequestTypeSubscribe,
+			Subscribe: SubscribeData{Events: EventTypeBanAdded.Mask() | EventTypeBanRemoved.Mask() | EventTypeBackendHealth.Mask()},
+		},
+	},
+	{
+		name: "acquire_lease_request",
+		request: &Request{
+			Header:       Header{RequestID: 18, Version: 3, Timeout: goldenTimeout},
+			Type:         RequestTypeAcquireLease,
+			AcquireLease: AcquireLeaseRequestData{Limit: 10, TTL: 30 * time.Second, Key: "a"},
+		},
+	},
+	{
+		name: "release_lease_request",
+		request: &Request{
+			Header: Header{RequestID: 19, Version: 3},
+			Type:   RequestTypeReleaseLease,
+			Lease:  LeaseData{Key: "a", ID: "0123456789abcdef0123456789abcdef"},
+		},
+	},
+	{
+		name: "rate_limit_request_without_cost",
+		raw: goldenRaw(&Header{RequestID: 4, Version: 1},
+			byte(RequestTypeRateLimit),
+			0, 0, 0, 0, 0, 0, 0, 100, // rate
+			0, 0, 0, 0, 0, 0, 0, 200, // burst
+			0, 0, 0, 0x0d, 0xf8, 0x47, 0x58, 0x00, // period, one minute
+			0, 0, 0, 1, 'a', // key
+		),
+		request: &Request{
+			Header:    Header{RequestID: 4, Version: 1},
+			Type:      RequestTypeRateLimit,
+			RateLimit: RateLimitRequestData{Rate: 100, Burst: 200, Period: time.Minute, Key: "a"},
+		},
+	},
+	{
+		name: "unknown_request",
+		raw:  goldenRaw(&Header{RequestID: 13, Version: 3}, 0xff, 'x'),
+		request: &Request{
+			Header:  Header{RequestID: 13, Version: 3},
+			Type:    RequestTypeUnknown,
+			Unknown: []byte{'x'},
+		},
+	},
+	{
+		name: "ping_response_v1",
+		response: &Response{
+			Header:  Header{RequestID: 1, Version: 1},
+			Type:    RequestTypePing,
+			Status:  ResponseStatusOK,
+			Message: "pong to ping",
+		},
+	},
+	{
+		name: "hello_response",
+		response: &Response{
+			Header: Header{RequestID: 1, Version: 1},
+			Type:   RequestTypeHello,
+			Status: ResponseStatusOK,
+			Hello: HelloData{
+				MinVersion: 3,
+				MaxVersion: 3,
+				Features:   FeatureBatch | FeaturePeek | FeatureDeadlines | FeaturePolicies | FeatureGoAway,
+			},
+		},
+	},
+	{
+		name: "auth_challenge_response",
+		response: &Response{
+			Header: Header{RequestID: 2, Version: 3},
+			Type:   RequestTypeAuthChallenge,
+			Status: ResponseStatusOK,
+			Auth:   AuthData{Nonce: goldenBytes16(0x20), MAC: goldenBytes32(0x80)},
+		},
+	},
+	{
+		name: "auth_response",
+		response: &Response{
+			Header: Header{RequestID: 3, Version: 3},
+			Type:   RequestTypeAuth,
+			Status: ResponseStatusOK,
+		},
+	},
+	{
+		name: "rate_limit_response",
+		response: &Response{
+			Header:    Header{RequestID: 5, Version: 3},
+			Type:      RequestTypeRateLimit,
+			Status:    ResponseStatusOK,
+			RateLimit: RateLimitResponseData{Allowed: 3, Remaining: 197, RetryAfter: -1, ResetAfter: 1800 * time.Millisecond},
+		},
+	},
+	{
+		name: "rate_limit_batch_response_v2",
+		response: &Response{
+			Header: Header{RequestID: 6, Version: 2},
+			Type:   RequestTypeRateLimitBatch,
+			Status: ResponseStatusOK,
+			Batch: RateLimitBatchResponseData{Results: []*RateLimitBatchResult{
+				{Status: ResponseStatusOK, Data: RateLimitResponseData{Allowed: 1, Remaining: 199, RetryAfter: -1, ResetAfter: 300 * time.Millisecond}},
+				{Status: ResponseStatusError, Error: "redis: connection refused"},
+			}},
+		},
+	},
+	{
+		name: "rate_limit_batch_response_v3",
+		response: &Response{
+			Header: Header{RequestID: 6, Version: 3},
+			Type:   RequestTypeRateLimitBatch,
+			Status: ResponseStatusOK,
+			Batch: RateLimitBatchResponseData{Results: []*RateLimitBatchResult{
+				{Status: ResponseStatusOK, Data: RateLimitResponseData{Allowed: 1, Remaining: 199, RetryAfter: -1, ResetAfter: 300 * time.Millisecond}},
+				{Status: ResponseStatusError, Code: ErrorCodeBackendUnavailable, Error: "redis: connection refused"},
+			}},
+		},
+	},
+	{
+		name: "list_keys_response",
+		response: &Response{
+			Header:   Header{RequestID: 9, Version: 3},
+			Type:     RequestTypeListKeys,
+			Status:   ResponseStatusOK,
+			ListKeys: ListKeysResponseData{Cursor: 0, Keys: []string{"traefik:a", "traefik:b"}},
+		},
+	},
+	{
+		name: "register_policy_response",
+		response: &Response{
+			Header: Header{RequestID: 10, Version: 3},
+			Type:   RequestTypeRegisterPolicy,
+			Status: ResponseStatusOK,
+		},
+	},
+	{
+		name: "subscribe_response",
+		response: &Response{
+			Header: Header{RequestID: 16, Version: 3},
+			Type:   RequestTypeSubscribe,
+			Status: ResponseStatusOK,
+		},
+	},
+	{
+		name: "event_response",
+		response: &Response{
+			Header: Header{RequestID: PushRequestID, Version: 3},
+			Type:   RequestTypeEvent,
+			Status: ResponseStatusOK,
+			Event:  EventData{Type: EventTypeBanAdded, Duration: 30 * time.Second, Key: "traefik:default:203.0.113.7"},
+		},
+	},
+	{
+		name: "acquire_lease_response",
+		response: &Response{
+			Header: Header{RequestID: 18, Version: 3},
+			Type:   RequestTypeAcquireLease,
+			Status: ResponseStatusOK,
+			Lease:  LeaseData{Key: "a", ID: "0123456789abcdef0123456789abcdef"},
+		},
+	},
+	{
+		name: "release_lease_response",
+		response: &Response{
+			Header: Header{RequestID: 19, Version: 3},
+			Type:   RequestTypeReleaseLease,
+			Status: ResponseStatusOK,
+		},
+	},
+	{
+		name: "error_response_v1",
+		response: &Response{
+			Header: Header{RequestID: 13, Version: 1},
+			Type:   RequestTypeUnknown,
+			Status: ResponseStatusError,
+			Error:  "unknown request type",
+		},
+	},
+	{
+		name: "error_response_v3",
+		response: &Response{
+			Header: Header{RequestID: 13, Version: 3},
+			Type:   RequestTypeUnknown,
+			Status: ResponseStatusError,
+			Code:   ErrorCodeUnknownType,
+			Error:  "unknown request type",
+		},
+	},
+	{
+		name: "unnegotiated_response",
+		response: &Response{
+			Header: Header{RequestID: 16, Version: 3},
+			Type:   RequestTypeSubscribe,
+			Status: ResponseStatusError,
+			Code:   ErrorCodeInvalidRequest,
+			Error:  "Subscribe uses features not negotiated: events",
+		},
+	},
+	{
+		name: "goaway_response",
+		response: &Response{
+			Header:  Header{RequestID: GoAwayRequestID, Version: 3},
+			Type:    RequestTypeGoAway,
+			Status:  ResponseStatusOK,
+			Message: "server shutting down",
+		},
+	},
+}
+
+func goldenBytes16(start byte) [16]byte {
+	var b [16]byte
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+func goldenBytes32(start byte) [32]byte {
+	var b [32]byte
+	for i := range b {
+		b[i] = start + byte(i)
+	}
+	return b
+}
+
+// goldenRaw returns the frame of the header and payload.
+func goldenRaw(header *Header, payload ...byte) []byte {
+	return append(header.Marshal(header.Version, uint32(len(payload))), payload...)
+}
+
+func goldenPath(name string) string {
+	return filepath.Join("testdata", "golden", name+".bin")
+}
+
+// encode returns the frame of the golden value.
+func (g *goldenFrame) encode() ([]byte, error) {
+	if g.raw != nil {
+		return g.raw, nil
+	}
+	buf := &bytes.Buffer{}
+	if g.request != nil {
+		err := g.request.Marshal(buf)
+		return buf.Bytes(), err
+	}
+	err := g.response.Marshal(buf)
+	return buf.Bytes(), err
+}
+
+// decode decodes the frame like the peer reading it, without the content
+// length of the header, checked against the payload, nor the deadline taken
+// from a timeout.
+func (g *goldenFrame) decode(frame []byte) (any, error) {
+	r := bytes.NewReader(frame)
+	header, err := ReadHeader(r)
+	if err != nil {
+		return nil, err
+	}
+	payload := frame[len(frame)-r.Len():]
+	if int(header.ContentLength) != len(payload) {
+		return nil, fmt.Errorf("content length mismatch: expected %d, got %d", header.ContentLength, len(payload))
+	}
+	header.ContentLength = 0
+	// the deadline of a timeout is taken on the clock of the reader
+	if header.Timeout != 0 {
+		if header.Deadline.IsZero() {
+			return nil, fmt.Errorf("no deadline for the timeout %s", header.Timeout)
+		}
+		header.Deadline = time.Time{}
+	}
+	if g.request != nil {
+		req := &Request{}
+		err = req.Unmarshal(header, payload)
+		return req, err
+	}
+	resp := &Response{}
+	err = resp.Unmarshal(header, payload)
+	return resp, err
+}
+
+func TestGoldenFrames(t *testing.T) {
+	for _, tt := range goldenFrames {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded, err := tt.encode()
+			if err != nil {
+				t.Fatalf("failed to encode: %v", err)
+			}
+			if *update {
+				if err := os.WriteFile(goldenPath(tt.name), encoded, 0o644); err != nil {
+					t.Fatalf("failed to update golden frame: %v", err)
+				}
+			}
+			golden, err := os.ReadFile(goldenPath(tt.name))
+			if err != nil {
+				t.Fatalf("failed to read golden frame: %v", err)
+			}
+			if !bytes.Equal(encoded, golden) {
+				t.Errorf("Expected %x \nWanted %x", encoded, golden)
+			}
+
+			decoded, err := tt.decode(golden)
+			if err != nil {
+				t.Fatalf("failed to decode: %v", err)
+			}
+			var expected any = tt.request
+			if tt.response != nil {
+				expected = tt.response
+			}
+			if !reflect.DeepEqual(decoded, expected) {
+				t.Errorf("Expected %+v \nWanted %+v", decoded, expected)
+			}
+		})
+	}
+}
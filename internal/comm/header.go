@@ -2,14 +2,98 @@ package comm
 
 import (
 	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"time"
 )
 
-const VERSION = uint32(1)
+// ErrUnsupportedVersion is returned for frames of a protocol version outside
+// of MinVersion to VERSION.
+var ErrUnsupportedVersion = errors.New("unsupported protocol version")
+
+const (
+	// VERSION is the newest protocol version spoken by this package.
+	VERSION = uint32(3)
+	// MinVersion is the oldest protocol version still accepted.
+	MinVersion = uint32(1)
+	// errorCodeVersion is the first protocol version carrying error codes.
+	errorCodeVersion = uint32(3)
+)
+
+const (
+	// HeaderSize is the size of the header prefix shared by every protocol version.
+	HeaderSize = 12
+	// headerTimeoutSize is the size of the timeout field appended to the header since version 2.
+	headerTimeoutSize = 8
+)
 
 type Header struct {
 	RequestID     uint32
 	Version       uint32
 	ContentLength uint32
+	// Deadline is the time after which the sender no longer waits for the response,
+	// on the clock of the reader of the frame, which takes it from the Timeout.
+	// The zero value means no deadline. It is not encoded.
+	Deadline time.Time
+	// Timeout is how long the sender still waits for the response when sending
+	// the frame, so that the peers need not agree on the time. The zero value
+	// means no timeout. It is only carried from version 2 on.
+	Timeout time.Duration
+}
+
+// Size returns the encoded size of the header for its version.
+func (h *Header) Size() int {
+	return headerSize(h.Version)
+}
+
+func headerSize(version uint32) int {
+	if version >= 2 {
+		return HeaderSize + headerTimeoutSize
+	}
+	return HeaderSize
+}
+
+// Marshal encodes the header for the given version.
+func (h *Header) Marshal(version uint32, contentLength uint32) []byte {
+	return h.Append(make([]byte, 0, headerSize(version)), version, contentLength)
+}
+
+// Append appends the header encoded for the given version to dst.
+func (h *Header) Append(dst []byte, version uint32, contentLength uint32) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, h.RequestID)
+	dst = binary.BigEndian.AppendUint32(dst, version)
+	dst = binary.BigEndian.AppendUint32(dst, contentLength)
+	if version >= 2 {
+		dst = binary.BigEndian.AppendUint64(dst, uint64(h.Timeout))
+	}
+	return dst
+}
+
+// SetTimeout sets the deadline of the header and the timeout carrying it, the
+// time left until the deadline. A deadline already passed still gets a
+// timeout, the shortest, for the reader to drop the frame.
+func (h *Header) SetTimeout(deadline time.Time) {
+	h.Deadline = deadline
+	h.Timeout = time.Until(deadline)
+	if h.Timeout <= 0 {
+		h.Timeout = 1
+	}
+}
+
+// readTimeout sets the timeout of a header read at now from its timeout field,
+// and the deadline it leaves.
+func (h *Header) readTimeout(field uint64, now time.Time) {
+	if field == 0 {
+		return
+	}
+	h.Timeout = time.Duration(field)
+	h.Deadline = now.Add(h.Timeout)
+}
+
+// Expired reports whether the deadline of the header has passed.
+func (h *Header) Expired(now time.Time) bool {
+	return !h.Deadline.IsZero() && !now.Before(h.Deadline)
 }
 
 func UnmarshalHeader(header []byte) *Header {
@@ -19,3 +103,31 @@ func UnmarshalHeader(header []byte) *Header {
 		ContentLength: binary.BigEndian.Uint32(header[8:12]),
 	}
 }
+
+// ReadHeader reads a header from the reader, including the fields of its version.
+func ReadHeader(r io.Reader) (*Header, error) {
+	prefix := make([]byte, HeaderSize)
+	if _, err := io.ReadFull(r, prefix); err != nil {
+		return nil, err
+	}
+	header := UnmarshalHeader(prefix)
+	if header.Version < MinVersion || header.Version > VERSION {
+		return header, fmt.Errorf("%w: %d", ErrUnsupportedVersion, header.Version)
+	}
+	if header.Version >= 2 {
+		ext := make([]byte, headerTimeoutSize)
+		if _, err := io.ReadFull(r, ext); err != nil {
+			return nil, err
+		}
+		header.readTimeout(binary.BigEndian.Uint64(ext), time.Now())
+	}
+	return header, nil
+}
+
+// version returns the version a frame answering or carrying this header is encoded with.
+func (h *Header) version() uint32 {
+	if h == nil || h.Version == 0 {
+		return VERSION
+	}
+	return h.Version
+}
@@ -0,0 +1,75 @@
+package comm
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+func TestHeader(t *testing.T) {
+	tests := []struct {
+		name   string
+		header Header
+	}{
+		{
+			name:   "Version1",
+			header: Header{RequestID: 1, Version: 1, ContentLength: 10},
+		},
+		{
+			name:   "Version2WithoutTimeout",
+			header: Header{RequestID: 2, Version: 2, ContentLength: 20},
+		},
+		{
+			name:   "Version2WithTimeout",
+			header: Header{RequestID: 3, Version: 2, ContentLength: 30, Timeout: 500 * time.Millisecond},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshalled := tt.header.Marshal(tt.header.Version, tt.header.ContentLength)
+			if len(marshalled) != tt.header.Size() {
+				t.Errorf("Expected %d bytes \nWanted %d", len(marshalled), tt.header.Size())
+			}
+			before := time.Now()
+			unmarshalled, err := ReadHeader(bytes.NewReader(marshalled))
+			if err != nil {
+				t.Errorf("failed to read header: %v", err)
+				return
+			}
+			if tt.header.Timeout != 0 {
+				// the deadline is taken on the clock of the reader
+				if unmarshalled.Deadline.Before(before.Add(tt.header.Timeout)) || unmarshalled.Deadline.After(time.Now().Add(tt.header.Timeout)) {
+					t.Errorf("Expected a deadline %s after reading, got %s", tt.header.Timeout, unmarshalled.Deadline)
+				}
+				unmarshalled.Deadline = time.Time{}
+			}
+			if unmarshalled.RequestID != tt.header.RequestID ||
+				unmarshalled.Version != tt.header.Version ||
+				unmarshalled.ContentLength != tt.header.ContentLength ||
+				unmarshalled.Timeout != tt.header.Timeout ||
+				!unmarshalled.Deadline.IsZero() {
+				t.Errorf("Expected %v \nWanted %v", unmarshalled, tt.header)
+			}
+		})
+	}
+}
+
+func TestHeaderTimeout(t *testing.T) {
+	header := Header{RequestID: 1, Version: VERSION}
+	header.SetTimeout(time.Now().Add(-time.Second))
+	read, err := ReadHeader(bytes.NewReader(header.Marshal(VERSION, 0)))
+	if err != nil {
+		t.Fatalf("failed to read header: %v", err)
+	}
+	if !read.Expired(time.Now()) {
+		t.Errorf("expected a deadline already passed to be expired on reading, got %+v", read)
+	}
+}
+
+func TestHeaderUnsupportedVersion(t *testing.T) {
+	header := Header{RequestID: 1}
+	marshalled := header.Marshal(VERSION+1, 0)
+	if _, err := ReadHeader(bytes.NewReader(marshalled)); err == nil {
+		t.Errorf("expected an error for version %d", VERSION+1)
+	}
+}
@@ -0,0 +1,115 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const helloSize = 12
+
+// Feature is an optional capability of a peer, agreed on in the handshake.
+type Feature uint32
+
+const (
+	FeatureBatch Feature = 1 << iota
+	// FeaturePeek covers inspecting, resetting and listing keys.
+	FeaturePeek
+	// FeatureLeases covers acquiring and releasing the concurrent slots of
+	// keys.
+	FeatureLeases
+	FeatureDeadlines
+	// FeaturePolicies covers registering policies and deciding under them.
+	FeaturePolicies
+	// FeatureGoAway lets the server announce it is going away with a RequestTypeGoAway frame.
+	FeatureGoAway
+	// FeatureEvents lets clients subscribe to events pushed by the server.
+	FeatureEvents
+	// FeatureNamedPolicies lets clients register policies defined by the
+	// server, by name.
+	FeatureNamedPolicies
+	// FeatureAlgorithms lets clients decide with the algorithms other than
+	// GCRA.
+	FeatureAlgorithms
+	// FeatureAdmin is asked for by clients proving the admin token, which
+	// may then reset and list keys. It is not part of SupportedFeatures, as
+	// only those clients ask for it.
+	FeatureAdmin
+)
+
+// SupportedFeatures are the features implemented by this package.
+const SupportedFeatures = FeatureBatch | FeaturePeek | FeatureLeases | FeatureDeadlines | FeaturePolicies | FeatureGoAway | FeatureEvents | FeatureNamedPolicies | FeatureAlgorithms
+
+// Has reports whether all the given features are set.
+func (f Feature) Has(features Feature) bool {
+	return f&features == features
+}
+
+func (f Feature) String() string {
+	names := []string{"batch", "peek", "leases", "deadlines", "policies", "goaway", "events", "namedpolicies", "algorithms", "admin"}
+	s := ""
+	for i, name := range names {
+		if f&(1<<i) == 0 {
+			continue
+		}
+		if s != "" {
+			s += ","
+		}
+		s += name
+	}
+	return s
+}
+
+// HelloData opens a connection. The client sends the range of versions and
+// the features it supports, the server answers with the version to use in
+// both bounds and the features both peers support.
+//
+// Hello frames are always sent with a MinVersion header, so that a peer of
+// any version can read them.
+type HelloData struct {
+	MinVersion uint32
+	MaxVersion uint32
+	Features   Feature
+}
+
+// Negotiate returns the answer of a peer supporting versions from minVersion
+// to maxVersion and the given features to the hello.
+func (h *HelloData) Negotiate(minVersion uint32, maxVersion uint32, features Feature) (*HelloData, error) {
+	version := h.MaxVersion
+	if maxVersion < version {
+		version = maxVersion
+	}
+	if version < h.MinVersion || version < minVersion {
+		return nil, fmt.Errorf("unsupported protocol version: peer supports %d to %d, expected %d to %d", h.MinVersion, h.MaxVersion, minVersion, maxVersion)
+	}
+	return &HelloData{
+		MinVersion: version,
+		MaxVersion: version,
+		Features:   h.Features & features,
+	}, nil
+}
+
+// Marshall encodes HelloData into a byte slice.
+func (h *HelloData) Marshall() []byte {
+	return h.Append(make([]byte, 0, helloSize))
+}
+
+// Append appends the encoding of HelloData to dst.
+func (h *HelloData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, h.MinVersion)
+	dst = binary.BigEndian.AppendUint32(dst, h.MaxVersion)
+	return binary.BigEndian.AppendUint32(dst, uint32(h.Features))
+}
+
+// Unmarshal decodes HelloData from a byte slice.
+func (h *HelloData) Unmarshal(data []byte) error {
+	if len(data) < helloSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), helloSize)
+	}
+	h.MinVersion = binary.BigEndian.Uint32(data[0:])
+	h.MaxVersion = binary.BigEndian.Uint32(data[4:])
+	h.Features = Feature(binary.BigEndian.Uint32(data[8:]))
+	if h.MinVersion > h.MaxVersion {
+		return fmt.Errorf("invalid version range: %d to %d", h.MinVersion, h.MaxVersion)
+	}
+	return nil
+}
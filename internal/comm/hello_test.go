@@ -0,0 +1,86 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestHelloDataNegotiate(t *testing.T) {
+	tests := []struct {
+		name    string
+		hello   HelloData
+		want    *HelloData
+		wantErr bool
+	}{
+		{
+			name:  "SameVersions",
+			hello: HelloData{MinVersion: MinVersion, MaxVersion: VERSION, Features: SupportedFeatures},
+			want:  &HelloData{MinVersion: VERSION, MaxVersion: VERSION, Features: SupportedFeatures},
+		},
+		{
+			name:  "NewerClient",
+			hello: HelloData{MinVersion: MinVersion, MaxVersion: VERSION + 1, Features: SupportedFeatures | 1<<31},
+			want:  &HelloData{MinVersion: VERSION, MaxVersion: VERSION, Features: SupportedFeatures},
+		},
+		{
+			name:  "OlderClient",
+			hello: HelloData{MinVersion: MinVersion, MaxVersion: MinVersion, Features: FeatureBatch},
+			want:  &HelloData{MinVersion: MinVersion, MaxVersion: MinVersion, Features: FeatureBatch},
+		},
+		{
+			name:    "NoCommonVersion",
+			hello:   HelloData{MinVersion: VERSION + 1, MaxVersion: VERSION + 2},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			marshalled := tt.hello.Marshall()
+			unmarshalled := &HelloData{}
+			if err := unmarshalled.Unmarshal(marshalled); err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			got, err := unmarshalled.Negotiate(MinVersion, VERSION, SupportedFeatures)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("unexpected error: %v", err)
+				return
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("Expected %v \nWanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRequestFeatures(t *testing.T) {
+	tests := []struct {
+		name string
+		req  Request
+		want Feature
+	}{
+		{name: "Ping", req: Request{Type: RequestTypePing}, want: 0},
+		{name: "RateLimit", req: Request{Type: RequestTypeRateLimit}, want: 0},
+		{name: "RateLimitAlgorithm", req: Request{Type: RequestTypeRateLimit, RateLimit: RateLimitRequestData{Algorithm: AlgorithmFixedWindow}}, want: FeatureAlgorithms},
+		{
+			name: "RateLimitBatch",
+			req: Request{Type: RequestTypeRateLimitBatch, Batch: RateLimitBatchRequestData{Entries: []*RateLimitRequestData{
+				{}, {Algorithm: AlgorithmSlidingWindowLog},
+			}}},
+			want: FeatureBatch | FeatureAlgorithms,
+		},
+		{name: "Peek", req: Request{Type: RequestTypePeek}, want: FeaturePeek},
+		{name: "ListKeys", req: Request{Type: RequestTypeListKeys}, want: FeaturePeek},
+		{name: "RegisterPolicy", req: Request{Type: RequestTypeRegisterPolicy, Policy: PolicyData{Rate: 1, Burst: 1, Period: 1}}, want: FeaturePolicies},
+		{name: "RegisterNamedPolicy", req: Request{Type: RequestTypeRegisterPolicy, Policy: PolicyData{Name: "api"}}, want: FeaturePolicies | FeatureNamedPolicies},
+		{name: "RateLimitPolicyBatch", req: Request{Type: RequestTypeRateLimitPolicyBatch}, want: FeaturePolicies | FeatureBatch},
+		{name: "Subscribe", req: Request{Type: RequestTypeSubscribe}, want: FeatureEvents},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.req.Features(); got != tt.want {
+				t.Errorf("Expected %s \nWanted %s", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,144 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+const (
+	// MaxListKeysCount is the largest page of keys a server returns.
+	MaxListKeysCount       = 1000
+	listKeysReqHeaderSize  = 16
+	listKeysRespHeaderSize = 12
+)
+
+// KeyData names a single key, as in a RequestTypeReset.
+type KeyData struct {
+	Key string
+}
+
+// Marshall encodes KeyData into a byte slice.
+func (k *KeyData) Marshall() []byte {
+	return k.Append(make([]byte, 0, 4+len(k.Key)))
+}
+
+// Append appends the encoding of KeyData to dst.
+func (k *KeyData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(k.Key)))
+	return append(dst, k.Key...)
+}
+
+// Unmarshal decodes KeyData from a byte slice.
+func (k *KeyData) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short: got %d bytes, expected at least 4", len(data))
+	}
+	keyLen := binary.BigEndian.Uint32(data)
+	if uint64(keyLen) > uint64(len(data)-4) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", keyLen, len(data)-4)
+	}
+	k.Key = decodeKey(k.Key, data[4:4+keyLen])
+	return nil
+}
+
+// decodeKey returns the key encoded in data. The previous key of the value
+// decoded into is kept when it is the same, so that a key repeated from one
+// frame to the next is not copied again.
+func decodeKey(previous string, data []byte) string {
+	if previous == string(data) {
+		return previous
+	}
+	return string(data)
+}
+
+// ListKeysRequestData asks for a page of the keys starting with Prefix. The
+// first page has a zero Cursor, the next ones the cursor of the previous page.
+// Count is a hint of the page size, pages may hold fewer or more keys.
+type ListKeysRequestData struct {
+	Prefix string
+	Cursor uint64
+	Count  uint32
+}
+
+// Marshall encodes ListKeysRequestData into a byte slice.
+func (l *ListKeysRequestData) Marshall() []byte {
+	return l.Append(make([]byte, 0, listKeysReqHeaderSize+len(l.Prefix)))
+}
+
+// Append appends the encoding of ListKeysRequestData to dst.
+func (l *ListKeysRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, l.Cursor)
+	dst = binary.BigEndian.AppendUint32(dst, l.Count)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(l.Prefix)))
+	return append(dst, l.Prefix...)
+}
+
+// Unmarshal decodes ListKeysRequestData from a byte slice.
+func (l *ListKeysRequestData) Unmarshal(data []byte) error {
+	if len(data) < listKeysReqHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), listKeysReqHeaderSize)
+	}
+	l.Cursor = binary.BigEndian.Uint64(data[0:])
+	l.Count = binary.BigEndian.Uint32(data[8:])
+	prefixLen := binary.BigEndian.Uint32(data[12:])
+	if uint64(prefixLen) > uint64(len(data)-listKeysReqHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", prefixLen, len(data)-listKeysReqHeaderSize)
+	}
+	l.Prefix = string(data[listKeysReqHeaderSize : listKeysReqHeaderSize+prefixLen])
+	return nil
+}
+
+// ListKeysResponseData is a page of keys. A zero Cursor means it is the last one.
+type ListKeysResponseData struct {
+	Cursor uint64
+	Keys   []string
+}
+
+// Marshall encodes ListKeysResponseData into a byte slice. The keys follow
+// the cursor and their count, each prefixed with its length.
+func (l *ListKeysResponseData) Marshall() []byte {
+	size := listKeysRespHeaderSize
+	for _, key := range l.Keys {
+		size += 4 + len(key)
+	}
+	return l.Append(make([]byte, 0, size))
+}
+
+// Append appends the encoding of ListKeysResponseData to dst.
+func (l *ListKeysResponseData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, l.Cursor)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(l.Keys)))
+	for _, key := range l.Keys {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(key)))
+		dst = append(dst, key...)
+	}
+	return dst
+}
+
+// Unmarshal decodes ListKeysResponseData from a byte slice.
+func (l *ListKeysResponseData) Unmarshal(data []byte) error {
+	if len(data) < listKeysRespHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), listKeysRespHeaderSize)
+	}
+	l.Cursor = binary.BigEndian.Uint64(data[0:])
+	count := binary.BigEndian.Uint32(data[8:])
+	data = data[listKeysRespHeaderSize:]
+	// Each key takes at least its length prefix.
+	if uint64(count)*4 > uint64(len(data)) {
+		return fmt.Errorf("data too short for %d keys", count)
+	}
+	l.Keys = make([]string, count)
+	for i := range l.Keys {
+		if len(data) < 4 {
+			return fmt.Errorf("key %d: data too short", i)
+		}
+		keyLen := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(keyLen) > uint64(len(data)) {
+			return fmt.Errorf("key %d: length mismatch: expected %d, got %d", i, keyLen, len(data))
+		}
+		l.Keys[i] = string(data[:keyLen])
+		data = data[keyLen:]
+	}
+	return nil
+}
@@ -0,0 +1,53 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestListKeysRequestData(t *testing.T) {
+	r := &ListKeysRequestData{Prefix: "traefik:default:", Cursor: 42, Count: 100}
+	unmarshalled := &ListKeysRequestData{}
+	if err := unmarshalled.Unmarshal(r.Marshall()); err != nil {
+		t.Errorf("failed to unmarshal: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(unmarshalled, r) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+	}
+}
+
+func TestListKeysResponseData(t *testing.T) {
+	tests := []struct {
+		name string
+		data *ListKeysResponseData
+	}{
+		{
+			name: "Empty",
+			data: &ListKeysResponseData{Keys: []string{}},
+		},
+		{
+			name: "Page",
+			data: &ListKeysResponseData{Cursor: 17, Keys: []string{"traefik:default:203.0.113.7", "", "traefik:default:2001:db8::1"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unmarshalled := &ListKeysResponseData{}
+			if err := unmarshalled.Unmarshal(tt.data.Marshall()); err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			if !reflect.DeepEqual(unmarshalled, tt.data) {
+				t.Errorf("Expected %v \nWanted %v", unmarshalled, tt.data)
+			}
+		})
+	}
+}
+
+func TestListKeysResponseDataTruncated(t *testing.T) {
+	marshalled := (&ListKeysResponseData{Keys: []string{"testing"}}).Marshall()
+	if err := (&ListKeysResponseData{}).Unmarshal(marshalled[:len(marshalled)-1]); err == nil {
+		t.Errorf("expected an error for truncated data")
+	}
+}
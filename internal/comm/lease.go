@@ -0,0 +1,92 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const acquireLeaseReqHeaderSize = 20
+
+// AcquireLeaseRequestData asks for one of the Limit concurrent slots of Key,
+// held for at most TTL unless released earlier.
+type AcquireLeaseRequestData struct {
+	Limit uint64
+	TTL   time.Duration // int64
+	Key   string
+}
+
+// Marshall encodes AcquireLeaseRequestData into a byte slice.
+func (a *AcquireLeaseRequestData) Marshall() []byte {
+	return a.Append(make([]byte, 0, acquireLeaseReqHeaderSize+len(a.Key)))
+}
+
+// Append appends the encoding of AcquireLeaseRequestData to dst.
+func (a *AcquireLeaseRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, a.Limit)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(a.TTL))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(a.Key)))
+	return append(dst, a.Key...)
+}
+
+// Unmarshal decodes AcquireLeaseRequestData from a byte slice.
+func (a *AcquireLeaseRequestData) Unmarshal(data []byte) error {
+	if len(data) < acquireLeaseReqHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), acquireLeaseReqHeaderSize)
+	}
+	a.Limit = binary.BigEndian.Uint64(data[0:])
+	a.TTL = time.Duration(binary.BigEndian.Uint64(data[8:]))
+	keyLen := binary.BigEndian.Uint32(data[16:])
+	if uint64(keyLen) > uint64(len(data)-acquireLeaseReqHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", keyLen, len(data)-acquireLeaseReqHeaderSize)
+	}
+	a.Key = decodeKey(a.Key, data[acquireLeaseReqHeaderSize:acquireLeaseReqHeaderSize+keyLen])
+	return nil
+}
+
+// LeaseData is a lease of Key, answered to a RequestTypeAcquireLease and
+// given back in a RequestTypeReleaseLease. An empty ID means all the slots of
+// the key are held.
+type LeaseData struct {
+	Key string
+	ID  string
+}
+
+// Acquired reports whether the lease holds a slot.
+func (l *LeaseData) Acquired() bool {
+	return l.ID != ""
+}
+
+// Marshall encodes LeaseData into a byte slice.
+func (l *LeaseData) Marshall() []byte {
+	return l.Append(make([]byte, 0, 8+len(l.Key)+len(l.ID)))
+}
+
+// Append appends the encoding of LeaseData to dst, the key then the ID, each
+// prefixed with its length.
+func (l *LeaseData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(l.Key)))
+	dst = append(dst, l.Key...)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(l.ID)))
+	return append(dst, l.ID...)
+}
+
+// Unmarshal decodes LeaseData from a byte slice.
+func (l *LeaseData) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short: got %d bytes, expected at least 4", len(data))
+	}
+	keyLen := binary.BigEndian.Uint32(data)
+	data = data[4:]
+	if uint64(keyLen)+4 > uint64(len(data)) {
+		return fmt.Errorf("data too short for a key of %d bytes: got %d", keyLen, len(data))
+	}
+	l.Key = decodeKey(l.Key, data[:keyLen])
+	data = data[keyLen:]
+	idLen := binary.BigEndian.Uint32(data)
+	if uint64(idLen) > uint64(len(data)-4) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", idLen, len(data)-4)
+	}
+	l.ID = string(data[4 : 4+idLen])
+	return nil
+}
@@ -0,0 +1,56 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestAcquireLeaseRequestData(t *testing.T) {
+	r := &AcquireLeaseRequestData{Limit: 10, TTL: 30 * time.Second, Key: "traefik:default:203.0.113.7"}
+	unmarshalled := &AcquireLeaseRequestData{}
+	if err := unmarshalled.Unmarshal(r.Marshall()); err != nil {
+		t.Errorf("failed to unmarshal: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(unmarshalled, r) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+	}
+}
+
+func TestLeaseData(t *testing.T) {
+	tests := []struct {
+		name string
+		data *LeaseData
+	}{
+		{
+			name: "Acquired",
+			data: &LeaseData{Key: "a", ID: "0123456789abcdef0123456789abcdef"},
+		},
+		{
+			name: "Full",
+			data: &LeaseData{Key: "a"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			unmarshalled := &LeaseData{}
+			if err := unmarshalled.Unmarshal(tt.data.Marshall()); err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			if !reflect.DeepEqual(unmarshalled, tt.data) {
+				t.Errorf("Expected %v \nWanted %v", unmarshalled, tt.data)
+			}
+		})
+	}
+}
+
+func TestLeaseDataTruncated(t *testing.T) {
+	marshalled := (&LeaseData{Key: "a", ID: "b"}).Marshall()
+	for i := range marshalled {
+		if err := (&LeaseData{}).Unmarshal(marshalled[:i]); err == nil {
+			t.Errorf("expected an error for %d bytes", i)
+		}
+	}
+}
@@ -0,0 +1,422 @@
+package comm
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+)
+
+const (
+	policyHeaderSize          = 41
+	policyRateLimitHeaderSize = 16
+)
+
+// Algorithm is the rate limiting algorithm of a policy.
+type Algorithm uint8
+
+const (
+	// AlgorithmGCRA is the generic cell rate algorithm of redis_rate: Rate
+	// tokens come back per Period, up to Burst.
+	AlgorithmGCRA Algorithm = iota
+	// AlgorithmSlidingWindowLog allows at most Rate tokens in any Period
+	// before a decision, logging the time of each token taken.
+	AlgorithmSlidingWindowLog
+	// AlgorithmSlidingWindowCounter allows about Rate tokens in any Period,
+	// weighing the count of the previous window by how much of it the
+	// sliding window still covers.
+	AlgorithmSlidingWindowCounter
+	// AlgorithmFixedWindow allows Rate tokens per window of Period, the
+	// windows being aligned on the Unix epoch, so on the minute, hour or
+	// day in UTC, or per calendar window of a time zone, see Calendar.
+	AlgorithmFixedWindow
+)
+
+// ParseAlgorithm returns the algorithm of the name, GCRA when empty.
+func ParseAlgorithm(name string) (Algorithm, error) {
+	switch name {
+	case "", "gcra":
+		return AlgorithmGCRA, nil
+	case "sliding-window-log":
+		return AlgorithmSlidingWindowLog, nil
+	case "sliding-window-counter":
+		return AlgorithmSlidingWindowCounter, nil
+	case "fixed-window":
+		return AlgorithmFixedWindow, nil
+	default:
+		return 0, fmt.Errorf("unknown algorithm %q, expected gcra, sliding-window-log, sliding-window-counter or fixed-window", name)
+	}
+}
+
+func (a Algorithm) String() string {
+	switch a {
+	case AlgorithmGCRA:
+		return "gcra"
+	case AlgorithmSlidingWindowLog:
+		return "sliding-window-log"
+	case AlgorithmSlidingWindowCounter:
+		return "sliding-window-counter"
+	case AlgorithmFixedWindow:
+		return "fixed-window"
+	default:
+		return fmt.Sprintf("algorithm(%d)", uint8(a))
+	}
+}
+
+// IsValid reports whether the algorithm is known.
+func (a Algorithm) IsValid() bool {
+	return a <= AlgorithmFixedWindow
+}
+
+// Calendar is the calendar unit fixed windows are aligned on, in the time zone
+// of their request. A calendar window lasts its unit, the period of the
+// request is not used.
+type Calendar uint8
+
+const (
+	// CalendarNone aligns fixed windows on the Unix epoch.
+	CalendarNone Calendar = iota
+	CalendarHour
+	CalendarDay
+	// CalendarWeek starts windows on Mondays.
+	CalendarWeek
+	CalendarMonth
+)
+
+// maxTimeZoneLen bounds the name of the time zone of a calendar, encoded
+// after a 1-byte length.
+const maxTimeZoneLen = 255
+
+// ParseCalendar returns the calendar of the name, none when empty.
+func ParseCalendar(name string) (Calendar, error) {
+	switch name {
+	case "":
+		return CalendarNone, nil
+	case "hour":
+		return CalendarHour, nil
+	case "day":
+		return CalendarDay, nil
+	case "week":
+		return CalendarWeek, nil
+	case "month":
+		return CalendarMonth, nil
+	default:
+		return 0, fmt.Errorf("unknown calendar %q, expected hour, day, week or month", name)
+	}
+}
+
+func (c Calendar) String() string {
+	switch c {
+	case CalendarNone:
+		return ""
+	case CalendarHour:
+		return "hour"
+	case CalendarDay:
+		return "day"
+	case CalendarWeek:
+		return "week"
+	case CalendarMonth:
+		return "month"
+	default:
+		return fmt.Sprintf("calendar(%d)", uint8(c))
+	}
+}
+
+// IsValid reports whether the calendar is known.
+func (c Calendar) IsValid() bool {
+	return c <= CalendarMonth
+}
+
+// validateCalendar checks the calendar and time zone of fixed windows under
+// the algorithm. The time zone is only known to exist by the server.
+func validateCalendar(algorithm Algorithm, calendar Calendar, timeZone string) error {
+	if !calendar.IsValid() {
+		return fmt.Errorf("unknown calendar: %s", calendar)
+	}
+	if calendar == CalendarNone {
+		if timeZone != "" {
+			return fmt.Errorf("a time zone needs a calendar")
+		}
+		return nil
+	}
+	if algorithm != AlgorithmFixedWindow {
+		return fmt.Errorf("calendars only align fixed windows")
+	}
+	if len(timeZone) > maxTimeZoneLen {
+		return fmt.Errorf("time zone too long: got %d bytes, expected at most %d", len(timeZone), maxTimeZoneLen)
+	}
+	return nil
+}
+
+// appendCalendar appends the calendar, then the length of the time zone and
+// the time zone.
+func appendCalendar(dst []byte, calendar Calendar, timeZone string) []byte {
+	dst = append(dst, byte(calendar), byte(len(timeZone)))
+	return append(dst, timeZone...)
+}
+
+// decodeCalendar decodes the calendar and the time zone encoded by
+// appendCalendar. The previous time zone is kept when it is the same.
+func decodeCalendar(data []byte, previous string) (Calendar, string, error) {
+	if len(data) < 2 {
+		return CalendarNone, "", fmt.Errorf("calendar too short: got %d bytes, expected at least 2", len(data))
+	}
+	timeZoneLen := int(data[1])
+	if timeZoneLen > len(data)-2 {
+		return CalendarNone, "", fmt.Errorf("time zone length mismatch: expected %d, got %d", timeZoneLen, len(data)-2)
+	}
+	return Calendar(data[0]), decodeKey(previous, data[2:2+timeZoneLen]), nil
+}
+
+// feature returns the feature deciding with the algorithm takes, none for GCRA.
+func (a Algorithm) feature() Feature {
+	if a == AlgorithmGCRA {
+		return 0
+	}
+	return FeatureAlgorithms
+}
+
+// PolicyData registers a policy on a connection in a RequestTypeRegisterPolicy.
+// Later decisions under the policy only carry its ID, the key and their cost.
+//
+// A policy without limits is named: it refers to the policy of its name
+// defined by the server, which applies its limits. Servers support them with
+// FeatureNamedPolicies.
+type PolicyData struct {
+	// ID identifies the policy on the connection, zero is not a valid ID.
+	ID        uint32
+	Algorithm Algorithm
+	Rate      uint64
+	Burst     uint64
+	Period    time.Duration
+	// Cost is the number of tokens of decisions without a cost of their own,
+	// zero meaning one.
+	Cost uint64
+	// Name identifies the policy across connections.
+	Name string
+	// Calendar and TimeZone align the windows of fixed window policies, see
+	// RateLimitRequestData.
+	Calendar Calendar
+	TimeZone string
+}
+
+// Validate checks that the policy can be enforced.
+func (p *PolicyData) Validate() error {
+	if p.ID == 0 {
+		return fmt.Errorf("policy ID must not be zero")
+	}
+	if p.IsNamed() {
+		if p.Name == "" {
+			return fmt.Errorf("a policy without limits must have a name")
+		}
+		if p.Calendar != CalendarNone || p.TimeZone != "" {
+			return fmt.Errorf("a policy without limits takes the calendar of the server")
+		}
+		return nil
+	}
+	request := p.Request("", 0)
+	return request.Validate()
+}
+
+// IsNamed reports whether the policy refers to the policy of its name defined
+// by the server, carrying no limits of its own.
+func (p *PolicyData) IsNamed() bool {
+	return p.Rate == 0 && p.Burst == 0 && p.Period == 0
+}
+
+// Request returns the full rate limit request of a decision for the key under
+// the policy. A zero cost takes the cost of the policy.
+func (p *PolicyData) Request(key string, cost uint64) RateLimitRequestData {
+	if cost == 0 {
+		cost = p.Cost
+	}
+	return RateLimitRequestData{
+		Algorithm: p.Algorithm,
+		Rate:      p.Rate,
+		Burst:     p.Burst,
+		Period:    p.Period,
+		Key:       key,
+		Cost:      cost,
+		PolicyID:  p.ID,
+		Calendar:  p.Calendar,
+		TimeZone:  p.TimeZone,
+	}
+}
+
+// Marshall encodes PolicyData into a byte slice.
+func (p *PolicyData) Marshall() []byte {
+	return p.Append(make([]byte, 0, policyHeaderSize+len(p.Name)+2+len(p.TimeZone)))
+}
+
+// Append appends the encoding of PolicyData to dst. The calendar trails the
+// name, and is absent from frames of policies without one and older clients.
+func (p *PolicyData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, p.ID)
+	dst = append(dst, byte(p.Algorithm))
+	dst = binary.BigEndian.AppendUint64(dst, p.Rate)
+	dst = binary.BigEndian.AppendUint64(dst, p.Burst)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(p.Period))
+	dst = binary.BigEndian.AppendUint64(dst, p.Cost)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(p.Name)))
+	dst = append(dst, p.Name...)
+	if p.Calendar != CalendarNone {
+		dst = appendCalendar(dst, p.Calendar, p.TimeZone)
+	}
+	return dst
+}
+
+// Unmarshal decodes PolicyData from a byte slice.
+func (p *PolicyData) Unmarshal(data []byte) error {
+	if len(data) < policyHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), policyHeaderSize)
+	}
+	p.ID = binary.BigEndian.Uint32(data[0:])
+	p.Algorithm = Algorithm(data[4])
+	p.Rate = binary.BigEndian.Uint64(data[5:])
+	p.Burst = binary.BigEndian.Uint64(data[13:])
+	p.Period = time.Duration(binary.BigEndian.Uint64(data[21:]))
+	p.Cost = binary.BigEndian.Uint64(data[29:])
+	nameLen := binary.BigEndian.Uint32(data[37:])
+	if uint64(nameLen) > uint64(len(data)-policyHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", nameLen, len(data)-policyHeaderSize)
+	}
+	nameEnd := policyHeaderSize + int(nameLen)
+	p.Name = string(data[policyHeaderSize:nameEnd])
+	if len(data) > nameEnd {
+		var err error
+		if p.Calendar, p.TimeZone, err = decodeCalendar(data[nameEnd:], p.TimeZone); err != nil {
+			return err
+		}
+	} else {
+		p.Calendar, p.TimeZone = CalendarNone, ""
+	}
+	return nil
+}
+
+// PolicyRateLimitRequestData is a decision under a policy registered on the
+// connection, in a RequestTypeRateLimitPolicy.
+type PolicyRateLimitRequestData struct {
+	PolicyID uint32
+	// Cost is the number of tokens to take at most, zero meaning the cost of the policy.
+	Cost uint64
+	Key  string
+	// Trace is the trace context of the decision, if any. It trails the key.
+	Trace TraceContext
+}
+
+// Marshall encodes PolicyRateLimitRequestData into a byte slice.
+func (r *PolicyRateLimitRequestData) Marshall() []byte {
+	return r.Append(make([]byte, 0, r.size()))
+}
+
+func (r *PolicyRateLimitRequestData) size() int {
+	size := policyRateLimitHeaderSize + len(r.Key)
+	if r.Trace.IsValid() {
+		size += traceContextSize
+	}
+	return size
+}
+
+// Append appends the encoding of PolicyRateLimitRequestData to dst.
+func (r *PolicyRateLimitRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, r.PolicyID)
+	dst = binary.BigEndian.AppendUint64(dst, r.Cost)
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Key)))
+	dst = append(dst, r.Key...)
+	if r.Trace.IsValid() {
+		dst = r.Trace.Append(dst)
+	}
+	return dst
+}
+
+// Unmarshal decodes PolicyRateLimitRequestData from a byte slice.
+func (r *PolicyRateLimitRequestData) Unmarshal(data []byte) error {
+	if len(data) < policyRateLimitHeaderSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), policyRateLimitHeaderSize)
+	}
+	r.PolicyID = binary.BigEndian.Uint32(data[0:])
+	r.Cost = binary.BigEndian.Uint64(data[4:])
+	keyLen := binary.BigEndian.Uint32(data[12:])
+	if uint64(keyLen) > uint64(len(data)-policyRateLimitHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", keyLen, len(data)-policyRateLimitHeaderSize)
+	}
+	keyEnd := policyRateLimitHeaderSize + int(keyLen)
+	r.Key = decodeKey(r.Key, data[policyRateLimitHeaderSize:keyEnd])
+	r.Trace = decodeTrace(data[keyEnd:])
+	return nil
+}
+
+// PolicyBatchRequestData carries several decisions under registered policies
+// in one frame, answered by a RateLimitBatchResponseData.
+type PolicyBatchRequestData struct {
+	Entries []*PolicyRateLimitRequestData
+}
+
+// SetLen resizes the entries to n, reusing the entries of an earlier batch.
+// Reused entries keep their values until set.
+func (r *PolicyBatchRequestData) SetLen(n int) []*PolicyRateLimitRequestData {
+	if cap(r.Entries) < n {
+		r.Entries = append(r.Entries[:cap(r.Entries)], make([]*PolicyRateLimitRequestData, n-cap(r.Entries))...)
+	}
+	r.Entries = r.Entries[:n]
+	for i, value := range r.Entries {
+		if value == nil {
+			r.Entries[i] = new(PolicyRateLimitRequestData)
+		}
+	}
+	return r.Entries
+}
+
+// Marshall encodes PolicyBatchRequestData into a byte slice.
+func (r *PolicyBatchRequestData) Marshall() []byte {
+	return r.Append(make([]byte, 0, 4+len(r.Entries)*(4+policyRateLimitHeaderSize)))
+}
+
+// Append appends the encoding of PolicyBatchRequestData to dst, a count
+// followed by the length-prefixed entries.
+func (r *PolicyBatchRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Entries)))
+	for _, entry := range r.Entries {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(entry.size()))
+		dst = entry.Append(dst)
+	}
+	return dst
+}
+
+// Unmarshal decodes PolicyBatchRequestData from a byte slice, reusing the
+// entries of an earlier batch.
+func (r *PolicyBatchRequestData) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short: got %d bytes, expected at least 4", len(data))
+	}
+	count := binary.BigEndian.Uint32(data)
+	if count > MaxBatchSize {
+		return fmt.Errorf("batch too large: got %d entries, expected at most %d", count, MaxBatchSize)
+	}
+	data = data[4:]
+	for i, entry := range r.SetLen(int(count)) {
+		if len(data) < 4 {
+			return fmt.Errorf("entry %d: data too short", i)
+		}
+		entryLen := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(entryLen) > uint64(len(data)) {
+			return fmt.Errorf("entry %d: length mismatch: expected %d, got %d", i, entryLen, len(data))
+		}
+		if err := entry.Unmarshal(data[:entryLen]); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		data = data[entryLen:]
+	}
+	return nil
+}
+
+// Validate checks that the batch fits in a frame.
+func (r *PolicyBatchRequestData) Validate() error {
+	if len(r.Entries) == 0 {
+		return fmt.Errorf("batch is empty")
+	}
+	if len(r.Entries) > MaxBatchSize {
+		return fmt.Errorf("batch too large: got %d entries, expected at most %d", len(r.Entries), MaxBatchSize)
+	}
+	return nil
+}
@@ -0,0 +1,68 @@
+package comm
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestPolicyData(t *testing.T) {
+	p := &PolicyData{ID: 1, Algorithm: AlgorithmGCRA, Rate: 100, Burst: 200, Period: time.Hour, Cost: 2, Name: "my-middleware"}
+	unmarshalled := &PolicyData{}
+	if err := unmarshalled.Unmarshal(p.Marshall()); err != nil {
+		t.Errorf("failed to unmarshal: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(unmarshalled, p) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, p)
+	}
+	if err := (&PolicyData{Rate: 1, Burst: 1, Period: time.Second}).Validate(); err == nil {
+		t.Errorf("expected an error for a zero policy ID")
+	}
+}
+
+func TestPolicyDataCalendar(t *testing.T) {
+	p := &PolicyData{ID: 1, Algorithm: AlgorithmFixedWindow, Rate: 100, Cost: 1, Calendar: CalendarDay, TimeZone: "Asia/Tokyo"}
+	if err := p.Validate(); err != nil {
+		t.Errorf("expected a calendar policy to be valid, got %v", err)
+	}
+	unmarshalled := &PolicyData{}
+	if err := unmarshalled.Unmarshal(p.Marshall()); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(unmarshalled, p) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, p)
+	}
+	if got := p.Request("testing", 0); got.Calendar != CalendarDay || got.TimeZone != "Asia/Tokyo" {
+		t.Errorf("expected the request to carry the calendar, got %s in %q", got.Calendar, got.TimeZone)
+	}
+	if err := (&PolicyData{ID: 1, Name: "api", Calendar: CalendarDay}).Validate(); err == nil {
+		t.Errorf("expected an error for a named policy with a calendar")
+	}
+}
+
+func TestPolicyDataRequest(t *testing.T) {
+	p := &PolicyData{ID: 3, Rate: 10, Burst: 20, Period: time.Minute, Cost: 5}
+	want := RateLimitRequestData{Rate: 10, Burst: 20, Period: time.Minute, Key: "testing", Cost: 5, PolicyID: 3}
+	if got := p.Request("testing", 0); !reflect.DeepEqual(got, want) {
+		t.Errorf("Expected %v \nWanted %v", got, want)
+	}
+	if got := p.Request("testing", 1); got.Cost != 1 {
+		t.Errorf("Expected cost %d \nWanted %d", got.Cost, 1)
+	}
+}
+
+func TestPolicyBatchRequestData(t *testing.T) {
+	r := &PolicyBatchRequestData{Entries: []*PolicyRateLimitRequestData{
+		{PolicyID: 1, Key: "traefik:default:203.0.113.7"},
+		{PolicyID: 2, Cost: 3, Key: ""},
+	}}
+	unmarshalled := &PolicyBatchRequestData{}
+	if err := unmarshalled.Unmarshal(r.Marshall()); err != nil {
+		t.Errorf("failed to unmarshal: %v", err)
+		return
+	}
+	if !reflect.DeepEqual(unmarshalled, r) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+	}
+}
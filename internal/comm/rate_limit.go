@@ -8,7 +8,11 @@ import (
 
 const (
 	rateLimitReqHeaderSize = 28
-	rateLimitRespSize      = 32
+	rateLimitReqCostSize   = 8
+	// rateLimitReqAlgorithmOffset is the offset of the algorithm in the
+	// fields trailing the key, after the cost and the trace context.
+	rateLimitReqAlgorithmOffset = rateLimitReqCostSize + traceContextSize
+	rateLimitRespSize           = 32
 )
 
 type RateLimitRequestData struct {
@@ -16,20 +20,67 @@ type RateLimitRequestData struct {
 	Burst  uint64
 	Period time.Duration // int64
 	Key    string
+	// Cost is the number of tokens to take at most, zero meaning one.
+	// It trails the key and is absent from frames of older clients.
+	Cost uint64
+	// PolicyID is the registered policy the limits come from, zero for none.
+	// It is not encoded, clients use it to send the shorter policy frames.
+	PolicyID uint32
+	// Trace is the trace context of the decision, if any. It trails the cost
+	// and is absent from frames of untraced decisions and older clients.
+	Trace TraceContext
+	// Algorithm is the algorithm of the decision. It trails the trace
+	// context, zero when the decision is untraced, and is absent from frames
+	// of GCRA decisions and older clients.
+	Algorithm Algorithm
+	// Calendar aligns fixed windows on the calendar of TimeZone, an IANA
+	// time zone name, UTC when empty. They trail the algorithm, and are
+	// absent from frames of decisions without a calendar and older clients.
+	Calendar Calendar
+	TimeZone string
 }
 
 // Marshall encodes RateLimitRequestData into a byte slice.
 func (r *RateLimitRequestData) Marshall() []byte {
-	keyLen := len(r.Key)
-	data := make([]byte, rateLimitReqHeaderSize+keyLen)
-	binary.BigEndian.PutUint64(data[0:], r.Rate)
-	binary.BigEndian.PutUint64(data[8:], r.Burst)
-	binary.BigEndian.PutUint64(data[16:], uint64(r.Period))
-	binary.BigEndian.PutUint32(data[24:], uint32(keyLen))
-	if keyLen > 0 {
-		copy(data[rateLimitReqHeaderSize:], r.Key)
+	return r.Append(make([]byte, 0, r.size()))
+}
+
+// Append appends the encoding of RateLimitRequestData to dst.
+func (r *RateLimitRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, r.Rate)
+	dst = binary.BigEndian.AppendUint64(dst, r.Burst)
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.Period))
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Key)))
+	dst = append(dst, r.Key...)
+	dst = binary.BigEndian.AppendUint64(dst, r.Cost)
+	if r.Algorithm != AlgorithmGCRA || r.Calendar != CalendarNone {
+		trace := r.Trace
+		if !trace.IsValid() {
+			trace = TraceContext{}
+		}
+		dst = trace.Append(dst)
+		dst = append(dst, byte(r.Algorithm))
+		if r.Calendar != CalendarNone {
+			dst = appendCalendar(dst, r.Calendar, r.TimeZone)
+		}
+		return dst
+	}
+	if r.Trace.IsValid() {
+		dst = r.Trace.Append(dst)
 	}
-	return data
+	return dst
+}
+
+func (r *RateLimitRequestData) size() int {
+	size := rateLimitReqHeaderSize + len(r.Key) + rateLimitReqCostSize
+	if r.Calendar != CalendarNone {
+		size += traceContextSize + 1 + 2 + len(r.TimeZone)
+	} else if r.Algorithm != AlgorithmGCRA {
+		size += traceContextSize + 1
+	} else if r.Trace.IsValid() {
+		size += traceContextSize
+	}
+	return size
 }
 
 // Unmarshal decodes RateLimitRequestData from a byte slice.
@@ -41,13 +92,70 @@ func (r *RateLimitRequestData) Unmarshal(data []byte) error {
 	r.Burst = binary.BigEndian.Uint64(data[8:])
 	r.Period = time.Duration(binary.BigEndian.Uint64(data[16:]))
 	keyLen := binary.BigEndian.Uint32(data[24:])
-	if len(data) < int(rateLimitReqHeaderSize+keyLen) {
-		return fmt.Errorf("data length mismatch: expected %d, got %d", rateLimitReqHeaderSize+keyLen, len(data))
+	// compared in 64 bits, the sum of the header size and a length close to
+	// the uint32 limit would wrap around
+	if uint64(keyLen) > uint64(len(data)-rateLimitReqHeaderSize) {
+		return fmt.Errorf("data length mismatch: expected %d, got %d", uint64(rateLimitReqHeaderSize)+uint64(keyLen), len(data))
+	}
+	keyEnd := rateLimitReqHeaderSize + int(keyLen)
+	r.Key = decodeKey(r.Key, data[rateLimitReqHeaderSize:keyEnd])
+	rest := data[keyEnd:]
+	if len(rest) >= rateLimitReqCostSize {
+		r.Cost = binary.BigEndian.Uint64(rest)
+		r.Trace = decodeTrace(rest[rateLimitReqCostSize:])
+	} else {
+		r.Cost = 0
+		r.Trace = TraceContext{}
+	}
+	r.Algorithm = AlgorithmGCRA
+	if len(rest) > rateLimitReqAlgorithmOffset {
+		r.Algorithm = Algorithm(rest[rateLimitReqAlgorithmOffset])
 	}
-	if keyLen > 0 {
-		r.Key = string(data[rateLimitReqHeaderSize : rateLimitReqHeaderSize+keyLen])
+	if len(rest) > rateLimitReqAlgorithmOffset+1 {
+		var err error
+		if r.Calendar, r.TimeZone, err = decodeCalendar(rest[rateLimitReqAlgorithmOffset+1:], r.TimeZone); err != nil {
+			return err
+		}
 	} else {
-		r.Key = ""
+		r.Calendar, r.TimeZone = CalendarNone, ""
+	}
+	return nil
+}
+
+// GetCost returns the number of tokens to take, at least one.
+func (r *RateLimitRequestData) GetCost() uint64 {
+	if r.Cost == 0 {
+		return 1
+	}
+	return r.Cost
+}
+
+// Limit returns the most tokens the key may have, the burst with GCRA and
+// the rate with the window algorithms.
+func (r *RateLimitRequestData) Limit() uint64 {
+	if r.Algorithm == AlgorithmGCRA {
+		return r.Burst
+	}
+	return r.Rate
+}
+
+// Validate checks that the limit can be enforced. The window algorithms do
+// not use the burst, nor calendar windows the period.
+func (r *RateLimitRequestData) Validate() error {
+	if !r.Algorithm.IsValid() {
+		return fmt.Errorf("unknown algorithm: %s", r.Algorithm)
+	}
+	if err := validateCalendar(r.Algorithm, r.Calendar, r.TimeZone); err != nil {
+		return err
+	}
+	if r.Rate == 0 {
+		return fmt.Errorf("rate must be positive")
+	}
+	if r.Burst == 0 && r.Algorithm == AlgorithmGCRA {
+		return fmt.Errorf("burst must be positive")
+	}
+	if r.Period <= 0 && r.Calendar == CalendarNone {
+		return fmt.Errorf("period must be positive")
 	}
 	return nil
 }
@@ -61,12 +169,15 @@ type RateLimitResponseData struct {
 
 // Marshall encodes RateLimitResponseData into a byte slice.
 func (r *RateLimitResponseData) Marshall() []byte {
-	data := make([]byte, rateLimitRespSize)
-	binary.BigEndian.PutUint64(data[0:], uint64(r.Allowed))
-	binary.BigEndian.PutUint64(data[8:], uint64(r.Remaining))
-	binary.BigEndian.PutUint64(data[16:], uint64(r.RetryAfter))
-	binary.BigEndian.PutUint64(data[24:], uint64(r.ResetAfter))
-	return data
+	return r.Append(make([]byte, 0, rateLimitRespSize))
+}
+
+// Append appends the encoding of RateLimitResponseData to dst.
+func (r *RateLimitResponseData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.Allowed))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.Remaining))
+	dst = binary.BigEndian.AppendUint64(dst, uint64(r.RetryAfter))
+	return binary.BigEndian.AppendUint64(dst, uint64(r.ResetAfter))
 }
 
 // Unmarshal decodes RateLimitResponseData from a byte slice.
@@ -80,3 +191,198 @@ func (r *RateLimitResponseData) Unmarshal(data []byte) error {
 	r.ResetAfter = time.Duration(binary.BigEndian.Uint64(data[24:]))
 	return nil
 }
+
+// MaxBatchSize is the maximum number of entries of a batch frame.
+const MaxBatchSize = 256
+
+// RateLimitBatchRequestData carries several rate limit decisions in one frame.
+type RateLimitBatchRequestData struct {
+	Entries []*RateLimitRequestData
+}
+
+// SetLen resizes the entries to n, reusing the entries of an earlier batch.
+// Reused entries keep their values until set.
+func (r *RateLimitBatchRequestData) SetLen(n int) []*RateLimitRequestData {
+	if cap(r.Entries) < n {
+		r.Entries = append(r.Entries[:cap(r.Entries)], make([]*RateLimitRequestData, n-cap(r.Entries))...)
+	}
+	r.Entries = r.Entries[:n]
+	for i, value := range r.Entries {
+		if value == nil {
+			r.Entries[i] = new(RateLimitRequestData)
+		}
+	}
+	return r.Entries
+}
+
+// Marshall encodes RateLimitBatchRequestData into a byte slice.
+func (r *RateLimitBatchRequestData) Marshall() []byte {
+	return r.Append(make([]byte, 0, 4+len(r.Entries)*(4+rateLimitReqHeaderSize+rateLimitReqCostSize)))
+}
+
+// Append appends the encoding of RateLimitBatchRequestData to dst, a count
+// followed by the length-prefixed entries.
+func (r *RateLimitBatchRequestData) Append(dst []byte) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Entries)))
+	for _, entry := range r.Entries {
+		dst = binary.BigEndian.AppendUint32(dst, uint32(entry.size()))
+		dst = entry.Append(dst)
+	}
+	return dst
+}
+
+// Unmarshal decodes RateLimitBatchRequestData from a byte slice, reusing the
+// entries of an earlier batch.
+func (r *RateLimitBatchRequestData) Unmarshal(data []byte) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short: got %d bytes, expected at least 4", len(data))
+	}
+	count := binary.BigEndian.Uint32(data)
+	if count > MaxBatchSize {
+		return fmt.Errorf("batch too large: got %d entries, expected at most %d", count, MaxBatchSize)
+	}
+	data = data[4:]
+	for i, entry := range r.SetLen(int(count)) {
+		if len(data) < 4 {
+			return fmt.Errorf("entry %d: data too short", i)
+		}
+		entryLen := binary.BigEndian.Uint32(data)
+		data = data[4:]
+		if uint64(entryLen) > uint64(len(data)) {
+			return fmt.Errorf("entry %d: length mismatch: expected %d, got %d", i, entryLen, len(data))
+		}
+		if err := entry.Unmarshal(data[:entryLen]); err != nil {
+			return fmt.Errorf("entry %d: %w", i, err)
+		}
+		data = data[entryLen:]
+	}
+	return nil
+}
+
+// Validate checks that the batch fits in a frame.
+func (r *RateLimitBatchRequestData) Validate() error {
+	if len(r.Entries) == 0 {
+		return fmt.Errorf("batch is empty")
+	}
+	if len(r.Entries) > MaxBatchSize {
+		return fmt.Errorf("batch too large: got %d entries, expected at most %d", len(r.Entries), MaxBatchSize)
+	}
+	return nil
+}
+
+// RateLimitBatchResult is the outcome of one entry of a batch. Data is set
+// when the status is OK, Code and Error otherwise.
+type RateLimitBatchResult struct {
+	Status ResponseStatus
+	Data   RateLimitResponseData
+	Code   ErrorCode
+	Error  string
+}
+
+// RateLimitBatchResponseData carries the results of a batch, in the order of its entries.
+type RateLimitBatchResponseData struct {
+	Results []*RateLimitBatchResult
+}
+
+// SetLen resizes the results to n, reusing the results of an earlier batch.
+// Reused results keep their values until set.
+func (r *RateLimitBatchResponseData) SetLen(n int) []*RateLimitBatchResult {
+	if cap(r.Results) < n {
+		r.Results = append(r.Results[:cap(r.Results)], make([]*RateLimitBatchResult, n-cap(r.Results))...)
+	}
+	r.Results = r.Results[:n]
+	for i, value := range r.Results {
+		if value == nil {
+			r.Results[i] = new(RateLimitBatchResult)
+		}
+	}
+	return r.Results
+}
+
+// Marshall encodes RateLimitBatchResponseData into a byte slice for the
+// newest protocol version.
+func (r *RateLimitBatchResponseData) Marshall() []byte {
+	return r.MarshallVersion(VERSION)
+}
+
+// MarshallVersion encodes RateLimitBatchResponseData into a byte slice.
+func (r *RateLimitBatchResponseData) MarshallVersion(version uint32) []byte {
+	return r.AppendVersion(make([]byte, 0, 4+len(r.Results)*(1+rateLimitRespSize)), version)
+}
+
+// AppendVersion appends the encoding of RateLimitBatchResponseData to dst.
+// Each result is a status byte followed by the response data or a
+// length-prefixed error, preceded by its error code since version 3.
+func (r *RateLimitBatchResponseData) AppendVersion(dst []byte, version uint32) []byte {
+	dst = binary.BigEndian.AppendUint32(dst, uint32(len(r.Results)))
+	for _, result := range r.Results {
+		if result.Status == ResponseStatusOK {
+			dst = append(dst, byte(ResponseStatusOK))
+			dst = result.Data.Append(dst)
+			continue
+		}
+		dst = append(dst, byte(ResponseStatusError))
+		if version >= errorCodeVersion {
+			dst = append(dst, byte(result.Code))
+		}
+		dst = binary.BigEndian.AppendUint32(dst, uint32(len(result.Error)))
+		dst = append(dst, result.Error...)
+	}
+	return dst
+}
+
+// Unmarshal decodes RateLimitBatchResponseData from a byte slice of the
+// newest protocol version.
+func (r *RateLimitBatchResponseData) Unmarshal(data []byte) error {
+	return r.UnmarshalVersion(data, VERSION)
+}
+
+// UnmarshalVersion decodes RateLimitBatchResponseData from a byte slice of
+// the given protocol version, reusing the results of an earlier batch.
+func (r *RateLimitBatchResponseData) UnmarshalVersion(data []byte, version uint32) error {
+	if len(data) < 4 {
+		return fmt.Errorf("data too short: got %d bytes, expected at least 4", len(data))
+	}
+	count := binary.BigEndian.Uint32(data)
+	if count > MaxBatchSize {
+		return fmt.Errorf("batch too large: got %d results, expected at most %d", count, MaxBatchSize)
+	}
+	data = data[4:]
+	for i, result := range r.SetLen(int(count)) {
+		if len(data) < 1 {
+			return fmt.Errorf("result %d: data too short", i)
+		}
+		*result = RateLimitBatchResult{}
+		switch data[0] {
+		case byte(ResponseStatusOK):
+			result.Status = ResponseStatusOK
+			if err := result.Data.Unmarshal(data[1:]); err != nil {
+				return fmt.Errorf("result %d: %w", i, err)
+			}
+			data = data[1+rateLimitRespSize:]
+		case byte(ResponseStatusError):
+			result.Status = ResponseStatusError
+			data = data[1:]
+			if version >= errorCodeVersion {
+				if len(data) < 1 {
+					return fmt.Errorf("result %d: data too short", i)
+				}
+				result.Code = ErrorCode(data[0])
+				data = data[1:]
+			}
+			if len(data) < 4 {
+				return fmt.Errorf("result %d: data too short", i)
+			}
+			errLen := binary.BigEndian.Uint32(data)
+			data = data[4:]
+			if uint64(errLen) > uint64(len(data)) {
+				return fmt.Errorf("result %d: length mismatch: expected %d, got %d", i, errLen, len(data))
+			}
+			result.Error = string(data[:errLen])
+			data = data[errLen:]
+		default:
+			return fmt.Errorf("result %d: unknown status byte: %d", i, data[0])
+		}
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package comm
 
 import (
+	"encoding/binary"
 	"reflect"
 	"testing"
 	"time"
@@ -51,8 +52,8 @@ func TestRateLimitRequestData(t *testing.T) {
 
 func TestRateLimitResponseData(t *testing.T) {
 	type fields struct {
-		Allowed    uint64
-		Remaining  uint64
+		Allowed    int64
+		Remaining  int64
 		RetryAfter time.Duration
 		ResetAfter time.Duration
 	}
@@ -91,3 +92,130 @@ func TestRateLimitResponseData(t *testing.T) {
 		})
 	}
 }
+
+func TestRateLimitBatchRequestData(t *testing.T) {
+	tests := []struct {
+		name    string
+		entries []*RateLimitRequestData
+	}{
+		{
+			name: "TestRateLimitBatchRequestData",
+			entries: []*RateLimitRequestData{
+				{Rate: 100, Burst: 100, Period: time.Hour, Key: "traefik:default:203.0.113.7"},
+				{Rate: 10, Burst: 20, Period: time.Minute, Key: "traefik:default:user-1", Cost: 3},
+				{Rate: 1, Burst: 1, Period: time.Second, Key: ""},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RateLimitBatchRequestData{Entries: tt.entries}
+			marshalled := r.Marshall()
+			unmarshalled := &RateLimitBatchRequestData{}
+			err := unmarshalled.Unmarshal(marshalled)
+			if err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			if !reflect.DeepEqual(unmarshalled, r) {
+				t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+			}
+		})
+	}
+}
+
+func TestRateLimitRequestDataKeyLengthOverflow(t *testing.T) {
+	data := (&RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second}).Marshall()
+	// with the header size, the key length wraps around to a length shorter than the data
+	binary.BigEndian.PutUint32(data[24:], 0xfffffff0)
+	if err := (&RateLimitRequestData{}).Unmarshal(data); err == nil {
+		t.Errorf("expected an error for key length %d", uint32(0xfffffff0))
+	}
+}
+
+func TestRateLimitRequestDataCalendar(t *testing.T) {
+	r := &RateLimitRequestData{Rate: 10, Key: "testing", Cost: 1, Algorithm: AlgorithmFixedWindow, Calendar: CalendarMonth, TimeZone: "Europe/Istanbul"}
+	if err := r.Validate(); err != nil {
+		t.Errorf("expected a calendar window without a period to be valid, got %v", err)
+	}
+	unmarshalled := &RateLimitRequestData{}
+	if err := unmarshalled.Unmarshal(r.Marshall()); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if !reflect.DeepEqual(unmarshalled, r) {
+		t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+	}
+	// a request without a calendar clears the one decoded before
+	if err := unmarshalled.Unmarshal((&RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second}).Marshall()); err != nil {
+		t.Fatalf("failed to unmarshal: %v", err)
+	}
+	if unmarshalled.Calendar != CalendarNone || unmarshalled.TimeZone != "" {
+		t.Errorf("expected no calendar, got %s in %q", unmarshalled.Calendar, unmarshalled.TimeZone)
+	}
+
+	invalid := map[string]*RateLimitRequestData{
+		"calendar under GCRA":        {Rate: 1, Burst: 1, Period: time.Second, Key: "testing", Calendar: CalendarDay},
+		"time zone without calendar": {Rate: 1, Period: time.Second, Key: "testing", Algorithm: AlgorithmFixedWindow, TimeZone: "UTC"},
+		"unknown calendar":           {Rate: 1, Key: "testing", Algorithm: AlgorithmFixedWindow, Calendar: CalendarMonth + 1},
+		"period without calendar":    {Rate: 1, Key: "testing", Algorithm: AlgorithmFixedWindow},
+	}
+	for name, r := range invalid {
+		if err := r.Validate(); err == nil {
+			t.Errorf("%s: expected an error", name)
+		}
+	}
+}
+
+func TestRateLimitBatchRequestDataTooLarge(t *testing.T) {
+	r := &RateLimitBatchRequestData{}
+	for i := 0; i <= MaxBatchSize; i++ {
+		r.Entries = append(r.Entries, &RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: "testing"})
+	}
+	if err := r.Validate(); err == nil {
+		t.Errorf("expected an error for %d entries", len(r.Entries))
+	}
+	if err := (&RateLimitBatchRequestData{}).Unmarshal(r.Marshall()); err == nil {
+		t.Errorf("expected an error unmarshalling %d entries", len(r.Entries))
+	}
+}
+
+func TestRateLimitBatchResponseData(t *testing.T) {
+	tests := []struct {
+		name    string
+		results []*RateLimitBatchResult
+	}{
+		{
+			name: "TestRateLimitBatchResponseData",
+			results: []*RateLimitBatchResult{
+				{
+					Status: ResponseStatusOK,
+					Data:   RateLimitResponseData{Allowed: 1, Remaining: 99, RetryAfter: -1, ResetAfter: time.Minute},
+				},
+				{
+					Status: ResponseStatusError,
+					Code:   ErrorCodeTimeout,
+					Error:  "rate limit failed: context deadline exceeded",
+				},
+				{
+					Status: ResponseStatusOK,
+					Data:   RateLimitResponseData{Allowed: 0, Remaining: 0, RetryAfter: time.Second, ResetAfter: time.Hour},
+				},
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &RateLimitBatchResponseData{Results: tt.results}
+			marshalled := r.Marshall()
+			unmarshalled := &RateLimitBatchResponseData{}
+			err := unmarshalled.Unmarshal(marshalled)
+			if err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			if !reflect.DeepEqual(unmarshalled, r) {
+				t.Errorf("Expected %v \nWanted %v", unmarshalled, r)
+			}
+		})
+	}
+}
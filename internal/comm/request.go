@@ -1,17 +1,40 @@
 package comm
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"sync"
 )
 
+// Request is a frame sent by clients. The data of its type is in the field
+// named after it, the fields of other types are ignored. Decoding into a
+// reused Request reuses the memory of the earlier requests.
 type Request struct {
-	*Header
+	Header
 	Type RequestType
-	Data any
+
+	// Ping is the data of RequestTypePing.
+	Ping string
+	// RateLimit is the data of RequestTypeRateLimit and RequestTypePeek.
+	RateLimit RateLimitRequestData
+	Batch     RateLimitBatchRequestData
+	Hello     HelloData
+	// Auth is the data of RequestTypeAuthChallenge and RequestTypeAuth.
+	Auth AuthData
+	// Key is the data of RequestTypeReset.
+	Key             KeyData
+	ListKeys        ListKeysRequestData
+	Policy          PolicyData
+	PolicyRateLimit PolicyRateLimitRequestData
+	PolicyBatch     PolicyBatchRequestData
+	Subscribe       SubscribeData
+	AcquireLease    AcquireLeaseRequestData
+	// Lease is the data of RequestTypeReleaseLease.
+	Lease LeaseData
+	// Unknown is the payload of request types this package does not know. It
+	// points into the decoded data.
+	Unknown []byte
 }
 
 type RequestType uint8
@@ -20,69 +43,271 @@ const (
 	RequestTypeUnknown RequestType = iota
 	RequestTypePing
 	RequestTypeRateLimit
+	RequestTypeRateLimitBatch
+	RequestTypeHello
+	RequestTypeAuthChallenge
+	RequestTypeAuth
+	// RequestTypePeek returns the state of a key without taking tokens.
+	RequestTypePeek
+	RequestTypeReset
+	RequestTypeListKeys
+	RequestTypeRegisterPolicy
+	// RequestTypeRateLimitPolicy and RequestTypeRateLimitPolicyBatch are rate
+	// limit decisions under policies registered on the connection.
+	RequestTypeRateLimitPolicy
+	RequestTypeRateLimitPolicyBatch
+	// RequestTypeGoAway is only sent by the server, unsolicited with request ID
+	// GoAwayRequestID. The client must stop sending new requests on the
+	// connection and close it once its pending requests are answered.
+	RequestTypeGoAway
+	// RequestTypeSubscribe sets the events the server pushes on the connection.
+	RequestTypeSubscribe
+	// RequestTypeEvent is only sent by the server, unsolicited with request ID
+	// PushRequestID, to connections subscribed to the type of its event.
+	RequestTypeEvent
+	// RequestTypeAcquireLease and RequestTypeReleaseLease take and give back
+	// the concurrent slots of keys.
+	RequestTypeAcquireLease
+	RequestTypeReleaseLease
 )
 
+var requestTypeNames = [...]string{
+	RequestTypeUnknown:              "Unknown",
+	RequestTypePing:                 "Ping",
+	RequestTypeRateLimit:            "RateLimit",
+	RequestTypeRateLimitBatch:       "RateLimitBatch",
+	RequestTypeHello:                "Hello",
+	RequestTypeAuthChallenge:        "AuthChallenge",
+	RequestTypeAuth:                 "Auth",
+	RequestTypePeek:                 "Peek",
+	RequestTypeReset:                "Reset",
+	RequestTypeListKeys:             "ListKeys",
+	RequestTypeRegisterPolicy:       "RegisterPolicy",
+	RequestTypeRateLimitPolicy:      "RateLimitPolicy",
+	RequestTypeRateLimitPolicyBatch: "RateLimitPolicyBatch",
+	RequestTypeGoAway:               "GoAway",
+	RequestTypeSubscribe:            "Subscribe",
+	RequestTypeEvent:                "Event",
+	RequestTypeAcquireLease:         "AcquireLease",
+	RequestTypeReleaseLease:         "ReleaseLease",
+}
+
+// String returns the name of the request type, as in docs/PROTOCOL.md.
+func (t RequestType) String() string {
+	if int(t) < len(requestTypeNames) {
+		return requestTypeNames[t]
+	}
+	return fmt.Sprintf("RequestType(%d)", uint8(t))
+}
+
+// Features returns the optional features the request uses, that the peers
+// must have agreed on in the handshake for it to be sent.
+func (r *Request) Features() Feature {
+	switch r.Type {
+	case RequestTypeRateLimit:
+		return r.RateLimit.Algorithm.feature()
+	case RequestTypeRateLimitBatch:
+		features := FeatureBatch
+		for _, entry := range r.Batch.Entries {
+			features |= entry.Algorithm.feature()
+		}
+		return features
+	case RequestTypePeek:
+		return FeaturePeek | r.RateLimit.Algorithm.feature()
+	case RequestTypeReset, RequestTypeListKeys:
+		return FeaturePeek
+	case RequestTypeRegisterPolicy:
+		features := FeaturePolicies | r.Policy.Algorithm.feature()
+		if r.Policy.IsNamed() {
+			features |= FeatureNamedPolicies
+		}
+		return features
+	case RequestTypeRateLimitPolicy:
+		return FeaturePolicies
+	case RequestTypeRateLimitPolicyBatch:
+		return FeaturePolicies | FeatureBatch
+	case RequestTypeSubscribe:
+		return FeatureEvents
+	case RequestTypeAcquireLease, RequestTypeReleaseLease:
+		return FeatureLeases
+	default:
+		return 0
+	}
+}
+
+// PushRequestID is the request ID of the frames the server sends unsolicited,
+// never used by clients.
+const PushRequestID = 0
+
+// GoAwayRequestID is the request ID of RequestTypeGoAway frames.
+const GoAwayRequestID = PushRequestID
+
 func (r *Request) GetPingData() string {
 	if r.Type != RequestTypePing {
 		panic("not a ping request")
 	}
-	return r.Data.(string)
+	return r.Ping
 }
 
 func (r *Request) GetRateLimitData() *RateLimitRequestData {
 	if r.Type != RequestTypeRateLimit {
 		panic("not a rate limit request")
 	}
-	return r.Data.(*RateLimitRequestData)
+	return &r.RateLimit
+}
+
+func (r *Request) GetHelloData() *HelloData {
+	if r.Type != RequestTypeHello {
+		panic("not a hello request")
+	}
+	return &r.Hello
+}
+
+func (r *Request) GetAuthData() *AuthData {
+	if r.Type != RequestTypeAuthChallenge && r.Type != RequestTypeAuth {
+		panic("not an auth request")
+	}
+	return &r.Auth
+}
+
+func (r *Request) GetRateLimitBatchData() *RateLimitBatchRequestData {
+	if r.Type != RequestTypeRateLimitBatch {
+		panic("not a rate limit batch request")
+	}
+	return &r.Batch
+}
+
+func (r *Request) GetPeekData() *RateLimitRequestData {
+	if r.Type != RequestTypePeek {
+		panic("not a peek request")
+	}
+	return &r.RateLimit
+}
+
+func (r *Request) GetResetData() *KeyData {
+	if r.Type != RequestTypeReset {
+		panic("not a reset request")
+	}
+	return &r.Key
+}
+
+func (r *Request) GetListKeysData() *ListKeysRequestData {
+	if r.Type != RequestTypeListKeys {
+		panic("not a list keys request")
+	}
+	return &r.ListKeys
+}
+
+func (r *Request) GetPolicyData() *PolicyData {
+	if r.Type != RequestTypeRegisterPolicy {
+		panic("not a register policy request")
+	}
+	return &r.Policy
+}
+
+func (r *Request) GetPolicyRateLimitData() *PolicyRateLimitRequestData {
+	if r.Type != RequestTypeRateLimitPolicy {
+		panic("not a policy rate limit request")
+	}
+	return &r.PolicyRateLimit
+}
+
+func (r *Request) GetPolicyBatchData() *PolicyBatchRequestData {
+	if r.Type != RequestTypeRateLimitPolicyBatch {
+		panic("not a policy rate limit batch request")
+	}
+	return &r.PolicyBatch
+}
+
+func (r *Request) GetSubscribeData() *SubscribeData {
+	if r.Type != RequestTypeSubscribe {
+		panic("not a subscribe request")
+	}
+	return &r.Subscribe
+}
+
+func (r *Request) GetAcquireLeaseData() *AcquireLeaseRequestData {
+	if r.Type != RequestTypeAcquireLease {
+		panic("not an acquire lease request")
+	}
+	return &r.AcquireLease
 }
 
-// buffer pool for marshaling request data part
-var requestDataPool = sync.Pool{
+func (r *Request) GetReleaseLeaseData() *LeaseData {
+	if r.Type != RequestTypeReleaseLease {
+		panic("not a release lease request")
+	}
+	return &r.Lease
+}
+
+// framePool holds the buffers frames are encoded into before being written.
+var framePool = sync.Pool{
 	New: func() interface{} {
-		return new(bytes.Buffer)
+		buf := make([]byte, 0, 512)
+		return &buf
 	},
 }
 
 // Marshal encodes the request into the writer.
 func (r *Request) Marshal(w io.Writer) error {
-	payloadBuf := requestDataPool.Get().(*bytes.Buffer)
-	payloadBuf.Reset()
-	defer requestDataPool.Put(payloadBuf)
+	buf := framePool.Get().(*[]byte)
+	defer framePool.Put(buf)
+	frame, err := r.Append((*buf)[:0])
+	*buf = frame
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write request: %w", err)
+	}
+	return nil
+}
 
+// Append appends the frame of the request to dst.
+func (r *Request) Append(dst []byte) ([]byte, error) {
+	version := r.Header.version()
+	start := len(dst)
+	dst = r.Header.Append(dst, version, 0)
+	payloadStart := len(dst)
+	dst = append(dst, byte(r.Type))
 	switch r.Type {
 	case RequestTypePing:
-		payloadBuf.WriteByte(byte(RequestTypePing))
-		if r.Data != nil {
-			switch v := r.Data.(type) {
-			case string:
-				payloadBuf.WriteString(v)
-			case []byte:
-				payloadBuf.Write(v)
-			default:
-				return fmt.Errorf("unsupported data type %T for request type %d", v, r.Type)
-			}
+		dst = append(dst, r.Ping...)
+	case RequestTypeRateLimit, RequestTypePeek:
+		dst = r.RateLimit.Append(dst)
+	case RequestTypeRateLimitBatch:
+		if err := r.Batch.Validate(); err != nil {
+			return dst[:start], err
 		}
-	case RequestTypeRateLimit:
-		payloadBuf.WriteByte(byte(RequestTypeRateLimit))
-		if r.Data != nil {
-			payloadBuf.Write(r.Data.(*RateLimitRequestData).Marshall())
+		dst = r.Batch.Append(dst)
+	case RequestTypeHello:
+		dst = r.Hello.Append(dst)
+	case RequestTypeAuthChallenge, RequestTypeAuth:
+		dst = r.Auth.Append(dst)
+	case RequestTypeReset:
+		dst = r.Key.Append(dst)
+	case RequestTypeListKeys:
+		dst = r.ListKeys.Append(dst)
+	case RequestTypeRegisterPolicy:
+		dst = r.Policy.Append(dst)
+	case RequestTypeRateLimitPolicy:
+		dst = r.PolicyRateLimit.Append(dst)
+	case RequestTypeRateLimitPolicyBatch:
+		if err := r.PolicyBatch.Validate(); err != nil {
+			return dst[:start], err
 		}
+		dst = r.PolicyBatch.Append(dst)
+	case RequestTypeSubscribe:
+		dst = r.Subscribe.Append(dst)
+	case RequestTypeAcquireLease:
+		dst = r.AcquireLease.Append(dst)
+	case RequestTypeReleaseLease:
+		dst = r.Lease.Append(dst)
 	default:
-		return fmt.Errorf("unknown request type: %d", r.Type)
+		return dst[:start], fmt.Errorf("unknown request type: %d", r.Type)
 	}
-
-	headerBytes := make([]byte, 12)
-	binary.BigEndian.PutUint32(headerBytes, r.Header.RequestID)
-	binary.BigEndian.PutUint32(headerBytes[4:], VERSION)
-	binary.BigEndian.PutUint32(headerBytes[8:], uint32(payloadBuf.Len()))
-
-	if _, err := w.Write(headerBytes); err != nil {
-		return fmt.Errorf("failed to write request header: %w", err)
-	}
-	if _, err := io.Copy(w, payloadBuf); err != nil {
-		return fmt.Errorf("failed to write request payload: %w", err)
-	}
-	return nil
+	binary.BigEndian.PutUint32(dst[start+8:], uint32(len(dst)-payloadStart))
+	return dst, nil
 }
 
 // Unmarshal decodes the request from header and data.
@@ -90,20 +315,68 @@ func (r *Request) Unmarshal(header *Header, data []byte) error {
 	if len(data) < 1 {
 		return fmt.Errorf("request data too short: got %d bytes, expected at least 1", len(data))
 	}
-	r.Header = header
-	switch data[0] {
-	case byte(RequestTypePing):
-		r.Type = RequestTypePing
-		r.Data = string(data[1:])
-	case byte(RequestTypeRateLimit):
-		r.Type = RequestTypeRateLimit
-		r.Data = &RateLimitRequestData{}
-		if err := r.Data.(*RateLimitRequestData).Unmarshal(data[1:]); err != nil {
-			return fmt.Errorf("failed to unmarshal rate limit data: %w", err)
+	r.Header = *header
+	r.Type = RequestType(data[0])
+	data = data[1:]
+	var err error
+	switch r.Type {
+	case RequestTypePing:
+		r.Ping = decodeKey(r.Ping, data)
+	case RequestTypeRateLimit:
+		if err = r.RateLimit.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal rate limit data: %w", err)
+		}
+	case RequestTypeRateLimitBatch:
+		if err = r.Batch.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal rate limit batch data: %w", err)
+		}
+	case RequestTypeHello:
+		if err = r.Hello.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal hello data: %w", err)
+		}
+	case RequestTypeAuthChallenge, RequestTypeAuth:
+		if err = r.Auth.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal auth data: %w", err)
+		}
+	case RequestTypePeek:
+		if err = r.RateLimit.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal peek data: %w", err)
+		}
+	case RequestTypeReset:
+		if err = r.Key.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal reset data: %w", err)
+		}
+	case RequestTypeListKeys:
+		if err = r.ListKeys.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal list keys data: %w", err)
+		}
+	case RequestTypeRegisterPolicy:
+		if err = r.Policy.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal policy data: %w", err)
+		}
+	case RequestTypeRateLimitPolicy:
+		if err = r.PolicyRateLimit.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal policy rate limit data: %w", err)
+		}
+	case RequestTypeRateLimitPolicyBatch:
+		if err = r.PolicyBatch.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal policy rate limit batch data: %w", err)
+		}
+	case RequestTypeSubscribe:
+		if err = r.Subscribe.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal subscribe data: %w", err)
+		}
+	case RequestTypeAcquireLease:
+		if err = r.AcquireLease.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal acquire lease data: %w", err)
+		}
+	case RequestTypeReleaseLease:
+		if err = r.Lease.Unmarshal(data); err != nil {
+			err = fmt.Errorf("failed to unmarshal release lease data: %w", err)
 		}
 	default:
 		r.Type = RequestTypeUnknown
-		r.Data = data[1:]
+		r.Unknown = data
 	}
-	return nil
+	return err
 }
@@ -1,19 +1,41 @@
 package comm
 
 import (
-	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
-	"sync"
 )
 
+// Response is a frame sent by the server. Like in Request, the data of its
+// type is in the field named after it, and decoding into a reused Response
+// reuses the memory of the earlier responses.
 type Response struct {
-	*Header
+	Header
 	Status ResponseStatus
 	Type   RequestType
-	Data   any
-	Error  string
+
+	// Message is the data of RequestTypePing and RequestTypeGoAway.
+	Message string
+	// RateLimit is the data of RequestTypeRateLimit, RequestTypePeek and
+	// RequestTypeRateLimitPolicy.
+	RateLimit RateLimitResponseData
+	// Batch is the data of RequestTypeRateLimitBatch and
+	// RequestTypeRateLimitPolicyBatch.
+	Batch RateLimitBatchResponseData
+	Hello HelloData
+	// Auth is the data of RequestTypeAuthChallenge.
+	Auth     AuthData
+	ListKeys ListKeysResponseData
+	Event    EventData
+	// Lease is the data of RequestTypeAcquireLease.
+	Lease LeaseData
+	// Unknown is the data of response types this package does not know. It
+	// points into the decoded data.
+	Unknown []byte
+
+	// Code classifies Error. It is only carried from version 3 on.
+	Code  ErrorCode
+	Error string
 }
 
 type ResponseStatus uint8
@@ -24,65 +46,74 @@ const (
 	ResponseStatusError
 )
 
-// buffer pool for marshaling response data part
-var responseDataPool = sync.Pool{
-	New: func() interface{} {
-		return new(bytes.Buffer)
-	},
+// Reset prepares the response to answer a request of reqType with header,
+// keeping the memory of the data of earlier responses. The deadline of the
+// request is not sent back.
+func (r *Response) Reset(header *Header, reqType RequestType) {
+	r.Header = Header{RequestID: header.RequestID, Version: header.Version}
+	r.Type = reqType
+	r.Status = ResponseStatusOK
+	r.Code = ErrorCodeUnknown
+	r.Error = ""
 }
 
 // Marshal encodes the response into the writer.
 func (r *Response) Marshal(w io.Writer) error {
-	payloadBuf := responseDataPool.Get().(*bytes.Buffer)
-	payloadBuf.Reset()
-	defer responseDataPool.Put(payloadBuf)
+	buf := framePool.Get().(*[]byte)
+	defer framePool.Put(buf)
+	frame, err := r.Append((*buf)[:0])
+	*buf = frame
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(frame); err != nil {
+		return fmt.Errorf("failed to write response: %w", err)
+	}
+	return nil
+}
 
-	payloadBuf.WriteByte(byte(r.Type))
+// Append appends the frame of the response to dst.
+func (r *Response) Append(dst []byte) ([]byte, error) {
+	version := r.Header.version()
+	start := len(dst)
+	dst = r.Header.Append(dst, version, 0)
+	payloadStart := len(dst)
+	dst = append(dst, byte(r.Type))
 	switch r.Status {
 	case ResponseStatusOK:
-		payloadBuf.WriteByte(byte(ResponseStatusOK))
-		if r.Data != nil {
-			switch r.Type {
-			case RequestTypePing:
-				switch v := r.Data.(type) {
-				case string:
-					payloadBuf.WriteString(v)
-				case []byte:
-					payloadBuf.Write(v)
-				default:
-					return fmt.Errorf("unsupported data type %T for response type %d", v, r.Type)
-				}
-			case RequestTypeRateLimit:
-				data, ok := r.Data.(*RateLimitResponseData)
-				if !ok {
-					return fmt.Errorf("unsupported data type %T for response type %d", r.Data, r.Type)
-				}
-				payloadBuf.Write(data.Marshall())
-			default:
-				return fmt.Errorf("unsupported response type for data: %d", r.Type)
-			}
+		dst = append(dst, byte(ResponseStatusOK))
+		switch r.Type {
+		case RequestTypePing, RequestTypeGoAway:
+			dst = append(dst, r.Message...)
+		case RequestTypeRateLimit, RequestTypePeek, RequestTypeRateLimitPolicy:
+			dst = r.RateLimit.Append(dst)
+		case RequestTypeRateLimitBatch, RequestTypeRateLimitPolicyBatch:
+			dst = r.Batch.AppendVersion(dst, version)
+		case RequestTypeHello:
+			dst = r.Hello.Append(dst)
+		case RequestTypeAuthChallenge:
+			dst = r.Auth.Append(dst)
+		case RequestTypeListKeys:
+			dst = r.ListKeys.Append(dst)
+		case RequestTypeEvent:
+			dst = r.Event.Append(dst)
+		case RequestTypeAcquireLease:
+			dst = r.Lease.Append(dst)
+		case RequestTypeAuth, RequestTypeReset, RequestTypeRegisterPolicy, RequestTypeSubscribe, RequestTypeReleaseLease:
+		default:
+			return dst[:start], fmt.Errorf("unsupported response type for data: %d", r.Type)
 		}
 	case ResponseStatusError:
-		payloadBuf.WriteByte(byte(ResponseStatusError))
-		if r.Error != "" {
-			payloadBuf.WriteString(r.Error)
+		dst = append(dst, byte(ResponseStatusError))
+		if version >= errorCodeVersion {
+			dst = append(dst, byte(r.Code))
 		}
+		dst = append(dst, r.Error...)
 	default:
-		return fmt.Errorf("unknown response status: %d", r.Status)
-	}
-
-	headerBytes := make([]byte, 12)
-	binary.BigEndian.PutUint32(headerBytes, r.Header.RequestID)
-	binary.BigEndian.PutUint32(headerBytes[4:], VERSION)
-	binary.BigEndian.PutUint32(headerBytes[8:], uint32(payloadBuf.Len()))
-
-	if _, err := w.Write(headerBytes); err != nil {
-		return fmt.Errorf("failed to write response header: %w", err)
-	}
-	if _, err := io.Copy(w, payloadBuf); err != nil {
-		return fmt.Errorf("failed to write response payload: %w", err)
+		return dst[:start], fmt.Errorf("unknown response status: %d", r.Status)
 	}
-	return nil
+	binary.BigEndian.PutUint32(dst[start+8:], uint32(len(dst)-payloadStart))
+	return dst, nil
 }
 
 // Unmarshal decodes the response from header and data.
@@ -90,33 +121,59 @@ func (r *Response) Unmarshal(header *Header, data []byte) error {
 	if len(data) < 2 {
 		return fmt.Errorf("response data too short: got %d bytes, expected at least 2", len(data))
 	}
-	r.Header = header
-	switch data[0] {
-	case byte(RequestTypePing):
-		r.Type = RequestTypePing
-	case byte(RequestTypeRateLimit):
-		r.Type = RequestTypeRateLimit
-	default:
+	r.Header = *header
+	r.Type = RequestType(data[0])
+	if r.Type > RequestTypeReleaseLease {
 		r.Type = RequestTypeUnknown
 	}
+	r.Code = ErrorCodeUnknown
+	r.Error = ""
+	payload := data[2:]
 	switch data[1] {
 	case byte(ResponseStatusOK):
 		r.Status = ResponseStatusOK
 		switch r.Type {
-		case RequestTypePing:
-			r.Data = string(data[2:])
-		case RequestTypeRateLimit:
-			dataObj := RateLimitResponseData{}
-			if err := dataObj.Unmarshal(data[2:]); err != nil {
+		case RequestTypePing, RequestTypeGoAway:
+			r.Message = decodeKey(r.Message, payload)
+		case RequestTypeRateLimit, RequestTypePeek, RequestTypeRateLimitPolicy:
+			if err := r.RateLimit.Unmarshal(payload); err != nil {
 				return fmt.Errorf("failed to unmarshal RateLimitResponseData: %w", err)
 			}
-			r.Data = &dataObj
+		case RequestTypeRateLimitBatch, RequestTypeRateLimitPolicyBatch:
+			if err := r.Batch.UnmarshalVersion(payload, header.version()); err != nil {
+				return fmt.Errorf("failed to unmarshal RateLimitBatchResponseData: %w", err)
+			}
+		case RequestTypeHello:
+			if err := r.Hello.Unmarshal(payload); err != nil {
+				return fmt.Errorf("failed to unmarshal HelloData: %w", err)
+			}
+		case RequestTypeAuthChallenge:
+			if err := r.Auth.Unmarshal(payload); err != nil {
+				return fmt.Errorf("failed to unmarshal AuthData: %w", err)
+			}
+		case RequestTypeListKeys:
+			if err := r.ListKeys.Unmarshal(payload); err != nil {
+				return fmt.Errorf("failed to unmarshal ListKeysResponseData: %w", err)
+			}
+		case RequestTypeEvent:
+			if err := r.Event.Unmarshal(payload); err != nil {
+				return fmt.Errorf("failed to unmarshal EventData: %w", err)
+			}
+		case RequestTypeAcquireLease:
+			if err := r.Lease.Unmarshal(payload); err != nil {
+				return fmt.Errorf("failed to unmarshal LeaseData: %w", err)
+			}
+		case RequestTypeAuth, RequestTypeReset, RequestTypeRegisterPolicy, RequestTypeSubscribe, RequestTypeReleaseLease:
 		default:
-			r.Data = data[2:]
+			r.Unknown = payload
 		}
 	case byte(ResponseStatusError):
 		r.Status = ResponseStatusError
-		r.Error = string(data[2:])
+		if header.version() >= errorCodeVersion && len(payload) > 0 {
+			r.Code = ErrorCode(payload[0])
+			payload = payload[1:]
+		}
+		r.Error = decodeKey(r.Error, payload)
 	default:
 		r.Status = ResponseStatusUnknown
 		return fmt.Errorf("unknown response status byte: %d", data[1])
@@ -0,0 +1,60 @@
+package comm
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestResponseErrorCode(t *testing.T) {
+	tests := []struct {
+		name     string
+		version  uint32
+		wantCode ErrorCode
+	}{
+		{
+			name:     "Version1",
+			version:  1,
+			wantCode: ErrorCodeUnknown,
+		},
+		{
+			name:     "Version2",
+			version:  2,
+			wantCode: ErrorCodeUnknown,
+		},
+		{
+			name:     "Version3",
+			version:  3,
+			wantCode: ErrorCodeBackendUnavailable,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := &Response{Header: Header{RequestID: 1, Version: tt.version}, Type: RequestTypeRateLimit}
+			r.SetError(ErrorCodeBackendUnavailable, "rate limit failed: connection refused")
+			buf := &bytes.Buffer{}
+			if err := r.Marshal(buf); err != nil {
+				t.Errorf("failed to marshal: %v", err)
+				return
+			}
+			header, err := ReadHeader(buf)
+			if err != nil {
+				t.Errorf("failed to read header: %v", err)
+				return
+			}
+			payload, err := io.ReadAll(buf)
+			if err != nil {
+				t.Errorf("failed to read payload: %v", err)
+				return
+			}
+			unmarshalled := &Response{}
+			if err := unmarshalled.Unmarshal(header, payload); err != nil {
+				t.Errorf("failed to unmarshal: %v", err)
+				return
+			}
+			if unmarshalled.Status != ResponseStatusError || unmarshalled.Code != tt.wantCode || unmarshalled.Error != r.Error {
+				t.Errorf("Expected %d %d %q \nWanted %d %d %q", unmarshalled.Status, unmarshalled.Code, unmarshalled.Error, ResponseStatusError, tt.wantCode, r.Error)
+			}
+		})
+	}
+}
@@ -0,0 +1,101 @@
+package comm
+
+import (
+	"encoding/hex"
+	"fmt"
+)
+
+// traceContextSize is the size of an encoded TraceContext.
+const traceContextSize = 25
+
+// TraceContext is the W3C trace context of the HTTP request a decision is
+// made for, so that the server can report its work in the same trace. The
+// zero value carries no trace.
+type TraceContext struct {
+	TraceID [16]byte
+	// SpanID is the span of the caller, the parent of the spans of the server.
+	SpanID [8]byte
+	Flags  byte
+}
+
+// traceFlagSampled is the flag of traces recorded by the caller.
+const traceFlagSampled = 0x01
+
+// ParseTraceParent parses the value of a traceparent header,
+// 00-<trace id>-<parent id>-<flags>.
+func ParseTraceParent(value string) (TraceContext, error) {
+	var t TraceContext
+	// later versions may append fields, version 00 must not
+	if len(value) < 55 || (len(value) > 55 && (value[:2] == "00" || value[55] != '-')) {
+		return t, fmt.Errorf("invalid traceparent length: %d", len(value))
+	}
+	if value[2] != '-' || value[35] != '-' || value[52] != '-' {
+		return t, fmt.Errorf("invalid traceparent format")
+	}
+	var version [1]byte
+	if _, err := hex.Decode(version[:], []byte(value[:2])); err != nil || version[0] == 0xff {
+		return t, fmt.Errorf("invalid traceparent version %q", value[:2])
+	}
+	if _, err := hex.Decode(t.TraceID[:], []byte(value[3:35])); err != nil {
+		return t, fmt.Errorf("invalid trace id: %w", err)
+	}
+	if _, err := hex.Decode(t.SpanID[:], []byte(value[36:52])); err != nil {
+		return t, fmt.Errorf("invalid parent id: %w", err)
+	}
+	var flags [1]byte
+	if _, err := hex.Decode(flags[:], []byte(value[53:55])); err != nil {
+		return t, fmt.Errorf("invalid trace flags: %w", err)
+	}
+	t.Flags = flags[0]
+	if !t.IsValid() {
+		return TraceContext{}, fmt.Errorf("invalid traceparent: zero trace or parent id")
+	}
+	return t, nil
+}
+
+// IsValid reports whether the trace context carries a trace.
+func (t TraceContext) IsValid() bool {
+	return t.TraceID != [16]byte{} && t.SpanID != [8]byte{}
+}
+
+// Sampled reports whether the caller records the trace.
+func (t TraceContext) Sampled() bool {
+	return t.Flags&traceFlagSampled != 0
+}
+
+// String returns the trace context as a traceparent header value.
+func (t TraceContext) String() string {
+	return "00-" + hex.EncodeToString(t.TraceID[:]) + "-" + hex.EncodeToString(t.SpanID[:]) + "-" + hex.EncodeToString([]byte{t.Flags})
+}
+
+// Append appends the encoding of the trace context to dst.
+func (t *TraceContext) Append(dst []byte) []byte {
+	dst = append(dst, t.TraceID[:]...)
+	dst = append(dst, t.SpanID[:]...)
+	return append(dst, t.Flags)
+}
+
+// Unmarshal decodes the trace context from a byte slice.
+func (t *TraceContext) Unmarshal(data []byte) error {
+	if len(data) < traceContextSize {
+		return fmt.Errorf("data too short: got %d bytes, expected at least %d", len(data), traceContextSize)
+	}
+	copy(t.TraceID[:], data[0:16])
+	copy(t.SpanID[:], data[16:24])
+	t.Flags = data[24]
+	return nil
+}
+
+// decodeTrace returns the trace context trailing the data of a decision, the
+// zero value when there is none.
+func decodeTrace(data []byte) TraceContext {
+	var t TraceContext
+	if len(data) < traceContextSize {
+		return t
+	}
+	_ = t.Unmarshal(data)
+	if !t.IsValid() {
+		return TraceContext{}
+	}
+	return t
+}
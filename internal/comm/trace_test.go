@@ -0,0 +1,43 @@
+package comm
+
+import (
+	"testing"
+)
+
+func TestParseTraceParent(t *testing.T) {
+	const traceParent = "00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01"
+	got, err := ParseTraceParent(traceParent)
+	if err != nil {
+		t.Fatalf("failed to parse traceparent: %v", err)
+	}
+	if got != goldenTrace {
+		t.Errorf("Expected %+v \nWanted %+v", got, goldenTrace)
+	}
+	if !got.Sampled() {
+		t.Errorf("expected a sampled trace")
+	}
+	if got.String() != traceParent {
+		t.Errorf("Expected %s \nWanted %s", got.String(), traceParent)
+	}
+
+	// later versions may append fields
+	if _, err := ParseTraceParent("01-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra"); err != nil {
+		t.Errorf("failed to parse traceparent of a later version: %v", err)
+	}
+
+	invalid := []string{
+		"",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01-extra",
+		"ff-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+		"00-00000000000000000000000000000000-00f067aa0ba902b7-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-0000000000000000-01",
+		"00-4bf92f3577b34da6a3ce929d0e0e473x-00f067aa0ba902b7-01",
+		"00_4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01",
+	}
+	for _, value := range invalid {
+		if _, err := ParseTraceParent(value); err == nil {
+			t.Errorf("expected an error for %q", value)
+		}
+	}
+}
@@ -2,18 +2,26 @@ package config
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/joho/godotenv"
 	"github.com/sethvargo/go-envconfig"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
 	"log"
 	"os"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const EnvKeyPrefix = "TRAEFIK_RATE_LIMIT__"
 
-var configSyncOnce sync.Once
-var config *Config
+var (
+	configSyncOnce sync.Once
+	current        atomic.Pointer[Config]
+	configFile     string
+	override       func(cfg *Config)
+)
 
 type RedisConfig struct {
 	Addrs            []string `env:"ADDRS, default=localhost:6379"`
@@ -23,28 +31,209 @@ type RedisConfig struct {
 	SentinelUsername string   `env:"SENTINEL_USERNAME"`
 	SentinelPassword string   `env:"SENTINEL_PASSWORD"`
 	MasterName       string   `env:"MASTER_NAME"`
+	PoolSize         int      `env:"POOL_SIZE, default=32"`
+	MinIdleConns     int      `env:"MIN_IDLE_CONNS, default=0"`
+	// MaxRetries is the number of retries of a failed command, -1 disables
+	// them. Retries wait between MinRetryBackoff and MaxRetryBackoff.
+	MaxRetries      int           `env:"MAX_RETRIES, default=3"`
+	MinRetryBackoff time.Duration `env:"MIN_RETRY_BACKOFF, default=8ms"`
+	MaxRetryBackoff time.Duration `env:"MAX_RETRY_BACKOFF, default=512ms"`
+	DialTimeout     time.Duration `env:"DIAL_TIMEOUT, default=5s"`
+	ReadTimeout     time.Duration `env:"READ_TIMEOUT, default=3s"`
+	WriteTimeout    time.Duration `env:"WRITE_TIMEOUT, default=3s"`
+	// PoolTimeout is how long a command waits for a free connection.
+	PoolTimeout time.Duration `env:"POOL_TIMEOUT, default=4s"`
+}
+
+// MemoryConfig sizes the memory backend. MaxEntries bounds the keys, split
+// evenly between the shards; a full shard evicts the key expiring first among
+// a few. CleanupInterval is how often expired keys are dropped.
+type MemoryConfig struct {
+	Shards          int           `env:"SHARDS, default=64"`
+	MaxEntries      int           `env:"MAX_ENTRIES, default=1000000"`
+	CleanupInterval time.Duration `env:"CLEANUP_INTERVAL, default=1m"`
+}
+
+// TLSConfig holds the certificates of tls:// addresses. The server presents
+// CertFile and, with ClientCAFile, requires client certificates. The CLI
+// commands verify the server with CAFile and present ClientCertFile.
+type TLSConfig struct {
+	CertFile       string `env:"CERT_FILE"`
+	KeyFile        string `env:"KEY_FILE"`
+	ClientCAFile   string `env:"CLIENT_CA_FILE"`
+	CAFile         string `env:"CA_FILE"`
+	ClientCertFile string `env:"CLIENT_CERT_FILE"`
+	ClientKeyFile  string `env:"CLIENT_KEY_FILE"`
+	ServerName     string `env:"SERVER_NAME"`
+}
+
+// AuthConfig restricts who may use the server. With a token, clients must
+// prove they know it before any other request. On Linux, unix socket peers
+// must also run as one of the allowed users or groups, when set.
+type AuthConfig struct {
+	Token string `env:"TOKEN"`
+	// AdminToken is proven by the clients resetting and listing keys. Without
+	// it, only servers requiring no token at all answer them.
+	AdminToken  string `env:"ADMIN_TOKEN"`
+	AllowedUIDs []int  `env:"ALLOWED_UIDS"`
+	AllowedGIDs []int  `env:"ALLOWED_GIDS"`
+}
+
+// SocketConfig sets the file mode and ownership of the unix socket. A
+// negative UID or GID leaves it unchanged.
+type SocketConfig struct {
+	Mode string `env:"MODE"`
+	UID  int    `env:"UID, default=-1"`
+	GID  int    `env:"GID, default=-1"`
+}
+
+// Configured reports whether the mode or ownership of the socket is set.
+func (c *SocketConfig) Configured() bool {
+	return c != nil && (c.Mode != "" || c.UID >= 0 || c.GID >= 0)
+}
+
+// TracingConfig exports the spans of traced decisions to an OTLP/HTTP
+// collector, to a file, or both. Tracing is off when neither is set.
+type TracingConfig struct {
+	// Endpoint is the OTLP/HTTP traces URL of the collector, such as
+	// http://localhost:4318/v1/traces.
+	Endpoint string `env:"ENDPOINT"`
+	// File receives the spans as OTLP/JSON, one export request per line.
+	File        string `env:"FILE"`
+	ServiceName string `env:"SERVICE_NAME, default=traefik-rate-limit"`
+}
+
+// AdminConfig enables the admin HTTP API on Addr, such as 127.0.0.1:8081.
+// Requests must carry the token as a bearer token.
+type AdminConfig struct {
+	Addr  string `env:"ADDR"`
+	Token string `env:"TOKEN"`
+}
+
+// MetricsConfig serves the Prometheus metrics of the server on Addr, such as
+// 127.0.0.1:9090, under /metrics.
+type MetricsConfig struct {
+	Addr string `env:"ADDR"`
+}
+
+// PolicyConfig is a policy owned by the server. Clients refer to it by name
+// and the server applies its limits, so that they are changed in one place.
+type PolicyConfig struct {
+	Algorithm comm.Algorithm
+	Rate      uint64
+	Burst     uint64
+	Period    time.Duration
+	// Cost is the number of tokens of decisions without a cost of their own,
+	// zero meaning one.
+	Cost uint64
+	// Namespace prefixes the keys decided under the policy, followed by a
+	// colon, when set.
+	Namespace string
+	// Calendar and TimeZone align the windows of fixed window policies on
+	// the calendar of an IANA time zone, UTC when empty.
+	Calendar comm.Calendar
+	TimeZone string
+}
+
+// Request returns the full rate limit request of a decision for the key
+// under the policy. A zero cost takes the cost of the policy.
+func (p *PolicyConfig) Request(key string, cost uint64) comm.RateLimitRequestData {
+	if cost == 0 {
+		cost = p.Cost
+	}
+	if p.Namespace != "" {
+		key = p.Namespace + ":" + key
+	}
+	return comm.RateLimitRequestData{
+		Algorithm: p.Algorithm,
+		Rate:      p.Rate,
+		Burst:     p.Burst,
+		Period:    p.Period,
+		Key:       key,
+		Cost:      cost,
+		Calendar:  p.Calendar,
+		TimeZone:  p.TimeZone,
+	}
 }
 
 type Config struct {
-	LogLevel   string       `env:"LOG_LEVEL, default=info"`
-	SocketPath string       `env:"SOCKET_PATH, default=./tmp/traefik-rate-limit.sock"`
-	Redis      *RedisConfig `env:", prefix=REDIS_"`
+	LogLevel string `env:"LOG_LEVEL, default=info"`
+	// SocketPath is the address of the server, a unix socket path or a
+	// unix://, tcp:// or tls:// URL.
+	SocketPath string        `env:"SOCKET_PATH, default=./tmp/traefik-rate-limit.sock"`
+	TLS        *TLSConfig    `env:", prefix=TLS_"`
+	Socket     *SocketConfig `env:", prefix=SOCKET_"`
+	Auth       *AuthConfig   `env:", prefix=AUTH_"`
+	// BackendTimeout bounds a backend call for requests that carry no deadline.
+	BackendTimeout time.Duration `env:"BACKEND_TIMEOUT, default=100ms"`
+	// DrainTimeout is how long connections keep being served after shutdown
+	// starts, for clients to move to another server.
+	DrainTimeout time.Duration `env:"DRAIN_TIMEOUT, default=5s"`
+	// ReadTimeout bounds the time a frame takes to arrive once it started,
+	// WriteTimeout that of writing a response, and IdleTimeout the time a
+	// connection waits for its next frame. Zero disables them.
+	ReadTimeout  time.Duration `env:"READ_TIMEOUT, default=10s"`
+	WriteTimeout time.Duration `env:"WRITE_TIMEOUT, default=10s"`
+	IdleTimeout  time.Duration `env:"IDLE_TIMEOUT, default=2m"`
+	// MaxConnections bounds the open connections, unlimited when zero.
+	// Connections beyond it are closed at once.
+	MaxConnections int `env:"MAX_CONNECTIONS, default=1024"`
+	// Workers answer the frames reaching the backend, for all connections.
+	// WorkerQueue is the number of frames waiting for a worker, beyond which
+	// frames are answered as overloaded.
+	Workers     int `env:"WORKERS, default=256"`
+	WorkerQueue int `env:"WORKER_QUEUE, default=4096"`
+	// MaxInFlight bounds the frames of a connection being answered at once,
+	// unlimited when zero.
+	MaxInFlight int `env:"MAX_IN_FLIGHT, default=1024"`
+	// Backend stores the state of the keys: redis, shared by the servers
+	// using it, or memory, local to this server.
+	Backend string         `env:"BACKEND, default=redis"`
+	Redis   *RedisConfig   `env:", prefix=REDIS_"`
+	Memory  *MemoryConfig  `env:", prefix=MEMORY_"`
+	Tracing *TracingConfig `env:", prefix=TRACING_"`
+	Admin   *AdminConfig   `env:", prefix=ADMIN_"`
+	Metrics *MetricsConfig `env:", prefix=METRICS_"`
+	// Policies are the policies owned by the server, by name. They are only
+	// read from the config file.
+	Policies map[string]*PolicyConfig
 }
 
-func newConfig() *Config {
-	cfg := &Config{}
-	ctx := context.Background()
-	if err := envconfig.ProcessWith(ctx, &envconfig.Config{
+// load reads the configuration from the environment and from the config file
+// at path, if any. The environment takes precedence over the file.
+func load(path string) (*Config, error) {
+	fileValues := map[string]string{}
+	var policies map[string]*PolicyConfig
+	if path != "" {
+		var err error
+		if fileValues, policies, err = readFile(path); err != nil {
+			return nil, err
+		}
+	}
+	env := &secretLookuper{values: envconfig.PrefixLookuper(EnvKeyPrefix, envconfig.OsLookuper())}
+	file := &secretLookuper{values: envconfig.MapLookuper(fileValues)}
+	cfg := &Config{Policies: policies}
+	if err := envconfig.ProcessWith(context.Background(), &envconfig.Config{
 		Target:   cfg,
-		Lookuper: envconfig.PrefixLookuper(EnvKeyPrefix, envconfig.OsLookuper()),
+		Lookuper: envconfig.MultiLookuper(env, file),
 	}); err != nil {
-		log.Fatalf("Failed to process env config: %v", err)
+		return nil, fmt.Errorf("invalid configuration: %w", err)
+	}
+	if err := errors.Join(env.err, file.err); err != nil {
+		return nil, fmt.Errorf("failed to read secret files: %w", err)
+	}
+	if override != nil {
+		override(cfg)
 	}
-	return cfg
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid configuration:\n%w", err)
+	}
+	return cfg, nil
 }
 
-func newConfigWithEnv() *Config {
-	// load env file
+// loadEnvFiles loads the .env and .override.env files of the working
+// directory into the environment.
+func loadEnvFiles() {
 	envFile := ".env"
 	if f, err := os.Stat(envFile); !(os.IsNotExist(err) || f.IsDir()) {
 		err = godotenv.Load(envFile)
@@ -60,13 +249,40 @@ func newConfigWithEnv() *Config {
 			panic(fmt.Sprintf("Error loading %s file", overrideEnvFile))
 		}
 	}
+}
+
+// filePath returns the path of the config file, set with SetFile or the
+// CONFIG_FILE environment variable.
+func filePath() string {
+	if configFile != "" {
+		return configFile
+	}
+	return os.Getenv(EnvKeyPrefix + "CONFIG_FILE")
+}
 
-	return newConfig()
+// SetFile sets the path of the config file, taking precedence over the
+// CONFIG_FILE environment variable. It must be called before GetConfig.
+func SetFile(path string) {
+	configFile = path
 }
 
+// SetOverride sets a function changing the configuration each time it is
+// loaded, before it is validated, such as to apply command line flags. It
+// must be called before GetConfig.
+func SetOverride(fn func(cfg *Config)) {
+	override = fn
+}
+
+// GetConfig returns the current configuration, loading it on first use. The
+// process exits when it is invalid.
 func GetConfig() *Config {
 	configSyncOnce.Do(func() {
-		config = newConfigWithEnv()
+		loadEnvFiles()
+		cfg, err := load(filePath())
+		if err != nil {
+			log.Fatalf("Failed to load config: %v", err)
+		}
+		current.Store(cfg)
 	})
-	return config
+	return current.Load()
 }
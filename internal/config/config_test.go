@@ -0,0 +1,118 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+const testYAML = `# sidecar config
+log_level: debug
+socket_path: "tcp://127.0.0.1:7000"   # a comment
+backend_timeout: 250ms
+redis:
+  addrs:
+    - redis-1:6379
+    - 'redis-2:6379'
+  pool_size: 8
+  password_file: %s
+auth:
+  allowed_uids: [1000, 1001]
+policies:
+  api-default:
+    algorithm: gcra
+    rate: 100
+    burst: 200
+    period: 1m
+    namespace: api
+`
+
+func writeFile(t *testing.T, name string, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), name)
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write %s: %v", name, err)
+	}
+	return path
+}
+
+func TestLoadFile(t *testing.T) {
+	secret := writeFile(t, "password", "s3cret\n")
+	yamlPath := writeFile(t, "config.yaml", strings.Replace(testYAML, "%s", secret, 1))
+	jsonPath := writeFile(t, "config.json", `{"log_level":"debug","socket_path":"tcp://127.0.0.1:7000","backend_timeout":"250ms",
+		"redis":{"addrs":["redis-1:6379","redis-2:6379"],"pool_size":8,"password_file":"`+secret+`"},"auth":{"allowed_uids":[1000,1001]},
+		"policies":{"api-default":{"algorithm":"gcra","rate":100,"burst":200,"period":"1m","namespace":"api"}}}`)
+	// the environment takes precedence over the file
+	t.Setenv(EnvKeyPrefix+"LOG_LEVEL", "warn")
+	t.Setenv(EnvKeyPrefix+"REDIS_ADDRS", "redis-env:6379")
+
+	for _, path := range []string{yamlPath, jsonPath} {
+		cfg, err := load(path)
+		if err != nil {
+			t.Fatalf("failed to load %s: %v", path, err)
+		}
+		if cfg.LogLevel != "warn" || cfg.SocketPath != "tcp://127.0.0.1:7000" || cfg.BackendTimeout != 250*time.Millisecond {
+			t.Errorf("%s: unexpected settings %q, %q, %s", path, cfg.LogLevel, cfg.SocketPath, cfg.BackendTimeout)
+		}
+		if strings.Join(cfg.Redis.Addrs, ",") != "redis-env:6379" || cfg.Redis.PoolSize != 8 || cfg.Redis.Password != "s3cret" {
+			t.Errorf("%s: unexpected redis settings %+v", path, cfg.Redis)
+		}
+		if values, _, _ := readFile(path); values["REDIS_ADDRS"] != "redis-1:6379,redis-2:6379" {
+			t.Errorf("%s: unexpected addresses in the file %q", path, values["REDIS_ADDRS"])
+		}
+		if len(cfg.Auth.AllowedUIDs) != 2 || cfg.Auth.AllowedUIDs[1] != 1001 {
+			t.Errorf("%s: unexpected allowed UIDs %v", path, cfg.Auth.AllowedUIDs)
+		}
+		policy, ok := cfg.Policies["api-default"]
+		if !ok || policy.Rate != 100 || policy.Burst != 200 || policy.Period != time.Minute {
+			t.Errorf("%s: unexpected policies %v", path, cfg.Policies)
+		} else if request := policy.Request("key", 0); request.Key != "api:key" {
+			t.Errorf("%s: expected the namespace to prefix the key, got %q", path, request.Key)
+		}
+		// the settings missing from both keep their defaults
+		if cfg.Workers != 256 || cfg.Redis.MaxRetries != 3 {
+			t.Errorf("%s: expected the defaults, got %d workers and %d retries", path, cfg.Workers, cfg.Redis.MaxRetries)
+		}
+	}
+}
+
+func TestLoadFileErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		file     string
+		expected string
+	}{
+		{"unknown.yaml", "redis:\n  pool_sise: 8\n", `unknown setting "redis.pool_sise"`},
+		{"indent.yaml", "redis:\n  pool_size: 8\n    db: 1\n", "line 3: unexpected indentation"},
+		{"invalid.json", `{"workers":0,"log_level":"verbose","redis":{"pool_size":-1}}`, "WORKERS: must be positive"},
+		{"invalid.yaml", "log_level: verbose\n", `invalid log level "verbose"`},
+		{"secret.yaml", "admin:\n  addr: 127.0.0.1:8081\n  token_file: /missing\n", "ADMIN_TOKEN_FILE"},
+		{"policy.yaml", "policies:\n  api:\n    rate: 1\n    limit: 2\n", `policy "api": unknown setting "limit"`},
+		{"limits.yaml", "policies:\n  api:\n    rate: 1\n    period: 1s\n", `policy "api": burst must be positive`},
+		{"backend.yaml", "backend: disk\nmemory:\n  shards: 0\n", "MEMORY_SHARDS: must be positive"},
+		{"algorithm.yaml", "policies:\n  api:\n    algorithm: leaky-bucket\n    rate: 1\n    period: 1s\n", `unknown algorithm "leaky-bucket"`},
+		{"calendar.yaml", "policies:\n  api:\n    calendar: day\n    rate: 1\n    burst: 1\n    period: 1s\n", `policy "api": calendars only align fixed windows`},
+		{"zone.yaml", "policies:\n  api:\n    algorithm: fixed-window\n    calendar: day\n    time_zone: Mars/Olympus_Mons\n    rate: 1\n", `policy "api": time zone`},
+		{"config.toml", "", "unknown format"},
+	} {
+		_, err := load(writeFile(t, test.name, test.file))
+		if err == nil || !strings.Contains(err.Error(), test.expected) {
+			t.Errorf("%s: expected an error containing %q, got %v", test.name, test.expected, err)
+		}
+	}
+}
+
+func TestLoadFileCalendar(t *testing.T) {
+	cfg, err := load(writeFile(t, "calendar.yaml", "policies:\n  api:\n    algorithm: fixed-window\n    calendar: month\n    time_zone: Europe/Istanbul\n    rate: 1000\n"))
+	if err != nil {
+		t.Fatalf("failed to load the calendar policy: %v", err)
+	}
+	request := cfg.Policies["api"].Request("key", 0)
+	if request.Calendar != comm.CalendarMonth || request.TimeZone != "Europe/Istanbul" || request.Rate != 1000 {
+		t.Errorf("unexpected calendar request %+v", request)
+	}
+}
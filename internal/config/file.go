@@ -0,0 +1,241 @@
+package config
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/sethvargo/go-envconfig"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// secretSuffix marks the settings holding the path of a file with their value.
+const secretSuffix = "_FILE"
+
+// readFile reads a YAML or JSON config file into the values of the settings
+// by the names of their environment variables, without the prefix. The keys
+// of nested mappings are joined with underscores, so redis: {pool_size: 8}
+// sets REDIS_POOL_SIZE, and lists are joined with commas. The policies of the
+// file are returned apart.
+func readFile(path string) (map[string]string, map[string]*PolicyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to read config file: %w", err)
+	}
+	var document map[string]any
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.UseNumber()
+		if err := decoder.Decode(&document); err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	case ".yaml", ".yml":
+		if document, err = parseYAML(data); err != nil {
+			return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+		}
+	default:
+		return nil, nil, fmt.Errorf("config file %s: unknown format, expected a .yaml, .yml or .json file", path)
+	}
+	policies, err := parsePolicies(document[policiesKey])
+	if err != nil {
+		return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	delete(document, policiesKey)
+	values := make(map[string]string)
+	if err := flatten(nil, document, values); err != nil {
+		return nil, nil, fmt.Errorf("config file %s: %w", path, err)
+	}
+	return values, policies, nil
+}
+
+// policiesKey holds the policies in config files, a mapping of the policies
+// by name.
+const policiesKey = "policies"
+
+// parsePolicies parses the policies of a config file.
+func parsePolicies(value any) (map[string]*PolicyConfig, error) {
+	if value == nil {
+		return nil, nil
+	}
+	mapping, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("%s: expected a mapping of the policies by name", policiesKey)
+	}
+	policies := make(map[string]*PolicyConfig, len(mapping))
+	for name, value := range mapping {
+		policy, err := parsePolicy(value)
+		if err != nil {
+			return nil, fmt.Errorf("policy %q: %w", name, err)
+		}
+		policies[name] = policy
+	}
+	return policies, nil
+}
+
+func parsePolicy(value any) (*PolicyConfig, error) {
+	settings, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("expected a mapping")
+	}
+	policy := &PolicyConfig{}
+	for key, value := range settings {
+		scalar, err := scalarValue(value)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+		switch key {
+		case "algorithm":
+			policy.Algorithm, err = comm.ParseAlgorithm(scalar)
+		case "rate":
+			policy.Rate, err = strconv.ParseUint(scalar, 10, 64)
+		case "burst":
+			policy.Burst, err = strconv.ParseUint(scalar, 10, 64)
+		case "period":
+			policy.Period, err = time.ParseDuration(scalar)
+		case "cost":
+			policy.Cost, err = strconv.ParseUint(scalar, 10, 64)
+		case "namespace":
+			policy.Namespace = scalar
+		case "calendar":
+			policy.Calendar, err = comm.ParseCalendar(scalar)
+		case "time_zone":
+			policy.TimeZone = scalar
+		default:
+			return nil, fmt.Errorf("unknown setting %q", key)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", key, err)
+		}
+	}
+	return policy, nil
+}
+
+// flatten adds the settings of the value found at path to values.
+func flatten(path []string, value any, values map[string]string) error {
+	if mapping, ok := value.(map[string]any); ok {
+		for key, nested := range mapping {
+			if err := flatten(append(path[:len(path):len(path)], key), nested, values); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	name := strings.ToUpper(strings.Join(path, "_"))
+	if !knownSetting(name) {
+		return fmt.Errorf("unknown setting %q", strings.Join(path, "."))
+	}
+	if value == nil {
+		return nil
+	}
+	scalar, err := scalarValue(value)
+	if list, ok := value.([]any); ok {
+		items := make([]string, len(list))
+		for i, item := range list {
+			if items[i], err = scalarValue(item); err != nil {
+				break
+			}
+		}
+		scalar = strings.Join(items, ",")
+	}
+	if err != nil {
+		return fmt.Errorf("setting %q: %w", strings.Join(path, "."), err)
+	}
+	values[name] = scalar
+	return nil
+}
+
+func scalarValue(value any) (string, error) {
+	switch value := value.(type) {
+	case string:
+		return value, nil
+	case json.Number:
+		return value.String(), nil
+	case bool:
+		return strconv.FormatBool(value), nil
+	case nil:
+		return "", nil
+	default:
+		return "", fmt.Errorf("expected a scalar value")
+	}
+}
+
+var (
+	settingsOnce sync.Once
+	settings     map[string]bool
+)
+
+// knownSetting reports whether name is the environment variable of a setting
+// of Config, or that of the file holding its value.
+func knownSetting(name string) bool {
+	settingsOnce.Do(func() {
+		settings = make(map[string]bool)
+		addSettings(reflect.TypeOf(Config{}), "")
+	})
+	return settings[name] || settings[strings.TrimSuffix(name, secretSuffix)]
+}
+
+// addSettings adds the settings of the struct type, read from the
+// environment variables in its env tags.
+func addSettings(t reflect.Type, prefix string) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		tag, ok := field.Tag.Lookup("env")
+		if !ok || tag == "-" {
+			continue
+		}
+		name, options, _ := strings.Cut(tag, ",")
+		name = strings.TrimSpace(name)
+		if name != "" {
+			settings[prefix+name] = true
+			continue
+		}
+		nested := field.Type
+		if nested.Kind() == reflect.Pointer {
+			nested = nested.Elem()
+		}
+		if nested.Kind() != reflect.Struct {
+			continue
+		}
+		nestedPrefix := ""
+		for _, option := range strings.Split(options, ",") {
+			if value, ok := strings.CutPrefix(strings.TrimSpace(option), "prefix="); ok {
+				nestedPrefix = value
+			}
+		}
+		addSettings(nested, prefix+nestedPrefix)
+	}
+}
+
+// secretLookuper looks the settings up, reading the file named by NAME_FILE
+// when NAME is not set, so secrets need not be stored in the environment or
+// the config file. A trailing newline of the file is dropped.
+type secretLookuper struct {
+	values envconfig.Lookuper
+	// err holds the errors of the files that could not be read.
+	err error
+}
+
+func (l *secretLookuper) Lookup(key string) (string, bool) {
+	if value, ok := l.values.Lookup(key); ok {
+		return value, true
+	}
+	path, ok := l.values.Lookup(key + secretSuffix)
+	if !ok || path == "" {
+		return "", false
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		l.err = errors.Join(l.err, fmt.Errorf("%s%s: %w", key, secretSuffix, err))
+		return "", false
+	}
+	return strings.TrimSuffix(strings.TrimSuffix(string(data), "\n"), "\r"), true
+}
@@ -0,0 +1,70 @@
+package config
+
+import (
+	"reflect"
+	"sync"
+)
+
+// restartSettings are the settings read once when the server starts. A
+// reload keeps their current values, they change with a restart or a hot
+// upgrade.
+var restartSettings = []struct {
+	field string
+	name  string
+}{
+	{"SocketPath", "SOCKET_PATH"},
+	{"TLS", "TLS_*"},
+	{"Socket", "SOCKET_*"},
+	{"MaxConnections", "MAX_CONNECTIONS"},
+	{"Workers", "WORKERS"},
+	{"WorkerQueue", "WORKER_QUEUE"},
+	{"Backend", "BACKEND"},
+	{"Redis", "REDIS_*"},
+	{"Memory", "MEMORY_*"},
+	{"Tracing", "TRACING_*"},
+	{"Admin", "ADMIN_*"},
+	{"Metrics", "METRICS_*"},
+}
+
+var (
+	reloadMu    sync.Mutex
+	reloadHooks []func(cfg *Config)
+)
+
+// OnReload registers a function called with the new configuration after
+// each successful reload.
+func OnReload(fn func(cfg *Config)) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	reloadHooks = append(reloadHooks, fn)
+}
+
+// Reload reads the environment and the config file again and makes the
+// result the current configuration, keeping the settings read at startup.
+// It returns the names of those that changed and were kept. The current
+// configuration is left as it is when the new one is invalid.
+//
+// The .env files are only read at startup.
+func Reload() (*Config, []string, error) {
+	reloadMu.Lock()
+	defer reloadMu.Unlock()
+	previous := GetConfig()
+	cfg, err := load(filePath())
+	if err != nil {
+		return nil, nil, err
+	}
+	var kept []string
+	next, old := reflect.ValueOf(cfg).Elem(), reflect.ValueOf(previous).Elem()
+	for _, setting := range restartSettings {
+		field := next.FieldByName(setting.field)
+		if !reflect.DeepEqual(field.Interface(), old.FieldByName(setting.field).Interface()) {
+			kept = append(kept, setting.name)
+		}
+		field.Set(old.FieldByName(setting.field))
+	}
+	current.Store(cfg)
+	for _, hook := range reloadHooks {
+		hook(cfg)
+	}
+	return cfg, kept, nil
+}
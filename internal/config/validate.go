@@ -0,0 +1,112 @@
+package config
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
+)
+
+// ParseLogLevel returns the slog level of a LOG_LEVEL value.
+func ParseLogLevel(level string) (slog.Level, error) {
+	switch strings.ToLower(level) {
+	case "debug":
+		return slog.LevelDebug, nil
+	case "info":
+		return slog.LevelInfo, nil
+	case "warn":
+		return slog.LevelWarn, nil
+	case "error":
+		return slog.LevelError, nil
+	default:
+		return slog.LevelInfo, fmt.Errorf("invalid log level %q, expected debug, info, warn or error", level)
+	}
+}
+
+// Validate reports all the invalid settings of the configuration, one per
+// line.
+func (c *Config) Validate() error {
+	var errs []error
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			errs = append(errs, fmt.Errorf(format, args...))
+		}
+	}
+	if _, err := ParseLogLevel(c.LogLevel); err != nil {
+		errs = append(errs, fmt.Errorf("LOG_LEVEL: %w", err))
+	}
+	if _, err := transport.ParseAddress(c.SocketPath); err != nil {
+		errs = append(errs, fmt.Errorf("SOCKET_PATH: %w", err))
+	}
+	if c.Socket != nil && c.Socket.Mode != "" {
+		_, err := strconv.ParseUint(c.Socket.Mode, 8, 32)
+		check(err == nil, "SOCKET_MODE: %q is not an octal file mode", c.Socket.Mode)
+	}
+	check(c.BackendTimeout > 0, "BACKEND_TIMEOUT: must be positive, got %s", c.BackendTimeout)
+	for _, timeout := range []namedDuration{
+		{"DRAIN_TIMEOUT", c.DrainTimeout},
+		{"READ_TIMEOUT", c.ReadTimeout},
+		{"WRITE_TIMEOUT", c.WriteTimeout},
+		{"IDLE_TIMEOUT", c.IdleTimeout},
+	} {
+		check(timeout.value >= 0, "%s: must not be negative, got %s", timeout.name, timeout.value)
+	}
+	check(c.MaxConnections >= 0, "MAX_CONNECTIONS: must not be negative, got %d", c.MaxConnections)
+	check(c.Workers > 0, "WORKERS: must be positive, got %d", c.Workers)
+	check(c.WorkerQueue > 0, "WORKER_QUEUE: must be positive, got %d", c.WorkerQueue)
+	check(c.MaxInFlight >= 0, "MAX_IN_FLIGHT: must not be negative, got %d", c.MaxInFlight)
+	check(c.Backend == "redis" || c.Backend == "memory", "BACKEND: expected redis or memory, got %q", c.Backend)
+	if redis := c.Redis; redis != nil {
+		check(len(redis.Addrs) > 0, "REDIS_ADDRS: at least one address is required")
+		check(redis.DB >= 0, "REDIS_DB: must not be negative, got %d", redis.DB)
+		check(redis.PoolSize > 0, "REDIS_POOL_SIZE: must be positive, got %d", redis.PoolSize)
+		check(redis.MinIdleConns >= 0 && redis.MinIdleConns <= redis.PoolSize, "REDIS_MIN_IDLE_CONNS: must be between 0 and REDIS_POOL_SIZE, got %d", redis.MinIdleConns)
+		check(redis.MaxRetries >= -1, "REDIS_MAX_RETRIES: must be -1 or more, got %d", redis.MaxRetries)
+		check(redis.MinRetryBackoff >= 0 && redis.MinRetryBackoff <= redis.MaxRetryBackoff, "REDIS_MIN_RETRY_BACKOFF: must be between 0 and REDIS_MAX_RETRY_BACKOFF, got %s", redis.MinRetryBackoff)
+		for _, timeout := range []namedDuration{
+			{"REDIS_DIAL_TIMEOUT", redis.DialTimeout},
+			{"REDIS_READ_TIMEOUT", redis.ReadTimeout},
+			{"REDIS_WRITE_TIMEOUT", redis.WriteTimeout},
+			{"REDIS_POOL_TIMEOUT", redis.PoolTimeout},
+		} {
+			check(timeout.value > 0, "%s: must be positive, got %s", timeout.name, timeout.value)
+		}
+	}
+	if memory := c.Memory; memory != nil {
+		check(memory.Shards > 0, "MEMORY_SHARDS: must be positive, got %d", memory.Shards)
+		check(memory.MaxEntries >= memory.Shards, "MEMORY_MAX_ENTRIES: must be at least MEMORY_SHARDS, got %d", memory.MaxEntries)
+		check(memory.CleanupInterval > 0, "MEMORY_CLEANUP_INTERVAL: must be positive, got %s", memory.CleanupInterval)
+	}
+	if c.Admin != nil && c.Admin.Addr != "" {
+		check(c.Admin.Token != "", "ADMIN_TOKEN: required with ADMIN_ADDR")
+	}
+	names := make([]string, 0, len(c.Policies))
+	for name := range c.Policies {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policy := c.Policies[name]
+		check(name != "", "policies: a policy name must not be empty")
+		request := policy.Request("", 0)
+		if err := request.Validate(); err != nil {
+			errs = append(errs, fmt.Errorf("policy %q: %w", name, err))
+		} else if policy.Calendar != comm.CalendarNone {
+			if _, err := time.LoadLocation(policy.TimeZone); err != nil {
+				errs = append(errs, fmt.Errorf("policy %q: time zone: %w", name, err))
+			}
+		}
+	}
+	return errors.Join(errs...)
+}
+
+type namedDuration struct {
+	name  string
+	value time.Duration
+}
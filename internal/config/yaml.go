@@ -0,0 +1,307 @@
+package config
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// parseYAML parses the subset of YAML config files are written in: block
+// mappings and lists, flow lists of scalars, plain and quoted scalars and
+// comments. Anchors, tags, block scalars and flow mappings are rejected.
+// Scalars are returned as strings, null values as nil.
+func parseYAML(data []byte) (map[string]any, error) {
+	lines, err := yamlLines(string(data))
+	if err != nil {
+		return nil, err
+	}
+	if len(lines) == 0 {
+		return map[string]any{}, nil
+	}
+	p := &yamlParser{lines: lines}
+	value, err := p.parseBlock(lines[0].indent)
+	if err != nil {
+		return nil, err
+	}
+	if p.pos < len(p.lines) {
+		return nil, p.lines[p.pos].errorf("unexpected indentation")
+	}
+	root, ok := value.(map[string]any)
+	if !ok {
+		return nil, fmt.Errorf("line %d: the document must be a mapping", lines[0].num)
+	}
+	return root, nil
+}
+
+type yamlLine struct {
+	num    int
+	indent int
+	text   string
+}
+
+func (l yamlLine) errorf(format string, args ...any) error {
+	return fmt.Errorf("line %d: %s", l.num, fmt.Sprintf(format, args...))
+}
+
+// yamlLines returns the lines holding content, without their indentation.
+func yamlLines(data string) ([]yamlLine, error) {
+	var lines []yamlLine
+	for i, text := range strings.Split(data, "\n") {
+		text = strings.TrimRight(text, " \t\r")
+		trimmed := strings.TrimLeft(text, " ")
+		if trimmed == "" || strings.HasPrefix(trimmed, "#") {
+			continue
+		}
+		line := yamlLine{num: i + 1, indent: len(text) - len(trimmed), text: trimmed}
+		if strings.HasPrefix(trimmed, "\t") {
+			return nil, line.errorf("tabs are not allowed in indentation")
+		}
+		if line.indent == 0 && (trimmed == "---" || trimmed == "...") {
+			if len(lines) > 0 && trimmed == "---" {
+				return nil, line.errorf("only one document is allowed")
+			}
+			continue
+		}
+		lines = append(lines, line)
+	}
+	return lines, nil
+}
+
+type yamlParser struct {
+	lines []yamlLine
+	pos   int
+}
+
+// parseBlock parses the mapping or the list starting at the current line.
+func (p *yamlParser) parseBlock(indent int) (any, error) {
+	if isListItem(p.lines[p.pos].text) {
+		return p.parseList(indent)
+	}
+	return p.parseMapping(indent)
+}
+
+func (p *yamlParser) parseMapping(indent int) (map[string]any, error) {
+	mapping := map[string]any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent {
+			break
+		}
+		if line.indent > indent {
+			return nil, line.errorf("unexpected indentation")
+		}
+		if isListItem(line.text) {
+			return nil, line.errorf("expected a key, got a list item")
+		}
+		key, rest, ok, err := splitKey(line)
+		if err != nil {
+			return nil, err
+		}
+		if !ok {
+			return nil, line.errorf("expected a key followed by a colon")
+		}
+		if _, ok := mapping[key]; ok {
+			return nil, line.errorf("duplicate key %q", key)
+		}
+		p.pos++
+		value, err := p.parseValue(line, rest, indent, true)
+		if err != nil {
+			return nil, err
+		}
+		mapping[key] = value
+	}
+	return mapping, nil
+}
+
+func (p *yamlParser) parseList(indent int) ([]any, error) {
+	list := []any{}
+	for p.pos < len(p.lines) {
+		line := p.lines[p.pos]
+		if line.indent < indent || !isListItem(line.text) {
+			break
+		}
+		if line.indent > indent {
+			return nil, line.errorf("unexpected indentation")
+		}
+		rest := strings.TrimLeft(line.text[1:], " ")
+		if _, _, isKey, _ := splitKey(yamlLine{text: rest}); rest != "" && (isKey || isListItem(rest)) {
+			// the item is a block starting on the line of its marker, the
+			// lines below it continue it at the column of its content
+			offset := len(line.text) - len(rest)
+			p.lines[p.pos] = yamlLine{num: line.num, indent: indent + offset, text: rest}
+			value, err := p.parseBlock(indent + offset)
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+			continue
+		}
+		p.pos++
+		value, err := p.parseValue(line, rest, indent, false)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, value)
+	}
+	return list, nil
+}
+
+// parseValue parses the value following a key or a list item marker, on its
+// line or in the block below it. The list under a key may start at the
+// indentation of the key.
+func (p *yamlParser) parseValue(line yamlLine, rest string, indent int, key bool) (any, error) {
+	if rest != "" {
+		return parseScalar(line, rest)
+	}
+	if p.pos == len(p.lines) {
+		return nil, nil
+	}
+	next := p.lines[p.pos]
+	if next.indent > indent || (key && next.indent == indent && isListItem(next.text)) {
+		return p.parseBlock(next.indent)
+	}
+	return nil, nil
+}
+
+func isListItem(text string) bool {
+	return text == "-" || strings.HasPrefix(text, "- ")
+}
+
+// splitKey splits a mapping entry into its key and the rest of the line,
+// without comments. ok is false when the line is not a mapping entry.
+func splitKey(line yamlLine) (key string, rest string, ok bool, err error) {
+	text := line.text
+	end := -1
+	if text != "" && (text[0] == '"' || text[0] == '\'') {
+		quoted, n, err := quotedPrefix(line, text)
+		if err != nil {
+			return "", "", false, err
+		}
+		if !strings.HasPrefix(text[n:], ":") {
+			return "", "", false, nil
+		}
+		key, end = quoted, n
+	} else {
+		for i := 0; i < len(text); i++ {
+			if text[i] == ':' && (i+1 == len(text) || text[i+1] == ' ') {
+				end = i
+				break
+			}
+		}
+		if end <= 0 {
+			return "", "", false, nil
+		}
+		key = strings.TrimSpace(text[:end])
+	}
+	rest = strings.TrimSpace(text[end+1:])
+	if strings.HasPrefix(rest, "#") {
+		rest = ""
+	}
+	if rest != "" && end+1 < len(text) && text[end+1] != ' ' {
+		return "", "", false, nil
+	}
+	return key, rest, true, nil
+}
+
+// quotedPrefix returns the value of the quoted string text starts with and
+// its length in text.
+func quotedPrefix(line yamlLine, text string) (string, int, error) {
+	if text[0] == '\'' {
+		for i := 1; i < len(text); i++ {
+			if text[i] != '\'' {
+				continue
+			}
+			if i+1 < len(text) && text[i+1] == '\'' {
+				i++
+				continue
+			}
+			return strings.ReplaceAll(text[1:i], "''", "'"), i + 1, nil
+		}
+		return "", 0, line.errorf("unterminated quoted string")
+	}
+	for i := 1; i < len(text); i++ {
+		switch text[i] {
+		case '\\':
+			i++
+		case '"':
+			value, err := strconv.Unquote(text[:i+1])
+			if err != nil {
+				return "", 0, line.errorf("invalid quoted string %s", text[:i+1])
+			}
+			return value, i + 1, nil
+		}
+	}
+	return "", 0, line.errorf("unterminated quoted string")
+}
+
+// parseScalar parses a scalar or a flow list of scalars.
+func parseScalar(line yamlLine, text string) (any, error) {
+	switch text[0] {
+	case '"', '\'':
+		value, n, err := quotedPrefix(line, text)
+		if err != nil {
+			return nil, err
+		}
+		if rest := strings.TrimSpace(text[n:]); rest != "" && !strings.HasPrefix(rest, "#") {
+			return nil, line.errorf("unexpected %q after quoted string", rest)
+		}
+		return value, nil
+	case '[':
+		return parseFlowList(line, text)
+	case '{':
+		if strings.HasPrefix(text, "{}") {
+			return map[string]any{}, nil
+		}
+		return nil, line.errorf("flow mappings are not supported, use a block mapping")
+	case '&', '*', '!':
+		return nil, line.errorf("anchors, aliases and tags are not supported, quote the value")
+	case '|', '>':
+		return nil, line.errorf("block scalars are not supported, use a quoted string")
+	}
+	if i := strings.Index(text, " #"); i >= 0 {
+		text = strings.TrimSpace(text[:i])
+	}
+	if text == "~" || text == "null" {
+		return nil, nil
+	}
+	return text, nil
+}
+
+func parseFlowList(line yamlLine, text string) ([]any, error) {
+	list := []any{}
+	text = strings.TrimSpace(text[1:])
+	for {
+		if text == "" {
+			return nil, line.errorf("unterminated flow list")
+		}
+		if text[0] == ']' {
+			if rest := strings.TrimSpace(text[1:]); rest != "" && !strings.HasPrefix(rest, "#") {
+				return nil, line.errorf("unexpected %q after flow list", rest)
+			}
+			return list, nil
+		}
+		var value string
+		if text[0] == '"' || text[0] == '\'' {
+			quoted, n, err := quotedPrefix(line, text)
+			if err != nil {
+				return nil, err
+			}
+			value, text = quoted, strings.TrimSpace(text[n:])
+		} else {
+			end := strings.IndexAny(text, ",]")
+			if end < 0 {
+				return nil, line.errorf("unterminated flow list")
+			}
+			value, text = strings.TrimSpace(text[:end]), text[end:]
+			if strings.ContainsAny(value, "[{") {
+				return nil, line.errorf("nested flow collections are not supported")
+			}
+		}
+		list = append(list, value)
+		if strings.HasPrefix(text, ",") {
+			text = strings.TrimSpace(text[1:])
+		} else if !strings.HasPrefix(text, "]") {
+			return nil, line.errorf("expected a comma or the end of the flow list")
+		}
+	}
+}
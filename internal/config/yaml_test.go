@@ -0,0 +1,80 @@
+package config
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseYAML(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		yaml     string
+		expected map[string]any
+	}{
+		{"empty", "# only a comment\n\n", map[string]any{}},
+		{"document markers", "---\na: 1\n...\n", map[string]any{"a": "1"}},
+		{"nested mappings", "a:\n  b:\n    c: 1\n  d: x\ne: y\n", map[string]any{
+			"a": map[string]any{"b": map[string]any{"c": "1"}, "d": "x"},
+			"e": "y",
+		}},
+		{"list", "a:\n  - 1\n  - two\n", map[string]any{"a": []any{"1", "two"}}},
+		{"list at the indentation of its key", "a:\n- 1\n- 2\nb: 3\n", map[string]any{"a": []any{"1", "2"}, "b": "3"}},
+		{"list of mappings", "a:\n  - name: x\n    rate: 1\n  - name: y\n", map[string]any{
+			"a": []any{map[string]any{"name": "x", "rate": "1"}, map[string]any{"name": "y"}},
+		}},
+		{"nested lists", "a:\n  - - 1\n    - 2\n  - 3\n", map[string]any{"a": []any{[]any{"1", "2"}, "3"}}},
+		{"flow lists", "a: [1, 'b c', \"d,e\"]\nb: []\n", map[string]any{"a": []any{"1", "b c", "d,e"}, "b": []any{}}},
+		{"empty flow mapping", "a: {}\n", map[string]any{"a": map[string]any{}}},
+		{"nulls", "a:\nb: ~\nc: null\n", map[string]any{"a": nil, "b": nil, "c": nil}},
+		{"single quotes", "a: 'it''s # not a comment'\n", map[string]any{"a": "it's # not a comment"}},
+		{"double quotes", `a: "tab\there"` + "\n", map[string]any{"a": "tab\there"}},
+		{"quoted key", "\"a: b\": 1\n'c': 2\n", map[string]any{"a: b": "1", "c": "2"}},
+		{"colons in values", "a: tcp://127.0.0.1:7000\n", map[string]any{"a": "tcp://127.0.0.1:7000"}},
+		{"comments", "a: 1 # one\nb: # a mapping\n  # inside\n  c: x#y\n", map[string]any{"a": "1", "b": map[string]any{"c": "x#y"}}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			parsed, err := parseYAML([]byte(test.yaml))
+			if err != nil {
+				t.Fatalf("failed to parse: %v", err)
+			}
+			if !reflect.DeepEqual(parsed, test.expected) {
+				t.Errorf("expected %#v, got %#v", test.expected, parsed)
+			}
+		})
+	}
+}
+
+func TestParseYAMLErrors(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		yaml     string
+		expected string
+	}{
+		{"tab indentation", "a:\n\tb: 1\n", "line 2: tabs are not allowed in indentation"},
+		{"several documents", "a: 1\n---\nb: 2\n", "line 2: only one document is allowed"},
+		{"unexpected indentation", "# comment\n\na: 1\n  b: 2\n", "line 4: unexpected indentation"},
+		{"duplicate key", "a: 1\na: 2\n", `line 2: duplicate key "a"`},
+		{"list item in a mapping", "a: 1\n- b\n", "line 2: expected a key, got a list item"},
+		{"missing colon", "a: 1\nb\n", "line 2: expected a key followed by a colon"},
+		{"list document", "- a\n", "line 1: the document must be a mapping"},
+		{"flow mapping", "a: {b: 1}\n", "line 1: flow mappings are not supported, use a block mapping"},
+		{"anchor", "a: &x 1\n", "line 1: anchors, aliases and tags are not supported, quote the value"},
+		{"alias", "a: *x\n", "line 1: anchors, aliases and tags are not supported, quote the value"},
+		{"tag", "a: !!str 1\n", "line 1: anchors, aliases and tags are not supported, quote the value"},
+		{"block scalar", "a: |\n  text\n", "line 1: block scalars are not supported, use a quoted string"},
+		{"unterminated double quote", "a: \"x\n", "line 1: unterminated quoted string"},
+		{"unterminated single quote", "a: 'x\n", "line 1: unterminated quoted string"},
+		{"invalid escape", `a: "\q"` + "\n", `line 1: invalid quoted string "\q"`},
+		{"text after a quoted string", "a: \"x\" y\n", `line 1: unexpected "y" after quoted string`},
+		{"unterminated flow list", "a: [1, 2\n", "line 1: unterminated flow list"},
+		{"nested flow list", "a: [[1]]\n", "line 1: nested flow collections are not supported"},
+		{"text after a flow list", "a: [1] x\n", `line 1: unexpected "x" after flow list`},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := parseYAML([]byte(test.yaml))
+			if err == nil || err.Error() != test.expected {
+				t.Errorf("expected %q, got %v", test.expected, err)
+			}
+		})
+	}
+}
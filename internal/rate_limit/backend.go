@@ -0,0 +1,127 @@
+package rate_limit
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// The backends of the BACKEND setting.
+const (
+	BackendRedis  = "redis"
+	BackendMemory = "memory"
+)
+
+// Result is the outcome of a decision or a peek.
+type Result struct {
+	// Allowed is the number of tokens taken.
+	Allowed int
+	// Remaining is the number of tokens left.
+	Remaining int
+	// RetryAfter is the time until a token is available, -1 when one is.
+	RetryAfter time.Duration
+	// ResetAfter is the time until the key is back to a full burst.
+	ResetAfter time.Duration
+}
+
+// Lease is one of the concurrent slots of a key, held until it is released
+// or expires.
+type Lease struct {
+	Key     string
+	ID      string
+	Expires time.Time
+}
+
+// OverrideKind is a list of keys decided by an operator rather than by their
+// limit.
+type OverrideKind uint8
+
+const (
+	// OverrideBan lists the keys denied whatever their limit.
+	OverrideBan OverrideKind = iota
+	// OverrideAllow lists the keys allowed without reaching the backend.
+	OverrideAllow
+)
+
+func (k OverrideKind) String() string {
+	if k == OverrideAllow {
+		return "allow"
+	}
+	return "ban"
+}
+
+// other returns the list a key leaves when added to this one.
+func (k OverrideKind) other() OverrideKind {
+	if k == OverrideAllow {
+		return OverrideBan
+	}
+	return OverrideAllow
+}
+
+// Override is a key of a list until it expires.
+type Override struct {
+	Key     string    `json:"key"`
+	Expires time.Time `json:"expires"`
+}
+
+// ErrTooManyOverrides is returned when adding a key to a full list.
+var ErrTooManyOverrides = errors.New("too many keys in the list")
+
+// Backend stores the state of the keys.
+type Backend interface {
+	// AllowAtMost takes up to the cost of the request in tokens for its key.
+	AllowAtMost(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error)
+	// Peek returns the state of the key under the limit of the request
+	// without taking any token.
+	Peek(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error)
+	// Reset forgets the state of the key.
+	Reset(ctx context.Context, key string) error
+	// ListKeys returns a page of the keys starting with the prefix and the
+	// cursor of the next page, zero after the last one.
+	ListKeys(ctx context.Context, prefix string, cursor uint64, count uint32) ([]string, uint64, error)
+	// AcquireLease takes one of the limit concurrent slots of the key for at
+	// most ttl. The lease is nil when all of them are held.
+	AcquireLease(ctx context.Context, key string, limit uint64, ttl time.Duration) (*Lease, error)
+	// ReleaseLease gives the slot of the lease back.
+	ReleaseLease(ctx context.Context, lease *Lease) error
+	// SetOverride adds the key to the list until it expires, replacing an
+	// earlier expiry and removing the key from the other list. It fails with
+	// ErrTooManyOverrides when the list already holds max other keys.
+	SetOverride(ctx context.Context, kind OverrideKind, key string, expires time.Time, max int) error
+	// RemoveOverride removes the key from the list, reporting whether it was
+	// there and not expired.
+	RemoveOverride(ctx context.Context, kind OverrideKind, key string) (bool, error)
+	// ListOverrides returns the keys of the list that have not expired.
+	ListOverrides(ctx context.Context, kind OverrideKind) ([]Override, error)
+	// Ping checks that the backend answers.
+	Ping(ctx context.Context) error
+	// Close releases the resources of the backend.
+	Close() error
+}
+
+// NewBackend returns the backend selected by the configuration.
+func NewBackend(cfg *config.Config) (Backend, error) {
+	switch cfg.Backend {
+	case BackendRedis:
+		return newRedisBackend(cfg.Redis), nil
+	case BackendMemory:
+		return newMemoryBackend(cfg.Memory), nil
+	default:
+		return nil, fmt.Errorf("unknown backend %q", cfg.Backend)
+	}
+}
+
+// newID returns a random ID, of leases and of the tokens of sliding logs.
+func newID() (string, error) {
+	var id [16]byte
+	if _, err := rand.Read(id[:]); err != nil {
+		return "", fmt.Errorf("failed to generate an id: %w", err)
+	}
+	return hex.EncodeToString(id[:]), nil
+}
@@ -0,0 +1,75 @@
+package rate_limit
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// timeZones caches the locations of the time zones of calendars by name, as
+// loading one reads the time zone database.
+var timeZones sync.Map
+
+// LoadTimeZone returns the location of the IANA time zone name, UTC when
+// empty.
+func LoadTimeZone(name string) (*time.Location, error) {
+	if location, ok := timeZones.Load(name); ok {
+		return location.(*time.Location), nil
+	}
+	location, err := time.LoadLocation(name)
+	if err != nil {
+		return nil, fmt.Errorf("unknown time zone %q: %w", name, err)
+	}
+	timeZones.Store(name, location)
+	return location, nil
+}
+
+// Validate checks that the backends can enforce the limit of the request, the
+// time zone of its calendar included.
+func Validate(data *comm.RateLimitRequestData) error {
+	if err := data.Validate(); err != nil {
+		return err
+	}
+	if data.Calendar != comm.CalendarNone {
+		if _, err := LoadTimeZone(data.TimeZone); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// fixedWindowBounds returns the start and the end, in Unix nanoseconds, of the
+// fixed window of the request holding now: a window of the period from the
+// Unix epoch, or the calendar window in the time zone of the request.
+func fixedWindowBounds(data *comm.RateLimitRequestData, now int64) (int64, int64) {
+	if data.Calendar == comm.CalendarNone {
+		period := int64(data.Period)
+		start := now - now%period
+		return start, start + period
+	}
+	location, err := LoadTimeZone(data.TimeZone)
+	if err != nil {
+		// the requests are validated before reaching the backends
+		location = time.UTC
+	}
+	t := time.Unix(0, now).In(location)
+	var start, end time.Time
+	switch data.Calendar {
+	case comm.CalendarHour:
+		// the hours of time zones offset by minutes start off those of UTC
+		start = t.Add(-time.Duration(t.Minute())*time.Minute - time.Duration(t.Second())*time.Second - time.Duration(t.Nanosecond()))
+		end = start.Add(time.Hour)
+	case comm.CalendarWeek:
+		start = time.Date(t.Year(), t.Month(), t.Day()-(int(t.Weekday())+6)%7, 0, 0, 0, 0, location)
+		end = start.AddDate(0, 0, 7)
+	case comm.CalendarMonth:
+		start = time.Date(t.Year(), t.Month(), 1, 0, 0, 0, 0, location)
+		end = start.AddDate(0, 1, 0)
+	default:
+		start = time.Date(t.Year(), t.Month(), t.Day(), 0, 0, 0, 0, location)
+		end = start.AddDate(0, 0, 1)
+	}
+	return start.UnixNano(), end.UnixNano()
+}
@@ -0,0 +1,56 @@
+package rate_limit
+
+import (
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// TestFixedWindowBounds expects the fixed windows to start on the multiples of
+// the period, or on the local calendar of their time zone.
+func TestFixedWindowBounds(t *testing.T) {
+	tests := []struct {
+		name       string
+		calendar   comm.Calendar
+		timeZone   string
+		now        string
+		start, end string
+	}{
+		{"epoch", comm.CalendarNone, "", "2023-11-14T22:13:20Z", "2023-11-14T22:00:00Z", "2023-11-14T23:00:00Z"},
+		{"hour", comm.CalendarHour, "", "2023-11-14T22:13:20Z", "2023-11-14T22:00:00Z", "2023-11-14T23:00:00Z"},
+		{"hour off by minutes", comm.CalendarHour, "Asia/Kathmandu", "2023-11-14T22:13:20Z", "2023-11-14T21:15:00Z", "2023-11-14T22:15:00Z"},
+		{"day", comm.CalendarDay, "Europe/Istanbul", "2023-11-14T22:13:20Z", "2023-11-14T21:00:00Z", "2023-11-15T21:00:00Z"},
+		{"day of 25 hours", comm.CalendarDay, "Europe/Berlin", "2023-10-29T12:00:00Z", "2023-10-28T22:00:00Z", "2023-10-29T23:00:00Z"},
+		{"day of 23 hours", comm.CalendarDay, "Europe/Berlin", "2023-03-26T12:00:00Z", "2023-03-25T23:00:00Z", "2023-03-26T22:00:00Z"},
+		{"week from Monday", comm.CalendarWeek, "", "2023-11-19T23:59:59Z", "2023-11-13T00:00:00Z", "2023-11-20T00:00:00Z"},
+		{"week on Monday", comm.CalendarWeek, "", "2023-11-20T00:00:00Z", "2023-11-20T00:00:00Z", "2023-11-27T00:00:00Z"},
+		{"month", comm.CalendarMonth, "America/New_York", "2024-02-29T12:00:00Z", "2024-02-01T05:00:00Z", "2024-03-01T05:00:00Z"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmFixedWindow, Calendar: test.calendar, TimeZone: test.timeZone, Rate: 1, Period: time.Hour}
+			now, _ := time.Parse(time.RFC3339, test.now)
+			start, end := fixedWindowBounds(data, now.UnixNano())
+			if got := time.Unix(0, start).UTC().Format(time.RFC3339); got != test.start {
+				t.Errorf("expected the window to start at %s, got %s", test.start, got)
+			}
+			if got := time.Unix(0, end).UTC().Format(time.RFC3339); got != test.end {
+				t.Errorf("expected the window to end at %s, got %s", test.end, got)
+			}
+		})
+	}
+}
+
+// TestValidateTimeZone expects a calendar in an unknown time zone to be
+// rejected.
+func TestValidateTimeZone(t *testing.T) {
+	data := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmFixedWindow, Calendar: comm.CalendarDay, TimeZone: "Europe/Istanbul", Rate: 1, Key: "a", Cost: 1}
+	if err := Validate(data); err != nil {
+		t.Fatalf("expected a known time zone to be valid, got %v", err)
+	}
+	data.TimeZone = "Mars/Olympus_Mons"
+	if err := Validate(data); err == nil {
+		t.Fatal("expected an unknown time zone to be rejected")
+	}
+}
@@ -0,0 +1,331 @@
+package rate_limit
+
+import (
+	"context"
+	"hash/maphash"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// evictionSamples is the number of entries looked at to pick the one evicted
+// from a full shard, the one expiring first.
+const evictionSamples = 5
+
+// memoryBackend stores the keys in the memory of the server, for deployments
+// with a single server. The state is lost on restart. It runs the algorithms
+// like the Redis backend does, so both decide the same way.
+type memoryBackend struct {
+	seed   maphash.Seed
+	shards []*memoryShard
+	// maxEntries bounds the entries of each shard.
+	maxEntries int
+	now        func() time.Time
+	stop       chan struct{}
+	stopOnce   sync.Once
+	// overrides holds the expiry of the keys of each list, by kind.
+	overridesMu sync.Mutex
+	overrides   [2]map[string]time.Time
+}
+
+// memoryShard holds the entries of the keys hashed to it, by key. The leases
+// are kept apart so that they never share the state of a key.
+type memoryShard struct {
+	mu      sync.Mutex
+	entries memoryEntries
+	leases  memoryEntries
+}
+
+// memoryEntries holds entries by key.
+type memoryEntries map[string]*memoryEntry
+
+type memoryEntry struct {
+	// expires is when the entry is dropped, in Unix nanoseconds.
+	expires int64
+	// algorithm is the algorithm of the state of the entry.
+	algorithm comm.Algorithm
+	// tat is the theoretical arrival time of the GCRA, in Unix nanoseconds.
+	tat int64
+	// log holds the tokens taken in the sliding window, oldest first.
+	log []logEntry
+	// window is the index of the current window of the sliding window
+	// counter, or the start of that of the fixed window in Unix nanoseconds,
+	// count the tokens taken in it, and previous those taken in the one
+	// before.
+	window   int64
+	count    uint64
+	previous uint64
+	// leases holds the expiry of the leases by ID.
+	leases map[string]int64
+}
+
+func newMemoryBackend(memoryCfg *config.MemoryConfig) *memoryBackend {
+	b := &memoryBackend{
+		seed:       maphash.MakeSeed(),
+		shards:     make([]*memoryShard, memoryCfg.Shards),
+		maxEntries: (memoryCfg.MaxEntries + memoryCfg.Shards - 1) / memoryCfg.Shards,
+		now:        time.Now,
+		stop:       make(chan struct{}),
+		overrides:  [2]map[string]time.Time{make(map[string]time.Time), make(map[string]time.Time)},
+	}
+	for i := range b.shards {
+		b.shards[i] = &memoryShard{entries: make(memoryEntries), leases: make(memoryEntries)}
+	}
+	go b.sweep(memoryCfg.CleanupInterval)
+	return b
+}
+
+func (b *memoryBackend) shard(key string) *memoryShard {
+	return b.shards[maphash.String(b.seed, key)%uint64(len(b.shards))]
+}
+
+// sweep drops the expired entries at each interval until the backend is
+// closed. Expired entries are also ignored, and replaced, when they are used.
+func (b *memoryBackend) sweep(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-b.stop:
+			return
+		case <-ticker.C:
+		}
+		for _, shard := range b.shards {
+			now := b.now().UnixNano()
+			shard.mu.Lock()
+			shard.entries.sweep(now)
+			shard.leases.sweep(now)
+			shard.mu.Unlock()
+		}
+	}
+}
+
+// sweep drops the expired entries. The shard must be locked.
+func (e memoryEntries) sweep(now int64) {
+	for key, entry := range e {
+		if entry.expires <= now {
+			delete(e, key)
+		}
+	}
+}
+
+// get returns the entry of the key unless it expired. The shard must be
+// locked.
+func (e memoryEntries) get(key string, now int64) *memoryEntry {
+	entry, ok := e[key]
+	if !ok {
+		return nil
+	}
+	if entry.expires <= now {
+		delete(e, key)
+		return nil
+	}
+	return entry
+}
+
+// add adds an entry for the key, evicting another one when the shard is full.
+// The shard must be locked.
+func (e memoryEntries) add(key string, entry *memoryEntry, maxEntries int) {
+	if len(e) >= maxEntries {
+		var evicted string
+		var earliest *memoryEntry
+		sampled := 0
+		for sample, candidate := range e {
+			if earliest == nil || candidate.expires < earliest.expires {
+				evicted, earliest = sample, candidate
+			}
+			if sampled++; sampled == evictionSamples {
+				break
+			}
+		}
+		delete(e, evicted)
+	}
+	e[key] = entry
+}
+
+func (b *memoryBackend) AllowAtMost(_ context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	return b.decide(data, data.GetCost()), nil
+}
+
+func (b *memoryBackend) Peek(_ context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	return b.decide(data, 0), nil
+}
+
+// decide takes up to cost tokens for the key of the request under its
+// algorithm, none when peeking with a zero cost. The state of a key kept under
+// another algorithm is dropped.
+func (b *memoryBackend) decide(data *comm.RateLimitRequestData, cost uint64) *Result {
+	s := b.shard(data.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := b.now().UnixNano()
+	key := data.Key
+	entry := s.entries.get(key, now)
+	if entry != nil && entry.algorithm != data.Algorithm {
+		// the key starts over under the algorithm, a peek leaves its state
+		if cost > 0 {
+			delete(s.entries, key)
+		}
+		entry = nil
+	}
+	added := entry == nil
+	if added {
+		entry = &memoryEntry{algorithm: data.Algorithm}
+	}
+	var result *Result
+	switch data.Algorithm {
+	case comm.AlgorithmSlidingWindowLog:
+		result = entry.slidingWindowLog(data, cost, now)
+	case comm.AlgorithmSlidingWindowCounter:
+		result = entry.slidingWindowCounter(data, cost, now)
+	case comm.AlgorithmFixedWindow:
+		result = entry.fixedWindow(data, cost, now)
+	default:
+		result = entry.gcra(data, cost, now)
+	}
+	if added && result.Allowed > 0 {
+		s.entries.add(key, entry, b.maxEntries)
+	}
+	return result
+}
+
+func (b *memoryBackend) Reset(_ context.Context, key string) error {
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.entries, key)
+	return nil
+}
+
+// ListKeys lists the keys shard by shard, in order within a shard. The cursor
+// holds the index of the shard and the offset of the page in it.
+func (b *memoryBackend) ListKeys(_ context.Context, prefix string, cursor uint64, count uint32) ([]string, uint64, error) {
+	if count == 0 {
+		count = 10
+	}
+	index, offset := int(cursor>>32), int(cursor&0xffffffff)
+	var keys []string
+	for ; index < len(b.shards); index, offset = index+1, 0 {
+		shardKeys := b.shards[index].keys(prefix, b.now().UnixNano())
+		if offset > len(shardKeys) {
+			offset = len(shardKeys)
+		}
+		taken := shardKeys[offset:]
+		if left := int(count) - len(keys); len(taken) > left {
+			keys = append(keys, taken[:left]...)
+			return keys, uint64(index)<<32 | uint64(offset+left), nil
+		}
+		keys = append(keys, taken...)
+		if len(keys) == int(count) && index+1 < len(b.shards) {
+			return keys, uint64(index+1) << 32, nil
+		}
+	}
+	return keys, 0, nil
+}
+
+// keys returns the sorted keys of the shard starting with the prefix.
+func (s *memoryShard) keys(prefix string, now int64) []string {
+	s.mu.Lock()
+	var keys []string
+	for key, entry := range s.entries {
+		if strings.HasPrefix(key, prefix) && entry.expires > now {
+			keys = append(keys, key)
+		}
+	}
+	s.mu.Unlock()
+	sort.Strings(keys)
+	return keys
+}
+
+func (b *memoryBackend) AcquireLease(_ context.Context, key string, limit uint64, ttl time.Duration) (*Lease, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	s := b.shard(key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := b.now()
+	expires := now.Add(ttl).UnixNano()
+	entry := s.leases.get(key, now.UnixNano())
+	if entry == nil {
+		entry = &memoryEntry{leases: make(map[string]int64)}
+		s.leases.add(key, entry, b.maxEntries)
+	}
+	for leaseID, leaseExpires := range entry.leases {
+		if leaseExpires <= now.UnixNano() {
+			delete(entry.leases, leaseID)
+		}
+	}
+	if uint64(len(entry.leases)) >= limit {
+		return nil, nil
+	}
+	entry.leases[id] = expires
+	entry.expires = max(entry.expires, expires)
+	return &Lease{Key: key, ID: id, Expires: time.Unix(0, expires)}, nil
+}
+
+func (b *memoryBackend) ReleaseLease(_ context.Context, lease *Lease) error {
+	s := b.shard(lease.Key)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if entry := s.leases.get(lease.Key, b.now().UnixNano()); entry != nil {
+		delete(entry.leases, lease.ID)
+		if len(entry.leases) == 0 {
+			delete(s.leases, lease.Key)
+		}
+	}
+	return nil
+}
+
+func (b *memoryBackend) SetOverride(_ context.Context, kind OverrideKind, key string, expires time.Time, max int) error {
+	b.overridesMu.Lock()
+	defer b.overridesMu.Unlock()
+	now := b.now()
+	list := b.overrides[kind]
+	for listed, listedExpires := range list {
+		if !now.Before(listedExpires) {
+			delete(list, listed)
+		}
+	}
+	delete(b.overrides[kind.other()], key)
+	if _, ok := list[key]; !ok && len(list) >= max {
+		return ErrTooManyOverrides
+	}
+	list[key] = expires
+	return nil
+}
+
+func (b *memoryBackend) RemoveOverride(_ context.Context, kind OverrideKind, key string) (bool, error) {
+	b.overridesMu.Lock()
+	defer b.overridesMu.Unlock()
+	expires, ok := b.overrides[kind][key]
+	delete(b.overrides[kind], key)
+	return ok && b.now().Before(expires), nil
+}
+
+func (b *memoryBackend) ListOverrides(_ context.Context, kind OverrideKind) ([]Override, error) {
+	b.overridesMu.Lock()
+	defer b.overridesMu.Unlock()
+	now := b.now()
+	var list []Override
+	for key, expires := range b.overrides[kind] {
+		if now.Before(expires) {
+			list = append(list, Override{Key: key, Expires: expires})
+		}
+	}
+	return list, nil
+}
+
+func (b *memoryBackend) Ping(context.Context) error {
+	return nil
+}
+
+func (b *memoryBackend) Close() error {
+	b.stopOnce.Do(func() { close(b.stop) })
+	return nil
+}
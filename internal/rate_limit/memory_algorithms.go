@@ -0,0 +1,189 @@
+package rate_limit
+
+import (
+	"math"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// logEntry is a number of tokens taken at once in a sliding window log.
+type logEntry struct {
+	at    int64
+	count uint64
+}
+
+// gcra runs the GCRA of redis_rate on the entry: AllowAtMost, or AllowN with
+// a zero cost to peek.
+func (e *memoryEntry) gcra(data *comm.RateLimitRequestData, cost uint64, now int64) *Result {
+	tat := max(e.tat, now)
+	emissionInterval := float64(data.Period) / float64(data.Rate)
+	burstOffset := emissionInterval * float64(data.Burst)
+	diff := burstOffset - float64(tat-now)
+	remaining := diff / emissionInterval
+	if cost == 0 {
+		if remaining < 0 {
+			return &Result{RetryAfter: time.Duration(-diff), ResetAfter: time.Duration(tat - now)}
+		}
+		return &Result{Remaining: int(remaining), RetryAfter: -1, ResetAfter: time.Duration(tat - now)}
+	}
+	if remaining < 1 {
+		return &Result{
+			RetryAfter: time.Duration(emissionInterval - diff),
+			ResetAfter: time.Duration(tat - now),
+		}
+	}
+	taken := float64(cost)
+	if remaining < taken {
+		taken = remaining
+		remaining = 0
+	} else {
+		remaining -= taken
+	}
+	e.tat = tat + int64(emissionInterval*taken)
+	e.expires = e.tat
+	return &Result{
+		Allowed:    int(taken),
+		Remaining:  int(remaining),
+		RetryAfter: -1,
+		ResetAfter: time.Duration(e.tat - now),
+	}
+}
+
+// slidingWindowLog allows at most the rate in tokens in the period before
+// now, logging the tokens taken.
+func (e *memoryEntry) slidingWindowLog(data *comm.RateLimitRequestData, cost uint64, now int64) *Result {
+	window := int64(data.Period)
+	// the tokens taken a window ago or earlier have left it
+	start := 0
+	for start < len(e.log) && e.log[start].at <= now-window {
+		start++
+	}
+	e.log = append(e.log[:0], e.log[start:]...)
+	var taken uint64
+	for _, tokens := range e.log {
+		taken += tokens.count
+	}
+	remaining := int64(data.Rate) - int64(taken)
+	var resetAfter time.Duration
+	if len(e.log) > 0 {
+		resetAfter = time.Duration(e.log[len(e.log)-1].at + window - now)
+	}
+	if remaining < 1 || cost == 0 {
+		result := &Result{Remaining: int(max(remaining, 0)), RetryAfter: -1, ResetAfter: resetAfter}
+		if remaining < 1 {
+			// a token is available once enough of the oldest left the window
+			excess := uint64(1 - remaining)
+			for _, tokens := range e.log {
+				if tokens.count >= excess {
+					result.RetryAfter = time.Duration(tokens.at + window - now)
+					break
+				}
+				excess -= tokens.count
+			}
+		}
+		return result
+	}
+	taking := min(cost, uint64(remaining))
+	if last := len(e.log) - 1; last >= 0 && e.log[last].at == now {
+		e.log[last].count += taking
+	} else {
+		e.log = append(e.log, logEntry{at: now, count: taking})
+	}
+	e.expires = now + window
+	return &Result{
+		Allowed:    int(taking),
+		Remaining:  int(uint64(remaining) - taking),
+		RetryAfter: -1,
+		ResetAfter: time.Duration(window),
+	}
+}
+
+// advance moves the counts of the entry to the window of now, the windows
+// being aligned on the Unix epoch, and returns the time elapsed in it.
+func (e *memoryEntry) advance(period int64, now int64) int64 {
+	current := now / period
+	switch e.window {
+	case current:
+	case current - 1:
+		e.previous, e.count = e.count, 0
+	default:
+		e.previous, e.count = 0, 0
+	}
+	e.window = current
+	return now - current*period
+}
+
+// slidingWindowCounter allows about the rate in tokens in the period before
+// now, estimating the tokens taken in it from the count of the current window
+// and that of the previous one, weighed by how much of it the period covers.
+func (e *memoryEntry) slidingWindowCounter(data *comm.RateLimitRequestData, cost uint64, now int64) *Result {
+	period := int64(data.Period)
+	elapsed := e.advance(period, now)
+	limit := float64(data.Rate)
+	weight := float64(period-elapsed) / float64(period)
+	remaining := math.Floor(limit - (float64(e.previous)*weight + float64(e.count)))
+	var resetAfter time.Duration
+	if e.count > 0 {
+		resetAfter = time.Duration(2*period - elapsed)
+	} else if e.previous > 0 {
+		resetAfter = time.Duration(period - elapsed)
+	}
+	if remaining < 1 || cost == 0 {
+		result := &Result{Remaining: int(max(remaining, 0)), RetryAfter: -1, ResetAfter: resetAfter}
+		if remaining < 1 {
+			// the estimate must drop to limit-1: the previous window slides
+			// out during the current one, the current one during the next
+			allowed := limit - 1
+			count, previous := float64(e.count), float64(e.previous)
+			if count <= allowed && previous > 0 {
+				at := float64(period) * (previous - allowed + count) / previous
+				result.RetryAfter = time.Duration(int64(math.Ceil(at)) - elapsed)
+			} else {
+				at := float64(period) * (count - allowed) / count
+				result.RetryAfter = time.Duration(period - elapsed + int64(math.Ceil(max(at, 0))))
+			}
+		}
+		return result
+	}
+	taking := min(cost, uint64(remaining))
+	e.count += taking
+	e.expires = (e.window + 2) * period
+	return &Result{
+		Allowed:    int(taking),
+		Remaining:  int(uint64(remaining) - taking),
+		RetryAfter: -1,
+		ResetAfter: time.Duration(2*period - elapsed),
+	}
+}
+
+// fixedWindow allows the rate in tokens per window, the windows being aligned
+// on the Unix epoch or on the calendar of the request.
+func (e *memoryEntry) fixedWindow(data *comm.RateLimitRequestData, cost uint64, now int64) *Result {
+	start, end := fixedWindowBounds(data, now)
+	if e.window != start {
+		e.window, e.count = start, 0
+	}
+	left := time.Duration(end - now)
+	remaining := int64(data.Rate) - int64(e.count)
+	var resetAfter time.Duration
+	if e.count > 0 {
+		resetAfter = left
+	}
+	if remaining < 1 || cost == 0 {
+		result := &Result{Remaining: int(max(remaining, 0)), RetryAfter: -1, ResetAfter: resetAfter}
+		if remaining < 1 {
+			result.RetryAfter = left
+		}
+		return result
+	}
+	taking := min(cost, uint64(remaining))
+	e.count += taking
+	e.expires = end
+	return &Result{
+		Allowed:    int(taking),
+		Remaining:  int(uint64(remaining) - taking),
+		RetryAfter: -1,
+		ResetAfter: left,
+	}
+}
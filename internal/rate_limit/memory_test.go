@@ -0,0 +1,233 @@
+package rate_limit
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+func newTestBackend(t *testing.T, maxEntries int) (*memoryBackend, *time.Time) {
+	t.Helper()
+	now := time.Unix(1_700_000_000, 0)
+	b := newMemoryBackend(&config.MemoryConfig{Shards: 1, MaxEntries: maxEntries, CleanupInterval: time.Hour})
+	b.now = func() time.Time { return now }
+	t.Cleanup(func() { b.Close() })
+	return b, &now
+}
+
+// TestMemoryGCRA expects the results of redis_rate for the same sequence.
+func TestMemoryGCRA(t *testing.T) {
+	b, now := newTestBackend(t, 100)
+	ctx := context.Background()
+	data := &comm.RateLimitRequestData{Rate: 10, Burst: 2, Period: time.Second, Key: "a"}
+
+	for _, expected := range []Result{
+		{Allowed: 1, Remaining: 1, RetryAfter: -1, ResetAfter: 100 * time.Millisecond},
+		{Allowed: 1, Remaining: 0, RetryAfter: -1, ResetAfter: 200 * time.Millisecond},
+		{Allowed: 0, Remaining: 0, RetryAfter: 100 * time.Millisecond, ResetAfter: 200 * time.Millisecond},
+	} {
+		result, err := b.AllowAtMost(ctx, data)
+		if err != nil || *result != expected {
+			t.Fatalf("expected %+v, got %+v, %v", expected, result, err)
+		}
+	}
+
+	*now = now.Add(150 * time.Millisecond)
+	if result, _ := b.Peek(ctx, data); *result != (Result{Remaining: 1, RetryAfter: -1, ResetAfter: 50 * time.Millisecond}) {
+		t.Errorf("unexpected peek %+v", result)
+	}
+	// the cost is taken up to the tokens left
+	cost := &comm.RateLimitRequestData{Rate: 10, Burst: 2, Period: time.Second, Key: "a", Cost: 5}
+	if result, _ := b.AllowAtMost(ctx, cost); result.Allowed != 1 || result.Remaining != 0 {
+		t.Errorf("expected the cost to be clamped, got %+v", result)
+	}
+
+	if err := b.Reset(ctx, "a"); err != nil {
+		t.Fatalf("failed to reset: %v", err)
+	}
+	if result, _ := b.Peek(ctx, data); result.Remaining != 2 {
+		t.Errorf("expected a full burst after a reset, got %+v", result)
+	}
+}
+
+func TestMemoryEviction(t *testing.T) {
+	b, now := newTestBackend(t, 10)
+	ctx := context.Background()
+	for i := 0; i < 20; i++ {
+		if _, err := b.AllowAtMost(ctx, &comm.RateLimitRequestData{Rate: 1, Burst: 1, Period: time.Second, Key: fmt.Sprint(i)}); err != nil {
+			t.Fatalf("failed to rate limit: %v", err)
+		}
+	}
+	if entries := len(b.shards[0].entries); entries != 10 {
+		t.Errorf("expected the entries to be bounded to 10, got %d", entries)
+	}
+
+	*now = now.Add(2 * time.Second)
+	if keys, cursor, _ := b.ListKeys(ctx, "", 0, 100); len(keys) != 0 || cursor != 0 {
+		t.Errorf("expected the expired keys to be hidden, got %v", keys)
+	}
+}
+
+func TestMemoryLeases(t *testing.T) {
+	b, now := newTestBackend(t, 100)
+	ctx := context.Background()
+	first, _ := b.AcquireLease(ctx, "a", 2, time.Second)
+	second, _ := b.AcquireLease(ctx, "a", 2, time.Second)
+	if first == nil || second == nil {
+		t.Fatalf("expected two leases, got %v and %v", first, second)
+	}
+	if lease, _ := b.AcquireLease(ctx, "a", 2, time.Second); lease != nil {
+		t.Fatalf("expected the limit to be reached, got %v", lease)
+	}
+	if err := b.ReleaseLease(ctx, first); err != nil {
+		t.Fatalf("failed to release: %v", err)
+	}
+	if lease, _ := b.AcquireLease(ctx, "a", 2, time.Second); lease == nil {
+		t.Fatalf("expected the released slot to be taken")
+	}
+	// expired leases give their slots back
+	*now = now.Add(2 * time.Second)
+	if lease, _ := b.AcquireLease(ctx, "a", 1, time.Second); lease == nil {
+		t.Errorf("expected the expired leases to be dropped")
+	}
+}
+
+// TestMemoryOverrides expects a key to move between the lists and a full list
+// to refuse new keys until some expire.
+func TestMemoryOverrides(t *testing.T) {
+	b, now := newTestBackend(t, 100)
+	ctx := context.Background()
+
+	if err := b.SetOverride(ctx, OverrideAllow, "a", now.Add(time.Minute), 2); err != nil {
+		t.Fatalf("failed to allow: %v", err)
+	}
+	if err := b.SetOverride(ctx, OverrideBan, "a", now.Add(time.Minute), 2); err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if allows, _ := b.ListOverrides(ctx, OverrideAllow); len(allows) != 0 {
+		t.Errorf("expected the ban to remove the key from the allow list, got %+v", allows)
+	}
+	if err := b.SetOverride(ctx, OverrideBan, "b", now.Add(time.Second), 2); err != nil {
+		t.Fatalf("failed to ban: %v", err)
+	}
+	if err := b.SetOverride(ctx, OverrideBan, "c", now.Add(time.Minute), 2); !errors.Is(err, ErrTooManyOverrides) {
+		t.Errorf("expected a full list to refuse a key, got %v", err)
+	}
+	// a listed key gets a new expiry in a full list
+	if err := b.SetOverride(ctx, OverrideBan, "a", now.Add(time.Hour), 2); err != nil {
+		t.Errorf("expected a listed key to be banned again, got %v", err)
+	}
+
+	*now = now.Add(time.Second)
+	if err := b.SetOverride(ctx, OverrideBan, "c", now.Add(time.Minute), 2); err != nil {
+		t.Errorf("expected an expired key to make room, got %v", err)
+	}
+	if removed, _ := b.RemoveOverride(ctx, OverrideBan, "b"); removed {
+		t.Errorf("expected the expired key not to be removed")
+	}
+	if removed, _ := b.RemoveOverride(ctx, OverrideBan, "c"); !removed {
+		t.Errorf("expected the key to be removed")
+	}
+	bans, _ := b.ListOverrides(ctx, OverrideBan)
+	if len(bans) != 1 || bans[0] != (Override{Key: "a", Expires: now.Add(time.Hour - time.Second)}) {
+		t.Errorf("expected only the first key to be banned, got %+v", bans)
+	}
+}
+
+// TestMemoryWindows runs the window algorithms, whose windows are aligned on
+// the second of the test clock.
+func TestMemoryWindows(t *testing.T) {
+	b, now := newTestBackend(t, 100)
+	testWindows(t, b, now, "")
+}
+
+// testWindows runs the window algorithms on the backend from the time now
+// points to, for keys starting with the prefix.
+func testWindows(t *testing.T, b Backend, now *time.Time, prefix string) {
+	ctx := context.Background()
+	start := *now
+	at := func(offset time.Duration) { *now = start.Add(offset) }
+	check := func(name string, result *Result, err error, expected Result) {
+		t.Helper()
+		if err != nil {
+			t.Fatalf("%s: %v", name, err)
+		}
+		if *result != expected {
+			t.Errorf("%s: expected %+v, got %+v", name, expected, *result)
+		}
+	}
+
+	log := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmSlidingWindowLog, Rate: 3, Period: time.Second, Key: prefix + "log", Cost: 2}
+	result, err := b.AllowAtMost(ctx, log)
+	check("log", result, err, Result{Allowed: 2, Remaining: 1, RetryAfter: -1, ResetAfter: time.Second})
+	at(400 * time.Millisecond)
+	log.Cost = 1
+	result, err = b.AllowAtMost(ctx, log)
+	check("log", result, err, Result{Allowed: 1, Remaining: 0, RetryAfter: -1, ResetAfter: time.Second})
+	at(500 * time.Millisecond)
+	result, err = b.AllowAtMost(ctx, log)
+	check("log denied", result, err, Result{RetryAfter: 500 * time.Millisecond, ResetAfter: 900 * time.Millisecond})
+	// the first two tokens leave the window a period after they were taken
+	at(time.Second)
+	result, err = b.Peek(ctx, log)
+	check("log peek", result, err, Result{Remaining: 2, RetryAfter: -1, ResetAfter: 400 * time.Millisecond})
+
+	fixed := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmFixedWindow, Rate: 2, Period: time.Second, Key: prefix + "fixed", Cost: 3}
+	at(300 * time.Millisecond)
+	result, err = b.AllowAtMost(ctx, fixed)
+	check("fixed", result, err, Result{Allowed: 2, Remaining: 0, RetryAfter: -1, ResetAfter: 700 * time.Millisecond})
+	result, err = b.AllowAtMost(ctx, fixed)
+	check("fixed denied", result, err, Result{RetryAfter: 700 * time.Millisecond, ResetAfter: 700 * time.Millisecond})
+	at(time.Second)
+	result, err = b.Peek(ctx, fixed)
+	check("fixed next window", result, err, Result{Remaining: 2, RetryAfter: -1})
+
+	counter := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmSlidingWindowCounter, Rate: 10, Period: time.Second, Key: prefix + "counter", Cost: 10}
+	at(0)
+	result, err = b.AllowAtMost(ctx, counter)
+	check("counter", result, err, Result{Allowed: 10, Remaining: 0, RetryAfter: -1, ResetAfter: 2 * time.Second})
+	// three quarters of the previous window are still covered
+	at(1250 * time.Millisecond)
+	result, err = b.Peek(ctx, counter)
+	check("counter peek", result, err, Result{Remaining: 2, RetryAfter: -1, ResetAfter: 750 * time.Millisecond})
+	counter.Cost = 5
+	result, err = b.AllowAtMost(ctx, counter)
+	check("counter", result, err, Result{Allowed: 2, Remaining: 0, RetryAfter: -1, ResetAfter: 1750 * time.Millisecond})
+	result, err = b.AllowAtMost(ctx, counter)
+	check("counter denied", result, err, Result{RetryAfter: 50 * time.Millisecond, ResetAfter: 1750 * time.Millisecond})
+
+	// a peek under another algorithm reports the key as new and leaves it
+	gcra := &comm.RateLimitRequestData{Rate: 10, Burst: 10, Period: time.Second, Key: counter.Key, Cost: 5}
+	result, err = b.Peek(ctx, gcra)
+	check("peek under GCRA", result, err, Result{Remaining: 10, RetryAfter: -1})
+	result, err = b.Peek(ctx, counter)
+	check("counter kept", result, err, Result{RetryAfter: 50 * time.Millisecond, ResetAfter: 1750 * time.Millisecond})
+	// a decision under another algorithm starts the key over, both ways
+	if result, err = b.AllowAtMost(ctx, gcra); err != nil || result.Allowed != 5 || result.Remaining != 5 {
+		t.Errorf("decision under GCRA: expected 5 tokens taken and 5 left, got %+v, %v", result, err)
+	}
+	fixed.Key = counter.Key
+	result, err = b.Peek(ctx, fixed)
+	check("peek under fixed window", result, err, Result{Remaining: 2, RetryAfter: -1})
+	result, err = b.AllowAtMost(ctx, fixed)
+	check("decision under fixed window", result, err, Result{Allowed: 2, Remaining: 0, RetryAfter: -1, ResetAfter: 750 * time.Millisecond})
+	if result, err = b.Peek(ctx, gcra); err != nil || result.Remaining != 10 {
+		t.Errorf("GCRA after a window: expected 10 tokens left, got %+v, %v", result, err)
+	}
+
+	// the day of Istanbul starts at 21:00 UTC, 22h46m38.75s from now
+	calendar := &comm.RateLimitRequestData{Algorithm: comm.AlgorithmFixedWindow, Calendar: comm.CalendarDay, TimeZone: "Europe/Istanbul", Rate: 1, Key: prefix + "calendar", Cost: 1}
+	day := 22*time.Hour + 46*time.Minute + 38750*time.Millisecond
+	result, err = b.AllowAtMost(ctx, calendar)
+	check("calendar", result, err, Result{Allowed: 1, Remaining: 0, RetryAfter: -1, ResetAfter: day})
+	result, err = b.AllowAtMost(ctx, calendar)
+	check("calendar denied", result, err, Result{RetryAfter: day, ResetAfter: day})
+	at(1250*time.Millisecond + day)
+	result, err = b.Peek(ctx, calendar)
+	check("calendar next day", result, err, Result{Remaining: 1, RetryAfter: -1})
+}
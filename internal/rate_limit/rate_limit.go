@@ -3,53 +3,205 @@ package rate_limit
 import (
 	"context"
 	"fmt"
+	"log"
 	"sync"
 	"time"
 
-	"github.com/go-redis/redis_rate/v10"
 	"github.com/redis/go-redis/v9"
 	"github.com/zekihan/traefik-rate-limit/internal/comm"
 	"github.com/zekihan/traefik-rate-limit/internal/config"
 )
 
 var (
-	redisClient redis.UniversalClient
-	once        sync.Once
+	backendMu sync.RWMutex
+	backend   Backend
 )
 
-func getRedisClient() redis.UniversalClient {
-	once.Do(func() {
-		cfg := config.GetConfig()
-		redisCfg := cfg.Redis
-		redisClient = redis.NewUniversalClient(&redis.UniversalOptions{
-			Addrs:            redisCfg.Addrs,
-			ClientName:       "TraefikRateLimiter",
-			DB:               redisCfg.DB,
-			Username:         redisCfg.Username,
-			Password:         redisCfg.Password,
-			SentinelUsername: redisCfg.SentinelUsername,
-			SentinelPassword: redisCfg.SentinelPassword,
-			PoolSize:         32, // Increased from 19 for better concurrency
-			MasterName:       redisCfg.MasterName,
-			MaxRetries:       3,
-			MinRetryBackoff:  8 * time.Millisecond,
-			MaxRetryBackoff:  512 * time.Millisecond,
-		})
-	})
-	return redisClient
-}
-
-func RateLimit(data *comm.RateLimitRequestData) (*redis_rate.Result, error) {
-	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond) // Reduced timeout
-	defer cancel()
-	limiter := redis_rate.NewLimiter(getRedisClient())
-	result, err := limiter.Allow(ctx, data.Key, redis_rate.Limit{
-		Rate:   int(data.Rate),
-		Burst:  int(data.Burst),
-		Period: data.Period,
-	})
+// getBackend returns the backend selected by the configuration, creating it
+// on first use.
+func getBackend() Backend {
+	backendMu.RLock()
+	current := backend
+	backendMu.RUnlock()
+	if current != nil {
+		return current
+	}
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		created, err := NewBackend(config.GetConfig())
+		if err != nil {
+			log.Fatalf("Failed to create the backend: %v", err)
+		}
+		backend = created
+	}
+	return backend
+}
+
+// SetBackend replaces the backend, closing the current one, until Close. It
+// lets tests decide with a backend of their own.
+func SetBackend(b Backend) {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend != nil {
+		_ = backend.Close()
+	}
+	backend = b
+}
+
+// Close closes the backend. The next call creates it again.
+func Close() error {
+	backendMu.Lock()
+	defer backendMu.Unlock()
+	if backend == nil {
+		return nil
+	}
+	err := backend.Close()
+	backend = nil
+	return err
+}
+
+// RateLimit takes up to the cost of the request in tokens for its key. The
+// context bounds the backend call; without a deadline, the configured backend
+// timeout applies.
+func RateLimit(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	result, err := getBackend().AllowAtMost(ctx, data)
 	if err != nil {
 		return nil, fmt.Errorf("rate limit failed: %w", err)
 	}
 	return result, nil
 }
+
+// withBackendTimeout bounds the context by the configured backend timeout
+// unless it already has a deadline or the backend does not block.
+func withBackendTimeout(ctx context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := ctx.Deadline(); ok || !Blocks() {
+		return ctx, func() {}
+	}
+	return context.WithTimeout(ctx, config.GetConfig().BackendTimeout)
+}
+
+// Blocks reports whether the calls of the backend wait on the network, so that
+// bounding them by a deadline matters. The memory backend decides at once,
+// and a context of its own would be the allocation of a decision.
+func Blocks() bool {
+	_, inMemory := getBackend().(*memoryBackend)
+	return !inMemory
+}
+
+// Peek returns the state of the key under the limit of the request without
+// taking any token. Allowed is always zero.
+func Peek(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	result, err := getBackend().Peek(ctx, data)
+	if err != nil {
+		return nil, fmt.Errorf("peek failed: %w", err)
+	}
+	return result, nil
+}
+
+// Reset forgets the state of the key, giving it a full burst again.
+func Reset(ctx context.Context, key string) error {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	if err := getBackend().Reset(ctx, key); err != nil {
+		return fmt.Errorf("reset failed: %w", err)
+	}
+	return nil
+}
+
+// AcquireLease takes one of the limit concurrent slots of the key for at most
+// ttl. The lease is nil when all of them are held.
+func AcquireLease(ctx context.Context, key string, limit uint64, ttl time.Duration) (*Lease, error) {
+	if limit == 0 || ttl <= 0 {
+		return nil, fmt.Errorf("acquire lease failed: the limit and the ttl must be positive")
+	}
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	lease, err := getBackend().AcquireLease(ctx, key, limit, ttl)
+	if err != nil {
+		return nil, fmt.Errorf("acquire lease failed: %w", err)
+	}
+	return lease, nil
+}
+
+// ReleaseLease gives the slot of the lease back before it expires.
+func ReleaseLease(ctx context.Context, lease *Lease) error {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	if err := getBackend().ReleaseLease(ctx, lease); err != nil {
+		return fmt.Errorf("release lease failed: %w", err)
+	}
+	return nil
+}
+
+// SetOverride adds the key to the list of the kind until it expires, removing
+// it from the other list. It fails with ErrTooManyOverrides when the list
+// already holds max other keys.
+func SetOverride(ctx context.Context, kind OverrideKind, key string, expires time.Time, max int) error {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	if err := getBackend().SetOverride(ctx, kind, key, expires, max); err != nil {
+		return fmt.Errorf("set %s failed: %w", kind, err)
+	}
+	return nil
+}
+
+// RemoveOverride removes the key from the list of the kind, reporting whether
+// it was there and not expired.
+func RemoveOverride(ctx context.Context, kind OverrideKind, key string) (bool, error) {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	removed, err := getBackend().RemoveOverride(ctx, kind, key)
+	if err != nil {
+		return false, fmt.Errorf("remove %s failed: %w", kind, err)
+	}
+	return removed, nil
+}
+
+// ListOverrides returns the keys of the list of the kind that have not
+// expired.
+func ListOverrides(ctx context.Context, kind OverrideKind) ([]Override, error) {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	list, err := getBackend().ListOverrides(ctx, kind)
+	if err != nil {
+		return nil, fmt.Errorf("list %ss failed: %w", kind, err)
+	}
+	return list, nil
+}
+
+// Ping checks that the backend answers.
+func Ping(ctx context.Context) error {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	if err := getBackend().Ping(ctx); err != nil {
+		return fmt.Errorf("ping failed: %w", err)
+	}
+	return nil
+}
+
+// PoolStats returns the counters of the pool of Redis connections, and false
+// when the backend is not Redis.
+func PoolStats() (*redis.PoolStats, bool) {
+	if b, ok := getBackend().(*redisBackend); ok {
+		return b.client.PoolStats(), true
+	}
+	return nil, false
+}
+
+// ListKeys returns a page of the keys starting with the prefix and the cursor
+// of the next page, zero after the last one. With Redis Cluster, only the keys
+// of the node serving the scan are listed.
+func ListKeys(ctx context.Context, prefix string, cursor uint64, count uint32) ([]string, uint64, error) {
+	ctx, cancel := withBackendTimeout(ctx)
+	defer cancel()
+	keys, next, err := getBackend().ListKeys(ctx, prefix, cursor, count)
+	if err != nil {
+		return nil, 0, fmt.Errorf("list keys failed: %w", err)
+	}
+	return keys, next, nil
+}
@@ -0,0 +1,278 @@
+package rate_limit
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis_rate/v10"
+	"github.com/redis/go-redis/v9"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// keyPrefix is the prefix redis_rate stores the keys under, as do the
+// scripts of the other algorithms.
+const keyPrefix = "rate:"
+
+// leasePrefix is the prefix of the sorted sets holding the leases of the keys,
+// scored by their expiry in milliseconds.
+const leasePrefix = "lease:"
+
+// acquireLease drops the expired leases of the set and adds one unless the
+// limit is reached, returning whether it did. The set expires with its
+// longest lease.
+var acquireLease = redis.NewScript(`
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local ttl = tonumber(ARGV[2])
+local id = ARGV[3]
+
+local time = redis.call("TIME")
+local now = tonumber(time[1]) * 1000 + math.floor(tonumber(time[2]) / 1000)
+
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now)
+if redis.call("ZCARD", key) >= limit then
+  return 0
+end
+redis.call("ZADD", key, now + ttl, id)
+if redis.call("PTTL", key) < ttl then
+  redis.call("PEXPIRE", key, ttl)
+end
+return 1
+`)
+
+// overridePrefix is the prefix of the sorted sets holding the lists of
+// overrides, scored by the expiry of their keys in milliseconds. The hash tag
+// keeps both lists in the same slot of a cluster.
+const overridePrefix = "{override}:"
+
+// setOverride drops the expired keys of the list and adds the key unless the
+// list is full, removing it from the other list. It returns whether it did.
+var setOverride = redis.NewScript(`
+local list = KEYS[1]
+local other = KEYS[2]
+local key = ARGV[1]
+local expires = tonumber(ARGV[2])
+local now = tonumber(ARGV[3])
+local max = tonumber(ARGV[4])
+
+redis.call("ZREMRANGEBYSCORE", list, "-inf", now)
+redis.call("ZREM", other, key)
+if not redis.call("ZSCORE", list, key) and redis.call("ZCARD", list) >= max then
+  return 0
+end
+redis.call("ZADD", list, expires, key)
+return 1
+`)
+
+// removeOverride removes the key from the list and returns whether it had not
+// expired.
+var removeOverride = redis.NewScript(`
+local list = KEYS[1]
+local key = ARGV[1]
+local now = tonumber(ARGV[2])
+
+local expires = redis.call("ZSCORE", list, key)
+redis.call("ZREM", list, key)
+if expires and tonumber(expires) > now then
+  return 1
+end
+return 0
+`)
+
+// dropOtherType deletes the key unless Redis keeps it as the type.
+var dropOtherType = redis.NewScript(`
+if redis.call("TYPE", KEYS[1]).ok ~= ARGV[1] then
+  redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+// redisBackend stores the keys in Redis, shared by all the servers using it.
+type redisBackend struct {
+	client  redis.UniversalClient
+	limiter *redis_rate.Limiter
+	// now replaces the clock of Redis in the scripts of the window
+	// algorithms when set, for the tests.
+	now func() time.Time
+}
+
+func newRedisBackend(redisCfg *config.RedisConfig) *redisBackend {
+	client := redis.NewUniversalClient(&redis.UniversalOptions{
+		Addrs:            redisCfg.Addrs,
+		ClientName:       "TraefikRateLimiter",
+		DB:               redisCfg.DB,
+		Username:         redisCfg.Username,
+		Password:         redisCfg.Password,
+		SentinelUsername: redisCfg.SentinelUsername,
+		SentinelPassword: redisCfg.SentinelPassword,
+		MasterName:       redisCfg.MasterName,
+		PoolSize:         redisCfg.PoolSize,
+		MinIdleConns:     redisCfg.MinIdleConns,
+		PoolTimeout:      redisCfg.PoolTimeout,
+		MaxRetries:       redisCfg.MaxRetries,
+		MinRetryBackoff:  redisCfg.MinRetryBackoff,
+		MaxRetryBackoff:  redisCfg.MaxRetryBackoff,
+		DialTimeout:      redisCfg.DialTimeout,
+		ReadTimeout:      redisCfg.ReadTimeout,
+		WriteTimeout:     redisCfg.WriteTimeout,
+	})
+	return &redisBackend{client: client, limiter: redis_rate.NewLimiter(client)}
+}
+
+func limitOf(data *comm.RateLimitRequestData) redis_rate.Limit {
+	return redis_rate.Limit{
+		Rate:   int(data.Rate),
+		Burst:  int(data.Burst),
+		Period: data.Period,
+	}
+}
+
+func resultOf(result *redis_rate.Result) *Result {
+	return &Result{
+		Allowed:    result.Allowed,
+		Remaining:  result.Remaining,
+		RetryAfter: result.RetryAfter,
+		ResetAfter: result.ResetAfter,
+	}
+}
+
+func (b *redisBackend) AllowAtMost(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	if data.Algorithm != comm.AlgorithmGCRA {
+		return b.runWindow(ctx, data, data.GetCost())
+	}
+	result, err := b.limiter.AllowAtMost(ctx, data.Key, limitOf(data), int(data.GetCost()))
+	if isWrongType(err) {
+		// the key was decided under a window algorithm and starts over
+		if err = dropOtherType.Run(ctx, b.client, []string{keyPrefix + data.Key}, "string").Err(); err != nil {
+			return nil, err
+		}
+		result, err = b.limiter.AllowAtMost(ctx, data.Key, limitOf(data), int(data.GetCost()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resultOf(result), nil
+}
+
+func (b *redisBackend) Peek(ctx context.Context, data *comm.RateLimitRequestData) (*Result, error) {
+	if data.Algorithm != comm.AlgorithmGCRA {
+		return b.runWindow(ctx, data, 0)
+	}
+	result, err := b.limiter.AllowN(ctx, data.Key, limitOf(data), 0)
+	if isWrongType(err) {
+		// the key was decided under a window algorithm, a peek leaves it
+		return &Result{Remaining: int(data.Burst), RetryAfter: -1}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resultOf(result), nil
+}
+
+// isWrongType returns whether the error is that of a command run on a key of
+// another type, which Redis wraps in the error of a script before version 7.
+func isWrongType(err error) bool {
+	return err != nil && strings.Contains(err.Error(), "WRONGTYPE")
+}
+
+func (b *redisBackend) Reset(ctx context.Context, key string) error {
+	return b.limiter.Reset(ctx, key)
+}
+
+// ListKeys lists the keys with SCAN. With Redis Cluster, only the keys of the
+// node serving the scan are listed.
+func (b *redisBackend) ListKeys(ctx context.Context, prefix string, cursor uint64, count uint32) ([]string, uint64, error) {
+	match := keyPrefix + escapePattern(prefix) + "*"
+	keys, next, err := b.client.Scan(ctx, cursor, match, int64(count)).Result()
+	if err != nil {
+		return nil, 0, err
+	}
+	for i, key := range keys {
+		keys[i] = strings.TrimPrefix(key, keyPrefix)
+	}
+	return keys, next, nil
+}
+
+func (b *redisBackend) AcquireLease(ctx context.Context, key string, limit uint64, ttl time.Duration) (*Lease, error) {
+	id, err := newID()
+	if err != nil {
+		return nil, err
+	}
+	expires := time.Now().Add(ttl)
+	acquired, err := acquireLease.Run(ctx, b.client, []string{leasePrefix + key}, limit, ttl.Milliseconds(), id).Int()
+	if err != nil {
+		return nil, err
+	}
+	if acquired == 0 {
+		return nil, nil
+	}
+	return &Lease{Key: key, ID: id, Expires: expires}, nil
+}
+
+func (b *redisBackend) ReleaseLease(ctx context.Context, lease *Lease) error {
+	return b.client.ZRem(ctx, leasePrefix+lease.Key, lease.ID).Err()
+}
+
+func (b *redisBackend) SetOverride(ctx context.Context, kind OverrideKind, key string, expires time.Time, max int) error {
+	keys := []string{overridePrefix + kind.String(), overridePrefix + kind.other().String()}
+	set, err := setOverride.Run(ctx, b.client, keys, key, expires.UnixMilli(), time.Now().UnixMilli(), max).Int()
+	if err != nil {
+		return err
+	}
+	if set == 0 {
+		return ErrTooManyOverrides
+	}
+	return nil
+}
+
+func (b *redisBackend) RemoveOverride(ctx context.Context, kind OverrideKind, key string) (bool, error) {
+	removed, err := removeOverride.Run(ctx, b.client, []string{overridePrefix + kind.String()}, key, time.Now().UnixMilli()).Int()
+	if err != nil {
+		return false, err
+	}
+	return removed == 1, nil
+}
+
+func (b *redisBackend) ListOverrides(ctx context.Context, kind OverrideKind) ([]Override, error) {
+	entries, err := b.client.ZRangeByScoreWithScores(ctx, overridePrefix+kind.String(), &redis.ZRangeBy{
+		Min: "(" + strconv.FormatInt(time.Now().UnixMilli(), 10),
+		Max: "+inf",
+	}).Result()
+	if err != nil {
+		return nil, err
+	}
+	list := make([]Override, len(entries))
+	for i, entry := range entries {
+		key, _ := entry.Member.(string)
+		list[i] = Override{Key: key, Expires: time.UnixMilli(int64(entry.Score))}
+	}
+	return list, nil
+}
+
+func (b *redisBackend) Ping(ctx context.Context) error {
+	return b.client.Ping(ctx).Err()
+}
+
+func (b *redisBackend) Close() error {
+	if err := b.client.Close(); err != nil {
+		return fmt.Errorf("failed to close the redis client: %w", err)
+	}
+	return nil
+}
+
+// escapePattern escapes the glob characters of a SCAN pattern.
+func escapePattern(s string) string {
+	var b strings.Builder
+	for _, r := range s {
+		switch r {
+		case '*', '?', '[', ']', '\\':
+			b.WriteByte('\\')
+		}
+		b.WriteRune(r)
+	}
+	return b.String()
+}
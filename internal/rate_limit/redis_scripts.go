@@ -0,0 +1,260 @@
+package rate_limit
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// The scripts of the window algorithms take the limit, the period in
+// microseconds, the cost, zero to peek, and the time in microseconds, zero for
+// that of Redis, and return the tokens taken, the tokens left, the retry
+// after and the reset after, in microseconds. The windows are aligned on the
+// Unix epoch, unless fixedWindow is given the start of a calendar window, the
+// period being its length. A key kept under another algorithm starts over, a
+// peek reports it as new and leaves its state. The memory backend runs the
+// same algorithms.
+
+// slidingWindowLog logs each decision in a sorted set scored by its time, as
+// the ID of the decision and the tokens it took, like the memory backend does.
+var slidingWindowLog = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+local id = ARGV[5]
+
+local now = tonumber(ARGV[4])
+if now == 0 then
+  local time = redis.call("TIME")
+  now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+end
+
+local kind = redis.call("TYPE", key).ok
+if kind ~= "zset" and kind ~= "none" then
+  if cost == 0 then
+    return {0, limit, -1, 0}
+  end
+  redis.call("DEL", key)
+end
+-- the decisions taken a window ago or earlier have left it
+redis.call("ZREMRANGEBYSCORE", key, "-inf", now - window)
+local log = redis.call("ZRANGE", key, 0, -1, "WITHSCORES")
+local counts = {}
+local taken = 0
+for i = 1, #log, 2 do
+  counts[i] = tonumber(string.match(log[i], ":(%d+)$"))
+  taken = taken + counts[i]
+end
+local remaining = limit - taken
+
+local reset_after = 0
+if #log > 0 then
+  reset_after = tonumber(log[#log]) + window - now
+end
+
+if remaining < 1 or cost == 0 then
+  local retry_after = -1
+  if remaining < 1 then
+    -- a token is available once enough of the oldest left the window
+    local excess = 1 - remaining
+    for i = 1, #log, 2 do
+      if counts[i] >= excess then
+        retry_after = tonumber(log[i + 1]) + window - now
+        break
+      end
+      excess = excess - counts[i]
+    end
+  end
+  return {0, math.max(remaining, 0), retry_after, reset_after}
+end
+
+cost = math.min(cost, remaining)
+redis.call("ZADD", key, now, id .. ":" .. cost)
+redis.call("PEXPIRE", key, math.ceil(window / 1000))
+return {cost, remaining - cost, -1, window}
+`)
+
+// slidingWindowCounter counts the tokens taken per window in a hash by the
+// index of the window, weighing the count of the previous window by how much
+// of it the period before now covers.
+var slidingWindowCounter = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local now = tonumber(ARGV[4])
+if now == 0 then
+  local time = redis.call("TIME")
+  now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+end
+
+local kind = redis.call("TYPE", key).ok
+if kind ~= "hash" and kind ~= "none" then
+  if cost == 0 then
+    return {0, limit, -1, 0}
+  end
+  redis.call("DEL", key)
+end
+local current = math.floor(now / window)
+local elapsed = now - current * window
+local count = tonumber(redis.call("HGET", key, current)) or 0
+local previous = tonumber(redis.call("HGET", key, current - 1)) or 0
+local weight = (window - elapsed) / window
+local remaining = math.floor(limit - (previous * weight + count))
+
+local reset_after = 0
+if count > 0 then
+  reset_after = 2 * window - elapsed
+elseif previous > 0 then
+  reset_after = window - elapsed
+end
+
+if remaining < 1 or cost == 0 then
+  local retry_after = -1
+  if remaining < 1 then
+    -- the estimate must drop to limit-1: the previous window slides out
+    -- during the current one, the current one during the next
+    local allowed = limit - 1
+    if count <= allowed and previous > 0 then
+      retry_after = math.ceil(window * (previous - allowed + count) / previous) - elapsed
+    else
+      retry_after = window - elapsed + math.ceil(math.max(window * (count - allowed) / count, 0))
+    end
+  end
+  return {0, math.max(remaining, 0), retry_after, reset_after}
+end
+
+cost = math.min(cost, remaining)
+redis.call("HINCRBY", key, current, cost)
+for _, field in ipairs(redis.call("HKEYS", key)) do
+  if tonumber(field) < current - 1 then
+    redis.call("HDEL", key, field)
+  end
+end
+redis.call("PEXPIRE", key, math.ceil((2 * window - elapsed) / 1000))
+return {cost, remaining - cost, -1, 2 * window - elapsed}
+`)
+
+// fixedWindow counts the tokens taken per window in a hash by the index of
+// the window.
+var fixedWindow = redis.NewScript(`
+redis.replicate_commands()
+
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local window = tonumber(ARGV[2])
+local cost = tonumber(ARGV[3])
+
+local now = tonumber(ARGV[4])
+if now == 0 then
+  local time = redis.call("TIME")
+  now = tonumber(time[1]) * 1000000 + tonumber(time[2])
+end
+
+local kind = redis.call("TYPE", key).ok
+if kind ~= "hash" and kind ~= "none" then
+  if cost == 0 then
+    return {0, limit, -1, 0}
+  end
+  redis.call("DEL", key)
+end
+local current = math.floor(now / window)
+local left = window - (now - current * window)
+local start = tonumber(ARGV[5])
+if start then
+  current = start
+  left = start + window - now
+end
+local count = tonumber(redis.call("HGET", key, current)) or 0
+local remaining = limit - count
+
+local reset_after = 0
+if count > 0 then
+  reset_after = left
+end
+
+if remaining < 1 or cost == 0 then
+  local retry_after = -1
+  if remaining < 1 then
+    retry_after = left
+  end
+  return {0, math.max(remaining, 0), retry_after, reset_after}
+end
+
+cost = math.min(cost, remaining)
+redis.call("HINCRBY", key, current, cost)
+for _, field in ipairs(redis.call("HKEYS", key)) do
+  if tonumber(field) ~= current then
+    redis.call("HDEL", key, field)
+  end
+end
+redis.call("PEXPIRE", key, math.ceil(left / 1000))
+return {cost, remaining - cost, -1, left}
+`)
+
+// runWindow takes up to cost tokens for the key of the request under its
+// window algorithm, none with a zero cost.
+func (b *redisBackend) runWindow(ctx context.Context, data *comm.RateLimitRequestData, cost uint64) (*Result, error) {
+	window := max(data.Period.Microseconds(), 1)
+	keys := []string{keyPrefix + data.Key}
+	var now int64
+	if b.now != nil {
+		now = b.now().UnixMicro()
+	}
+	var values []int64
+	var err error
+	switch data.Algorithm {
+	case comm.AlgorithmSlidingWindowLog:
+		var id string
+		if id, err = newID(); err != nil {
+			return nil, err
+		}
+		values, err = slidingWindowLog.Run(ctx, b.client, keys, data.Rate, window, cost, now, id).Int64Slice()
+	case comm.AlgorithmSlidingWindowCounter:
+		values, err = slidingWindowCounter.Run(ctx, b.client, keys, data.Rate, window, cost, now).Int64Slice()
+	case comm.AlgorithmFixedWindow:
+		if data.Calendar == comm.CalendarNone {
+			values, err = fixedWindow.Run(ctx, b.client, keys, data.Rate, window, cost, now).Int64Slice()
+			break
+		}
+		// the time zones are only known to the servers, which take calendar
+		// windows on their own clock
+		clock := time.Now()
+		if b.now != nil {
+			clock = b.now()
+		}
+		start, end := fixedWindowBounds(data, clock.UnixNano())
+		values, err = fixedWindow.Run(ctx, b.client, keys, data.Rate, (end-start)/1000, cost, clock.UnixMicro(), start/1000).Int64Slice()
+	default:
+		return nil, fmt.Errorf("unknown algorithm: %s", data.Algorithm)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(values) != 4 {
+		return nil, fmt.Errorf("unexpected reply of %d values", len(values))
+	}
+	return &Result{
+		Allowed:    int(values[0]),
+		Remaining:  int(values[1]),
+		RetryAfter: microseconds(values[2]),
+		ResetAfter: microseconds(values[3]),
+	}, nil
+}
+
+// microseconds returns the duration of a script, -1 staying -1.
+func microseconds(value int64) time.Duration {
+	if value < 0 {
+		return -1
+	}
+	return time.Duration(value) * time.Microsecond
+}
@@ -0,0 +1,43 @@
+package rate_limit
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// newRedisTestBackend returns a backend on the Redis of the configuration
+// whose window scripts run on the returned clock, skipping the test when
+// Redis cannot be reached.
+func newRedisTestBackend(t *testing.T) (*redisBackend, *time.Time) {
+	t.Helper()
+	b := newRedisBackend(config.GetConfig().Redis)
+	t.Cleanup(func() { b.Close() })
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := b.Ping(ctx); err != nil {
+		t.Skipf("redis is unreachable: %v", err)
+	}
+	now := time.Unix(1_700_000_000, 0)
+	b.now = func() time.Time { return now }
+	return b, &now
+}
+
+// TestRedisWindows expects the scripts of the window algorithms to answer
+// like the memory backend for the same sequence.
+func TestRedisWindows(t *testing.T) {
+	b, now := newRedisTestBackend(t)
+	prefix, err := newID()
+	if err != nil {
+		t.Fatalf("failed to make a key prefix: %v", err)
+	}
+	prefix = "test:" + prefix + ":"
+	t.Cleanup(func() {
+		for _, key := range []string{"log", "fixed", "counter", "calendar"} {
+			b.Reset(context.Background(), prefix+key)
+		}
+	})
+	testWindows(t, b, now, prefix)
+}
@@ -0,0 +1,416 @@
+package server
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+const (
+	// httpRetryTimeout is how long the HTTP listeners wait for their address
+	// after a hot upgrade, until the previous process releases it.
+	httpRetryTimeout = 30 * time.Second
+	// defaultHotKeys is the number of hot keys listed without a limit.
+	defaultHotKeys = 20
+	// maxAdminBody is the largest request body of the admin API.
+	maxAdminBody = 64 * 1024
+)
+
+// NewAdminHandler returns the admin HTTP API. Every request must carry the
+// token as a bearer token.
+func NewAdminHandler(token string) http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /v1/stats", handleStats)
+	mux.HandleFunc("GET /v1/policies", handlePolicies)
+	mux.HandleFunc("GET /v1/keys", handleListKeys)
+	mux.HandleFunc("GET /v1/keys/{key}", handlePeek)
+	mux.HandleFunc("DELETE /v1/keys/{key}", handleReset)
+	mux.HandleFunc("GET /v1/hot-keys", handleHotKeys)
+	mux.HandleFunc("GET /v1/bans", listOverrides(manualBans))
+	mux.HandleFunc("POST /v1/bans", handleBan)
+	mux.HandleFunc("DELETE /v1/bans/{key}", handleUnban)
+	mux.HandleFunc("GET /v1/allows", listOverrides(manualAllows))
+	mux.HandleFunc("POST /v1/allows", handleAllow)
+	mux.HandleFunc("DELETE /v1/allows/{key}", handleDisallow)
+	return requireToken(token, mux)
+}
+
+// requireToken rejects the requests without the bearer token.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		given, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			w.Header().Set("WWW-Authenticate", `Bearer realm="traefik-rate-limit"`)
+			writeError(w, http.StatusUnauthorized, "unauthorized")
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// adminEnabled reports whether the admin API is configured. The config
+// requires a token with an address.
+func adminEnabled(cfg *config.AdminConfig) bool {
+	return cfg != nil && cfg.Addr != ""
+}
+
+// serveAdmin serves the admin API until the context is done.
+func serveAdmin(ctx context.Context, cfg *config.AdminConfig, inherited bool) error {
+	hotKeys.enabled.Store(true)
+	return serveHTTP(ctx, "admin API", cfg.Addr, NewAdminHandler(cfg.Token), inherited)
+}
+
+// serveHTTP serves the handler on the address until the context is done.
+// After a hot upgrade, the address is retried until the previous process
+// releases it.
+func serveHTTP(ctx context.Context, name string, addr string, handler http.Handler, inherited bool) error {
+	listener, err := net.Listen("tcp", addr)
+	for deadline := time.Now().Add(httpRetryTimeout); err != nil && inherited && time.Now().Before(deadline); {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(100 * time.Millisecond):
+		}
+		listener, err = net.Listen("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to listen for the %s: %w", name, err)
+	}
+	server := &http.Server{
+		Handler:           handler,
+		ReadHeaderTimeout: 5 * time.Second,
+	}
+	go func() {
+		<-ctx.Done()
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		_ = server.Shutdown(shutdownCtx)
+	}()
+	slog.Info(name+" listening", slog.String("addr", listener.Addr().String()))
+	if err := server.Serve(listener); err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+	return nil
+}
+
+func writeJSON(w http.ResponseWriter, status int, value any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if err := json.NewEncoder(w).Encode(value); err != nil {
+		slog.Debug("failed to write admin response", slog.Any("error", err))
+	}
+}
+
+func writeError(w http.ResponseWriter, status int, message string) {
+	writeJSON(w, status, map[string]string{"error": message})
+}
+
+// writeBackendError answers an error of the backend with the status of its class.
+func writeBackendError(w http.ResponseWriter, err error) {
+	status := http.StatusServiceUnavailable
+	switch errorCode(err) {
+	case comm.ErrorCodeInvalidRequest:
+		status = http.StatusBadRequest
+	case comm.ErrorCodeTimeout:
+		status = http.StatusGatewayTimeout
+	}
+	writeError(w, status, err.Error())
+}
+
+func handleStats(w http.ResponseWriter, _ *http.Request) {
+	snapshot := stats.snapshot()
+	writeJSON(w, http.StatusOK, struct {
+		Stats
+		Uptime string `json:"uptime"`
+	}{Stats: snapshot, Uptime: snapshot.Uptime.Round(time.Second).String()})
+}
+
+type policyJSON struct {
+	Name      string `json:"name"`
+	Algorithm string `json:"algorithm"`
+	Rate      uint64 `json:"rate"`
+	Burst     uint64 `json:"burst"`
+	Period    string `json:"period"`
+	Cost      uint64 `json:"cost"`
+	Namespace string `json:"namespace,omitempty"`
+	Calendar  string `json:"calendar,omitempty"`
+	TimeZone  string `json:"time_zone,omitempty"`
+	// Source is config for the policies of the config, client for those
+	// registered with their limits.
+	Source      string `json:"source"`
+	Connections int    `json:"connections"`
+}
+
+func namedPolicyJSON(name string, policy *config.PolicyConfig, connections int) policyJSON {
+	return policyJSON{
+		Name:        name,
+		Algorithm:   policy.Algorithm.String(),
+		Rate:        policy.Rate,
+		Burst:       policy.Burst,
+		Period:      policy.Period.String(),
+		Cost:        policy.Cost,
+		Namespace:   policy.Namespace,
+		Calendar:    policy.Calendar.String(),
+		TimeZone:    policy.TimeZone,
+		Source:      "config",
+		Connections: connections,
+	}
+}
+
+// handlePolicies lists the policies registered on the open connections and
+// the policies of the config, registered or not.
+func handlePolicies(w http.ResponseWriter, _ *http.Request) {
+	named := config.GetConfig().Policies
+	policies := make([]policyJSON, 0)
+	listed := make(map[string]bool)
+	for _, active := range activePolicies.list() {
+		if policy, ok := named[active.Policy.Name]; ok && active.Policy.IsNamed() {
+			policies = append(policies, namedPolicyJSON(active.Policy.Name, policy, active.Connections))
+			listed[active.Policy.Name] = true
+			continue
+		}
+		policies = append(policies, policyJSON{
+			Name:        active.Policy.Name,
+			Algorithm:   active.Policy.Algorithm.String(),
+			Rate:        active.Policy.Rate,
+			Burst:       active.Policy.Burst,
+			Period:      active.Policy.Period.String(),
+			Cost:        active.Policy.Cost,
+			Calendar:    active.Policy.Calendar.String(),
+			TimeZone:    active.Policy.TimeZone,
+			Source:      "client",
+			Connections: active.Connections,
+		})
+	}
+	names := make([]string, 0, len(named))
+	for name := range named {
+		if !listed[name] {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		policies = append(policies, namedPolicyJSON(name, named[name], 0))
+	}
+	writeJSON(w, http.StatusOK, policies)
+}
+
+func handleListKeys(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	cursor, err := parseUint(query.Get("cursor"), 0)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid cursor: %v", err))
+		return
+	}
+	count, err := parseUint(query.Get("count"), comm.MaxListKeysCount)
+	if err != nil || count == 0 || count > comm.MaxListKeysCount {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("count must be between 1 and %d", comm.MaxListKeysCount))
+		return
+	}
+	keys, next, err := rate_limit.ListKeys(r.Context(), query.Get("prefix"), cursor, uint32(count))
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	if keys == nil {
+		keys = []string{}
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"keys": keys, "cursor": next})
+}
+
+// handlePeek shows the state of a key under the limits of the policy named
+// by the policy parameter, or those of the rate, burst and period parameters.
+func handlePeek(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	query := r.URL.Query()
+	var data comm.RateLimitRequestData
+	if name := query.Get("policy"); name != "" {
+		if named, err := namedPolicy(config.GetConfig(), name); err == nil {
+			// the key is given whole, with the namespace of the policy
+			data = named.Request("", 0)
+			data.Key = key
+		} else if policy, ok := activePolicies.get(name); ok {
+			data = policy.Request(key, 0)
+		} else {
+			writeError(w, http.StatusNotFound, fmt.Sprintf("unknown policy %q", name))
+			return
+		}
+	} else {
+		algorithm, algorithmErr := comm.ParseAlgorithm(query.Get("algorithm"))
+		rate, rateErr := parseUint(query.Get("rate"), 0)
+		burst, burstErr := parseUint(query.Get("burst"), 0)
+		period, periodErr := time.ParseDuration(query.Get("period"))
+		calendar, calendarErr := comm.ParseCalendar(query.Get("calendar"))
+		if err := errors.Join(algorithmErr, rateErr, burstErr, periodErr, calendarErr); err != nil {
+			writeError(w, http.StatusBadRequest, fmt.Sprintf("a policy or a rate, burst and period are required: %v", err))
+			return
+		}
+		data = comm.RateLimitRequestData{Algorithm: algorithm, Rate: rate, Burst: burst, Period: period, Key: key, Calendar: calendar, TimeZone: query.Get("time_zone")}
+	}
+	if err := rate_limit.Validate(&data); err != nil {
+		writeError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	result, err := rate_limit.Peek(r.Context(), &data)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	now := time.Now()
+	state := map[string]any{
+		"key":        key,
+		"remaining":  result.Remaining,
+		"retryAfter": max(result.RetryAfter, 0).String(),
+		"resetAfter": result.ResetAfter.String(),
+	}
+	if left, ok := manualBans.get(key, now); ok {
+		state["bannedFor"] = left.String()
+	}
+	if left, ok := manualAllows.get(key, now); ok {
+		state["allowedFor"] = left.String()
+	}
+	writeJSON(w, http.StatusOK, state)
+}
+
+func handleReset(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	if err := rate_limit.Reset(r.Context(), key); err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	slog.Info("key reset", slog.String("key", key), slog.String("remote_addr", r.RemoteAddr))
+	events.unbanned(key)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleHotKeys(w http.ResponseWriter, r *http.Request) {
+	limit, err := parseUint(r.URL.Query().Get("limit"), defaultHotKeys)
+	if err != nil || limit == 0 || limit > maxHotKeys {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("limit must be between 1 and %d", maxHotKeys))
+		return
+	}
+	writeJSON(w, http.StatusOK, hotKeys.top(int(limit), time.Now()))
+}
+
+func listOverrides(list *overrideList) http.HandlerFunc {
+	return func(w http.ResponseWriter, _ *http.Request) {
+		writeJSON(w, http.StatusOK, list.list(time.Now()))
+	}
+}
+
+// overrideRequest is the body adding a ban or an allow-list entry.
+type overrideRequest struct {
+	Key string `json:"key"`
+	// TTL is how long the entry lasts, such as 10m.
+	TTL string `json:"ttl"`
+}
+
+// parseOverride reads the key and the ttl of the body, answering the errors.
+func parseOverride(w http.ResponseWriter, r *http.Request) (string, time.Duration, bool) {
+	var body overrideRequest
+	decoder := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxAdminBody))
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(&body); err != nil {
+		writeError(w, http.StatusBadRequest, fmt.Sprintf("invalid body: %v", err))
+		return "", 0, false
+	}
+	if body.Key == "" {
+		writeError(w, http.StatusBadRequest, "key is empty")
+		return "", 0, false
+	}
+	ttl, err := time.ParseDuration(body.TTL)
+	if err != nil || ttl <= 0 {
+		writeError(w, http.StatusBadRequest, "ttl must be a positive duration")
+		return "", 0, false
+	}
+	return body.Key, ttl, true
+}
+
+func handleBan(w http.ResponseWriter, r *http.Request) {
+	key, ttl, ok := parseOverride(w, r)
+	if !ok {
+		return
+	}
+	expires, err := ban(r.Context(), key, ttl)
+	if err != nil {
+		writeOverrideError(w, err)
+		return
+	}
+	slog.Info("key banned", slog.String("key", key), slog.Duration("ttl", ttl), slog.String("remote_addr", r.RemoteAddr))
+	writeJSON(w, http.StatusCreated, rate_limit.Override{Key: key, Expires: expires})
+}
+
+func handleUnban(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	banned, err := unban(r.Context(), key)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	if !banned {
+		writeError(w, http.StatusNotFound, "key is not banned")
+		return
+	}
+	slog.Info("key unbanned", slog.String("key", key), slog.String("remote_addr", r.RemoteAddr))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func handleAllow(w http.ResponseWriter, r *http.Request) {
+	key, ttl, ok := parseOverride(w, r)
+	if !ok {
+		return
+	}
+	expires, err := allow(r.Context(), key, ttl)
+	if err != nil {
+		writeOverrideError(w, err)
+		return
+	}
+	slog.Info("key allowed", slog.String("key", key), slog.Duration("ttl", ttl), slog.String("remote_addr", r.RemoteAddr))
+	writeJSON(w, http.StatusCreated, rate_limit.Override{Key: key, Expires: expires})
+}
+
+func handleDisallow(w http.ResponseWriter, r *http.Request) {
+	key := r.PathValue("key")
+	allowed, err := disallow(r.Context(), key)
+	if err != nil {
+		writeBackendError(w, err)
+		return
+	}
+	if !allowed {
+		writeError(w, http.StatusNotFound, "key is not allowed")
+		return
+	}
+	slog.Info("key no longer allowed", slog.String("key", key), slog.String("remote_addr", r.RemoteAddr))
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// writeOverrideError answers an error adding a key to a list, a conflict when
+// the list is full.
+func writeOverrideError(w http.ResponseWriter, err error) {
+	if errors.Is(err, rate_limit.ErrTooManyOverrides) {
+		writeError(w, http.StatusConflict, fmt.Sprintf("%v, at most %d", err, maxOverrides))
+		return
+	}
+	writeBackendError(w, err)
+}
+
+// parseUint parses a query parameter, the fallback when it is empty.
+func parseUint(value string, fallback uint64) (uint64, error) {
+	if value == "" {
+		return fallback, nil
+	}
+	return strconv.ParseUint(value, 10, 64)
+}
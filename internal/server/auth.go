@@ -0,0 +1,57 @@
+package server
+
+import (
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"slices"
+	"strconv"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// checkPeer rejects unix socket peers running as a user or group that is not allowed.
+func checkPeer(conn net.Conn, auth *config.AuthConfig) error {
+	if auth == nil || (len(auth.AllowedUIDs) == 0 && len(auth.AllowedGIDs) == 0) {
+		return nil
+	}
+	unixConn, ok := conn.(*net.UnixConn)
+	if !ok {
+		return nil
+	}
+	uid, gid, err := peerCredentials(unixConn)
+	if err != nil {
+		return err
+	}
+	if len(auth.AllowedUIDs) > 0 && !slices.Contains(auth.AllowedUIDs, uid) {
+		return fmt.Errorf("peer user %d is not allowed", uid)
+	}
+	if len(auth.AllowedGIDs) > 0 && !slices.Contains(auth.AllowedGIDs, gid) {
+		return fmt.Errorf("peer group %d is not allowed", gid)
+	}
+	slog.Debug("peer credentials accepted", slog.Int("uid", uid), slog.Int("gid", gid))
+	return nil
+}
+
+// applySocketPermissions sets the file mode and ownership of the unix socket.
+func applySocketPermissions(socketPath string, socket *config.SocketConfig) error {
+	if socket == nil {
+		return nil
+	}
+	if socket.Mode != "" {
+		mode, err := strconv.ParseUint(socket.Mode, 8, 32)
+		if err != nil {
+			return fmt.Errorf("invalid socket mode %s: %w", socket.Mode, err)
+		}
+		if err := os.Chmod(socketPath, os.FileMode(mode)); err != nil {
+			return fmt.Errorf("failed to set socket mode: %w", err)
+		}
+	}
+	if socket.UID >= 0 || socket.GID >= 0 {
+		if err := os.Chown(socketPath, socket.UID, socket.GID); err != nil {
+			return fmt.Errorf("failed to set socket owner: %w", err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,222 @@
+package server
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
+)
+
+const testToken = "secret"
+
+// challenge sends the nonce and returns the answer of the server.
+func (c *testClient) challenge(nonce [comm.AuthNonceSize]byte) comm.AuthData {
+	c.t.Helper()
+	resp := c.send(&comm.Request{Type: comm.RequestTypeAuthChallenge, Auth: comm.AuthData{Nonce: nonce}})
+	if resp.Status != comm.ResponseStatusOK {
+		c.t.Fatalf("expected the challenge to be answered, got %s", resp.Error)
+	}
+	return resp.Auth
+}
+
+// prove sends the proof of the client and returns the response.
+func (c *testClient) prove(mac [comm.AuthMACSize]byte) *comm.Response {
+	c.t.Helper()
+	return c.send(&comm.Request{Type: comm.RequestTypeAuth, Auth: comm.AuthData{MAC: mac}})
+}
+
+func nonce(t *testing.T) [comm.AuthNonceSize]byte {
+	t.Helper()
+	nonce, err := comm.NewAuthNonce()
+	if err != nil {
+		t.Fatalf("failed to create nonce: %v", err)
+	}
+	return nonce
+}
+
+func TestAuth(t *testing.T) {
+	c := startSession(t, &config.AuthConfig{Token: testToken})
+	clientNonce := nonce(t)
+	answer := c.challenge(clientNonce)
+	if !comm.VerifyProof(comm.ServerProof(testToken, clientNonce, answer.Nonce), answer.MAC) {
+		t.Errorf("expected the server to prove it knows the token")
+	}
+	if resp := c.prove(comm.ClientProof(testToken, clientNonce, answer.Nonce)); resp.Status != comm.ResponseStatusOK {
+		t.Fatalf("expected the proof to be accepted, got %s", resp.Error)
+	}
+	if resp := c.send(&comm.Request{Type: comm.RequestTypePing, Ping: "a"}); resp.Status != comm.ResponseStatusOK {
+		t.Errorf("expected requests once authenticated, got %s", resp.Error)
+	}
+}
+
+func TestAuthWrongToken(t *testing.T) {
+	c := startSession(t, &config.AuthConfig{Token: testToken})
+	failures := metrics.authFailures.Load()
+	clientNonce := nonce(t)
+	answer := c.challenge(clientNonce)
+	resp := c.prove(comm.ClientProof("wrong", clientNonce, answer.Nonce))
+	if resp.Status != comm.ResponseStatusError || resp.Code != comm.ErrorCodeUnauthorized {
+		t.Errorf("expected the proof to be refused, got %v: %s", resp.Code, resp.Error)
+	}
+	c.expectClosed()
+	if got := metrics.authFailures.Load() - failures; got != 1 {
+		t.Errorf("expected 1 failure counted, got %d", got)
+	}
+}
+
+// TestAuthReplayedChallenge expects the proof of a past authentication to be
+// refused, the server nonce of each challenge being new.
+func TestAuthReplayedChallenge(t *testing.T) {
+	first := startSession(t, &config.AuthConfig{Token: testToken})
+	clientNonce := nonce(t)
+	answer := first.challenge(clientNonce)
+	proof := comm.ClientProof(testToken, clientNonce, answer.Nonce)
+	if resp := first.prove(proof); resp.Status != comm.ResponseStatusOK {
+		t.Fatalf("expected the proof to be accepted, got %s", resp.Error)
+	}
+
+	tests := []struct {
+		name      string
+		challenge bool
+	}{
+		{name: "without a challenge"},
+		{name: "after a challenge with the same client nonce", challenge: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := startSession(t, &config.AuthConfig{Token: testToken})
+			if tt.challenge {
+				if replayed := c.challenge(clientNonce); replayed.Nonce == answer.Nonce {
+					t.Fatalf("expected a new server nonce")
+				}
+			}
+			if resp := c.prove(proof); resp.Code != comm.ErrorCodeUnauthorized {
+				t.Errorf("expected the replayed proof to be refused, got %v: %s", resp.Code, resp.Error)
+			}
+			c.expectClosed()
+		})
+	}
+}
+
+func TestUnauthenticatedRequest(t *testing.T) {
+	c := startSession(t, &config.AuthConfig{Token: testToken})
+	resp := c.send(&comm.Request{Type: comm.RequestTypePing, Ping: "a"})
+	if resp.Status != comm.ResponseStatusError || resp.Code != comm.ErrorCodeUnauthorized {
+		t.Errorf("expected the request to be refused, got %v: %s", resp.Code, resp.Error)
+	}
+	// the client may still authenticate
+	clientNonce := nonce(t)
+	answer := c.challenge(clientNonce)
+	if resp := c.prove(comm.ClientProof(testToken, clientNonce, answer.Nonce)); resp.Status != comm.ResponseStatusOK {
+		t.Errorf("expected the proof to be accepted, got %s", resp.Error)
+	}
+}
+
+// login proves the token after a challenge and returns the response.
+func (c *testClient) login(token string) *comm.Response {
+	c.t.Helper()
+	clientNonce := nonce(c.t)
+	answer := c.challenge(clientNonce)
+	return c.prove(comm.ClientProof(token, clientNonce, answer.Nonce))
+}
+
+// hello agrees on the features with the server.
+func (c *testClient) hello(features comm.Feature) comm.Feature {
+	c.t.Helper()
+	resp := c.send(&comm.Request{Type: comm.RequestTypeHello, Hello: comm.HelloData{MinVersion: comm.MinVersion, MaxVersion: comm.VERSION, Features: features}})
+	return resp.Hello.Features
+}
+
+func TestAdminFrames(t *testing.T) {
+	tests := []struct {
+		name    string
+		auth    *config.AuthConfig
+		admin   bool
+		token   string
+		allowed bool
+	}{
+		{name: "no token", allowed: true},
+		{name: "token", auth: &config.AuthConfig{Token: testToken}, token: testToken},
+		{name: "admin token without the admin feature", auth: &config.AuthConfig{Token: testToken, AdminToken: "admin"}, token: testToken},
+		{name: "admin token", auth: &config.AuthConfig{Token: testToken, AdminToken: "admin"}, admin: true, token: "admin", allowed: true},
+		{name: "admin token only", auth: &config.AuthConfig{AdminToken: "admin"}},
+		{name: "admin token only, proven", auth: &config.AuthConfig{AdminToken: "admin"}, admin: true, token: "admin", allowed: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			c := startSession(t, tt.auth)
+			features := comm.SupportedFeatures
+			if tt.admin {
+				features |= comm.FeatureAdmin
+			}
+			if agreed := c.hello(features); agreed.Has(comm.FeatureAdmin) != tt.admin {
+				t.Fatalf("expected the admin feature to be agreed on: %t, got %s", tt.admin, agreed)
+			}
+			if tt.token != "" {
+				if resp := c.login(tt.token); resp.Status != comm.ResponseStatusOK {
+					t.Fatalf("expected the proof to be accepted, got %s", resp.Error)
+				}
+			}
+			// allowed frames reach the backend, only refused ones are sent
+			for _, reqType := range []comm.RequestType{comm.RequestTypeReset, comm.RequestTypeListKeys} {
+				if allowed := c.sess.allowed(reqType); allowed != tt.allowed {
+					t.Errorf("expected %s to be allowed: %t, got %t", reqType, tt.allowed, allowed)
+				}
+			}
+			if !tt.allowed {
+				resp := c.send(&comm.Request{Type: comm.RequestTypeReset, Key: comm.KeyData{Key: "a"}})
+				if resp.Code != comm.ErrorCodeUnauthorized {
+					t.Errorf("expected the reset to be refused, got %v: %s", resp.Code, resp.Error)
+				}
+			}
+			if !c.sess.allowed(comm.RequestTypePing) {
+				t.Errorf("expected other requests to be allowed")
+			}
+		})
+	}
+}
+
+// TestAdminTokenProof expects clients asking for the admin feature to prove
+// the admin token, not the token of the other clients.
+func TestAdminTokenProof(t *testing.T) {
+	c := startSession(t, &config.AuthConfig{Token: testToken, AdminToken: "admin"})
+	c.hello(comm.SupportedFeatures | comm.FeatureAdmin)
+	if resp := c.login(testToken); resp.Code != comm.ErrorCodeUnauthorized {
+		t.Errorf("expected the proof of the token to be refused, got %v: %s", resp.Code, resp.Error)
+	}
+	c.expectClosed()
+}
+
+func TestListenRestrictsSocket(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("unix sockets have no file mode on windows")
+	}
+	path := filepath.Join(t.TempDir(), "server.sock")
+	address, err := transport.ParseAddress(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, _, err := listen(address, &config.SocketConfig{Mode: "0660", UID: -1, GID: -1})
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	defer listener.Close()
+	info, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the configured mode is only applied once the socket exists
+	if mode := info.Mode().Perm(); mode != 0o600 {
+		t.Errorf("expected the socket to be created as 0600, got %o", mode)
+	}
+	if err := applySocketPermissions(path, &config.SocketConfig{Mode: "0660", UID: -1, GID: -1}); err != nil {
+		t.Fatal(err)
+	}
+	if info, err = os.Stat(path); err != nil || info.Mode().Perm() != 0o660 {
+		t.Errorf("expected the configured mode, got %v, %v", info.Mode().Perm(), err)
+	}
+}
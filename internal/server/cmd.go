@@ -4,12 +4,24 @@ import (
 	"context"
 	"log/slog"
 	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
 )
 
+// RunServer serves on the socket with the config of the process until the
+// context is done.
 func RunServer(ctx context.Context, socketPath string) {
+	RunServerWithConfig(ctx, socketPath, config.GetConfig)
+}
+
+// RunServerWithConfig serves on the socket with the config returned by
+// getConfig until the context is done. The config is read again for each
+// connection and each named policy looked up, so that its changes apply. The
+// decisions are made by the backend of the rate_limit package.
+func RunServerWithConfig(ctx context.Context, socketPath string, getConfig func() *config.Config) {
 	serverErr := make(chan error, 1)
 	go func() {
-		serverErr <- runServer(ctx, socketPath)
+		serverErr <- runServer(ctx, socketPath, getConfig)
 	}()
 
 	// Listen for the interrupt signal or server error.
@@ -20,8 +32,8 @@ func RunServer(ctx context.Context, socketPath string) {
 		}
 	case <-ctx.Done():
 		slog.Info("shutting down gracefully, press Ctrl+C again to force")
-		// Optionally add a timeout for graceful shutdown
-		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		// connections get the drain timeout to move to another server
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), getConfig().DrainTimeout+5*time.Second)
 		defer cancel()
 
 		// Wait for server goroutine to finish (it should return when context is cancelled)
@@ -0,0 +1,219 @@
+package server
+
+import (
+	"container/heap"
+	"context"
+	"log/slog"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+const (
+	// eventQueueSize is the number of events waiting to be written to a
+	// subscribed connection. Events pushed while it is full are dropped,
+	// except for health events, which do not wait in the queue.
+	eventQueueSize = 256
+	// maxTrackedBans bounds the number of denied keys remembered, so that a
+	// ban is announced once and not on every denied decision.
+	maxTrackedBans = 100000
+	// healthProbeInterval is the time between two checks of a backend that
+	// is down.
+	healthProbeInterval = time.Second
+)
+
+// eventHub pushes the events of the server to the subscribed connections.
+type eventHub struct {
+	mu          sync.Mutex
+	subscribers map[*session]comm.EventMask
+	// bans are the announced denied keys and the time they may retry, at
+	// most maxBans. expiries orders them by that time, so that the expired
+	// ones are forgotten as new ones come without scanning them all.
+	bans     map[string]time.Time
+	expiries banExpiries
+	maxBans  int
+	// subscribed is the union of the events of the subscribers, read on the
+	// decision path without taking mu.
+	subscribed atomic.Uint32
+	// down is set while the backend is unavailable.
+	down atomic.Bool
+}
+
+var events = newEventHub(maxTrackedBans)
+
+func newEventHub(maxBans int) *eventHub {
+	return &eventHub{
+		subscribers: make(map[*session]comm.EventMask),
+		bans:        make(map[string]time.Time),
+		maxBans:     maxBans,
+	}
+}
+
+// subscribe sets the events pushed to the session, none removing it.
+func (h *eventHub) subscribe(sess *session, mask comm.EventMask) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if mask == 0 {
+		delete(h.subscribers, sess)
+	} else {
+		h.subscribers[sess] = mask
+	}
+	h.updateSubscribed()
+	// subscribers learn at once of a backend already down
+	if mask.Has(comm.EventTypeBackendHealth) && h.down.Load() {
+		sess.push(comm.EventData{Type: comm.EventTypeBackendHealth, Healthy: false})
+	}
+}
+
+// unsubscribe stops the events of the session. None is pushed to it once it returns.
+func (h *eventHub) unsubscribe(sess *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.subscribers, sess)
+	h.updateSubscribed()
+}
+
+func (h *eventHub) updateSubscribed() {
+	var subscribed comm.EventMask
+	for _, mask := range h.subscribers {
+		subscribed |= mask
+	}
+	h.subscribed.Store(uint32(subscribed))
+}
+
+// wants reports whether a subscriber wants events of the type.
+func (h *eventHub) wants(eventType comm.EventType) bool {
+	return comm.EventMask(h.subscribed.Load()).Has(eventType)
+}
+
+// publish pushes the event to the sessions subscribed to its type.
+func (h *eventHub) publish(event comm.EventData) {
+	if !h.wants(event.Type) {
+		return
+	}
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.publishLocked(event)
+}
+
+func (h *eventHub) publishLocked(event comm.EventData) {
+	for sess, mask := range h.subscribers {
+		if mask.Has(event.Type) {
+			sess.push(event)
+		}
+	}
+}
+
+// decided reports the outcome of a backend call of a decision, announcing
+// the keys starting to be denied and the changes of the backend health.
+func (h *eventHub) decided(key string, result *rate_limit.Result, err error) {
+	if err != nil {
+		if errorCode(err) == comm.ErrorCodeBackendUnavailable {
+			h.setHealthy(false)
+		}
+		return
+	}
+	h.setHealthy(true)
+	if result.Allowed <= 0 && result.RetryAfter > 0 && h.wants(comm.EventTypeBanAdded) {
+		h.banned(key, result.RetryAfter, time.Now())
+	}
+}
+
+// banned announces the denied key, unless it was already announced and has
+// not been allowed to retry since.
+func (h *eventHub) banned(key string, retryAfter time.Duration, now time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if until, ok := h.bans[key]; ok && now.Before(until) {
+		return
+	}
+	h.forgetExpired(now)
+	if len(h.bans) >= h.maxBans {
+		slog.Debug("too many denied keys to announce", slog.String("key", key))
+		return
+	}
+	until := now.Add(retryAfter)
+	h.bans[key] = until
+	heap.Push(&h.expiries, banExpiry{key: key, until: until})
+	h.publishLocked(comm.EventData{Type: comm.EventTypeBanAdded, Duration: retryAfter, Key: key})
+}
+
+// forgetExpired forgets the bans that expired by now. An entry of expiries
+// whose key was reset or banned again since only leaves expiries.
+func (h *eventHub) forgetExpired(now time.Time) {
+	for len(h.expiries) > 0 && !now.Before(h.expiries[0].until) {
+		expiry := heap.Pop(&h.expiries).(banExpiry)
+		if until, ok := h.bans[expiry.key]; ok && until.Equal(expiry.until) {
+			delete(h.bans, expiry.key)
+		}
+	}
+}
+
+// banExpiry is the time a denied key may retry.
+type banExpiry struct {
+	key   string
+	until time.Time
+}
+
+// banExpiries is a min-heap of ban expiries, implementing heap.Interface.
+type banExpiries []banExpiry
+
+func (e banExpiries) Len() int           { return len(e) }
+func (e banExpiries) Less(i, j int) bool { return e[i].until.Before(e[j].until) }
+func (e banExpiries) Swap(i, j int)      { e[i], e[j] = e[j], e[i] }
+func (e *banExpiries) Push(x any)        { *e = append(*e, x.(banExpiry)) }
+func (e *banExpiries) Pop() any {
+	old := *e
+	last := old[len(old)-1]
+	*e = old[:len(old)-1]
+	return last
+}
+
+// unbanned announces that the key was reset.
+func (h *eventHub) unbanned(key string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	delete(h.bans, key)
+	h.publishLocked(comm.EventData{Type: comm.EventTypeBanRemoved, Key: key})
+}
+
+// policyChanged announces that the limits of the policy of the name changed.
+func (h *eventHub) policyChanged(name string) {
+	h.publish(comm.EventData{Type: comm.EventTypePolicyChanged, Key: name})
+}
+
+// setHealthy records the state of the backend, announcing its changes. Once
+// down, the backend is probed until it answers again, so that it is seen
+// coming back without decisions reaching it.
+func (h *eventHub) setHealthy(healthy bool) {
+	if !h.down.CompareAndSwap(healthy, !healthy) {
+		return
+	}
+	if healthy {
+		slog.Info("backend is available again")
+	} else {
+		slog.Warn("backend is unavailable")
+		go h.probe()
+	}
+	h.publish(comm.EventData{Type: comm.EventTypeBackendHealth, Healthy: healthy})
+}
+
+// probe pings the backend until it is healthy again.
+func (h *eventHub) probe() {
+	ticker := time.NewTicker(healthProbeInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if !h.down.Load() {
+			return
+		}
+		if err := rate_limit.Ping(context.Background()); err != nil {
+			slog.Debug("backend probe failed", slog.Any("error", err))
+			continue
+		}
+		h.setHealthy(true)
+		return
+	}
+}
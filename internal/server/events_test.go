@@ -0,0 +1,78 @@
+package server
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+)
+
+// TestHealthEventsNotDropped expects the backend coming back to be pushed to
+// a client that does not keep up, whose queue dropped other events.
+func TestHealthEventsNotDropped(t *testing.T) {
+	c := startSession(t, nil)
+	c.hello(comm.SupportedFeatures)
+	c.sess.subscribe(&comm.SubscribeData{Events: comm.AllEvents})
+	// the client reads nothing until the queue is full
+	for i := range eventQueueSize + 10 {
+		c.sess.push(comm.EventData{Type: comm.EventTypeBanAdded, Duration: time.Second, Key: fmt.Sprint(i)})
+	}
+	c.sess.push(comm.EventData{Type: comm.EventTypeBackendHealth, Healthy: false})
+	c.sess.push(comm.EventData{Type: comm.EventTypeBackendHealth, Healthy: true})
+
+	_ = c.conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	bans, health := 0, []bool{}
+	for len(health) == 0 || !health[len(health)-1] {
+		resp, err := c.read()
+		if err != nil {
+			t.Fatalf("expected the backend coming back to be pushed, got %v after %d bans and health %v", err, bans, health)
+		}
+		switch resp.Event.Type {
+		case comm.EventTypeBanAdded:
+			bans++
+		case comm.EventTypeBackendHealth:
+			health = append(health, resp.Event.Healthy)
+		}
+	}
+	// a health event waiting is replaced by the next one
+	if len(health) > 2 {
+		t.Errorf("expected at most the two health events, got %v", health)
+	}
+	if bans > eventQueueSize+1 {
+		t.Errorf("expected the bans beyond the queue to be dropped, got %d", bans)
+	}
+}
+
+func TestBanExpiry(t *testing.T) {
+	h := newEventHub(2)
+	now := time.Now()
+	h.banned("a", time.Second, now)
+	h.banned("b", 3*time.Second, now)
+	// no room until a ban expires
+	h.banned("c", time.Second, now)
+	if _, ok := h.bans["c"]; ok || len(h.bans) != 2 {
+		t.Errorf("expected the ban beyond the maximum to be left out, got %v", h.bans)
+	}
+
+	now = now.Add(time.Second)
+	h.banned("c", time.Second, now)
+	if _, ok := h.bans["a"]; ok {
+		t.Errorf("expected the expired ban to be forgotten, got %v", h.bans)
+	}
+	if _, ok := h.bans["c"]; !ok {
+		t.Errorf("expected the ban to take the room of the expired one, got %v", h.bans)
+	}
+
+	// a key reset and banned again keeps its new expiry
+	h.unbanned("c")
+	h.banned("c", 5*time.Second, now)
+	now = now.Add(2 * time.Second)
+	h.forgetExpired(now)
+	if until, ok := h.bans["c"]; !ok || !until.After(now) {
+		t.Errorf("expected the ban of the key banned again to be kept, got %v", h.bans)
+	}
+	if len(h.expiries) != len(h.bans) {
+		t.Errorf("expected an expiry per ban, got %d for %v", len(h.expiries), h.bans)
+	}
+}
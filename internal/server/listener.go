@@ -0,0 +1,52 @@
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
+)
+
+// listen returns the listener of the address. A socket inherited from systemd
+// or from the process handing over in a hot upgrade is used in place of a new
+// one, and reported as such. A unix socket whose permissions are configured is
+// created accessible to its owner only, until they are applied.
+func listen(address *transport.Address, socket *config.SocketConfig) (net.Listener, bool, error) {
+	listener, err := inheritedListener()
+	if err != nil {
+		return nil, false, err
+	}
+	if listener != nil {
+		if listener.Addr().Network() != address.Network() {
+			_ = listener.Close()
+			return nil, false, fmt.Errorf("inherited %s socket does not match address %s", listener.Addr().Network(), address)
+		}
+		keepSocketFile(listener)
+		return listener, true, nil
+	}
+	restore := func() {}
+	if address.IsUnix() {
+		_ = os.Remove(address.Address)
+		if socket.Configured() {
+			restore = restrictSocketMode()
+		}
+	}
+	listener, err = net.Listen(address.Network(), address.Address)
+	restore()
+	if err != nil {
+		return nil, false, err
+	}
+	keepSocketFile(listener)
+	return listener, false, nil
+}
+
+// keepSocketFile leaves the file of a unix socket in place when the listener
+// is closed, as the process it was handed over to still accepts on it. The
+// server removes the file itself on a plain shutdown.
+func keepSocketFile(listener net.Listener) {
+	if unixListener, ok := listener.(*net.UnixListener); ok {
+		unixListener.SetUnlinkOnClose(false)
+	}
+}
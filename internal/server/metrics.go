@@ -0,0 +1,251 @@
+package server
+
+import (
+	"bufio"
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+const (
+	// metricsNamespace prefixes the names of the exported metrics.
+	metricsNamespace = "traefik_rate_limit_"
+	// maxMetricPolicies bounds the policies decisions are counted by. The
+	// decisions of policies first seen once it is reached are counted under
+	// otherPolicy.
+	maxMetricPolicies = 1000
+	otherPolicy       = "_other"
+)
+
+// latencyBuckets are the upper bounds of the latency histograms, in seconds.
+var latencyBuckets = [...]float64{0.0001, 0.00025, 0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1}
+
+// histogram counts durations in latencyBuckets without locks, the last bucket
+// counting those above the last bound.
+type histogram struct {
+	buckets [len(latencyBuckets) + 1]atomic.Uint64
+	count   atomic.Uint64
+	sum     atomic.Int64
+}
+
+func (h *histogram) observe(d time.Duration) {
+	seconds := d.Seconds()
+	i := sort.SearchFloat64s(latencyBuckets[:], seconds)
+	h.buckets[i].Add(1)
+	h.count.Add(1)
+	h.sum.Add(int64(d))
+}
+
+// outcome is how a decision ended, the label its metrics are split by.
+type outcome uint8
+
+const (
+	outcomeAllowed outcome = iota
+	outcomeDenied
+	outcomeError
+)
+
+func (o outcome) String() string {
+	switch o {
+	case outcomeAllowed:
+		return "allowed"
+	case outcomeDenied:
+		return "denied"
+	default:
+		return "error"
+	}
+}
+
+func outcomeOf(result *rate_limit.Result, err error) outcome {
+	switch {
+	case err != nil:
+		return outcomeError
+	case result.Allowed > 0:
+		return outcomeAllowed
+	default:
+		return outcomeDenied
+	}
+}
+
+// serverMetrics are the metrics of the server not already counted by stats.
+type serverMetrics struct {
+	mu sync.RWMutex
+	// decisions counts the decisions of each policy by outcome. Requests
+	// carrying their limits are counted under the empty policy.
+	decisions map[string]*[3]atomic.Int64
+	// backendErrors counts the failed backend calls by error code.
+	backendErrors  [comm.ErrorCodeUnsupportedVersion + 1]atomic.Int64
+	socketLatency  histogram
+	backendLatency histogram
+	inFlight       atomic.Int64
+	// overloadedConnection and overloadedQueue count the frames answered as
+	// overloaded, for a connection with too many frames in flight and with
+	// the worker queue full.
+	overloadedConnection atomic.Int64
+	overloadedQueue      atomic.Int64
+	rejectedConnections  atomic.Int64
+	authFailures         atomic.Int64
+	decodeErrors         atomic.Int64
+	oversizedFrames      atomic.Int64
+	unsupportedVersion   atomic.Int64
+}
+
+var metrics = &serverMetrics{decisions: make(map[string]*[3]atomic.Int64)}
+
+// decided counts a decision of the policy.
+func (m *serverMetrics) decided(policy string, result *rate_limit.Result, err error) {
+	m.policyCounters(policy)[outcomeOf(result, err)].Add(1)
+}
+
+func (m *serverMetrics) policyCounters(policy string) *[3]atomic.Int64 {
+	m.mu.RLock()
+	counters, ok := m.decisions[policy]
+	m.mu.RUnlock()
+	if ok {
+		return counters
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if counters, ok := m.decisions[policy]; ok {
+		return counters
+	}
+	if len(m.decisions) >= maxMetricPolicies {
+		policy = otherPolicy
+		if counters, ok := m.decisions[policy]; ok {
+			return counters
+		}
+	}
+	counters = &[3]atomic.Int64{}
+	m.decisions[policy] = counters
+	return counters
+}
+
+// backendCalled records the latency and the error of a backend call.
+func (m *serverMetrics) backendCalled(d time.Duration, err error) {
+	m.backendLatency.observe(d)
+	if err != nil {
+		if code := errorCode(err); int(code) < len(m.backendErrors) {
+			m.backendErrors[code].Add(1)
+		}
+	}
+}
+
+// NewMetricsHandler returns the metrics of the server in the Prometheus text
+// exposition format.
+func NewMetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		out := bufio.NewWriter(w)
+		writeMetrics(out)
+		_ = out.Flush()
+	})
+}
+
+// writeMetrics writes all the metrics of the server.
+func writeMetrics(w *bufio.Writer) {
+	snapshot := stats.snapshot()
+
+	writeHeader(w, "decisions_total", "counter", "Rate limit decisions by policy and outcome.")
+	metrics.mu.RLock()
+	policies := make([]string, 0, len(metrics.decisions))
+	for policy := range metrics.decisions {
+		policies = append(policies, policy)
+	}
+	metrics.mu.RUnlock()
+	sort.Strings(policies)
+	for _, policy := range policies {
+		counters := metrics.policyCounters(policy)
+		for o := outcomeAllowed; o <= outcomeError; o++ {
+			fmt.Fprintf(w, "%sdecisions_total{policy=%s,outcome=%q} %d\n", metricsNamespace, labelValue(policy), o.String(), counters[o].Load())
+		}
+	}
+
+	writeHeader(w, "decision_duration_seconds", "histogram", "Latency of decision frames: the time in the sidecar outside decisions (socket) and that of each backend call (backend).")
+	writeHistogram(w, "decision_duration_seconds", `phase="socket"`, &metrics.socketLatency)
+	writeHistogram(w, "decision_duration_seconds", `phase="backend"`, &metrics.backendLatency)
+
+	writeHeader(w, "backend_errors_total", "counter", "Failed backend calls by error code.")
+	for _, code := range []comm.ErrorCode{comm.ErrorCodeBackendUnavailable, comm.ErrorCodeTimeout} {
+		fmt.Fprintf(w, "%sbackend_errors_total{code=%s} %d\n", metricsNamespace, labelValue(strings.ReplaceAll(code.String(), " ", "_")), metrics.backendErrors[code].Load())
+	}
+
+	writeHeader(w, "backend_up", "gauge", "Whether the backend answers.")
+	fmt.Fprintf(w, "%sbackend_up %d\n", metricsNamespace, boolValue(snapshot.BackendHealthy))
+
+	writeHeader(w, "connections", "gauge", "Open client connections.")
+	fmt.Fprintf(w, "%sconnections %d\n", metricsNamespace, snapshot.Connections)
+	writeHeader(w, "connections_total", "counter", "Client connections accepted.")
+	fmt.Fprintf(w, "%sconnections_total %d\n", metricsNamespace, snapshot.ConnectionsTotal)
+	writeHeader(w, "requests_total", "counter", "Frames received from clients.")
+	fmt.Fprintf(w, "%srequests_total %d\n", metricsNamespace, snapshot.Requests)
+	writeHeader(w, "requests_in_flight", "gauge", "Frames being answered.")
+	fmt.Fprintf(w, "%srequests_in_flight %d\n", metricsNamespace, metrics.inFlight.Load())
+	writeHeader(w, "overloaded_total", "counter", "Frames answered as overloaded by reason.")
+	fmt.Fprintf(w, "%soverloaded_total{reason=\"connection_in_flight\"} %d\n", metricsNamespace, metrics.overloadedConnection.Load())
+	fmt.Fprintf(w, "%soverloaded_total{reason=\"queue_full\"} %d\n", metricsNamespace, metrics.overloadedQueue.Load())
+	writeHeader(w, "connections_rejected_total", "counter", "Connections closed at once for exceeding the maximum.")
+	fmt.Fprintf(w, "%sconnections_rejected_total %d\n", metricsNamespace, metrics.rejectedConnections.Load())
+	writeHeader(w, "auth_failures_total", "counter", "Connections closed after a failed authentication.")
+	fmt.Fprintf(w, "%sauth_failures_total %d\n", metricsNamespace, metrics.authFailures.Load())
+
+	writeHeader(w, "frame_errors_total", "counter", "Frames rejected by reason.")
+	fmt.Fprintf(w, "%sframe_errors_total{reason=\"decode\"} %d\n", metricsNamespace, metrics.decodeErrors.Load())
+	fmt.Fprintf(w, "%sframe_errors_total{reason=\"too_large\"} %d\n", metricsNamespace, metrics.oversizedFrames.Load())
+	fmt.Fprintf(w, "%sframe_errors_total{reason=\"unsupported_version\"} %d\n", metricsNamespace, metrics.unsupportedVersion.Load())
+
+	writeHeader(w, "policies", "gauge", "Policies registered on the open connections.")
+	fmt.Fprintf(w, "%spolicies %d\n", metricsNamespace, snapshot.Policies)
+
+	// the memory backend has no connection pool
+	if pool, ok := rate_limit.PoolStats(); ok {
+		writeHeader(w, "redis_pool_hits_total", "counter", "Times a free connection was found in the Redis pool.")
+		fmt.Fprintf(w, "%sredis_pool_hits_total %d\n", metricsNamespace, pool.Hits)
+		writeHeader(w, "redis_pool_misses_total", "counter", "Times no free connection was found in the Redis pool.")
+		fmt.Fprintf(w, "%sredis_pool_misses_total %d\n", metricsNamespace, pool.Misses)
+		writeHeader(w, "redis_pool_timeouts_total", "counter", "Times waiting for a Redis pool connection timed out.")
+		fmt.Fprintf(w, "%sredis_pool_timeouts_total %d\n", metricsNamespace, pool.Timeouts)
+		writeHeader(w, "redis_pool_connections", "gauge", "Connections of the Redis pool by state.")
+		fmt.Fprintf(w, "%sredis_pool_connections{state=\"total\"} %d\n", metricsNamespace, pool.TotalConns)
+		fmt.Fprintf(w, "%sredis_pool_connections{state=\"idle\"} %d\n", metricsNamespace, pool.IdleConns)
+		writeHeader(w, "redis_pool_stale_connections_total", "counter", "Stale connections removed from the Redis pool.")
+		fmt.Fprintf(w, "%sredis_pool_stale_connections_total %d\n", metricsNamespace, pool.StaleConns)
+	}
+}
+
+func writeHeader(w *bufio.Writer, name string, kind string, help string) {
+	fmt.Fprintf(w, "# HELP %s%s %s\n# TYPE %s%s %s\n", metricsNamespace, name, help, metricsNamespace, name, kind)
+}
+
+// writeHistogram writes the cumulative buckets, the sum and the count of h.
+func writeHistogram(w *bufio.Writer, name string, labels string, h *histogram) {
+	var cumulative uint64
+	for i, bound := range latencyBuckets {
+		cumulative += h.buckets[i].Load()
+		fmt.Fprintf(w, "%s%s_bucket{%s,le=\"%g\"} %d\n", metricsNamespace, name, labels, bound, cumulative)
+	}
+	cumulative += h.buckets[len(latencyBuckets)].Load()
+	fmt.Fprintf(w, "%s%s_bucket{%s,le=\"+Inf\"} %d\n", metricsNamespace, name, labels, cumulative)
+	fmt.Fprintf(w, "%s%s_sum{%s} %g\n", metricsNamespace, name, labels, time.Duration(h.sum.Load()).Seconds())
+	fmt.Fprintf(w, "%s%s_count{%s} %d\n", metricsNamespace, name, labels, h.count.Load())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelValue quotes a label value the way the exposition format expects.
+func labelValue(value string) string {
+	return `"` + labelEscaper.Replace(value) + `"`
+}
+
+func boolValue(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+// maxOverrides bounds the keys of each list, so that bans cannot exhaust the
+// memory of the servers or of the backend.
+const maxOverrides = 10000
+
+// overrideSyncInterval is how often the lists are read again from the
+// backend, picking up the changes made through other servers.
+const overrideSyncInterval = 2 * time.Second
+
+// overrideList caches a list of keys decided by an operator rather than by
+// their limit, each until it expires. The backend holds the list, shared by
+// the servers using it. Expired keys are forgotten when next looked up.
+type overrideList struct {
+	kind rate_limit.OverrideKind
+	mu   sync.RWMutex
+	keys map[string]time.Time
+	// changes counts the changes made through this server, so that a sync
+	// does not replace them with a list read before.
+	changes uint64
+	// size is the number of keys, so that decisions skip the lock when there
+	// are none.
+	size atomic.Int64
+}
+
+var (
+	// manualBans are denied whatever their limit.
+	manualBans = newOverrideList(rate_limit.OverrideBan)
+	// manualAllows are allowed without reaching the backend.
+	manualAllows = newOverrideList(rate_limit.OverrideAllow)
+)
+
+func newOverrideList(kind rate_limit.OverrideKind) *overrideList {
+	return &overrideList{kind: kind, keys: make(map[string]time.Time)}
+}
+
+// set adds the key until it expires, replacing an earlier expiry.
+func (l *overrideList) set(key string, expires time.Time) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.keys[key] = expires
+	l.changes++
+	l.size.Store(int64(len(l.keys)))
+}
+
+// remove forgets the key, reporting whether it was set and not expired.
+func (l *overrideList) remove(key string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	expires, ok := l.keys[key]
+	delete(l.keys, key)
+	l.changes++
+	l.size.Store(int64(len(l.keys)))
+	return ok && now.Before(expires)
+}
+
+// replace sets the keys to those of the list unless the keys changed since
+// the count of changes was taken, reporting whether it did.
+func (l *overrideList) replace(list []rate_limit.Override, changes uint64) bool {
+	keys := make(map[string]time.Time, len(list))
+	for _, override := range list {
+		keys[override.Key] = override.Expires
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.changes != changes {
+		return false
+	}
+	l.keys = keys
+	l.size.Store(int64(len(l.keys)))
+	return true
+}
+
+// changeCount returns the number of changes made through this server.
+func (l *overrideList) changeCount() uint64 {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	return l.changes
+}
+
+// get returns the time left until the key expires, if it is set.
+func (l *overrideList) get(key string, now time.Time) (time.Duration, bool) {
+	if l.size.Load() == 0 {
+		return 0, false
+	}
+	l.mu.RLock()
+	expires, ok := l.keys[key]
+	l.mu.RUnlock()
+	if !ok {
+		return 0, false
+	}
+	left := expires.Sub(now)
+	if left <= 0 {
+		l.mu.Lock()
+		// it may have been set again in between
+		if expires, ok := l.keys[key]; ok && !now.Before(expires) {
+			delete(l.keys, key)
+			l.size.Store(int64(len(l.keys)))
+		}
+		l.mu.Unlock()
+		return 0, false
+	}
+	return left, true
+}
+
+// list returns the keys that have not expired, by key.
+func (l *overrideList) list(now time.Time) []rate_limit.Override {
+	l.mu.RLock()
+	defer l.mu.RUnlock()
+	list := make([]rate_limit.Override, 0, len(l.keys))
+	for key, expires := range l.keys {
+		if now.Before(expires) {
+			list = append(list, rate_limit.Override{Key: key, Expires: expires})
+		}
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Key < list[j].Key
+	})
+	return list
+}
+
+// sync reads the list again from the backend.
+func (l *overrideList) sync(ctx context.Context) error {
+	changes := l.changeCount()
+	list, err := rate_limit.ListOverrides(ctx, l.kind)
+	if err != nil {
+		return err
+	}
+	// a change made meanwhile is picked up by the next sync
+	l.replace(list, changes)
+	return nil
+}
+
+// syncOverrides reads the lists again from the backend at each interval
+// until the context is done.
+func syncOverrides(ctx context.Context) {
+	ticker := time.NewTicker(overrideSyncInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		for _, list := range []*overrideList{manualBans, manualAllows} {
+			if err := list.sync(ctx); err != nil {
+				slog.Debug("failed to sync the overrides", slog.String("kind", list.kind.String()), slog.Any("error", err))
+			}
+		}
+	}
+}
+
+// ban denies the key until the ttl expires, announcing it to subscribers. It
+// returns the expiry of the ban.
+func ban(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+	now := time.Now()
+	if err := rate_limit.SetOverride(ctx, rate_limit.OverrideBan, key, now.Add(ttl), maxOverrides); err != nil {
+		return time.Time{}, err
+	}
+	manualAllows.remove(key, now)
+	manualBans.set(key, now.Add(ttl))
+	events.publish(comm.EventData{Type: comm.EventTypeBanAdded, Duration: ttl, Key: key})
+	return now.Add(ttl), nil
+}
+
+// allow exempts the key from its limit until the ttl expires, lifting any ban
+// of the key subscribers know of. It returns the expiry of the entry.
+func allow(ctx context.Context, key string, ttl time.Duration) (time.Time, error) {
+	now := time.Now()
+	if err := rate_limit.SetOverride(ctx, rate_limit.OverrideAllow, key, now.Add(ttl), maxOverrides); err != nil {
+		return time.Time{}, err
+	}
+	manualBans.remove(key, now)
+	manualAllows.set(key, now.Add(ttl))
+	events.unbanned(key)
+	return now.Add(ttl), nil
+}
+
+// unban lifts the ban of the key, reporting whether it was banned.
+func unban(ctx context.Context, key string) (bool, error) {
+	stored, err := rate_limit.RemoveOverride(ctx, rate_limit.OverrideBan, key)
+	if err != nil {
+		return false, err
+	}
+	if !manualBans.remove(key, time.Now()) && !stored {
+		return false, nil
+	}
+	events.unbanned(key)
+	return true, nil
+}
+
+// disallow removes the key from the allow list, reporting whether it was
+// there.
+func disallow(ctx context.Context, key string) (bool, error) {
+	stored, err := rate_limit.RemoveOverride(ctx, rate_limit.OverrideAllow, key)
+	if err != nil {
+		return false, err
+	}
+	return manualAllows.remove(key, time.Now()) || stored, nil
+}
+
+// handedOverOverrides are the lists a server passes on in a hot upgrade, so
+// that the new process keeps them with a backend it does not share.
+type handedOverOverrides struct {
+	Bans   []rate_limit.Override `json:"bans"`
+	Allows []rate_limit.Override `json:"allows"`
+}
+
+// handoverOverrides returns the lists to pass on in a hot upgrade.
+func handoverOverrides() []byte {
+	now := time.Now()
+	data, err := json.Marshal(handedOverOverrides{Bans: manualBans.list(now), Allows: manualAllows.list(now)})
+	if err != nil {
+		slog.Error("failed to hand over the overrides", slog.Any("error", err))
+		return nil
+	}
+	return data
+}
+
+// restoreOverrides adds the lists passed on by the process this one upgrades,
+// if any, to the backend and to the cache.
+func restoreOverrides(ctx context.Context) error {
+	data, err := inheritedOverrides()
+	if err != nil || data == nil {
+		return err
+	}
+	var handedOver handedOverOverrides
+	if err := json.Unmarshal(data, &handedOver); err != nil {
+		return fmt.Errorf("invalid overrides handed over: %w", err)
+	}
+	var storeErr error
+	for _, list := range []struct {
+		cache     *overrideList
+		overrides []rate_limit.Override
+	}{{manualBans, handedOver.Bans}, {manualAllows, handedOver.Allows}} {
+		for _, override := range list.overrides {
+			// the cache keeps the keys when the backend is not reachable
+			list.cache.set(override.Key, override.Expires)
+			if storeErr == nil {
+				storeErr = rate_limit.SetOverride(ctx, list.cache.kind, override.Key, override.Expires, maxOverrides)
+			}
+		}
+	}
+	return storeErr
+}
+
+// overridden returns the result of a decision for a key banned or allowed
+// through the admin API, if it is.
+func overridden(data *comm.RateLimitRequestData) (*rate_limit.Result, bool) {
+	now := time.Now()
+	if left, ok := manualBans.get(data.Key, now); ok {
+		return &rate_limit.Result{Allowed: 0, Remaining: 0, RetryAfter: left, ResetAfter: left}, true
+	}
+	if _, ok := manualAllows.get(data.Key, now); ok {
+		return &rate_limit.Result{Allowed: int(data.GetCost()), Remaining: int(data.Limit()), RetryAfter: -1}, true
+	}
+	return nil, false
+}
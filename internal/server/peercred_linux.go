@@ -0,0 +1,30 @@
+//go:build linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"syscall"
+)
+
+// peerCredentials returns the user and group of the process at the other end
+// of a unix socket connection.
+func peerCredentials(conn *net.UnixConn) (int, int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return -1, -1, err
+	}
+	var ucred *syscall.Ucred
+	var credErr error
+	err = raw.Control(func(fd uintptr) {
+		ucred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	})
+	if err != nil {
+		return -1, -1, err
+	}
+	if credErr != nil {
+		return -1, -1, fmt.Errorf("failed to get peer credentials: %w", credErr)
+	}
+	return int(ucred.Uid), int(ucred.Gid), nil
+}
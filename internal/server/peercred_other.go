@@ -0,0 +1,13 @@
+//go:build !linux
+
+package server
+
+import (
+	"fmt"
+	"net"
+)
+
+// peerCredentials is only supported on Linux.
+func peerCredentials(_ *net.UnixConn) (int, int, error) {
+	return -1, -1, fmt.Errorf("peer credentials are not supported on this platform")
+}
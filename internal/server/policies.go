@@ -0,0 +1,119 @@
+package server
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"sync"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// ActivePolicy is a policy registered on at least one connection.
+type ActivePolicy struct {
+	Policy *comm.PolicyData
+	// Connections is the number of connections the policy is registered on.
+	Connections int
+}
+
+// policyRegistry is the view of the policies registered across connections,
+// by name. Policies of the same name registered with different limits show
+// the last registration.
+type policyRegistry struct {
+	mu       sync.Mutex
+	policies map[string]*ActivePolicy
+}
+
+var activePolicies = &policyRegistry{policies: make(map[string]*ActivePolicy)}
+
+// add records the policy, reporting whether it changes the limits of the
+// policy of its name.
+func (r *policyRegistry) add(policy *comm.PolicyData) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active, ok := r.policies[policy.Name]
+	if !ok {
+		active = &ActivePolicy{}
+		r.policies[policy.Name] = active
+	}
+	changed := ok && !sameLimits(active.Policy, policy)
+	active.Policy = policy
+	active.Connections++
+	return changed
+}
+
+// sameLimits reports whether the policies enforce the same limits, whatever their IDs.
+func sameLimits(a *comm.PolicyData, b *comm.PolicyData) bool {
+	return a.Algorithm == b.Algorithm && a.Rate == b.Rate && a.Burst == b.Burst && a.Period == b.Period && a.Cost == b.Cost &&
+		a.Calendar == b.Calendar && a.TimeZone == b.TimeZone
+}
+
+func (r *policyRegistry) remove(policy *comm.PolicyData) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active, ok := r.policies[policy.Name]
+	if !ok {
+		return
+	}
+	active.Connections--
+	if active.Connections <= 0 {
+		delete(r.policies, policy.Name)
+	}
+}
+
+// get returns the last policy registered under the name, if still registered.
+func (r *policyRegistry) get(name string) (*comm.PolicyData, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	active, ok := r.policies[name]
+	if !ok {
+		return nil, false
+	}
+	return active.Policy, true
+}
+
+func (r *policyRegistry) list() []ActivePolicy {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list := make([]ActivePolicy, 0, len(r.policies))
+	for _, active := range r.policies {
+		list = append(list, *active)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Policy.Name < list[j].Policy.Name
+	})
+	return list
+}
+
+// Policies returns the policies registered on the open connections, by name.
+func Policies() []ActivePolicy {
+	return activePolicies.list()
+}
+
+// namedPolicy returns the policy of the config clients refer to by the name.
+func namedPolicy(cfg *config.Config, name string) (*config.PolicyConfig, error) {
+	policy, ok := cfg.Policies[name]
+	if !ok {
+		return nil, fmt.Errorf("%w %q", errUnknownPolicy, name)
+	}
+	return policy, nil
+}
+
+// changedPolicies returns the names of the policies of the config that are
+// new, removed or have other settings in the next config.
+func changedPolicies(previous map[string]*config.PolicyConfig, next map[string]*config.PolicyConfig) []string {
+	var names []string
+	for name, policy := range next {
+		if old, ok := previous[name]; !ok || !reflect.DeepEqual(old, policy) {
+			names = append(names, name)
+		}
+	}
+	for name := range previous {
+		if _, ok := next[name]; !ok {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+	return names
+}
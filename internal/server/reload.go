@@ -0,0 +1,28 @@
+package server
+
+import (
+	"log/slog"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+// reloadConfig reloads the config. The open connections keep being served,
+// with the timeouts and limits they started with; new connections and
+// backend calls use the new values. Decisions under named policies take the
+// new limits at once, and clients are told of the policies that changed.
+func reloadConfig() {
+	previous := config.GetConfig()
+	cfg, kept, err := config.Reload()
+	if err != nil {
+		slog.Error("config reload failed, keeping the current config", slog.Any("error", err))
+		return
+	}
+	if len(kept) > 0 {
+		slog.Warn("settings changed that only apply after a restart or a hot upgrade, keeping their current values", slog.Any("settings", kept))
+	}
+	changed := changedPolicies(previous.Policies, cfg.Policies)
+	for _, name := range changed {
+		events.policyChanged(name)
+	}
+	slog.Info("config reloaded", slog.String("log_level", cfg.LogLevel), slog.Int("policies", len(cfg.Policies)), slog.Any("changed_policies", changed))
+}
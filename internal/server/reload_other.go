@@ -0,0 +1,11 @@
+//go:build !unix
+
+package server
+
+import "os"
+
+// notifyReload returns no channel, reloading on SIGHUP is only supported on
+// unix systems.
+func notifyReload() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}
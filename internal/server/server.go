@@ -1,33 +1,111 @@
 package server
 
 import (
-	"bytes"
 	"context"
+	"crypto/tls"
 	"errors"
+	"fmt"
 	"io"
 	"log/slog"
 	"net"
+	"net/http"
 	"os"
 	"sync"
+	"time"
 
 	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
 	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
 )
 
-var bufferPool = sync.Pool{
-	New: func() interface{} {
-		return bytes.NewBuffer(make([]byte, 0, 128))
-	},
-}
+// pongPrefix starts the answers to pings, followed by their data.
+const pongPrefix = "pong to "
+
+// maxPayloadSize is the largest payload accepted from clients. Connections
+// sending larger ones are closed.
+const maxPayloadSize = 1024 * 1024
 
-func runServer(ctx context.Context, socketPath string) error {
-	_ = os.Remove(socketPath)
-	listener, err := net.Listen("unix", socketPath)
+func runServer(ctx context.Context, socketPath string, getConfig func() *config.Config) error {
+	address, err := transport.ParseAddress(socketPath)
+	if err != nil {
+		return err
+	}
+	var tlsConfig *tls.Config
+	if address.Scheme == transport.SchemeTLS {
+		tlsCfg := getConfig().TLS
+		tlsConfig, err = transport.ServerTLSConfig(tlsCfg.CertFile, tlsCfg.KeyFile, tlsCfg.ClientCAFile)
+		if err != nil {
+			return err
+		}
+	}
+	rawListener, inherited, err := listen(address, getConfig().Socket)
 	if err != nil {
 		return err
 	}
+	listener := transport.Wrap(address, rawListener, tlsConfig)
 	defer listener.Close()
-	slog.Info("server listening", slog.String("socket", socketPath))
+	// the process the socket was inherited from already set its permissions
+	if address.IsUnix() && !inherited {
+		if err := applySocketPermissions(address.Address, getConfig().Socket); err != nil {
+			return err
+		}
+	}
+	cfg := getConfig()
+	tracer, err := newTracer(getConfig().Tracing)
+	if err != nil {
+		return err
+	}
+	if tracer != nil {
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			if err := tracer.Shutdown(ctx); err != nil {
+				slog.Warn("failed to export the last spans", slog.Any("error", err))
+			}
+		}()
+	}
+	adminCfg := getConfig().Admin
+	httpCtx, stopHTTP := context.WithCancel(ctx)
+	defer stopHTTP()
+	if adminEnabled(adminCfg) {
+		go func() {
+			if err := serveAdmin(httpCtx, adminCfg, inherited); err != nil {
+				slog.Error("admin API error", slog.Any("error", err))
+			}
+		}()
+	}
+	if metricsCfg := getConfig().Metrics; metricsCfg != nil && metricsCfg.Addr != "" {
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("GET /metrics", NewMetricsHandler())
+			if err := serveHTTP(httpCtx, "metrics endpoint", metricsCfg.Addr, mux, inherited); err != nil {
+				slog.Error("metrics endpoint error", slog.Any("error", err))
+			}
+		}()
+	}
+	if err := restoreOverrides(ctx); err != nil {
+		slog.Warn("failed to restore the overrides handed over", slog.Any("error", err))
+	}
+	go syncOverrides(httpCtx)
+	slog.Info("server listening", slog.String("socket", address.String()), slog.String("backend", cfg.Backend), slog.Bool("inherited", inherited), slog.Bool("tracing", tracer != nil))
+	notifyReady()
+
+	upgradeChan, stopUpgrade := notifyUpgrade()
+	defer stopUpgrade()
+	reloadChan, stopReload := notifyReload()
+	defer stopReload()
+	// connections drain on shutdown and once the listener is handed over
+	connCtx, stopConns := context.WithCancel(ctx)
+	defer stopConns()
+	upgraded := false
+
+	pool := newWorkerPool(cfg.Workers, cfg.WorkerQueue, tracer)
+	// connSlots holds a value for each open connection, nil when they are unlimited
+	var connSlots chan struct{}
+	if cfg.MaxConnections > 0 {
+		connSlots = make(chan struct{}, cfg.MaxConnections)
+	}
 
 	var wg sync.WaitGroup
 	connChan := make(chan net.Conn)
@@ -56,8 +134,34 @@ func runServer(ctx context.Context, socketPath string) error {
 			if !ok {
 				goto shutdown
 			}
+			if connSlots != nil {
+				select {
+				case connSlots <- struct{}{}:
+				default:
+					slog.Warn("rejecting connection, too many connections", slog.String("remote_addr", conn.RemoteAddr().String()), slog.Int("max_connections", cfg.MaxConnections))
+					metrics.rejectedConnections.Add(1)
+					_ = conn.Close()
+					continue
+				}
+			}
 			wg.Add(1)
-			go handleConn(&wg, conn)
+			go func() {
+				handleConn(connCtx, &wg, conn, pool, getConfig)
+				if connSlots != nil {
+					<-connSlots
+				}
+			}()
+		case <-upgradeChan:
+			slog.Info("hot upgrade requested")
+			if err := upgrade(rawListener, handoverOverrides()); err != nil {
+				slog.Error("hot upgrade failed", slog.Any("error", err))
+				continue
+			}
+			upgraded = true
+			_ = listener.Close()
+			goto shutdown
+		case <-reloadChan:
+			reloadConfig()
 		case <-ctx.Done():
 			slog.Info("shutdown signal received")
 			_ = listener.Close()
@@ -69,93 +173,373 @@ func runServer(ctx context.Context, socketPath string) error {
 	}
 
 shutdown:
+	// the new process listens on the HTTP addresses after a hot upgrade
+	stopHTTP()
+	stopConns()
 	wg.Wait()
+	pool.stop()
 	slog.Info("all connections closed")
+	// the new process accepts on the socket file after a hot upgrade
+	if address.IsUnix() && !upgraded {
+		_ = os.Remove(address.Address)
+	}
 	return nil
 }
 
-func handleConn(wg *sync.WaitGroup, conn net.Conn) {
+func handleConn(serverCtx context.Context, wg *sync.WaitGroup, conn net.Conn, pool *workerPool, getConfig func() *config.Config) {
 	defer wg.Done()
 	defer conn.Close()
+	// requests keep being served while the connection drains after shutdown
+	ctx, cancel := context.WithCancel(context.WithoutCancel(serverCtx))
+	defer cancel()
 	slog.Debug("new connection", slog.String("remote_addr", conn.RemoteAddr().String()))
+	auth := getConfig().Auth
+	if err := checkPeer(conn, auth); err != nil {
+		slog.Warn("connection rejected", slog.Any("error", err))
+		return
+	}
+	cfg := getConfig()
+	sess := newSession(conn, auth, pool, cfg.MaxInFlight, cfg.WriteTimeout)
+	sess.config = getConfig
+	defer sess.close()
+	stats.connected()
+	defer stats.disconnected()
+	go func() {
+		select {
+		case <-serverCtx.Done():
+			sess.goAway(getConfig().DrainTimeout, "server shutting down")
+		case <-ctx.Done():
+		}
+	}()
+	serveConn(ctx, sess, cfg)
+}
 
+// serveConn answers the frames of the session until the connection is closed,
+// fails or has to be closed, such as after a failed authentication.
+func serveConn(ctx context.Context, sess *session, cfg *config.Config) {
+	conn, pool := sess.conn, sess.pool
+	frames := comm.NewFrameReader(conn, maxPayloadSize)
+	defer frames.Release()
+	resp := &comm.Response{}
 	for {
-		header, err := readHeader(conn)
+		// the idle timeout runs until a frame starts, the read timeout until it is whole
+		sess.setReadDeadline(cfg.IdleTimeout)
+		idle := true
+		err := frames.Wait()
+		var header *comm.Header
+		var payload []byte
+		if err == nil {
+			idle = false
+			sess.setReadDeadline(cfg.ReadTimeout)
+			header, payload, err = frames.Next()
+		}
 		if err != nil {
-			if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
+			if errors.Is(err, comm.ErrUnsupportedVersion) {
+				metrics.unsupportedVersion.Add(1)
+				slog.Warn("unsupported protocol version", slog.Uint64("version", uint64(header.Version)))
+				resp.Reset(&comm.Header{RequestID: header.RequestID, Version: comm.MinVersion}, comm.RequestTypeUnknown)
+				resp.SetError(comm.ErrorCodeUnsupportedVersion, fmt.Sprintf("unsupported protocol version: %d, expected %d to %d", header.Version, comm.MinVersion, comm.VERSION))
+				sess.respond(resp)
+			} else if errors.Is(err, comm.ErrFrameTooLarge) {
+				metrics.oversizedFrames.Add(1)
+				slog.Warn("closing connection sending a frame too large", slog.Any("error", err), slog.String("remote_addr", conn.RemoteAddr().String()))
+			} else if errors.Is(err, net.ErrClosed) || errors.Is(err, io.EOF) {
 				slog.Debug("connection closed", slog.Any("error", err))
+			} else if sess.isDraining() && errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Info("closing connection after drain timeout", slog.String("remote_addr", conn.RemoteAddr().String()))
+			} else if idle && errors.Is(err, os.ErrDeadlineExceeded) {
+				// a client told to go away does not send its next request
+				// on a connection about to be closed
+				if sess.goAway(cfg.DrainTimeout, "connection idle") {
+					continue
+				}
+				slog.Debug("closing idle connection", slog.String("remote_addr", conn.RemoteAddr().String()), slog.Duration("idle_timeout", cfg.IdleTimeout))
+			} else if errors.Is(err, os.ErrDeadlineExceeded) {
+				slog.Warn("closing connection, a frame took too long to arrive", slog.String("remote_addr", conn.RemoteAddr().String()), slog.Duration("read_timeout", cfg.ReadTimeout))
 			} else {
-				slog.Warn("read header error", slog.Any("error", err))
+				slog.Warn("read frame error", slog.Any("error", err))
 			}
 			return
 		}
-		if header == nil || header.Version != comm.VERSION || header.ContentLength > 1024*1024 {
-			return
-		}
 
-		payload := make([]byte, header.ContentLength)
-		if err := readFull(conn, payload); err != nil {
-			slog.Debug("read payload error", slog.Any("error", err))
-			return
-		}
-
-		req := &comm.Request{}
-		if err := req.Unmarshal(header, payload); err != nil {
+		stats.requests.Add(1)
+		j := pool.get(ctx, sess)
+		err = j.req.Unmarshal(header, payload)
+		j.trace.decoded()
+		j.resp.Reset(header, j.req.Type)
+		switch {
+		case err != nil:
+			// The payload has been read whole, so the connection is still in sync.
 			slog.Debug("parse request error", slog.Any("error", err))
+			metrics.decodeErrors.Add(1)
+			j.resp.SetError(comm.ErrorCodeInvalidRequest, err.Error())
+			j.respond()
+		case !sess.allowed(j.req.Type):
+			slog.Debug("unauthorized request", slog.Uint64("request_id", uint64(header.RequestID)))
+			j.resp.SetError(comm.ErrorCodeUnauthorized, "unauthorized")
+			j.respond()
+		case sess.unnegotiated(&j.req) != 0:
+			missing := sess.unnegotiated(&j.req)
+			slog.Debug("request using features not negotiated", slog.String("type", j.req.Type.String()), slog.String("features", missing.String()))
+			j.resp.SetError(comm.ErrorCodeInvalidRequest, fmt.Sprintf("%s uses features not negotiated: %s", j.req.Type, missing))
+			j.respond()
+		case !concurrent(j.req.Type):
+			j.run()
+		case !sess.acquire():
+			slog.Debug("too many requests in flight", slog.String("remote_addr", conn.RemoteAddr().String()))
+			metrics.overloadedConnection.Add(1)
+			j.resp.SetError(comm.ErrorCodeOverloaded, "too many requests in flight")
+			j.respond()
+		case !pool.submit(j):
+			sess.release()
+			slog.Debug("worker queue full", slog.String("remote_addr", conn.RemoteAddr().String()))
+			metrics.overloadedQueue.Add(1)
+			j.resp.SetError(comm.ErrorCodeOverloaded, "server overloaded")
+			j.respond()
+		}
+		if sess.rejected {
+			slog.Warn("closing connection after a failed authentication", slog.String("remote_addr", conn.RemoteAddr().String()))
 			return
 		}
+	}
+}
 
-		resp := &comm.Response{Header: header, Type: req.Type, Status: comm.ResponseStatusOK}
-		switch req.Type {
-		case comm.RequestTypePing:
-			resp.Data = "pong to " + req.GetPingData()
-		case comm.RequestTypeRateLimit:
-			data := req.GetRateLimitData()
-			slog.Debug("rate limit request", slog.Any("data", data))
-			result, err := rate_limit.RateLimit(data)
-			if err != nil {
-				resp.Status = comm.ResponseStatusError
-				resp.Error = err.Error()
+// handleRequest answers the request of the job in its response.
+func handleRequest(j *job) {
+	ctx, sess, req, resp := j.ctx, j.sess, &j.req, &j.resp
+	header := &req.Header
+	switch req.Type {
+	case comm.RequestTypeAuthChallenge:
+		if err := sess.challenge(req.GetAuthData(), &resp.Auth); err != nil {
+			resp.SetError(comm.ErrorCodeUnauthorized, err.Error())
+		}
+	case comm.RequestTypeAuth:
+		if err := sess.authenticate(req.GetAuthData()); err != nil {
+			slog.Warn("authentication failed", slog.Any("error", err), slog.String("remote_addr", sess.conn.RemoteAddr().String()))
+			metrics.authFailures.Add(1)
+			resp.SetError(comm.ErrorCodeUnauthorized, "unauthorized")
+			// the client gets a single attempt per connection
+			sess.rejected = true
+		}
+	case comm.RequestTypeHello:
+		hello, err := sess.negotiate(req.GetHelloData())
+		if err != nil {
+			// the versions of the server tell the client no version is shared,
+			// an error would be taken for a server predating the handshake
+			slog.Warn("handshake failed", slog.Any("error", err))
+			resp.Hello = comm.HelloData{MinVersion: comm.MinVersion, MaxVersion: comm.VERSION}
+			break
+		}
+		resp.Hello = *hello
+	case comm.RequestTypePing:
+		resp.Message = j.pongTo(req.GetPingData())
+	case comm.RequestTypeRegisterPolicy:
+		if err := sess.registerPolicy(req.GetPolicyData()); err != nil {
+			resp.SetError(errorCode(err), err.Error())
+		}
+	case comm.RequestTypeRateLimit, comm.RequestTypeRateLimitPolicy:
+		data := &j.scratch
+		policy := ""
+		if req.Type == comm.RequestTypeRateLimitPolicy {
+			var err error
+			if policy, err = sess.resolve(req.GetPolicyRateLimitData(), data); err != nil {
+				resp.SetError(errorCode(err), err.Error())
 				break
 			}
-			resp.Data = &comm.RateLimitResponseData{
-				Allowed:    int64(result.Allowed),
-				Remaining:  int64(result.Remaining),
-				RetryAfter: result.RetryAfter,
-				ResetAfter: result.ResetAfter,
+		} else {
+			data = req.GetRateLimitData()
+		}
+		if debugEnabled(ctx) {
+			slog.Debug("rate limit request", slog.Any("data", data), slog.Time("deadline", header.Deadline))
+		}
+		if header.Expired(time.Now()) {
+			slog.Debug("dropping expired rate limit request", slog.Uint64("request_id", uint64(header.RequestID)))
+			resp.SetError(comm.ErrorCodeTimeout, "deadline exceeded")
+			break
+		}
+		result, err := j.decide(header, policy, data)
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+			break
+		}
+		resp.RateLimit = toResponseData(result)
+	case comm.RequestTypeRateLimitBatch, comm.RequestTypeRateLimitPolicyBatch:
+		var count int
+		if req.Type == comm.RequestTypeRateLimitPolicyBatch {
+			count = len(req.GetPolicyBatchData().Entries)
+		} else {
+			count = len(req.GetRateLimitBatchData().Entries)
+		}
+		if debugEnabled(ctx) {
+			slog.Debug("rate limit batch request", slog.Int("entries", count), slog.Time("deadline", header.Deadline))
+		}
+		if header.Expired(time.Now()) {
+			slog.Debug("dropping expired rate limit batch request", slog.Uint64("request_id", uint64(header.RequestID)))
+			resp.SetError(comm.ErrorCodeTimeout, "deadline exceeded")
+			break
+		}
+		for i, result := range resp.Batch.SetLen(count) {
+			entry := &j.scratch
+			policy := ""
+			if req.Type == comm.RequestTypeRateLimitPolicyBatch {
+				var err error
+				if policy, err = sess.resolve(req.PolicyBatch.Entries[i], entry); err != nil {
+					*result = comm.RateLimitBatchResult{Status: comm.ResponseStatusError, Code: errorCode(err), Error: err.Error()}
+					continue
+				}
+			} else {
+				entry = req.Batch.Entries[i]
 			}
-		default:
-			resp.Status = comm.ResponseStatusError
-			resp.Error = "unknown request type"
+			decision, err := j.decide(header, policy, entry)
+			if err != nil {
+				*result = comm.RateLimitBatchResult{Status: comm.ResponseStatusError, Code: errorCode(err), Error: err.Error()}
+				continue
+			}
+			*result = comm.RateLimitBatchResult{Status: comm.ResponseStatusOK, Data: toResponseData(decision)}
+		}
+	case comm.RequestTypePeek:
+		data := req.GetPeekData()
+		if err := rate_limit.Validate(data); err != nil {
+			resp.SetError(comm.ErrorCodeInvalidRequest, err.Error())
+			break
+		}
+		backendCtx, cancel := withDeadline(ctx, header)
+		result, err := rate_limit.Peek(backendCtx, data)
+		cancel()
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+			break
+		}
+		resp.RateLimit = toResponseData(result)
+	case comm.RequestTypeReset:
+		data := req.GetResetData()
+		if data.Key == "" {
+			resp.SetError(comm.ErrorCodeInvalidRequest, "key is empty")
+			break
 		}
-		respond(conn, resp)
+		backendCtx, cancel := withDeadline(ctx, header)
+		err := rate_limit.Reset(backendCtx, data.Key)
+		cancel()
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+			break
+		}
+		slog.Info("key reset", slog.String("key", data.Key), slog.String("remote_addr", sess.conn.RemoteAddr().String()))
+		events.unbanned(data.Key)
+	case comm.RequestTypeListKeys:
+		data := req.GetListKeysData()
+		count := data.Count
+		if count == 0 || count > comm.MaxListKeysCount {
+			count = comm.MaxListKeysCount
+		}
+		backendCtx, cancel := withDeadline(ctx, header)
+		keys, cursor, err := rate_limit.ListKeys(backendCtx, data.Prefix, data.Cursor, count)
+		cancel()
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+			break
+		}
+		resp.ListKeys = comm.ListKeysResponseData{Cursor: cursor, Keys: keys}
+	case comm.RequestTypeSubscribe:
+		sess.subscribe(req.GetSubscribeData())
+	case comm.RequestTypeAcquireLease:
+		data := req.GetAcquireLeaseData()
+		if data.Key == "" || data.Limit == 0 || data.TTL <= 0 {
+			resp.SetError(comm.ErrorCodeInvalidRequest, "key is empty or limit and ttl are not positive")
+			break
+		}
+		backendCtx, cancel := withDeadline(ctx, header)
+		lease, err := rate_limit.AcquireLease(backendCtx, data.Key, data.Limit, data.TTL)
+		cancel()
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+			break
+		}
+		resp.Lease = comm.LeaseData{Key: data.Key}
+		if lease != nil {
+			resp.Lease.ID = lease.ID
+		}
+	case comm.RequestTypeReleaseLease:
+		data := req.GetReleaseLeaseData()
+		if data.Key == "" || data.ID == "" {
+			resp.SetError(comm.ErrorCodeInvalidRequest, "key or lease ID is empty")
+			break
+		}
+		backendCtx, cancel := withDeadline(ctx, header)
+		err := rate_limit.ReleaseLease(backendCtx, &rate_limit.Lease{Key: data.Key, ID: data.ID})
+		cancel()
+		if err != nil {
+			resp.SetError(errorCode(err), err.Error())
+		}
+	default:
+		resp.SetError(comm.ErrorCodeUnknownType, "unknown request type")
 	}
 }
 
-func readHeader(conn net.Conn) (*comm.Header, error) {
-	header := make([]byte, 12)
-	if err := readFull(conn, header); err != nil {
-		return nil, err
-	}
-	return comm.UnmarshalHeader(header), nil
+// debugEnabled reports whether debug records are logged, so that the
+// attributes of hot path records are only built when they are.
+func debugEnabled(ctx context.Context) bool {
+	return slog.Default().Enabled(ctx, slog.LevelDebug)
 }
 
-func readFull(r io.Reader, buf []byte) error {
-	_, err := io.ReadFull(r, buf)
-	return err
+// errInvalidRequest marks requests rejected before reaching the backend.
+var errInvalidRequest = errors.New("invalid request")
+
+// errUnknownPolicy marks references to a named policy missing from the config.
+var errUnknownPolicy = errors.New("unknown policy")
+
+// rateLimit runs the backend call within the deadline carried by the header.
+// The policy is the name of the registered policy of the request, empty when
+// the request carries its limits.
+func rateLimit(ctx context.Context, header *comm.Header, policy string, data *comm.RateLimitRequestData) (*rate_limit.Result, error) {
+	if err := rate_limit.Validate(data); err != nil {
+		return nil, fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	hotKeys.record(data.Key)
+	if result, ok := overridden(data); ok {
+		stats.decided(result, nil)
+		metrics.decided(policy, result, nil)
+		return result, nil
+	}
+	ctx, cancel := withDeadline(ctx, header)
+	defer cancel()
+	start := time.Now()
+	result, err := rate_limit.RateLimit(ctx, data)
+	metrics.backendCalled(time.Since(start), err)
+	events.decided(data.Key, result, err)
+	stats.decided(result, err)
+	metrics.decided(policy, result, err)
+	return result, err
 }
 
-func respond(conn net.Conn, resp *comm.Response) {
-	buf := bufferPool.Get().(*bytes.Buffer)
-	buf.Reset()
-	defer bufferPool.Put(buf)
+// withDeadline bounds the context by the deadline carried by the header, if
+// any, when the backend blocks.
+func withDeadline(ctx context.Context, header *comm.Header) (context.Context, context.CancelFunc) {
+	if header.Deadline.IsZero() || !rate_limit.Blocks() {
+		return ctx, func() {}
+	}
+	return context.WithDeadline(ctx, header.Deadline)
+}
 
-	if err := resp.Marshal(buf); err != nil {
-		slog.Info("marshal response error", slog.Any("error", err))
-		return
+// errorCode classifies an error of rateLimit for the client.
+func errorCode(err error) comm.ErrorCode {
+	switch {
+	case errors.Is(err, errInvalidRequest):
+		return comm.ErrorCodeInvalidRequest
+	case errors.Is(err, errUnknownPolicy):
+		return comm.ErrorCodeUnknownPolicy
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(err, context.Canceled):
+		return comm.ErrorCodeTimeout
+	default:
+		return comm.ErrorCodeBackendUnavailable
 	}
-	_, err := conn.Write(buf.Bytes())
-	if err != nil {
-		slog.Debug("write response error", slog.Any("error", err), slog.Int("attempted_bytes", buf.Len()))
+}
+
+func toResponseData(result *rate_limit.Result) comm.RateLimitResponseData {
+	return comm.RateLimitResponseData{
+		Allowed:    int64(result.Allowed),
+		Remaining:  int64(result.Remaining),
+		RetryAfter: result.RetryAfter,
+		ResetAfter: result.ResetAfter,
 	}
 }
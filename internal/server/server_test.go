@@ -0,0 +1,272 @@
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+// testClient speaks to a session served over an in-memory connection.
+type testClient struct {
+	t      *testing.T
+	conn   net.Conn
+	sess   *session
+	nextID uint32
+}
+
+// startSession serves a session authenticated as configured, none when nil,
+// until the test ends.
+func startSession(t *testing.T, auth *config.AuthConfig) *testClient {
+	t.Helper()
+	return startPooledSession(t, auth, newWorkerPool(1, 1, nil), 0)
+}
+
+// startPooledSession serves a session answering its frames on the pool, with
+// at most maxInFlight of them in flight, until the test ends. The pool stops
+// with the session.
+func startPooledSession(t *testing.T, auth *config.AuthConfig, pool *workerPool, maxInFlight int) *testClient {
+	t.Helper()
+	clientConn, serverConn := net.Pipe()
+	sess := newSession(serverConn, auth, pool, maxInFlight, 0)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveConn(context.Background(), sess, &config.Config{})
+		_ = serverConn.Close()
+		sess.close()
+		pool.stop()
+	}()
+	t.Cleanup(func() {
+		_ = clientConn.Close()
+		<-done
+	})
+	return &testClient{t: t, conn: clientConn, sess: sess}
+}
+
+// roundTrip sends the request and returns the response, or the error reading
+// it when the server closed the connection.
+func (c *testClient) roundTrip(req *comm.Request) (*comm.Response, error) {
+	c.t.Helper()
+	if err := c.write(req); err != nil {
+		return nil, err
+	}
+	return c.read()
+}
+
+// write sends the request under the next request ID without waiting for its
+// response.
+func (c *testClient) write(req *comm.Request) error {
+	c.nextID++
+	req.Header = comm.Header{RequestID: c.nextID, Version: comm.VERSION}
+	return req.Marshal(c.conn)
+}
+
+// read returns the next frame sent by the server.
+func (c *testClient) read() (*comm.Response, error) {
+	c.t.Helper()
+	header, err := comm.ReadHeader(c.conn)
+	if err != nil {
+		return nil, err
+	}
+	payload := make([]byte, header.ContentLength)
+	if _, err := io.ReadFull(c.conn, payload); err != nil {
+		return nil, err
+	}
+	resp := &comm.Response{}
+	if err := resp.Unmarshal(header, payload); err != nil {
+		c.t.Fatalf("failed to decode response: %v", err)
+	}
+	return resp, nil
+}
+
+// send sends the request and fails the test when it is not answered.
+func (c *testClient) send(req *comm.Request) *comm.Response {
+	c.t.Helper()
+	resp, err := c.roundTrip(req)
+	if err != nil {
+		c.t.Fatalf("failed to send %s: %v", req.Type, err)
+	}
+	return resp
+}
+
+// expectClosed fails the test unless the server closed the connection.
+func (c *testClient) expectClosed() {
+	c.t.Helper()
+	if _, err := c.roundTrip(&comm.Request{Type: comm.RequestTypePing}); err == nil {
+		c.t.Errorf("expected the connection to be closed")
+	}
+}
+
+// blockingBackend takes the cost of each decision once its key is released,
+// announcing each decision it starts.
+type blockingBackend struct {
+	rate_limit.Backend
+	started chan string
+	mu      sync.Mutex
+	gates   map[string]chan struct{}
+	all     chan struct{}
+}
+
+func newBlockingBackend() *blockingBackend {
+	return &blockingBackend{started: make(chan string, 64), gates: make(map[string]chan struct{}), all: make(chan struct{})}
+}
+
+// useBackend decides with the backend until the test ends.
+func useBackend(t *testing.T, b rate_limit.Backend) {
+	t.Helper()
+	rate_limit.SetBackend(b)
+	t.Cleanup(func() { _ = rate_limit.Close() })
+}
+
+// gate returns the channel closed once the decisions of the key may end.
+func (b *blockingBackend) gate(key string) chan struct{} {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	gate, ok := b.gates[key]
+	if !ok {
+		gate = make(chan struct{})
+		b.gates[key] = gate
+	}
+	return gate
+}
+
+// release lets the decisions of the key end.
+func (b *blockingBackend) release(key string) {
+	close(b.gate(key))
+}
+
+// releaseAll lets all the decisions end.
+func (b *blockingBackend) releaseAll() {
+	close(b.all)
+}
+
+// waitStarted waits for the backend to start n decisions.
+func (b *blockingBackend) waitStarted(t *testing.T, n int) {
+	t.Helper()
+	for range n {
+		select {
+		case <-b.started:
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for a decision to reach the backend")
+		}
+	}
+}
+
+func (b *blockingBackend) AllowAtMost(ctx context.Context, data *comm.RateLimitRequestData) (*rate_limit.Result, error) {
+	b.started <- data.Key
+	select {
+	case <-b.gate(data.Key):
+	case <-b.all:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	return &rate_limit.Result{Allowed: int(data.GetCost()), RetryAfter: -1}, nil
+}
+
+func (b *blockingBackend) Close() error {
+	return nil
+}
+
+// decision returns a decision request for the key taking cost tokens.
+func decision(key string, cost uint64) *comm.Request {
+	return &comm.Request{Type: comm.RequestTypeRateLimit, RateLimit: comm.RateLimitRequestData{Rate: 100, Burst: 100, Period: time.Second, Cost: cost, Key: key}}
+}
+
+// TestConcurrentFrames expects the frames of one connection to be answered as
+// they are decided, each with the answer of its own key.
+func TestConcurrentFrames(t *testing.T) {
+	backend := newBlockingBackend()
+	useBackend(t, backend)
+	c := startPooledSession(t, nil, newWorkerPool(2, 2, nil), 0)
+
+	for i, key := range []string{"slow", "fast"} {
+		if err := c.write(decision(key, uint64(i+1))); err != nil {
+			t.Fatalf("failed to send: %v", err)
+		}
+	}
+	backend.waitStarted(t, 2)
+	backend.release("fast")
+	for _, expected := range []struct {
+		id      uint32
+		allowed int64
+	}{{2, 2}, {1, 1}} {
+		if expected.id == 1 {
+			backend.release("slow")
+		}
+		resp, err := c.read()
+		if err != nil {
+			t.Fatalf("failed to read: %v", err)
+		}
+		if resp.RequestID != expected.id || resp.RateLimit.Allowed != expected.allowed {
+			t.Errorf("expected request %d to be allowed %d, got request %d with %+v", expected.id, expected.allowed, resp.RequestID, resp.RateLimit)
+		}
+	}
+}
+
+// TestInFlightLimits expects frames beyond the in-flight limit of their
+// connection, or beyond the queue of the pool, to be answered as overloaded
+// without reaching the backend.
+func TestInFlightLimits(t *testing.T) {
+	for _, tc := range []struct {
+		name        string
+		workers     int
+		queue       int
+		maxInFlight int
+		message     string
+		metric      *atomic.Int64
+	}{
+		{"connection", 4, 4, 2, "too many requests in flight", &metrics.overloadedConnection},
+		// one frame is decided and the other queued
+		{"queue", 1, 1, 0, "server overloaded", &metrics.overloadedQueue},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			backend := newBlockingBackend()
+			useBackend(t, backend)
+			c := startPooledSession(t, nil, newWorkerPool(tc.workers, tc.queue, nil), tc.maxInFlight)
+			overloaded := tc.metric.Load()
+
+			for i := range 2 {
+				if err := c.write(decision(fmt.Sprintf("in-flight:%d", i), 1)); err != nil {
+					t.Fatalf("failed to send: %v", err)
+				}
+				if i == 0 {
+					// the first frame holds the only worker before the second is queued
+					backend.waitStarted(t, 1)
+				}
+			}
+			resp := c.send(decision("in-flight:overloaded", 1))
+			if resp.RequestID != 3 || resp.Code != comm.ErrorCodeOverloaded || resp.Error != tc.message {
+				t.Errorf("expected the third frame to be overloaded with %q, got %v: %s", tc.message, resp.Code, resp.Error)
+			}
+			if got := tc.metric.Load() - overloaded; got != 1 {
+				t.Errorf("expected one overloaded frame to be counted, got %d", got)
+			}
+
+			backend.releaseAll()
+			for range 2 {
+				resp, err := c.read()
+				if err != nil {
+					t.Fatalf("failed to read: %v", err)
+				}
+				if resp.Error != "" || resp.RateLimit.Allowed != 1 {
+					t.Errorf("expected request %d to be allowed, got %v: %s", resp.RequestID, resp.Code, resp.Error)
+				}
+			}
+			close(backend.started)
+			for key := range backend.started {
+				if key == "in-flight:overloaded" {
+					t.Errorf("expected the overloaded frame not to reach the backend")
+				}
+			}
+		})
+	}
+}
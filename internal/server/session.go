@@ -0,0 +1,431 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+// maxRetainedOutput is the largest output buffer a session keeps from one
+// response to the next.
+const maxRetainedOutput = 64 * 1024
+
+// legacyFeatures are the features of the clients predating the handshake,
+// which sent batches before the features were negotiated.
+const legacyFeatures = comm.FeatureBatch
+
+// session is the state of one client connection.
+type session struct {
+	conn net.Conn
+	// config returns the current config of the server, read for the named
+	// policies.
+	config func() *config.Config
+	// mu serializes the frames written to the connection and guards the
+	// state the shutdown goroutine reads.
+	mu sync.Mutex
+	// draining is set once the server asked the client to go away.
+	draining bool
+	// version and features are agreed on in the handshake. Clients that skip it
+	// speak the version of each frame header and use the legacyFeatures.
+	version  uint32
+	features comm.Feature
+
+	// token is the pre-shared token clients must prove they know, if any.
+	// Clients asking for comm.FeatureAdmin prove the adminToken instead,
+	// which lets them reset and list keys.
+	token         string
+	adminToken    string
+	clientNonce   [comm.AuthNonceSize]byte
+	serverNonce   [comm.AuthNonceSize]byte
+	challenged    bool
+	authenticated bool
+	admin         bool
+	// rejected closes the connection once the response of a failed
+	// authentication is written. It is set by the goroutine reading the
+	// frames, authentication frames being answered inline.
+	rejected bool
+
+	// policies are the policies registered on the connection, by ID. They are
+	// registered as frames are read and resolved by the workers.
+	policyMu sync.RWMutex
+	policies map[uint32]*comm.PolicyData
+	// out is the buffer frames are encoded into, guarded by mu.
+	out []byte
+	// writeTimeout bounds the writing of a frame, none when zero.
+	writeTimeout time.Duration
+
+	// pool answers the frames reaching the backend. At most maxInFlight of
+	// them are answered at once, unlimited when zero.
+	pool        *workerPool
+	maxInFlight int64
+	inFlight    atomic.Int64
+	pending     sync.WaitGroup
+	// events are the events waiting to be pushed to the client, nil until it
+	// subscribes.
+	events chan comm.EventData
+	// health is the last backend health event not yet pushed, guarded by
+	// healthMu. Health events are never dropped: a newer one replaces the
+	// one waiting, and healthReady wakes the writer.
+	healthMu      sync.Mutex
+	health        comm.EventData
+	healthPending bool
+	healthReady   chan struct{}
+}
+
+func newSession(conn net.Conn, auth *config.AuthConfig, pool *workerPool, maxInFlight int, writeTimeout time.Duration) *session {
+	token, adminToken := "", ""
+	if auth != nil {
+		token, adminToken = auth.Token, auth.AdminToken
+	}
+	return &session{
+		conn:          conn,
+		config:        config.GetConfig,
+		token:         token,
+		adminToken:    adminToken,
+		authenticated: token == "",
+		features:      legacyFeatures,
+		pool:          pool,
+		maxInFlight:   int64(maxInFlight),
+		writeTimeout:  writeTimeout,
+	}
+}
+
+// acquire takes an in-flight slot for a frame handed to the pool, reporting
+// false when the client already has too many frames in flight.
+func (s *session) acquire() bool {
+	if s.inFlight.Add(1) > s.maxInFlight && s.maxInFlight > 0 {
+		s.inFlight.Add(-1)
+		return false
+	}
+	s.pending.Add(1)
+	return true
+}
+
+// release gives back the slot of a frame answered by the pool.
+func (s *session) release() {
+	s.inFlight.Add(-1)
+	s.pending.Done()
+}
+
+// allowed reports whether the session may send requests of the type.
+func (s *session) allowed(reqType comm.RequestType) bool {
+	switch reqType {
+	case comm.RequestTypeHello, comm.RequestTypeAuthChallenge, comm.RequestTypeAuth:
+		return true
+	case comm.RequestTypeReset, comm.RequestTypeListKeys:
+		// servers requiring no token trust all their clients
+		return s.admin || (s.authenticated && s.token == "" && s.adminToken == "")
+	default:
+		return s.authenticated
+	}
+}
+
+// unnegotiated returns the features the request uses that were not agreed on
+// in the handshake, none when it may be answered. The features are only set
+// by the goroutine reading the frames, which calls it.
+func (s *session) unnegotiated(req *comm.Request) comm.Feature {
+	return req.Features() &^ s.features
+}
+
+// challenge answers the nonce of the client in answer, with a fresh server
+// nonce and the proof that the server knows the token.
+func (s *session) challenge(data *comm.AuthData, answer *comm.AuthData) error {
+	token := s.authToken()
+	if token == "" {
+		return fmt.Errorf("authentication is not enabled")
+	}
+	serverNonce, err := comm.NewAuthNonce()
+	if err != nil {
+		return err
+	}
+	s.clientNonce = data.Nonce
+	s.serverNonce = serverNonce
+	s.challenged = true
+	s.authenticated = false
+	s.admin = false
+	*answer = comm.AuthData{
+		Nonce: serverNonce,
+		MAC:   comm.ServerProof(token, s.clientNonce, s.serverNonce),
+	}
+	return nil
+}
+
+// authToken returns the token the client proves: the admin token when it
+// asked for comm.FeatureAdmin in the handshake.
+func (s *session) authToken() string {
+	if s.features.Has(comm.FeatureAdmin) {
+		return s.adminToken
+	}
+	return s.token
+}
+
+// authenticate checks the proof of the client against the last challenge.
+func (s *session) authenticate(data *comm.AuthData) error {
+	token := s.authToken()
+	if token == "" {
+		return fmt.Errorf("authentication is not enabled")
+	}
+	if !s.challenged {
+		return fmt.Errorf("no pending challenge")
+	}
+	// a challenge answers a single attempt
+	s.challenged = false
+	if !comm.VerifyProof(comm.ClientProof(token, s.clientNonce, s.serverNonce), data.MAC) {
+		return fmt.Errorf("invalid proof")
+	}
+	s.authenticated = true
+	s.admin = s.features.Has(comm.FeatureAdmin)
+	slog.Debug("client authenticated", slog.String("remote_addr", s.conn.RemoteAddr().String()), slog.Bool("admin", s.admin))
+	return nil
+}
+
+// negotiate answers the hello of the client and records the agreed version and features.
+func (s *session) negotiate(hello *comm.HelloData) (*comm.HelloData, error) {
+	supported := comm.SupportedFeatures
+	if s.adminToken != "" {
+		supported |= comm.FeatureAdmin
+	}
+	agreed, err := hello.Negotiate(comm.MinVersion, comm.VERSION, supported)
+	if err != nil {
+		return nil, err
+	}
+	// goAway reads them from the shutdown goroutine
+	s.mu.Lock()
+	s.version = agreed.MaxVersion
+	s.features = agreed.Features
+	s.mu.Unlock()
+	slog.Debug("handshake completed", slog.Uint64("version", uint64(s.version)), slog.String("features", s.features.String()))
+	return agreed, nil
+}
+
+// respond writes the response to the connection.
+func (s *session) respond(resp *comm.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out, err := resp.Append(s.out[:0])
+	if err != nil {
+		slog.Info("marshal response error", slog.Any("error", err))
+		return
+	}
+	// keep the buffer of most frames, not that of a large listing
+	if cap(out) <= maxRetainedOutput {
+		s.out = out
+	}
+	if s.writeTimeout > 0 {
+		if err := s.conn.SetWriteDeadline(time.Now().Add(s.writeTimeout)); err != nil {
+			slog.Debug("failed to set write deadline", slog.Any("error", err))
+		}
+	}
+	if _, err := s.conn.Write(out); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			// the frame may be partly written, the connection is out of sync
+			slog.Warn("closing connection, the client does not read its responses", slog.String("remote_addr", s.conn.RemoteAddr().String()))
+			_ = s.conn.Close()
+			return
+		}
+		slog.Debug("write response error", slog.Any("error", err), slog.Int("attempted_bytes", len(out)))
+	}
+}
+
+// setReadDeadline bounds the time until the next read by the timeout, none
+// when zero, unless the connection is draining with a deadline of its own.
+func (s *session) setReadDeadline(timeout time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.draining {
+		return
+	}
+	var deadline time.Time
+	if timeout > 0 {
+		deadline = time.Now().Add(timeout)
+	}
+	if err := s.conn.SetReadDeadline(deadline); err != nil {
+		slog.Debug("failed to set read deadline", slog.Any("error", err))
+	}
+}
+
+// goAway tells the client to move to another connection for the reason, when
+// it supports it, and gives it the drain timeout to finish its pending
+// requests. Requests keep being served until the client closes the connection
+// or the timeout expires. It reports whether the client was told.
+func (s *session) goAway(drainTimeout time.Duration, reason string) bool {
+	s.mu.Lock()
+	s.draining = true
+	version, features := s.version, s.features
+	if err := s.conn.SetReadDeadline(time.Now().Add(drainTimeout)); err != nil {
+		slog.Debug("failed to set drain deadline", slog.Any("error", err))
+	}
+	s.mu.Unlock()
+	if features.Has(comm.FeatureGoAway) {
+		s.respond(&comm.Response{
+			Header:  comm.Header{RequestID: comm.GoAwayRequestID, Version: version},
+			Type:    comm.RequestTypeGoAway,
+			Status:  comm.ResponseStatusOK,
+			Message: reason,
+		})
+	}
+	slog.Debug("draining connection", slog.String("remote_addr", s.conn.RemoteAddr().String()), slog.String("reason", reason), slog.Duration("timeout", drainTimeout))
+	return features.Has(comm.FeatureGoAway)
+}
+
+// isDraining reports whether the server asked the client to go away.
+func (s *session) isDraining() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.draining
+}
+
+// registerPolicy records the policy for later decisions of the connection,
+// replacing any policy of the same ID.
+func (s *session) registerPolicy(data *comm.PolicyData) error {
+	if err := data.Validate(); err != nil {
+		return fmt.Errorf("%w: %w", errInvalidRequest, err)
+	}
+	if data.Calendar != comm.CalendarNone {
+		if _, err := rate_limit.LoadTimeZone(data.TimeZone); err != nil {
+			return fmt.Errorf("%w: %w", errInvalidRequest, err)
+		}
+	}
+	if data.IsNamed() {
+		if _, err := namedPolicy(s.config(), data.Name); err != nil {
+			return err
+		}
+	}
+	// the data belongs to the request, which is reused for the next frames
+	policy := new(comm.PolicyData)
+	*policy = *data
+	s.policyMu.Lock()
+	if s.policies == nil {
+		s.policies = make(map[uint32]*comm.PolicyData)
+	}
+	if previous, ok := s.policies[policy.ID]; ok {
+		activePolicies.remove(previous)
+	}
+	s.policies[policy.ID] = policy
+	s.policyMu.Unlock()
+	if activePolicies.add(policy) {
+		events.policyChanged(policy.Name)
+	}
+	slog.Debug("policy registered", slog.Uint64("id", uint64(policy.ID)), slog.String("name", policy.Name), slog.String("algorithm", policy.Algorithm.String()))
+	return nil
+}
+
+// resolve sets dst to the full request of a decision under a registered policy.
+// Named policies take the limits of the current config, those of the last
+// reload.
+func (s *session) resolve(data *comm.PolicyRateLimitRequestData, dst *comm.RateLimitRequestData) (string, error) {
+	s.policyMu.RLock()
+	policy, ok := s.policies[data.PolicyID]
+	s.policyMu.RUnlock()
+	if !ok {
+		return "", fmt.Errorf("%w: unknown policy %d", errInvalidRequest, data.PolicyID)
+	}
+	if policy.IsNamed() {
+		named, err := namedPolicy(s.config(), policy.Name)
+		if err != nil {
+			return policy.Name, err
+		}
+		cost := data.Cost
+		if cost == 0 {
+			cost = policy.Cost
+		}
+		*dst = named.Request(data.Key, cost)
+		dst.PolicyID = policy.ID
+	} else {
+		*dst = policy.Request(data.Key, data.Cost)
+	}
+	dst.Trace = data.Trace
+	return policy.Name, nil
+}
+
+// subscribe sets the events pushed to the client.
+func (s *session) subscribe(data *comm.SubscribeData) {
+	if s.events == nil {
+		s.events = make(chan comm.EventData, eventQueueSize)
+		s.healthReady = make(chan struct{}, 1)
+		go s.writeEvents(s.events)
+	}
+	events.subscribe(s, data.Events&comm.AllEvents)
+	slog.Debug("events subscribed", slog.String("remote_addr", s.conn.RemoteAddr().String()), slog.Uint64("events", uint64(data.Events)))
+}
+
+// push queues the event for the client, dropping it when the client does not
+// keep up, so that publishers never wait for a connection. Health events are
+// kept instead, only the last one: clients that missed the backend coming
+// back would not send decisions again.
+func (s *session) push(event comm.EventData) {
+	if event.Type == comm.EventTypeBackendHealth {
+		s.healthMu.Lock()
+		s.health = event
+		s.healthPending = true
+		s.healthMu.Unlock()
+		select {
+		case s.healthReady <- struct{}{}:
+		default:
+		}
+		return
+	}
+	select {
+	case s.events <- event:
+	default:
+		slog.Warn("dropping event, the client does not keep up", slog.String("event", event.Type.String()), slog.String("remote_addr", s.conn.RemoteAddr().String()))
+	}
+}
+
+// writeEvents writes the queued events and the pending health event to the
+// connection until the queue is closed.
+func (s *session) writeEvents(queue <-chan comm.EventData) {
+	resp := &comm.Response{Type: comm.RequestTypeEvent, Status: comm.ResponseStatusOK}
+	for {
+		select {
+		case event, ok := <-queue:
+			if !ok {
+				return
+			}
+			s.writeEvent(resp, event)
+		case <-s.healthReady:
+			s.healthMu.Lock()
+			event, pending := s.health, s.healthPending
+			s.healthPending = false
+			s.healthMu.Unlock()
+			if pending {
+				s.writeEvent(resp, event)
+			}
+		}
+	}
+}
+
+// writeEvent writes the event to the connection.
+func (s *session) writeEvent(resp *comm.Response, event comm.EventData) {
+	s.mu.Lock()
+	version := s.version
+	s.mu.Unlock()
+	resp.Header = comm.Header{RequestID: comm.PushRequestID, Version: version}
+	resp.Event = event
+	s.respond(resp)
+}
+
+// close releases the policies and the subscription of the connection, once
+// its frames are answered.
+func (s *session) close() {
+	s.pending.Wait()
+	s.policyMu.Lock()
+	for _, policy := range s.policies {
+		activePolicies.remove(policy)
+	}
+	s.policies = nil
+	s.policyMu.Unlock()
+	if s.events != nil {
+		events.unsubscribe(s)
+		close(s.events)
+	}
+}
@@ -0,0 +1,9 @@
+//go:build !unix
+
+package server
+
+// restrictSocketMode does nothing, unix sockets only have a file mode on unix
+// systems.
+func restrictSocketMode() func() {
+	return func() {}
+}
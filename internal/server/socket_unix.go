@@ -0,0 +1,14 @@
+//go:build unix
+
+package server
+
+import "syscall"
+
+// restrictSocketMode makes the files created next, such as a unix socket,
+// accessible to their owner only, and returns the function restoring the
+// previous umask. The umask is that of the process, so it is only restricted
+// at startup, while the socket is created.
+func restrictSocketMode() func() {
+	previous := syscall.Umask(0o177)
+	return func() { syscall.Umask(previous) }
+}
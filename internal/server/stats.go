@@ -0,0 +1,168 @@
+package server
+
+import (
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+// Stats are the counters of the server since it started.
+type Stats struct {
+	Uptime time.Duration `json:"-"`
+	// Connections is the number of open connections.
+	Connections      int64 `json:"connections"`
+	ConnectionsTotal int64 `json:"connectionsTotal"`
+	Requests         int64 `json:"requests"`
+	// Decisions counts the rate limit decisions, Allowed and Denied those
+	// made and Errors those that failed.
+	Decisions      int64 `json:"decisions"`
+	Allowed        int64 `json:"allowed"`
+	Denied         int64 `json:"denied"`
+	Errors         int64 `json:"errors"`
+	BackendHealthy bool  `json:"backendHealthy"`
+	Policies       int   `json:"policies"`
+	Bans           int   `json:"bans"`
+	Allows         int   `json:"allows"`
+}
+
+// serverStats counts the work of the server, updated without locks on the
+// request path.
+type serverStats struct {
+	start            time.Time
+	connections      atomic.Int64
+	connectionsTotal atomic.Int64
+	requests         atomic.Int64
+	decisions        atomic.Int64
+	allowed          atomic.Int64
+	denied           atomic.Int64
+	errors           atomic.Int64
+}
+
+var stats = &serverStats{start: time.Now()}
+
+func (s *serverStats) connected() {
+	s.connections.Add(1)
+	s.connectionsTotal.Add(1)
+}
+
+func (s *serverStats) disconnected() {
+	s.connections.Add(-1)
+}
+
+func (s *serverStats) decided(result *rate_limit.Result, err error) {
+	s.decisions.Add(1)
+	switch {
+	case err != nil:
+		s.errors.Add(1)
+	case result.Allowed > 0:
+		s.allowed.Add(1)
+	default:
+		s.denied.Add(1)
+	}
+}
+
+// snapshot returns the current counters of the server.
+func (s *serverStats) snapshot() Stats {
+	now := time.Now()
+	return Stats{
+		Uptime:           now.Sub(s.start),
+		Connections:      s.connections.Load(),
+		ConnectionsTotal: s.connectionsTotal.Load(),
+		Requests:         s.requests.Load(),
+		Decisions:        s.decisions.Load(),
+		Allowed:          s.allowed.Load(),
+		Denied:           s.denied.Load(),
+		Errors:           s.errors.Load(),
+		BackendHealthy:   !events.down.Load(),
+		Policies:         len(activePolicies.list()),
+		Bans:             len(manualBans.list(now)),
+		Allows:           len(manualAllows.list(now)),
+	}
+}
+
+const (
+	// hotKeysWindow is the period over which the decisions of keys are counted.
+	hotKeysWindow = time.Minute
+	// maxHotKeys bounds the number of keys counted in a window. Keys first
+	// seen once it is reached are not counted until the next window.
+	maxHotKeys = 10000
+)
+
+// HotKey is a key and its number of decisions over the last window.
+type HotKey struct {
+	Key       string `json:"key"`
+	Decisions uint64 `json:"decisions"`
+}
+
+// hotKeyCounter counts the decisions of each key over the current and the
+// previous window. It only counts once enabled, by the admin API.
+type hotKeyCounter struct {
+	enabled  atomic.Bool
+	mu       sync.Mutex
+	current  map[string]uint64
+	previous map[string]uint64
+	rotateAt time.Time
+}
+
+var hotKeys = &hotKeyCounter{current: make(map[string]uint64)}
+
+func (c *hotKeyCounter) record(key string) {
+	if !c.enabled.Load() {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.rotate(time.Now())
+	if _, ok := c.current[key]; !ok && len(c.current) >= maxHotKeys {
+		return
+	}
+	c.current[key]++
+}
+
+// rotate starts a new window once the current one is over.
+func (c *hotKeyCounter) rotate(now time.Time) {
+	if now.Before(c.rotateAt) {
+		return
+	}
+	if now.Before(c.rotateAt.Add(hotKeysWindow)) {
+		c.previous = c.current
+	} else {
+		// no decision for a whole window
+		c.previous = nil
+	}
+	c.current = make(map[string]uint64, len(c.previous))
+	c.rotateAt = now.Add(hotKeysWindow)
+}
+
+// top returns the keys of the most decisions over the current and the
+// previous window, at most limit of them.
+func (c *hotKeyCounter) top(limit int, now time.Time) []HotKey {
+	c.mu.Lock()
+	c.rotate(now)
+	counts := make(map[string]uint64, len(c.current)+len(c.previous))
+	for key, count := range c.previous {
+		counts[key] += count
+	}
+	for key, count := range c.current {
+		counts[key] += count
+	}
+	c.mu.Unlock()
+
+	keys := make([]HotKey, 0, len(counts))
+	for key, count := range counts {
+		keys = append(keys, HotKey{Key: key, Decisions: count})
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].Decisions != keys[j].Decisions {
+			return keys[i].Decisions > keys[j].Decisions
+		}
+		return keys[i].Key < keys[j].Key
+	})
+	if len(keys) > limit {
+		keys = keys[:limit]
+	}
+	return keys
+}
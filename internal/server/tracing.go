@@ -0,0 +1,169 @@
+package server
+
+import (
+	"context"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+	"github.com/zekihan/traefik-rate-limit/internal/tracing"
+)
+
+// newTracer returns the tracer of the configured exporters, nil when tracing
+// is off.
+func newTracer(cfg *config.TracingConfig) (*tracing.Tracer, error) {
+	if cfg == nil || (cfg.Endpoint == "" && cfg.File == "") {
+		return nil, nil
+	}
+	var exporters []tracing.Exporter
+	if cfg.Endpoint != "" {
+		exporters = append(exporters, tracing.NewHTTPExporter(cfg.Endpoint, cfg.ServiceName))
+	}
+	if cfg.File != "" {
+		exporter, err := tracing.NewFileExporter(cfg.File, cfg.ServiceName)
+		if err != nil {
+			return nil, err
+		}
+		exporters = append(exporters, exporter)
+	}
+	return tracing.New(exporters...), nil
+}
+
+// frameTrace collects the timings of a frame for the spans of its sampled
+// decisions. It is reused from one frame to the next, a nil frameTrace
+// records nothing.
+type frameTrace struct {
+	tracer    *tracing.Tracer
+	start     time.Time
+	decodedAt time.Time
+	encodeAt  time.Time
+	decisions []tracedDecision
+}
+
+// tracedDecision is a backend call made for a sampled decision.
+type tracedDecision struct {
+	trace  comm.TraceContext
+	key    string
+	cost   uint64
+	start  time.Time
+	end    time.Time
+	result rate_limit.Result
+	err    error
+}
+
+func newFrameTrace(tracer *tracing.Tracer) *frameTrace {
+	if tracer == nil {
+		return nil
+	}
+	return &frameTrace{tracer: tracer}
+}
+
+// begin starts the trace of a frame just read.
+func (f *frameTrace) begin() {
+	if f == nil {
+		return
+	}
+	f.start = time.Now()
+	f.decisions = f.decisions[:0]
+}
+
+// decoded marks the end of the decoding of the frame.
+func (f *frameTrace) decoded() {
+	if f == nil {
+		return
+	}
+	f.decodedAt = time.Now()
+}
+
+// encoding marks the start of the encoding of the response.
+func (f *frameTrace) encoding() {
+	if f == nil {
+		return
+	}
+	f.encodeAt = time.Now()
+}
+
+// decide makes the decision like rateLimit, recording it when its trace is sampled.
+func (f *frameTrace) decide(ctx context.Context, header *comm.Header, policy string, data *comm.RateLimitRequestData) (*rate_limit.Result, error) {
+	if f == nil || !data.Trace.Sampled() {
+		return rateLimit(ctx, header, policy, data)
+	}
+	decision := tracedDecision{trace: data.Trace, key: data.Key, cost: data.GetCost(), start: time.Now()}
+	result, err := rateLimit(ctx, header, policy, data)
+	decision.end = time.Now()
+	decision.err = err
+	if result != nil {
+		decision.result = *result
+	}
+	f.decisions = append(f.decisions, decision)
+	return result, err
+}
+
+// finish records the spans of the sampled decisions of the frame, once its
+// response is written. Each decision gets a server span, a child of the span
+// of the caller, with the decoding, the backend call and the encoding as
+// children.
+func (f *frameTrace) finish(reqType comm.RequestType) {
+	if f == nil || len(f.decisions) == 0 {
+		return
+	}
+	end := time.Now()
+	for i := range f.decisions {
+		decision := &f.decisions[i]
+		server := &tracing.Span{
+			TraceID:      decision.trace.TraceID,
+			SpanID:       tracing.NewSpanID(),
+			ParentSpanID: decision.trace.SpanID,
+			Name:         "rate_limit " + reqType.String(),
+			Kind:         tracing.SpanKindServer,
+			Start:        f.start,
+			End:          end,
+			Attributes: []tracing.Attribute{
+				tracing.String("rate_limit.key", decision.key),
+				tracing.Int64("rate_limit.cost", int64(decision.cost)),
+			},
+		}
+		backend := &tracing.Span{
+			TraceID:      decision.trace.TraceID,
+			SpanID:       tracing.NewSpanID(),
+			ParentSpanID: server.SpanID,
+			Name:         "redis rate_limit",
+			Kind:         tracing.SpanKindClient,
+			Start:        decision.start,
+			End:          decision.end,
+			Attributes:   []tracing.Attribute{tracing.String("db.system", "redis")},
+		}
+		if decision.err != nil {
+			server.Error = decision.err.Error()
+			backend.Error = decision.err.Error()
+		} else {
+			server.Attributes = append(server.Attributes,
+				tracing.Int64("rate_limit.allowed", int64(decision.result.Allowed)),
+				tracing.Int64("rate_limit.remaining", int64(decision.result.Remaining)),
+			)
+		}
+		f.tracer.Record(server)
+		f.tracer.Record(&tracing.Span{
+			TraceID:      decision.trace.TraceID,
+			SpanID:       tracing.NewSpanID(),
+			ParentSpanID: server.SpanID,
+			Name:         "decode",
+			Kind:         tracing.SpanKindInternal,
+			Start:        f.start,
+			End:          f.decodedAt,
+		})
+		f.tracer.Record(backend)
+		f.tracer.Record(&tracing.Span{
+			TraceID:      decision.trace.TraceID,
+			SpanID:       tracing.NewSpanID(),
+			ParentSpanID: server.SpanID,
+			Name:         "encode",
+			Kind:         tracing.SpanKindInternal,
+			Start:        f.encodeAt,
+			End:          end,
+		})
+		decision.key = ""
+		decision.err = nil
+	}
+}
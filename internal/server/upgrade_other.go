@@ -0,0 +1,32 @@
+//go:build !unix
+
+package server
+
+import (
+	"fmt"
+	"net"
+	"os"
+)
+
+// inheritedListener is only supported on unix systems.
+func inheritedListener() (net.Listener, error) {
+	return nil, nil
+}
+
+// notifyReady is only supported on unix systems.
+func notifyReady() {}
+
+// notifyUpgrade returns no channel, hot upgrades are only supported on unix systems.
+func notifyUpgrade() (<-chan os.Signal, func()) {
+	return nil, func() {}
+}
+
+// inheritedOverrides is only supported on unix systems.
+func inheritedOverrides() ([]byte, error) {
+	return nil, nil
+}
+
+// upgrade is only supported on unix systems.
+func upgrade(_ net.Listener, _ []byte) error {
+	return fmt.Errorf("hot upgrades are not supported on this platform")
+}
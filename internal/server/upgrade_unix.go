@@ -0,0 +1,205 @@
+//go:build unix
+
+package server
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+)
+
+const (
+	// listenFDsStart is the first file descriptor passed with LISTEN_FDS.
+	listenFDsStart = 3
+	// upgradeReadyEnv names the pipe the new process closes once it listens.
+	upgradeReadyEnv = config.EnvKeyPrefix + "UPGRADE_READY_FD"
+	// upgradeOverridesEnv names the file holding the overrides handed over.
+	upgradeOverridesEnv = config.EnvKeyPrefix + "UPGRADE_OVERRIDES_FD"
+	// upgradeTimeout is how long the new process gets to start listening.
+	upgradeTimeout = 30 * time.Second
+)
+
+// inheritedListener returns the socket passed with LISTEN_FDS, nil if there
+// is none. systemd sets LISTEN_PID to the process the sockets are meant for.
+// A process handing over in a hot upgrade does not know the PID before exec
+// and leaves it out.
+func inheritedListener() (net.Listener, error) {
+	fds := os.Getenv("LISTEN_FDS")
+	if fds == "" {
+		return nil, nil
+	}
+	if pid := os.Getenv("LISTEN_PID"); pid != "" && pid != strconv.Itoa(os.Getpid()) {
+		return nil, nil
+	}
+	// the sockets are not passed on to the processes started later
+	_ = os.Unsetenv("LISTEN_FDS")
+	_ = os.Unsetenv("LISTEN_PID")
+	_ = os.Unsetenv("LISTEN_FDNAMES")
+
+	count, err := strconv.Atoi(fds)
+	if err != nil || count < 1 {
+		return nil, fmt.Errorf("invalid LISTEN_FDS %q", fds)
+	}
+	if count > 1 {
+		slog.Warn("only the first inherited socket is used", slog.Int("count", count))
+	}
+	file := os.NewFile(listenFDsStart, "listener")
+	defer file.Close()
+	listener, err := net.FileListener(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to use inherited socket: %w", err)
+	}
+	return listener, nil
+}
+
+// notifyReady tells the process that started this one in a hot upgrade that
+// the server listens.
+func notifyReady() {
+	fd := os.Getenv(upgradeReadyEnv)
+	if fd == "" {
+		return
+	}
+	_ = os.Unsetenv(upgradeReadyEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		slog.Error("invalid upgrade ready file descriptor", slog.String("fd", fd))
+		return
+	}
+	file := os.NewFile(uintptr(n), "ready")
+	if _, err := file.Write([]byte{1}); err != nil {
+		slog.Error("failed to notify upgrade", slog.Any("error", err))
+	}
+	_ = file.Close()
+}
+
+// inheritedOverrides returns the overrides handed over by the process that
+// started this one in a hot upgrade, nil if there are none.
+func inheritedOverrides() ([]byte, error) {
+	fd := os.Getenv(upgradeOverridesEnv)
+	if fd == "" {
+		return nil, nil
+	}
+	_ = os.Unsetenv(upgradeOverridesEnv)
+	n, err := strconv.Atoi(fd)
+	if err != nil {
+		return nil, fmt.Errorf("invalid upgrade overrides file descriptor %q", fd)
+	}
+	file := os.NewFile(uintptr(n), "overrides")
+	defer file.Close()
+	data, err := io.ReadAll(file)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read the overrides handed over: %w", err)
+	}
+	return data, nil
+}
+
+// notifyUpgrade returns the channel receiving the signal asking for a hot
+// upgrade, SIGUSR2.
+func notifyUpgrade() (<-chan os.Signal, func()) {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGUSR2)
+	return signals, func() { signal.Stop(signals) }
+}
+
+// upgrade starts the executable again with the same command line and hands it
+// the listener and the overrides. It returns once the new process listens,
+// the caller then drains its own connections. On error the caller keeps
+// serving.
+func upgrade(listener net.Listener, overrides []byte) error {
+	filer, ok := listener.(interface{ File() (*os.File, error) })
+	if !ok {
+		return fmt.Errorf("listener %T cannot be handed over", listener)
+	}
+	file, err := filer.File()
+	if err != nil {
+		return fmt.Errorf("failed to get listener file: %w", err)
+	}
+	defer file.Close()
+	executable, err := os.Executable()
+	if err != nil {
+		return fmt.Errorf("failed to find executable: %w", err)
+	}
+	ready, readyWriter, err := os.Pipe()
+	if err != nil {
+		return fmt.Errorf("failed to create ready pipe: %w", err)
+	}
+	defer ready.Close()
+
+	// os.Args holds the command line main left: the subcommand and its flags
+	cmd := exec.Command(executable, os.Args...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// the extra files start at descriptor 3
+	cmd.ExtraFiles = []*os.File{file, readyWriter}
+	cmd.Env = append(os.Environ(),
+		"LISTEN_FDS=1",
+		upgradeReadyEnv+"="+strconv.Itoa(listenFDsStart+1),
+	)
+	if overrides != nil {
+		overridesFile, err := overridesFile(overrides)
+		if err != nil {
+			_ = readyWriter.Close()
+			return err
+		}
+		defer overridesFile.Close()
+		cmd.ExtraFiles = append(cmd.ExtraFiles, overridesFile)
+		cmd.Env = append(cmd.Env, upgradeOverridesEnv+"="+strconv.Itoa(listenFDsStart+2))
+	}
+	err = cmd.Start()
+	_ = readyWriter.Close()
+	if err != nil {
+		return fmt.Errorf("failed to start new process: %w", err)
+	}
+
+	readyErr := make(chan error, 1)
+	go func() {
+		// the pipe closes without a byte if the new process exits first
+		_, err := ready.Read(make([]byte, 1))
+		readyErr <- err
+	}()
+	select {
+	case err = <-readyErr:
+	case <-time.After(upgradeTimeout):
+		err = fmt.Errorf("timed out after %s", upgradeTimeout)
+	}
+	if err != nil {
+		_ = cmd.Process.Kill()
+		_ = cmd.Wait()
+		return fmt.Errorf("new process failed to start listening: %w", err)
+	}
+	go func() {
+		_ = cmd.Wait()
+	}()
+	slog.Info("listener handed over", slog.Int("pid", cmd.Process.Pid))
+	return nil
+}
+
+// overridesFile returns an unlinked temporary file holding the overrides,
+// read from the start by the new process. Unlike a pipe, it does not block
+// on a large list until the new process reads it.
+func overridesFile(overrides []byte) (*os.File, error) {
+	file, err := os.CreateTemp("", "traefik-rate-limit-overrides-")
+	if err != nil {
+		return nil, fmt.Errorf("failed to create overrides file: %w", err)
+	}
+	_ = os.Remove(file.Name())
+	if _, err := file.Write(overrides); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to write overrides file: %w", err)
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		_ = file.Close()
+		return nil, fmt.Errorf("failed to rewind overrides file: %w", err)
+	}
+	return file, nil
+}
@@ -0,0 +1,151 @@
+//go:build unix
+
+package server
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/config"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+)
+
+// upgradeHelperEnv makes TestUpgradeHelper act as the process started by a
+// hot upgrade: "serve" accepts one connection on the inherited listener,
+// "overrides" also restores the overrides handed over and tells whether
+// upgradeBannedKey is banned, "exit" exits before listening.
+const upgradeHelperEnv = "UPGRADE_TEST_HELPER"
+
+// upgradeBannedKey is the key banned before the overrides are handed over.
+const upgradeBannedKey = "upgrade:banned"
+
+// TestUpgradeHelper is the new process of the upgrade tests, not a test.
+func TestUpgradeHelper(t *testing.T) {
+	mode := os.Getenv(upgradeHelperEnv)
+	if mode == "" {
+		t.Skip("only run by the upgrade tests")
+	}
+	if mode == "exit" {
+		os.Exit(1)
+	}
+	listener, err := inheritedListener()
+	if err != nil || listener == nil {
+		os.Exit(2)
+	}
+	greeting := "new process\n"
+	if mode == "overrides" {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := restoreOverrides(ctx); err != nil {
+			os.Exit(4)
+		}
+		bans, err := rate_limit.ListOverrides(ctx, rate_limit.OverrideBan)
+		_, cached := manualBans.get(upgradeBannedKey, time.Now())
+		if err != nil || len(bans) != 1 || bans[0].Key != upgradeBannedKey || !cached {
+			greeting = "not banned\n"
+		} else {
+			greeting = "banned\n"
+		}
+	}
+	notifyReady()
+	_ = listener.(*net.UnixListener).SetDeadline(time.Now().Add(10 * time.Second))
+	conn, err := listener.Accept()
+	if err != nil {
+		os.Exit(3)
+	}
+	_, _ = conn.Write([]byte(greeting))
+	_ = conn.Close()
+	// exit before the test framework reports to the output of the test
+	os.Exit(0)
+}
+
+// startUpgrade listens on a unix socket and hands it to TestUpgradeHelper
+// in the mode with the overrides, returning the socket path, the listener and
+// the error of the upgrade.
+func startUpgrade(t *testing.T, mode string, overrides []byte) (string, net.Listener, error) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "server.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	keepSocketFile(listener)
+	t.Cleanup(func() { _ = listener.Close() })
+
+	args := os.Args
+	os.Args = []string{"-test.run=^TestUpgradeHelper$"}
+	t.Cleanup(func() { os.Args = args })
+	t.Setenv(upgradeHelperEnv, mode)
+	return path, listener, upgrade(listener, overrides)
+}
+
+// readGreeting dials the socket and returns the line written by the process
+// accepting the connection.
+func readGreeting(t *testing.T, path string) string {
+	t.Helper()
+	conn, err := net.DialTimeout("unix", path, 5*time.Second)
+	if err != nil {
+		t.Fatalf("failed to dial: %v", err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	if err != nil {
+		t.Fatalf("failed to read: %v", err)
+	}
+	return line
+}
+
+func TestUpgrade(t *testing.T) {
+	path, listener, err := startUpgrade(t, "serve", nil)
+	if err != nil {
+		t.Fatalf("expected the upgrade to succeed, got %v", err)
+	}
+	// like the server, stop accepting once the listener is handed over
+	_ = listener.Close()
+	if line := readGreeting(t, path); line != "new process\n" {
+		t.Errorf("expected the new process to accept on the socket, got %q", line)
+	}
+}
+
+// TestUpgradeOverrides expects a ban to survive a hot upgrade with a backend
+// the new process does not share.
+func TestUpgradeOverrides(t *testing.T) {
+	t.Setenv(config.EnvKeyPrefix+"BACKEND", rate_limit.BackendMemory)
+	manualBans.set(upgradeBannedKey, time.Now().Add(time.Hour))
+	t.Cleanup(func() { manualBans.remove(upgradeBannedKey, time.Now()) })
+
+	path, listener, err := startUpgrade(t, "overrides", handoverOverrides())
+	if err != nil {
+		t.Fatalf("expected the upgrade to succeed, got %v", err)
+	}
+	_ = listener.Close()
+	if line := readGreeting(t, path); line != "banned\n" {
+		t.Errorf("expected the ban to be handed over, got %q", line)
+	}
+}
+
+// TestUpgradeRollback expects the server to keep accepting on its listener
+// when the new process exits before listening.
+func TestUpgradeRollback(t *testing.T) {
+	path, listener, err := startUpgrade(t, "exit", nil)
+	if err == nil {
+		t.Fatalf("expected the upgrade to fail")
+	}
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		_, _ = conn.Write([]byte("old process\n"))
+		_ = conn.Close()
+	}()
+	if line := readGreeting(t, path); line != "old process\n" {
+		t.Errorf("expected the old process to keep accepting, got %q", line)
+	}
+}
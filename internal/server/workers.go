@@ -0,0 +1,165 @@
+package server
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/rate_limit"
+	"github.com/zekihan/traefik-rate-limit/internal/tracing"
+)
+
+// workerPool answers the frames that reach the backend, for all connections,
+// on a fixed number of goroutines. The frames of one connection are answered
+// concurrently, clients match the responses by request ID.
+type workerPool struct {
+	queue  chan *job
+	wg     sync.WaitGroup
+	jobs   sync.Pool
+	tracer *tracing.Tracer
+}
+
+// job is a frame being answered. Jobs are reused from one frame to the next.
+type job struct {
+	ctx  context.Context
+	sess *session
+	req  comm.Request
+	resp comm.Response
+	// scratch holds the request of the decision under a policy being made.
+	scratch comm.RateLimitRequestData
+	// start is when the frame was read, decideTime the time spent making its decisions.
+	start      time.Time
+	decideTime time.Duration
+	// trace records the spans of the traced decisions, nil without tracing.
+	trace *frameTrace
+	// queued is set when the job runs on the pool and holds an in-flight slot
+	// of its session.
+	queued bool
+	// pong is the answer to the last ping of the job, reused while pings
+	// carry the same data, such as keepalives.
+	pong string
+}
+
+// newWorkerPool starts the workers, queueing at most queueSize frames when
+// they are all busy.
+func newWorkerPool(workers int, queueSize int, tracer *tracing.Tracer) *workerPool {
+	p := &workerPool{
+		queue:  make(chan *job, queueSize),
+		tracer: tracer,
+	}
+	p.jobs.New = func() any {
+		return &job{trace: newFrameTrace(p.tracer)}
+	}
+	p.wg.Add(workers)
+	for range workers {
+		go p.work()
+	}
+	return p
+}
+
+func (p *workerPool) work() {
+	defer p.wg.Done()
+	for j := range p.queue {
+		j.run()
+	}
+}
+
+// get returns a job for a frame of the session just read.
+func (p *workerPool) get(ctx context.Context, sess *session) *job {
+	j := p.jobs.Get().(*job)
+	j.ctx = ctx
+	j.sess = sess
+	j.start = time.Now()
+	j.decideTime = 0
+	j.queued = false
+	j.trace.begin()
+	metrics.inFlight.Add(1)
+	return j
+}
+
+// put releases the job once its response is written.
+func (p *workerPool) put(j *job) {
+	metrics.inFlight.Add(-1)
+	if j.queued {
+		j.sess.release()
+	}
+	j.ctx = nil
+	j.sess = nil
+	p.jobs.Put(j)
+}
+
+// submit queues the job, reporting false when the queue is full.
+func (p *workerPool) submit(j *job) bool {
+	j.queued = true
+	select {
+	case p.queue <- j:
+		return true
+	default:
+		j.queued = false
+		return false
+	}
+}
+
+// stop waits for the queued jobs once no more are submitted.
+func (p *workerPool) stop() {
+	close(p.queue)
+	p.wg.Wait()
+}
+
+// run answers the request of the job.
+func (j *job) run() {
+	handleRequest(j)
+	j.respond()
+}
+
+// pongTo returns the answer to a ping carrying the data.
+func (j *job) pongTo(data string) string {
+	if len(j.pong) != len(pongPrefix)+len(data) || !strings.HasSuffix(j.pong, data) {
+		j.pong = pongPrefix + data
+	}
+	return j.pong
+}
+
+// respond writes the response of the job and releases it.
+func (j *job) respond() {
+	j.trace.encoding()
+	j.sess.respond(&j.resp)
+	j.trace.finish(j.req.Type)
+	if isDecision(j.req.Type) {
+		metrics.socketLatency.observe(time.Since(j.start) - j.decideTime)
+	}
+	j.sess.pool.put(j)
+}
+
+// decide makes the decision of the policy, adding its time to that of the
+// decisions of the frame.
+func (j *job) decide(header *comm.Header, policy string, data *comm.RateLimitRequestData) (*rate_limit.Result, error) {
+	start := time.Now()
+	result, err := j.trace.decide(j.ctx, header, policy, data)
+	j.decideTime += time.Since(start)
+	return result, err
+}
+
+// concurrent reports whether frames of the type are answered by the worker
+// pool. The others change the state of the session, and are answered in
+// order as they are read.
+func concurrent(reqType comm.RequestType) bool {
+	switch reqType {
+	case comm.RequestTypePeek, comm.RequestTypeReset, comm.RequestTypeListKeys, comm.RequestTypeAcquireLease, comm.RequestTypeReleaseLease:
+		return true
+	default:
+		return isDecision(reqType)
+	}
+}
+
+// isDecision reports whether requests of the type are rate limit decisions.
+func isDecision(reqType comm.RequestType) bool {
+	switch reqType {
+	case comm.RequestTypeRateLimit, comm.RequestTypeRateLimitPolicy, comm.RequestTypeRateLimitBatch, comm.RequestTypeRateLimitPolicyBatch:
+		return true
+	default:
+		return false
+	}
+}
@@ -0,0 +1,201 @@
+package tracing
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+)
+
+// scopeName is the instrumentation scope of the spans of the server.
+const scopeName = "github.com/zekihan/traefik-rate-limit"
+
+// The OTLP/JSON encoding of an ExportTraceServiceRequest. IDs are hex strings
+// and 64-bit integers decimal strings, as the OTLP specification requires.
+type otlpRequest struct {
+	ResourceSpans []otlpResourceSpans `json:"resourceSpans"`
+}
+
+type otlpResourceSpans struct {
+	Resource   otlpResource     `json:"resource"`
+	ScopeSpans []otlpScopeSpans `json:"scopeSpans"`
+}
+
+type otlpResource struct {
+	Attributes []otlpAttribute `json:"attributes"`
+}
+
+type otlpScopeSpans struct {
+	Scope otlpScope  `json:"scope"`
+	Spans []otlpSpan `json:"spans"`
+}
+
+type otlpScope struct {
+	Name string `json:"name"`
+}
+
+type otlpSpan struct {
+	TraceID           string          `json:"traceId"`
+	SpanID            string          `json:"spanId"`
+	ParentSpanID      string          `json:"parentSpanId,omitempty"`
+	Name              string          `json:"name"`
+	Kind              SpanKind        `json:"kind"`
+	StartTimeUnixNano string          `json:"startTimeUnixNano"`
+	EndTimeUnixNano   string          `json:"endTimeUnixNano"`
+	Attributes        []otlpAttribute `json:"attributes,omitempty"`
+	Status            otlpStatus      `json:"status"`
+}
+
+type otlpStatus struct {
+	// Code is 0 for unset and 2 for an error.
+	Code    int    `json:"code,omitempty"`
+	Message string `json:"message,omitempty"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"`
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+func toOTLPAttribute(attribute Attribute) otlpAttribute {
+	var value otlpValue
+	switch v := attribute.Value.(type) {
+	case int64:
+		s := strconv.FormatInt(v, 10)
+		value.IntValue = &s
+	case bool:
+		value.BoolValue = &v
+	case string:
+		value.StringValue = &v
+	default:
+		s := fmt.Sprint(v)
+		value.StringValue = &s
+	}
+	return otlpAttribute{Key: attribute.Key, Value: value}
+}
+
+// marshalOTLP encodes the spans as an OTLP/JSON export request of the service.
+func marshalOTLP(serviceName string, spans []*Span) ([]byte, error) {
+	encoded := make([]otlpSpan, len(spans))
+	for i, span := range spans {
+		encoded[i] = otlpSpan{
+			TraceID:           hex.EncodeToString(span.TraceID[:]),
+			SpanID:            hex.EncodeToString(span.SpanID[:]),
+			Name:              span.Name,
+			Kind:              span.Kind,
+			StartTimeUnixNano: strconv.FormatInt(span.Start.UnixNano(), 10),
+			EndTimeUnixNano:   strconv.FormatInt(span.End.UnixNano(), 10),
+		}
+		if span.ParentSpanID != [8]byte{} {
+			encoded[i].ParentSpanID = hex.EncodeToString(span.ParentSpanID[:])
+		}
+		for _, attribute := range span.Attributes {
+			encoded[i].Attributes = append(encoded[i].Attributes, toOTLPAttribute(attribute))
+		}
+		if span.Error != "" {
+			encoded[i].Status = otlpStatus{Code: 2, Message: span.Error}
+		}
+	}
+	return json.Marshal(otlpRequest{ResourceSpans: []otlpResourceSpans{{
+		Resource:   otlpResource{Attributes: []otlpAttribute{toOTLPAttribute(String("service.name", serviceName))}},
+		ScopeSpans: []otlpScopeSpans{{Scope: otlpScope{Name: scopeName}, Spans: encoded}},
+	}}})
+}
+
+// HTTPExporter posts spans to an OTLP/HTTP collector in the JSON encoding.
+type HTTPExporter struct {
+	endpoint    string
+	serviceName string
+	client      *http.Client
+}
+
+// NewHTTPExporter returns an exporter to the traces endpoint of a collector,
+// such as http://localhost:4318/v1/traces.
+func NewHTTPExporter(endpoint string, serviceName string) *HTTPExporter {
+	return &HTTPExporter{
+		endpoint:    endpoint,
+		serviceName: serviceName,
+		client:      &http.Client{},
+	}
+}
+
+func (e *HTTPExporter) Export(ctx context.Context, spans []*Span) error {
+	body, err := marshalOTLP(e.serviceName, spans)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, e.endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := e.client.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to post spans: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("collector answered %s", resp.Status)
+	}
+	return nil
+}
+
+func (e *HTTPExporter) Close() error {
+	e.client.CloseIdleConnections()
+	return nil
+}
+
+// FileExporter appends spans to a file, one OTLP/JSON export request per
+// line, the format of the file exporter of the OpenTelemetry Collector.
+type FileExporter struct {
+	serviceName string
+	mu          sync.Mutex
+	file        *os.File
+	w           *bufio.Writer
+}
+
+// NewFileExporter opens the file for appending, creating it if needed.
+func NewFileExporter(path string, serviceName string) (*FileExporter, error) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0o644)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open trace file: %w", err)
+	}
+	return &FileExporter{serviceName: serviceName, file: file, w: bufio.NewWriter(file)}, nil
+}
+
+func (e *FileExporter) Export(_ context.Context, spans []*Span) error {
+	line, err := marshalOTLP(e.serviceName, spans)
+	if err != nil {
+		return fmt.Errorf("failed to encode spans: %w", err)
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if _, err := e.w.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	return e.w.Flush()
+}
+
+func (e *FileExporter) Close() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if err := e.w.Flush(); err != nil {
+		_ = e.file.Close()
+		return err
+	}
+	return e.file.Close()
+}
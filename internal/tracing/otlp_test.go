@@ -0,0 +1,96 @@
+package tracing
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func testSpans() []*Span {
+	start := time.Unix(0, 1767225600000000000)
+	return []*Span{{
+		TraceID:      [16]byte{0x4b, 0xf9, 0x2f, 0x35, 0x77, 0xb3, 0x4d, 0xa6, 0xa3, 0xce, 0x92, 0x9d, 0x0e, 0x0e, 0x47, 0x36},
+		SpanID:       [8]byte{1, 2, 3, 4, 5, 6, 7, 8},
+		ParentSpanID: [8]byte{0x00, 0xf0, 0x67, 0xaa, 0x0b, 0xa9, 0x02, 0xb7},
+		Name:         "rate_limit RateLimitPolicy",
+		Kind:         SpanKindServer,
+		Start:        start,
+		End:          start.Add(time.Millisecond),
+		Attributes:   []Attribute{String("rate_limit.key", "a"), Int64("rate_limit.allowed", 1)},
+		Error:        "redis: connection refused",
+	}}
+}
+
+const expectedOTLP = `{"resourceSpans":[{"resource":{"attributes":[{"key":"service.name","value":{"stringValue":"test"}}]},` +
+	`"scopeSpans":[{"scope":{"name":"github.com/zekihan/traefik-rate-limit"},"spans":[{` +
+	`"traceId":"4bf92f3577b34da6a3ce929d0e0e4736","spanId":"0102030405060708","parentSpanId":"00f067aa0ba902b7",` +
+	`"name":"rate_limit RateLimitPolicy","kind":2,"startTimeUnixNano":"1767225600000000000","endTimeUnixNano":"1767225600001000000",` +
+	`"attributes":[{"key":"rate_limit.key","value":{"stringValue":"a"}},{"key":"rate_limit.allowed","value":{"intValue":"1"}}],` +
+	`"status":{"code":2,"message":"redis: connection refused"}}]}]}]}`
+
+func TestMarshalOTLP(t *testing.T) {
+	got, err := marshalOTLP("test", testSpans())
+	if err != nil {
+		t.Fatalf("failed to encode spans: %v", err)
+	}
+	if string(got) != expectedOTLP {
+		t.Errorf("Expected %s \nWanted %s", got, expectedOTLP)
+	}
+}
+
+func TestHTTPExporter(t *testing.T) {
+	received := make(chan string, 1)
+	collector := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body json.RawMessage
+		if r.URL.Path != "/v1/traces" || r.Header.Get("Content-Type") != "application/json" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		received <- string(body)
+	}))
+	defer collector.Close()
+
+	tracer := New(NewHTTPExporter(collector.URL+"/v1/traces", "test"))
+	tracer.Record(testSpans()[0])
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	select {
+	case body := <-received:
+		if body != expectedOTLP {
+			t.Errorf("Expected %s \nWanted %s", body, expectedOTLP)
+		}
+	default:
+		t.Fatalf("the collector received no spans")
+	}
+}
+
+func TestFileExporter(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "spans.json")
+	exporter, err := NewFileExporter(path, "test")
+	if err != nil {
+		t.Fatalf("failed to open file: %v", err)
+	}
+	tracer := New(exporter)
+	tracer.Record(testSpans()[0])
+	if err := tracer.Shutdown(context.Background()); err != nil {
+		t.Fatalf("failed to shut down: %v", err)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatalf("failed to read file: %v", err)
+	}
+	if lines := strings.Split(strings.TrimSuffix(string(data), "\n"), "\n"); len(lines) != 1 || lines[0] != expectedOTLP {
+		t.Errorf("Expected %s \nWanted %s", data, expectedOTLP)
+	}
+}
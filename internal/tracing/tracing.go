@@ -0,0 +1,186 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"log/slog"
+	"math/rand/v2"
+	"sync"
+	"time"
+)
+
+// SpanKind is the role of a span in a trace, as numbered by OTLP.
+type SpanKind int
+
+const (
+	SpanKindInternal SpanKind = 1
+	SpanKindServer   SpanKind = 2
+	SpanKindClient   SpanKind = 3
+)
+
+// Span is a timed operation of a trace.
+type Span struct {
+	TraceID      [16]byte
+	SpanID       [8]byte
+	ParentSpanID [8]byte
+	Name         string
+	Kind         SpanKind
+	Start        time.Time
+	End          time.Time
+	Attributes   []Attribute
+	// Error is the error the operation failed with, empty when it succeeded.
+	Error string
+}
+
+// Attribute is a key and a string, int64 or bool value describing a span.
+type Attribute struct {
+	Key   string
+	Value any
+}
+
+func String(key string, value string) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+func Int64(key string, value int64) Attribute {
+	return Attribute{Key: key, Value: value}
+}
+
+// NewSpanID returns a random span ID, never zero.
+func NewSpanID() [8]byte {
+	var id [8]byte
+	for id == [8]byte{} {
+		v := rand.Uint64()
+		for i := range id {
+			id[i] = byte(v >> (8 * i))
+		}
+	}
+	return id
+}
+
+// Exporter sends finished spans to a collector or a file.
+type Exporter interface {
+	Export(ctx context.Context, spans []*Span) error
+	Close() error
+}
+
+const (
+	// queueSize is the number of spans waiting for export. Spans recorded
+	// while it is full are dropped.
+	queueSize = 4096
+	// batchSize is the largest number of spans exported at once.
+	batchSize = 512
+	// flushInterval is the longest a span waits for its batch to fill up.
+	flushInterval = time.Second
+	// exportTimeout bounds a single export.
+	exportTimeout = 10 * time.Second
+)
+
+// Tracer exports the spans it records in batches, in the background, so that
+// recording never waits for the exporter.
+type Tracer struct {
+	exporters []Exporter
+	queue     chan *Span
+	stop      chan struct{}
+	stopped   chan struct{}
+	once      sync.Once
+
+	mu      sync.Mutex
+	dropped int
+}
+
+// New returns a tracer exporting through each of the exporters. Shutdown
+// exports the spans still queued and closes the exporters.
+func New(exporters ...Exporter) *Tracer {
+	t := &Tracer{
+		exporters: exporters,
+		queue:     make(chan *Span, queueSize),
+		stop:      make(chan struct{}),
+		stopped:   make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Record queues the finished span for export.
+func (t *Tracer) Record(span *Span) {
+	select {
+	case t.queue <- span:
+	default:
+		t.mu.Lock()
+		t.dropped++
+		t.mu.Unlock()
+	}
+}
+
+func (t *Tracer) run() {
+	defer close(t.stopped)
+	ticker := time.NewTicker(flushInterval)
+	defer ticker.Stop()
+	batch := make([]*Span, 0, batchSize)
+	for {
+		select {
+		case span := <-t.queue:
+			batch = append(batch, span)
+			if len(batch) >= batchSize {
+				batch = t.export(batch)
+			}
+		case <-ticker.C:
+			batch = t.export(batch)
+		case <-t.stop:
+			for {
+				select {
+				case span := <-t.queue:
+					batch = append(batch, span)
+					if len(batch) >= batchSize {
+						batch = t.export(batch)
+					}
+				default:
+					t.export(batch)
+					return
+				}
+			}
+		}
+	}
+}
+
+// export sends the batch and returns it emptied.
+func (t *Tracer) export(batch []*Span) []*Span {
+	t.mu.Lock()
+	dropped := t.dropped
+	t.dropped = 0
+	t.mu.Unlock()
+	if dropped > 0 {
+		slog.Warn("dropped spans, the export queue is full", slog.Int("count", dropped))
+	}
+	if len(batch) == 0 {
+		return batch
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), exportTimeout)
+	defer cancel()
+	for _, exporter := range t.exporters {
+		if err := exporter.Export(ctx, batch); err != nil {
+			slog.Warn("failed to export spans", slog.Any("error", err), slog.Int("count", len(batch)))
+		}
+	}
+	clear(batch)
+	return batch[:0]
+}
+
+// Shutdown exports the queued spans and closes the exporters, giving up once
+// the context is done.
+func (t *Tracer) Shutdown(ctx context.Context) error {
+	t.once.Do(func() {
+		close(t.stop)
+	})
+	select {
+	case <-t.stopped:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var errs []error
+	for _, exporter := range t.exporters {
+		errs = append(errs, exporter.Close())
+	}
+	return errors.Join(errs...)
+}
@@ -0,0 +1,162 @@
+package transport
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+const (
+	SchemeUnix = "unix"
+	SchemeTCP  = "tcp"
+	SchemeTLS  = "tls"
+)
+
+// Address is where the server listens, as unix:///path, tcp://host:port or
+// tls://host:port. A plain path is a unix socket.
+type Address struct {
+	Scheme string
+	// Address is the socket path for unix, host and port otherwise.
+	Address string
+}
+
+func ParseAddress(address string) (*Address, error) {
+	if address == "" {
+		return nil, fmt.Errorf("address is empty")
+	}
+	scheme, rest, found := strings.Cut(address, "://")
+	if !found {
+		return &Address{Scheme: SchemeUnix, Address: address}, nil
+	}
+	if rest == "" {
+		return nil, fmt.Errorf("address %s has no host or path", address)
+	}
+	switch strings.ToLower(scheme) {
+	case SchemeUnix:
+		return &Address{Scheme: SchemeUnix, Address: rest}, nil
+	case SchemeTCP, SchemeTLS:
+		if _, _, err := net.SplitHostPort(rest); err != nil {
+			return nil, fmt.Errorf("invalid address %s: %w", address, err)
+		}
+		return &Address{Scheme: strings.ToLower(scheme), Address: rest}, nil
+	default:
+		return nil, fmt.Errorf("unknown scheme %s in address %s", scheme, address)
+	}
+}
+
+// Network returns the network name of the address for net.Dial and net.Listen.
+func (a *Address) Network() string {
+	if a.Scheme == SchemeUnix {
+		return "unix"
+	}
+	return "tcp"
+}
+
+// IsUnix reports whether the address is a unix socket path.
+func (a *Address) IsUnix() bool {
+	return a.Scheme == SchemeUnix
+}
+
+func (a *Address) String() string {
+	return a.Scheme + "://" + a.Address
+}
+
+// Dial connects to the address, with TLS for tls:// addresses.
+func Dial(ctx context.Context, address *Address, tlsConfig *tls.Config) (net.Conn, error) {
+	if address.Scheme == SchemeTLS {
+		if tlsConfig == nil {
+			tlsConfig = &tls.Config{}
+		}
+		dialer := &tls.Dialer{Config: tlsConfig}
+		return dialer.DialContext(ctx, address.Network(), address.Address)
+	}
+	dialer := &net.Dialer{}
+	return dialer.DialContext(ctx, address.Network(), address.Address)
+}
+
+// Listen listens on the address, with TLS for tls:// addresses.
+func Listen(address *Address, tlsConfig *tls.Config) (net.Listener, error) {
+	if address.Scheme == SchemeTLS && tlsConfig == nil {
+		return nil, fmt.Errorf("address %s needs a TLS certificate", address)
+	}
+	listener, err := net.Listen(address.Network(), address.Address)
+	if err != nil {
+		return nil, err
+	}
+	return Wrap(address, listener, tlsConfig), nil
+}
+
+// Wrap serves TLS on the listener for tls:// addresses. Other listeners are
+// returned as they are.
+func Wrap(address *Address, listener net.Listener, tlsConfig *tls.Config) net.Listener {
+	if address.Scheme == SchemeTLS {
+		return tls.NewListener(listener, tlsConfig)
+	}
+	return listener
+}
+
+// ServerTLSConfig loads the certificate of the server. With a client CA file,
+// clients must present a certificate signed by it.
+func ServerTLSConfig(certFile string, keyFile string, clientCAFile string) (*tls.Config, error) {
+	if certFile == "" || keyFile == "" {
+		return nil, fmt.Errorf("certificate and key files are required")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig builds the TLS configuration of a client. The CA file
+// replaces the system roots, the certificate is presented for mutual TLS.
+func ClientTLSConfig(caFile string, certFile string, keyFile string, serverName string, insecureSkipVerify bool) (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         serverName,
+		InsecureSkipVerify: insecureSkipVerify,
+		MinVersion:         tls.VersionTLS12,
+	}
+	if caFile != "" {
+		pool, err := loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("no certificate found in CA file %s", caFile)
+	}
+	return pool, nil
+}
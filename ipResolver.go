@@ -11,11 +11,17 @@ import (
 type IPResolverConfig struct {
 	Header   string `json:"header,omitempty"`
 	UseSrcIP bool   `json:"useSrcIP,omitempty"`
+	// TrustedProxies are the networks allowed to set the header. When set, the
+	// header of other peers is ignored and trusted hops are skipped in X-Forwarded-For.
+	TrustedProxies []string `json:"trustedProxies,omitempty"`
+	// TrustedProxiesFile lists more trusted proxy networks, one per line.
+	TrustedProxiesFile string `json:"trustedProxiesFile,omitempty"`
 }
 
 type IPResolver struct {
-	config *IPResolverConfig
-	logger *PluginLogger
+	config         *IPResolverConfig
+	logger         *PluginLogger
+	trustedProxies *IPSet
 }
 
 func (a *IPResolver) getIP(req *http.Request) (net.IP, error) {
@@ -31,6 +37,16 @@ func (a *IPResolver) getIP(req *http.Request) (net.IP, error) {
 		}
 		return ip, nil
 	}
+	if a.trustedProxies != nil {
+		srcIP, err := a.getSrcIP(req)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse source IP: %w", err)
+		}
+		if !a.trustedProxies.Contains(srcIP) {
+			a.logger.Debug("Source IP is not a trusted proxy, ignoring header", slog.String("ip", srcIP.String()), slog.String("header", a.config.Header))
+			return srcIP, nil
+		}
+	}
 	a.logger.Debug("Using IP resolver", slog.String("header", a.config.Header))
 	ip, err := a.getIPFromHeader(req, a.config.Header)
 	if err != nil {
@@ -51,6 +67,9 @@ func (a *IPResolver) getIPFromHeader(req *http.Request, header string) (net.IP,
 func (a *IPResolver) handleXForwardedFor(req *http.Request) (net.IP, error) {
 	xForwardedForList := req.Header.Values(XForwardedFor)
 	if len(xForwardedForList) == 1 {
+		if a.trustedProxies != nil {
+			return a.handleXForwardedForTrusted(xForwardedForList[0])
+		}
 		xForwardedForValuesStr := strings.Split(xForwardedForList[0], ",")
 		xForwardedForValues := make([]net.IP, 0)
 		if len(xForwardedForValuesStr) > 0 {
@@ -76,6 +95,23 @@ func (a *IPResolver) handleXForwardedFor(req *http.Request) (net.IP, error) {
 	}
 }
 
+// handleXForwardedForTrusted walks the hops from the nearest one and returns
+// the first address that is not a trusted proxy.
+func (a *IPResolver) handleXForwardedForTrusted(xForwardedFor string) (net.IP, error) {
+	hops := strings.Split(xForwardedFor, ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			return nil, fmt.Errorf("invalid IP format in X-Forwarded-For: %s", hops[i])
+		}
+		if !a.trustedProxies.Contains(hop) {
+			a.logger.Debug("Found valid X-Forwarded-For IP", slog.String("ip", hop.String()))
+			return hop, nil
+		}
+	}
+	return nil, fmt.Errorf("no untrusted IP found in X-Forwarded-For")
+}
+
 func (a *IPResolver) handleHeader(req *http.Request, header string) (net.IP, error) {
 	headerValues := req.Header.Values(header)
 	switch len(headerValues) {
@@ -140,14 +176,3 @@ func (a *IPResolver) getLocalIPsHardcoded() ([]*net.IPNet, error) {
 	}
 	return ips, nil
 }
-
-func (a *IPResolver) isWhitelisted(ip net.IP, whitelistedIPNets []*net.IPNet) bool {
-	for _, ipNet := range whitelistedIPNets {
-		if ipNet.Contains(ip) {
-			a.logger.Debug("IP is whitelisted", slog.String("ip", ip.String()))
-			return true
-		}
-	}
-	a.logger.Debug("IP is not whitelisted", slog.String("ip", ip.String()))
-	return false
-}
@@ -0,0 +1,153 @@
+package traefik_rate_limit
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+)
+
+// IPSet is a set of IP networks stored in one binary prefix trie per address
+// family. A lookup walks at most 32 or 128 nodes whatever the number of networks.
+type IPSet struct {
+	v4   *ipSetNode
+	v6   *ipSetNode
+	size int
+}
+
+type ipSetNode struct {
+	children [2]*ipSetNode
+	// terminal marks the end of a network, every address below it is in the set.
+	terminal bool
+}
+
+func NewIPSet() *IPSet {
+	return &IPSet{
+		v4: &ipSetNode{},
+		v6: &ipSetNode{},
+	}
+}
+
+// Add adds the network to the set.
+func (s *IPSet) Add(ipNet *net.IPNet) {
+	ones, _ := ipNet.Mask.Size()
+	root, ip := s.root(ipNet.IP)
+	if ip == nil {
+		return
+	}
+	if len(ip) == net.IPv4len && len(ipNet.Mask) == net.IPv6len {
+		ones -= 96
+	}
+
+	node := root
+	for i := 0; i < ones; i++ {
+		if node.terminal {
+			// already covered by a wider network
+			return
+		}
+		bit := ipBit(ip, i)
+		if node.children[bit] == nil {
+			node.children[bit] = &ipSetNode{}
+		}
+		node = node.children[bit]
+	}
+	if !node.terminal {
+		s.size++
+	}
+	node.terminal = true
+	// narrower networks are covered by this one now
+	node.children = [2]*ipSetNode{}
+}
+
+// AddCIDR parses the value as a CIDR range or a single IP address and adds it to the set.
+func (s *IPSet) AddCIDR(value string) error {
+	value = strings.TrimSpace(value)
+	if !strings.Contains(value, "/") {
+		ip := net.ParseIP(value)
+		if ip == nil {
+			return fmt.Errorf("invalid IP address: %s", value)
+		}
+		bits := net.IPv6len * 8
+		if ip.To4() != nil {
+			ip = ip.To4()
+			bits = net.IPv4len * 8
+		}
+		s.Add(&net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+		return nil
+	}
+	_, ipNet, err := net.ParseCIDR(value)
+	if err != nil {
+		return fmt.Errorf("invalid IP range: %s", value)
+	}
+	s.Add(ipNet)
+	return nil
+}
+
+// AddFile adds the networks listed in the file, one per line. Blank lines and
+// lines starting with # are ignored.
+func (s *IPSet) AddFile(path string) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	lineNumber := 0
+	for scanner.Scan() {
+		lineNumber++
+		line := scanner.Text()
+		if i := strings.IndexByte(line, '#'); i >= 0 {
+			line = line[:i]
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			continue
+		}
+		if err := s.AddCIDR(line); err != nil {
+			return fmt.Errorf("%s:%d: %w", path, lineNumber, err)
+		}
+	}
+	return scanner.Err()
+}
+
+// Contains reports whether the IP is in one of the networks of the set.
+func (s *IPSet) Contains(ip net.IP) bool {
+	node, ip := s.root(ip)
+	if ip == nil {
+		return false
+	}
+	bits := len(ip) * 8
+	for i := 0; ; i++ {
+		if node.terminal {
+			return true
+		}
+		if i == bits {
+			return false
+		}
+		node = node.children[ipBit(ip, i)]
+		if node == nil {
+			return false
+		}
+	}
+}
+
+// Len returns the number of networks in the set.
+func (s *IPSet) Len() int {
+	return s.size
+}
+
+func (s *IPSet) root(ip net.IP) (*ipSetNode, net.IP) {
+	if ip4 := ip.To4(); ip4 != nil {
+		return s.v4, ip4
+	}
+	if ip16 := ip.To16(); ip16 != nil {
+		return s.v6, ip16
+	}
+	return nil, nil
+}
+
+func ipBit(ip net.IP, i int) int {
+	return int(ip[i/8]>>(7-uint(i%8))) & 1
+}
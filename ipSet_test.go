@@ -0,0 +1,89 @@
+package traefik_rate_limit
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestIPSet(t *testing.T) {
+	set := NewIPSet()
+	for _, cidr := range []string{"10.0.0.0/8", "192.168.1.0/24", "203.0.113.7", "2001:db8::/32", "::ffff:198.51.100.0/120"} {
+		if err := set.AddCIDR(cidr); err != nil {
+			t.Fatalf("failed to add %s: %v", cidr, err)
+		}
+	}
+	tests := []struct {
+		ip   string
+		want bool
+	}{
+		{ip: "10.1.2.3", want: true},
+		{ip: "11.1.2.3", want: false},
+		{ip: "192.168.1.255", want: true},
+		{ip: "192.168.2.1", want: false},
+		{ip: "203.0.113.7", want: true},
+		{ip: "203.0.113.8", want: false},
+		{ip: "198.51.100.42", want: true},
+		{ip: "::ffff:10.0.0.1", want: true},
+		{ip: "2001:db8::1", want: true},
+		{ip: "2001:db9::1", want: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.ip, func(t *testing.T) {
+			if got := set.Contains(net.ParseIP(tt.ip)); got != tt.want {
+				t.Errorf("Expected %v \nWanted %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestIPSetAddFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ranges.txt")
+	content := "# partners\n10.0.0.0/8\n\n2001:db8::/32 # office\n"
+	if err := os.WriteFile(path, []byte(content), 0o600); err != nil {
+		t.Fatalf("failed to write file: %v", err)
+	}
+	set := NewIPSet()
+	if err := set.AddFile(path); err != nil {
+		t.Fatalf("failed to load file: %v", err)
+	}
+	if set.Len() != 2 {
+		t.Errorf("Expected %d networks \nWanted %d", set.Len(), 2)
+	}
+	if !set.Contains(net.ParseIP("2001:db8::1")) {
+		t.Errorf("expected 2001:db8::1 to be in the set")
+	}
+}
+
+func BenchmarkIPSetContains(b *testing.B) {
+	for _, size := range []int{10, 1000, 100000} {
+		set := NewIPSet()
+		nets := make([]*net.IPNet, 0, size)
+		for i := 0; i < size; i++ {
+			ip := make(net.IP, net.IPv4len)
+			binary.BigEndian.PutUint32(ip, uint32(i)<<8|0x0b000000)
+			ipNet := &net.IPNet{IP: ip, Mask: net.CIDRMask(24, 32)}
+			set.Add(ipNet)
+			nets = append(nets, ipNet)
+		}
+		miss := net.ParseIP("203.0.113.7")
+
+		b.Run(fmt.Sprintf("trie/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				set.Contains(miss)
+			}
+		})
+		b.Run(fmt.Sprintf("linear/%d", size), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				for _, ipNet := range nets {
+					if ipNet.Contains(miss) {
+						break
+					}
+				}
+			}
+		})
+	}
+}
@@ -6,88 +6,238 @@ import (
 	"github.com/zekihan/traefik-rate-limit/internal/client"
 	"github.com/zekihan/traefik-rate-limit/internal/comm"
 	"log/slog"
-	"net"
 	"net/http"
 	"net/url"
+	"strings"
 	"time"
 )
 
 type RatelimitConfig struct {
-	// Rate is the number of requests recovered per period.
+	// Algorithm is the rate limiting algorithm: gcra, the default,
+	// sliding-window-log, sliding-window-counter or fixed-window.
+	Algorithm string `json:"algorithm,omitempty"`
+
+	// Rate is the number of requests recovered per period, or allowed per
+	// period with the window algorithms.
 	Rate int `json:"rate,omitempty"`
 
-	// Burst is the maximum number of requests allowed in a burst.
+	// Burst is the maximum number of requests allowed in a burst. The window
+	// algorithms do not use it.
 	Burst int `json:"burst,omitempty"`
 
 	// Period is the time period for the rate limit.
 	Period string `json:"period,omitempty"`
 
+	// Calendar aligns the windows of fixed-window on the hour, day, week or
+	// month of TimeZone rather than on the Unix epoch.
+	Calendar string `json:"calendar,omitempty"`
+
+	// TimeZone is the IANA time zone of the calendar, UTC when empty.
+	TimeZone string `json:"timeZone,omitempty"`
+
 	// period is the parsed time duration for the rate limit.
 	period time.Duration
+
+	// algorithm is the parsed algorithm.
+	algorithm comm.Algorithm
+
+	// calendar is the parsed calendar.
+	calendar comm.Calendar
 }
 
 func (c *RatelimitConfig) Validate() error {
+	algorithm, err := comm.ParseAlgorithm(c.Algorithm)
+	if err != nil {
+		return err
+	}
 	if c.Rate <= 0 {
 		return fmt.Errorf("rate must be greater than 0")
 	}
-	if c.Burst <= 0 {
+	if c.Burst <= 0 && algorithm == comm.AlgorithmGCRA {
 		return fmt.Errorf("burst must be greater than 0")
 	}
-	period, err := time.ParseDuration(c.Period)
+	calendar, err := comm.ParseCalendar(c.Calendar)
 	if err != nil {
-		return fmt.Errorf("invalid period: %v", err)
+		return err
+	}
+	if calendar != comm.CalendarNone && algorithm != comm.AlgorithmFixedWindow {
+		return fmt.Errorf("calendar is only used by fixed-window")
 	}
-	if period <= time.Duration(0) {
-		return fmt.Errorf("period must be greater than 0")
+	if c.TimeZone != "" && calendar == comm.CalendarNone {
+		return fmt.Errorf("timeZone requires a calendar")
+	}
+	// calendar windows last their unit
+	var period time.Duration
+	if c.Period != "" || calendar == comm.CalendarNone {
+		if period, err = time.ParseDuration(c.Period); err != nil {
+			return fmt.Errorf("invalid period: %v", err)
+		}
+		if period <= time.Duration(0) {
+			return fmt.Errorf("period must be greater than 0")
+		}
 	}
 	c.period = period
+	c.algorithm = algorithm
+	c.calendar = calendar
+	return nil
+}
+
+type BatchConfig struct {
+	// Enabled groups concurrent decisions into batch frames to the sidecar.
+	Enabled bool `json:"enabled,omitempty"`
+
+	// MaxSize is the maximum number of distinct keys in a batch.
+	MaxSize int `json:"maxSize,omitempty"`
+
+	// MaxDelay is the longest a decision waits for its batch to fill up.
+	MaxDelay string `json:"maxDelay,omitempty"`
+
+	// maxDelay is the parsed time duration of MaxDelay.
+	maxDelay time.Duration
+}
+
+func (c *BatchConfig) Validate() error {
+	if !c.Enabled {
+		return nil
+	}
+	if c.MaxSize <= 0 {
+		return fmt.Errorf("maxSize must be greater than 0")
+	}
+	maxDelay, err := time.ParseDuration(c.MaxDelay)
+	if err != nil {
+		return fmt.Errorf("invalid maxDelay: %v", err)
+	}
+	if maxDelay <= time.Duration(0) {
+		return fmt.Errorf("maxDelay must be greater than 0")
+	}
+	c.maxDelay = maxDelay
+	return nil
+}
+
+type KeepAliveConfig struct {
+	// Interval is the time between two pings checking that the sidecar
+	// connection is alive, none when empty.
+	Interval string `json:"interval,omitempty"`
+
+	// Timeout is how long a ping waits for its answer before the connection
+	// is closed and a new one dialed.
+	Timeout string `json:"timeout,omitempty"`
+
+	// interval and timeout are the parsed time durations of Interval and Timeout.
+	interval time.Duration
+	timeout  time.Duration
+}
+
+func (c *KeepAliveConfig) Validate() error {
+	if c.Interval == "" {
+		return nil
+	}
+	interval, err := time.ParseDuration(c.Interval)
+	if err != nil {
+		return fmt.Errorf("invalid interval: %v", err)
+	}
+	if interval <= time.Duration(0) {
+		return fmt.Errorf("interval must be greater than 0")
+	}
+	c.interval = interval
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		if timeout <= time.Duration(0) {
+			return fmt.Errorf("timeout must be greater than 0")
+		}
+		c.timeout = timeout
+	}
 	return nil
 }
 
 // RateLimiter plugin.
 type RateLimiter struct {
-	next              http.Handler
-	name              string
-	conf              *Config
-	logger            *PluginLogger
-	ipResolver        *IPResolver
-	whitelistedIPNets []*net.IPNet
-	socketPath        string
+	next          http.Handler
+	name          string
+	conf          *Config
+	logger        *PluginLogger
+	ipResolver    *IPResolver
+	whitelist     *IPSet
+	denylist      *IPSet
+	socketPath    string
+	clientOptions *client.Options
+	policy        *comm.PolicyData
+	timeout       time.Duration
+	denyCache     *DenyCache
+
+	// conn is the sidecar connection shared by all requests, and by the
+	// instances of the middleware built with the same configuration.
+	conn *sidecarConn
 }
 
+// defaultTimeout is the decision budget used when none is configured.
+const defaultTimeout = 500 * time.Millisecond
+
 func (a *RateLimiter) GetKey(ip string) string {
-	prefix := "traefik"
+	ipKey := url.PathEscape(ip)
+	if ipKey == "" {
+		ipKey = "default"
+	}
+	return a.keyPrefix() + ipKey
+}
+
+// keyPrefix is the prefix of the keys of the plugin.
+func (a *RateLimiter) keyPrefix() string {
 	name := url.PathEscape(a.name)
 	if name == "" {
 		name = "default"
 	}
+	return fmt.Sprintf("%s:%s:", "traefik", name)
+}
 
-	ipKey := url.PathEscape(ip)
-	if ipKey == "" {
-		ipKey = "default"
-	}
+// policyID is the ID of the policy of the plugin, the only one registered on
+// its sidecar connection.
+const policyID = 1
 
-	key := fmt.Sprintf("%s:%s:%s", prefix, name, ipKey)
-	return key
+// newPolicy returns the policy of the plugin, registered on every sidecar
+// connection. With a sidecar policy, it is the named policy carrying no
+// limits.
+func newPolicy(name string, config *Config) *comm.PolicyData {
+	if config.Policy != "" {
+		return &comm.PolicyData{ID: policyID, Name: config.Policy}
+	}
+	if name == "" {
+		name = "default"
+	}
+	return &comm.PolicyData{
+		ID:        policyID,
+		Algorithm: config.Ratelimit.algorithm,
+		Rate:      uint64(config.Ratelimit.Rate),
+		Burst:     uint64(config.Ratelimit.Burst),
+		Period:    config.Ratelimit.period,
+		Name:      name,
+		Calendar:  config.Ratelimit.calendar,
+		TimeZone:  config.Ratelimit.TimeZone,
+	}
 }
 
-func (a *RateLimiter) Allow(ctx context.Context, ip string) (res *comm.RateLimitResponseData, err error) {
+// Allow asks the sidecar for a decision on the ip. The decision is bounded by
+// the configured timeout and abandoned as soon as ctx is done. A valid trace
+// context lets the sidecar report its work in the trace of the request.
+func (a *RateLimiter) Allow(ctx context.Context, ip string, trace comm.TraceContext) (res *comm.RateLimitResponseData, err error) {
 	if a.conf == nil {
 		return nil, fmt.Errorf("missing configuration")
 	}
-	if a.conf.Ratelimit == nil {
+	if a.conf.Ratelimit == nil && a.conf.Policy == "" {
 		return nil, fmt.Errorf("missing ratelimit configuration")
 	}
+	if a.policy == nil {
+		return nil, fmt.Errorf("missing policy")
+	}
 	if ip == "" {
 		return nil, fmt.Errorf("missing ip address")
 	}
 
-	limit := &comm.RateLimitRequestData{
-		Rate:   uint64(a.conf.Ratelimit.Rate),
-		Burst:  uint64(a.conf.Ratelimit.Burst),
-		Period: a.conf.Ratelimit.period,
-		Key:    a.GetKey(ip),
-	}
+	limit := a.policy.Request(a.GetKey(ip), 0)
+	limit.Trace = trace
 
 	defer func() {
 		if r := recover(); r != nil {
@@ -96,20 +246,80 @@ func (a *RateLimiter) Allow(ctx context.Context, ip string) (res *comm.RateLimit
 			err = fmt.Errorf("%v", r)
 		}
 	}()
-	newClient, err := client.NewClient(a.socketPath)
-	if err != nil {
-		panic(err)
+	timeout := a.timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
 	}
-	defer newClient.Close()
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 
-	res, err = newClient.RateLimit(ctx, limit)
+	if a.conn == nil {
+		return nil, fmt.Errorf("missing sidecar connection")
+	}
+	// a decision started as the sidecar sends a GOAWAY is made on the next connection
+	err = a.conn.reconnector.Do(ctx, func(sidecar *client.Client) error {
+		// the sidecar would only answer after its backend timeout
+		if !sidecar.BackendAvailable() {
+			return fmt.Errorf("%w: the sidecar reports its backend down", client.ErrBackendUnavailable)
+		}
+		var err error
+		if batcher := a.conn.getBatcher(sidecar, a.conf.Batch); batcher != nil {
+			res, err = batcher.RateLimit(ctx, &limit)
+		} else {
+			res, err = sidecar.RateLimit(ctx, &limit)
+		}
+		return err
+	})
 	if err != nil {
-		slog.Info("failed to send request", slog.Any("error", err))
+		a.logger.Debug("failed to send request", slog.Any("error", err))
 		return nil, err
 	}
-	newClient.Close()
-	cancel()
+	if res == nil {
+		return nil, fmt.Errorf("empty rate limit response")
+	}
 	return res, nil
 }
+
+// events are the events the plugin subscribes to, those of bans only
+// mattering to the deny cache.
+func (a *RateLimiter) events() comm.EventMask {
+	events := comm.EventTypeBackendHealth.Mask()
+	if a.denyCache != nil {
+		events |= comm.EventTypeBanAdded.Mask() | comm.EventTypeBanRemoved.Mask()
+	}
+	return events
+}
+
+// handleEvent applies an event pushed by the sidecar. Bans of the keys of the
+// plugin, decided by any Traefik instance, update the deny cache at once.
+func (a *RateLimiter) handleEvent(event comm.EventData) {
+	a.logger.Debug("Event received", slog.String("type", event.Type.String()), slog.String("key", event.Key), slog.Bool("healthy", event.Healthy))
+	if a.denyCache == nil {
+		return
+	}
+	key, ok := a.eventKey(event.Key)
+	if !ok {
+		return
+	}
+	switch event.Type {
+	case comm.EventTypeBanAdded:
+		a.denyCache.Put(key, event.Duration, time.Now())
+	case comm.EventTypeBanRemoved:
+		a.denyCache.Delete(key)
+	}
+}
+
+// eventKey returns the key of the plugin an event is about, false when the
+// event is about the key of another plugin. Under a named policy, the sidecar
+// prefixes the keys with the namespace of the policy and a colon. Namespaces
+// may hold colons, so the namespace ends at the last colon followed by the
+// prefix of the keys of the plugin, which IP addresses never hold.
+func (a *RateLimiter) eventKey(key string) (string, bool) {
+	prefix := a.keyPrefix()
+	if a.conf.Policy != "" {
+		if i := strings.LastIndex(key, ":"+prefix); i >= 0 {
+			return key[i+1:], true
+		}
+	}
+	return key, strings.HasPrefix(key, prefix)
+}
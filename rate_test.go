@@ -0,0 +1,53 @@
+package traefik_rate_limit
+
+import (
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"log/slog"
+	"testing"
+	"time"
+)
+
+func TestEventKey(t *testing.T) {
+	tests := []struct {
+		name   string
+		plugin string
+		policy string
+		key    string
+		// expected is the key of the plugin, empty when the event is not
+		// about one
+		expected string
+	}{
+		{name: "Plain", plugin: "web", key: "traefik:web:203.0.113.7", expected: "traefik:web:203.0.113.7"},
+		{name: "OtherPlugin", plugin: "web", key: "traefik:api:203.0.113.7"},
+		{name: "PlainIPv6", plugin: "web", key: "traefik:web:2001:db8::1", expected: "traefik:web:2001:db8::1"},
+		{name: "NamespaceWithoutPolicy", plugin: "web", key: "api:traefik:web:203.0.113.7"},
+		{name: "Namespace", plugin: "web", policy: "api", key: "api:traefik:web:203.0.113.7", expected: "traefik:web:203.0.113.7"},
+		{name: "NoNamespace", plugin: "web", policy: "api", key: "traefik:web:203.0.113.7", expected: "traefik:web:203.0.113.7"},
+		{name: "NamespaceWithColons", plugin: "web", policy: "api", key: "team:api:traefik:web:2001:db8::1", expected: "traefik:web:2001:db8::1"},
+		{name: "NamespaceLikeAKey", plugin: "web", policy: "api", key: "traefik:web:traefik:web:203.0.113.7", expected: "traefik:web:203.0.113.7"},
+		{name: "PluginNameWithColons", plugin: "web:v2", policy: "api", key: "api:traefik:web:v2:203.0.113.7", expected: "traefik:web:v2:203.0.113.7"},
+		{name: "NamespacedOtherPlugin", plugin: "web", policy: "api", key: "api:traefik:web2:203.0.113.7"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			a := &RateLimiter{name: tt.plugin, conf: &Config{Policy: tt.policy}}
+			key, ok := a.eventKey(tt.key)
+			if ok != (tt.expected != "") || (ok && key != tt.expected) {
+				t.Errorf("Expected %q, %t \nWanted %q", key, ok, tt.expected)
+			}
+		})
+	}
+}
+
+func TestHandleEventNamespacedBan(t *testing.T) {
+	a := &RateLimiter{
+		name:      "web:v2",
+		conf:      &Config{Policy: "api"},
+		logger:    NewPluginLogger("web:v2", &slog.LevelVar{}),
+		denyCache: NewDenyCache(&DenyCacheConfig{Enabled: true, MaxEntries: 10}),
+	}
+	a.handleEvent(comm.EventData{Type: comm.EventTypeBanAdded, Duration: time.Minute, Key: "team:api:traefik:web:v2:203.0.113.7"})
+	if _, ok := a.denyCache.Get("traefik:web:v2:203.0.113.7", time.Now()); !ok {
+		t.Errorf("Expected the ban of the namespaced key to reach the deny cache")
+	}
+}
@@ -0,0 +1,104 @@
+package traefik_rate_limit
+
+import (
+	"encoding/json"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"sync"
+	"time"
+)
+
+// retireDelay is how long the connection of a middleware whose configuration
+// changed stays open, for the requests still going through the instances
+// built with the previous configuration.
+var retireDelay = 30 * time.Second
+
+// sidecarConn is the connection of a middleware to the sidecar. Traefik builds
+// the middleware again on every configuration change, the instances built
+// with the same configuration share the connection instead of each leaving
+// one open.
+type sidecarConn struct {
+	fingerprint string
+	reconnector *client.Reconnector
+	// denyCache is shared as well, the events of the connection only reach
+	// the instance that made it.
+	denyCache *DenyCache
+
+	// mu guards the batcher of the current connection.
+	mu      sync.Mutex
+	batcher *client.Batcher
+}
+
+var (
+	sidecarConnsMu sync.Mutex
+	// sidecarConns holds the connection of each middleware by name.
+	sidecarConns = make(map[string]*sidecarConn)
+)
+
+// fingerprintOf returns what tells the configurations of a middleware apart,
+// empty when it cannot be told.
+func fingerprintOf(config *Config) string {
+	data, err := json.Marshal(config)
+	if err != nil {
+		return ""
+	}
+	return string(data)
+}
+
+// shareSidecarConn returns the connection of the middleware, made by newConn
+// unless an instance with the same configuration already made one. The
+// connection of an earlier configuration is closed after retireDelay.
+func shareSidecarConn(name string, config *Config, newConn func() *sidecarConn) *sidecarConn {
+	fingerprint := fingerprintOf(config)
+	sidecarConnsMu.Lock()
+	defer sidecarConnsMu.Unlock()
+	current := sidecarConns[name]
+	if current != nil && fingerprint != "" && current.fingerprint == fingerprint {
+		return current
+	}
+	if current != nil {
+		time.AfterFunc(retireDelay, current.close)
+	}
+	conn := newConn()
+	conn.fingerprint = fingerprint
+	sidecarConns[name] = conn
+	return conn
+}
+
+// close closes the connection, flushing the decisions waiting for a batch.
+func (s *sidecarConn) close() {
+	s.mu.Lock()
+	if s.batcher != nil {
+		s.batcher.Close()
+		s.batcher = nil
+	}
+	s.mu.Unlock()
+	s.reconnector.Close()
+}
+
+// getBatcher returns the batcher of the sidecar connection, nil when batching
+// is disabled. A new batcher is made once the connection is replaced.
+func (s *sidecarConn) getBatcher(sidecar *client.Client, batch *BatchConfig) *client.Batcher {
+	if batch == nil || !batch.Enabled {
+		return nil
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.batcher == nil || s.batcher.Client() != sidecar {
+		// a caller still holding a connection that went away must not take
+		// the batcher from the current one, its decision is sent on its own
+		select {
+		case <-sidecar.GoAway():
+			return nil
+		case <-sidecar.Done():
+			return nil
+		default:
+		}
+		// the decisions waiting on the previous connection are sent at once
+		if s.batcher != nil {
+			s.batcher.Close()
+		}
+		s.batcher = client.NewBatcher(sidecar, batch.MaxSize, batch.maxDelay)
+	}
+	return s.batcher
+}
@@ -0,0 +1,90 @@
+package traefik_rate_limit
+
+import (
+	"context"
+	"encoding/json"
+	"github.com/zekihan/traefik-rate-limit/internal/server"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestRebuildsShareConnection builds a middleware again and again like
+// Traefik on configuration changes, and expects the sidecar to keep a single
+// connection open.
+func TestRebuildsShareConnection(t *testing.T) {
+	socketPath := filepath.Join(t.TempDir(), "sidecar.sock")
+	serverCtx, serverCancel := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		server.RunServer(serverCtx, socketPath)
+	}()
+	t.Cleanup(func() {
+		serverCancel()
+		<-done
+	})
+	for deadline := time.Now().Add(5 * time.Second); ; time.Sleep(10 * time.Millisecond) {
+		if _, err := os.Stat(socketPath); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Server socket not found")
+		}
+	}
+
+	admin := server.NewAdminHandler("secret")
+	connections := func() float64 {
+		request := httptest.NewRequest(http.MethodGet, "/v1/stats", nil)
+		request.Header.Set("Authorization", "Bearer secret")
+		recorder := httptest.NewRecorder()
+		admin.ServeHTTP(recorder, request)
+		var stats map[string]any
+		if err := json.NewDecoder(recorder.Body).Decode(&stats); err != nil {
+			t.Fatalf("Failed to decode stats: %v", err)
+		}
+		return stats["connections"].(float64)
+	}
+	waitConnections := func(expected float64) {
+		t.Helper()
+		deadline := time.Now().Add(5 * time.Second)
+		for connections() != expected && time.Now().Before(deadline) {
+			time.Sleep(10 * time.Millisecond)
+		}
+		if got := connections(); got != expected {
+			t.Errorf("Expected %v open connections \nWanted %v", got, expected)
+		}
+	}
+
+	previousDelay := retireDelay
+	retireDelay = 0
+	t.Cleanup(func() {
+		retireDelay = previousDelay
+		sidecarConnsMu.Lock()
+		defer sidecarConnsMu.Unlock()
+		sidecarConns["rebuilt"].close()
+		delete(sidecarConns, "rebuilt")
+	})
+	next := http.HandlerFunc(func(http.ResponseWriter, *http.Request) {})
+	build := func(rate int) {
+		config := CreateConfig()
+		config.SocketPath = socketPath
+		config.Ratelimit.Rate = rate
+		handler, err := New(context.Background(), next, config, "rebuilt")
+		if err != nil {
+			t.Fatalf("Failed to build the middleware: %v", err)
+		}
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	for range 10 {
+		build(100)
+	}
+	waitConnections(1)
+	// the connection of the previous configuration is closed
+	build(200)
+	waitConnections(1)
+}
@@ -2,10 +2,13 @@ package traefik_rate_limit
 
 import (
 	"context"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"github.com/zekihan/traefik-rate-limit/internal/client"
+	"github.com/zekihan/traefik-rate-limit/internal/comm"
+	"github.com/zekihan/traefik-rate-limit/internal/transport"
 	"log/slog"
-	"net"
 	"net/http"
 	"reflect"
 	"strconv"
@@ -15,12 +18,44 @@ import (
 
 // Config the plugin configuration.
 type Config struct {
-	LogLevel          string            `json:"logLevel,omitempty"`
-	Ratelimit         *RatelimitConfig  `json:"rateLimit,omitempty"`
+	LogLevel  string           `json:"logLevel,omitempty"`
+	Ratelimit *RatelimitConfig `json:"rateLimit,omitempty"`
+	// Policy names a policy defined by the sidecar, whose limits replace
+	// those of rateLimit, so that they are changed in the sidecar config.
+	Policy            string            `json:"policy,omitempty"`
 	IPResolver        *IPResolverConfig `json:"ipResolver,omitempty"`
 	WhitelistedIPNets []string          `json:"whitelistedIPNets,omitempty"`
-	WhitelistLocalIPs bool              `json:"whitelistLocalIPs,omitempty"`
-	SocketPath        string            `json:"socketPath,omitempty"`
+	// WhitelistedIPNetsFile lists more whitelisted networks, one per line.
+	WhitelistedIPNetsFile string `json:"whitelistedIPNetsFile,omitempty"`
+	WhitelistLocalIPs     bool   `json:"whitelistLocalIPs,omitempty"`
+	// DeniedIPNets are networks whose requests are always rejected.
+	DeniedIPNets []string `json:"deniedIPNets,omitempty"`
+	// DeniedIPNetsFile lists more denied networks, one per line.
+	DeniedIPNetsFile string `json:"deniedIPNetsFile,omitempty"`
+	SocketPath       string `json:"socketPath,omitempty"`
+	// Timeout is the latency budget of a single rate limit decision.
+	Timeout   string           `json:"timeout,omitempty"`
+	DenyCache *DenyCacheConfig `json:"denyCache,omitempty"`
+	Batch     *BatchConfig     `json:"batch,omitempty"`
+	// KeepAlive pings the sidecar to detect dead connections.
+	KeepAlive *KeepAliveConfig `json:"keepAlive,omitempty"`
+	// FailurePolicy decides, per kind of error, whether requests are let
+	// through or rejected when no rate limit decision could be made.
+	FailurePolicy *FailurePolicyConfig `json:"failurePolicy,omitempty"`
+	// TLS configures the connection to tls:// sidecar addresses.
+	TLS *TLSConfig `json:"tls,omitempty"`
+	// AuthToken is the pre-shared token of sidecars requiring authentication.
+	AuthToken string `json:"authToken,omitempty"`
+}
+
+type TLSConfig struct {
+	// CAFile verifies the sidecar certificate instead of the system roots.
+	CAFile string `json:"caFile,omitempty"`
+	// CertFile and KeyFile are presented to sidecars requiring mutual TLS.
+	CertFile           string `json:"certFile,omitempty"`
+	KeyFile            string `json:"keyFile,omitempty"`
+	ServerName         string `json:"serverName,omitempty"`
+	InsecureSkipVerify bool   `json:"insecureSkipVerify,omitempty"`
 }
 
 // CreateConfig creates the default plugin configuration.
@@ -38,16 +73,67 @@ func CreateConfig() *Config {
 		},
 		WhitelistedIPNets: make([]string, 0),
 		WhitelistLocalIPs: true,
+		DeniedIPNets:      make([]string, 0),
 		SocketPath:        "",
+		Timeout:           "500ms",
+		DenyCache: &DenyCacheConfig{
+			Enabled:    false,
+			MaxEntries: 10000,
+			Eviction:   DenyCacheEvictionLRU,
+		},
+		Batch: &BatchConfig{
+			Enabled:  true,
+			MaxSize:  64,
+			MaxDelay: "200us",
+		},
+		FailurePolicy: &FailurePolicyConfig{
+			Default: FailOpen,
+		},
 	}
 }
 
 func (c *Config) Validate() error {
-	if c.Ratelimit == nil {
-		return fmt.Errorf("missing ratelimit configuration")
+	if c.Policy == "" {
+		if c.Ratelimit == nil {
+			return fmt.Errorf("missing ratelimit configuration")
+		}
+		if err := c.Ratelimit.Validate(); err != nil {
+			return fmt.Errorf("invalid ratelimit configuration")
+		}
+	}
+	if c.Timeout != "" {
+		timeout, err := time.ParseDuration(c.Timeout)
+		if err != nil {
+			return fmt.Errorf("invalid timeout: %v", err)
+		}
+		if timeout <= 0 {
+			return fmt.Errorf("timeout must be greater than 0")
+		}
+	}
+	if c.SocketPath != "" {
+		if _, err := transport.ParseAddress(c.SocketPath); err != nil {
+			return fmt.Errorf("invalid socketPath: %v", err)
+		}
+	}
+	if c.DenyCache != nil {
+		if err := c.DenyCache.Validate(); err != nil {
+			return fmt.Errorf("invalid deny cache configuration: %v", err)
+		}
+	}
+	if c.Batch != nil {
+		if err := c.Batch.Validate(); err != nil {
+			return fmt.Errorf("invalid batch configuration: %v", err)
+		}
+	}
+	if c.KeepAlive != nil {
+		if err := c.KeepAlive.Validate(); err != nil {
+			return fmt.Errorf("invalid keep alive configuration: %v", err)
+		}
 	}
-	if err := c.Ratelimit.Validate(); err != nil {
-		return fmt.Errorf("invalid ratelimit configuration")
+	if c.FailurePolicy != nil {
+		if err := c.FailurePolicy.Validate(); err != nil {
+			return fmt.Errorf("invalid failure policy configuration: %v", err)
+		}
 	}
 	return nil
 }
@@ -65,13 +151,16 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 	if err := config.Validate(); err != nil {
 		return rateLimiter, err
 	}
-	period, err := time.ParseDuration(config.Ratelimit.Period)
-	if err != nil {
-		return nil, fmt.Errorf("invalid period: %v", err)
-	}
-	slog.Debug("Parsed period", slog.String("period", config.Ratelimit.Period), slog.Any("duration", period), slog.Any("error", err), slog.Any("type", reflect.TypeOf(period)))
+	// calendar windows may leave the period out
+	if config.Policy == "" && config.Ratelimit.Period != "" {
+		period, err := time.ParseDuration(config.Ratelimit.Period)
+		if err != nil {
+			return nil, fmt.Errorf("invalid period: %v", err)
+		}
+		slog.Debug("Parsed period", slog.String("period", config.Ratelimit.Period), slog.Any("duration", period), slog.Any("error", err), slog.Any("type", reflect.TypeOf(period)))
 
-	config.Ratelimit.period = period
+		config.Ratelimit.period = period
+	}
 	rateLimiter.conf = config
 
 	logLevel := &slog.LevelVar{}
@@ -97,6 +186,42 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 	}
 	rateLimiter.socketPath = socketPath
 
+	rateLimiter.policy = newPolicy(name, config)
+	rateLimiter.clientOptions = &client.Options{
+		AuthToken: config.AuthToken,
+		Policies:  []*comm.PolicyData{rateLimiter.policy},
+	}
+	if config.KeepAlive != nil {
+		rateLimiter.clientOptions.KeepAlive = config.KeepAlive.interval
+		rateLimiter.clientOptions.KeepAliveTimeout = config.KeepAlive.timeout
+	}
+	if config.TLS != nil {
+		tlsConfig, err := transport.ClientTLSConfig(config.TLS.CAFile, config.TLS.CertFile, config.TLS.KeyFile, config.TLS.ServerName, config.TLS.InsecureSkipVerify)
+		if err != nil {
+			return nil, fmt.Errorf("invalid TLS configuration: %v", err)
+		}
+		rateLimiter.clientOptions.TLS = tlsConfig
+	}
+
+	timeout := defaultTimeout
+	if config.Timeout != "" {
+		timeout, _ = time.ParseDuration(config.Timeout)
+	}
+	rateLimiter.timeout = timeout
+
+	if config.DenyCache != nil && config.DenyCache.Enabled {
+		rateLimiter.denyCache = NewDenyCache(config.DenyCache)
+	}
+	rateLimiter.clientOptions.Events = rateLimiter.events()
+	rateLimiter.clientOptions.OnEvent = rateLimiter.handleEvent
+	rateLimiter.conn = shareSidecarConn(name, config, func() *sidecarConn {
+		return &sidecarConn{
+			reconnector: client.NewReconnector(socketPath, rateLimiter.clientOptions),
+			denyCache:   rateLimiter.denyCache,
+		}
+	})
+	rateLimiter.denyCache = rateLimiter.conn.denyCache
+
 	pluginLogger := NewPluginLogger(name, logLevel)
 	rateLimiter.logger = pluginLogger
 
@@ -104,27 +229,56 @@ func New(_ context.Context, next http.Handler, config *Config, name string) (htt
 		config: config.IPResolver,
 		logger: rateLimiter.logger,
 	}
+	if config.IPResolver != nil {
+		trustedProxies, err := newIPSet(config.IPResolver.TrustedProxies, config.IPResolver.TrustedProxiesFile)
+		if err != nil {
+			return nil, fmt.Errorf("invalid trusted proxies: %v", err)
+		}
+		if trustedProxies.Len() > 0 {
+			rateLimiter.ipResolver.trustedProxies = trustedProxies
+		}
+	}
 
-	whitelistedIPNets := make([]*net.IPNet, 0)
+	whitelist, err := newIPSet(config.WhitelistedIPNets, config.WhitelistedIPNetsFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid whitelisted IP ranges: %v", err)
+	}
 	if config.WhitelistLocalIPs {
 		localIPs, err := rateLimiter.ipResolver.getLocalIPsHardcoded()
 		if err != nil {
 			return nil, fmt.Errorf("error getting local IPs: %v", err)
 		}
-		whitelistedIPNets = append(whitelistedIPNets, localIPs...)
-	}
-	for _, ipRange := range config.WhitelistedIPNets {
-		_, ipNet, err := net.ParseCIDR(ipRange)
-		if err != nil {
-			return nil, fmt.Errorf("invalid whitelisted IP range: %s", ipRange)
+		for _, localIP := range localIPs {
+			whitelist.Add(localIP)
 		}
-		whitelistedIPNets = append(whitelistedIPNets, ipNet)
 	}
-	rateLimiter.whitelistedIPNets = whitelistedIPNets
+	rateLimiter.whitelist = whitelist
+
+	denylist, err := newIPSet(config.DeniedIPNets, config.DeniedIPNetsFile)
+	if err != nil {
+		return nil, fmt.Errorf("invalid denied IP ranges: %v", err)
+	}
+	rateLimiter.denylist = denylist
 
 	return rateLimiter, nil
 }
 
+// newIPSet builds a set from the listed networks and those of the file, if any.
+func newIPSet(ipRanges []string, path string) (*IPSet, error) {
+	set := NewIPSet()
+	for _, ipRange := range ipRanges {
+		if err := set.AddCIDR(ipRange); err != nil {
+			return nil, err
+		}
+	}
+	if path != "" {
+		if err := set.AddFile(path); err != nil {
+			return nil, err
+		}
+	}
+	return set, nil
+}
+
 func (a *RateLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	defer a.handlePanic(rw, req)
 
@@ -136,31 +290,87 @@ func (a *RateLimiter) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
 	}
 	a.logger.Debug("Request received", slog.String("ip", ip.String()), slog.String("method", req.Method), slog.String("path", req.URL.Path))
 
-	if a.ipResolver.isWhitelisted(ip, a.whitelistedIPNets) {
+	if a.denylist.Contains(ip) {
+		a.logger.Debug("IP is denied", slog.String("ip", ip.String()))
+		http.Error(rw, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	}
+
+	if a.whitelist.Contains(ip) {
 		a.logger.Debug("IP is whitelisted, skipping rate limit", slog.String("ip", ip.String()))
 		a.next.ServeHTTP(rw, req)
 		return
 	}
 
+	if a.denyCache != nil {
+		if retryAfter, ok := a.denyCache.Get(a.GetKey(ip.String()), time.Now()); ok {
+			a.logger.Debug("Key is in the deny cache", slog.String("ip", ip.String()), slog.Duration("retryAfter", retryAfter))
+			a.tooManyRequests(rw, retryAfter)
+			return
+		}
+	}
+
 	ctx := req.Context()
-	res, err := a.Allow(ctx, ip.String())
+	trace := requestTrace(req)
+	start := time.Now()
+	res, err := a.Allow(ctx, ip.String(), trace)
+	latency := slog.Duration("latency", time.Since(start))
 	if err != nil {
-		a.logger.Error("Error getting rate limit", ErrorAttrWithoutStack(err))
+		if ctx.Err() != nil {
+			a.logger.Debug("Client went away before the rate limit decision", slog.String("ip", ip.String()), latency, traceAttr(trace))
+			return
+		}
+		if a.conf.FailurePolicy.FailClosed(err) {
+			a.logger.Error("Error getting rate limit, rejecting request", ErrorAttrWithoutStack(err), slog.String("class", errorClass(err)), latency, traceAttr(trace))
+			http.Error(rw, http.StatusText(http.StatusServiceUnavailable), http.StatusServiceUnavailable)
+			return
+		}
+		a.logger.Error("Error getting rate limit, letting request through", ErrorAttrWithoutStack(err), slog.String("class", errorClass(err)), latency, traceAttr(trace))
 		a.next.ServeHTTP(rw, req)
 		return
 	}
-	a.logger.Debug("Rate limit response", slog.String("key", ip.String()), slog.Int64("allowed", res.Allowed), slog.Int64("remaining", res.Remaining), slog.Duration("resetAfter", res.ResetAfter))
+	a.logger.Debug("Rate limit response", slog.String("key", ip.String()), slog.Int64("allowed", res.Allowed), slog.Int64("remaining", res.Remaining), slog.Duration("resetAfter", res.ResetAfter), latency, traceAttr(trace))
 
 	if res.Allowed <= 0 {
-		retryAfter := int64(res.RetryAfter/time.Second) + 1
-		rw.Header().Set("Retry-After", strconv.FormatInt(retryAfter, 10))
-		http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+		if a.denyCache != nil {
+			a.denyCache.Put(a.GetKey(ip.String()), res.RetryAfter, time.Now())
+		}
+		a.tooManyRequests(rw, res.RetryAfter)
 		return
 	}
 
 	a.next.ServeHTTP(rw, req)
 }
 
+// requestTrace returns the trace context of the traceparent header of the
+// request, the zero value when it has none or it is invalid.
+func requestTrace(req *http.Request) comm.TraceContext {
+	value := req.Header.Get("traceparent")
+	if value == "" {
+		return comm.TraceContext{}
+	}
+	trace, err := comm.ParseTraceParent(value)
+	if err != nil {
+		return comm.TraceContext{}
+	}
+	return trace
+}
+
+// traceAttr is the trace ID log field of a traced request, an empty attribute
+// that is not logged otherwise.
+func traceAttr(trace comm.TraceContext) slog.Attr {
+	if !trace.IsValid() {
+		return slog.Attr{}
+	}
+	return slog.String("traceID", hex.EncodeToString(trace.TraceID[:]))
+}
+
+func (a *RateLimiter) tooManyRequests(rw http.ResponseWriter, retryAfter time.Duration) {
+	retryAfterSeconds := int64(retryAfter/time.Second) + 1
+	rw.Header().Set("Retry-After", strconv.FormatInt(retryAfterSeconds, 10))
+	http.Error(rw, http.StatusText(http.StatusTooManyRequests), http.StatusTooManyRequests)
+}
+
 func (a *RateLimiter) handlePanic(rw http.ResponseWriter, req *http.Request) {
 	r := recover()
 	err := getPanicError(r)